@@ -3,8 +3,14 @@ module github.com/tiagostutz/schelly-postgres
 go 1.12
 
 require (
+	github.com/Azure/azure-pipeline-go v0.1.8
 	github.com/Azure/azure-storage-blob-go v0.6.0
+	github.com/aws/aws-sdk-go v1.44.0
 	github.com/flaviostutz/schelly-webhook v0.0.0-20190610124343-669f6442af78
+	github.com/go-test/deep v1.1.1 // indirect
+	github.com/gorilla/mux v1.7.2
+	github.com/klauspost/compress v1.9.8
+	github.com/pierrec/lz4 v2.6.1+incompatible
 	go.uber.org/atomic v1.4.0 // indirect
 	go.uber.org/multierr v1.1.0 // indirect
 	go.uber.org/zap v1.10.0
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/flaviostutz/schelly-webhook/schellyhook"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+//restoreRequest is the body of POST /backups/{id}/restore
+type restoreRequest struct {
+	TargetDatabase string `json:"target_database"`
+	Database       string `json:"database"` //database restored from cluster backups
+	Force          bool   `json:"force"`    //allows restoring into --dbname, replacing the database being backed up
+}
+
+//startAPIServer serves the endpoints that aren't part of the Schelly webhook spec (such as restores).
+//Schellyhook owns its router, so these endpoints are served on their own port. They aren't authenticated and send
+//decrypted backups, so they should only be reachable by trusted clients
+func startAPIServer(listenIP string, listenPort int) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	router := newAPIRouter()
+	listen := fmt.Sprintf("%s:%d", listenIP, listenPort)
+	sugar.Infof("Provider API listening at %s", listen)
+	go func() {
+		err := http.ListenAndServe(listen, router)
+		if err != nil {
+			sugar.Errorf("Provider API stopped. err=%s", err)
+		}
+	}()
+}
+
+func newAPIRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/backups/{id}/restore", restoreBackupHandler).Methods("POST")
+	router.HandleFunc("/backups/{id}/restore", getRestoreHandler).Methods("GET")
+	router.HandleFunc("/backups/{id}/verify", verifyBackupHandler).Methods("POST")
+	router.HandleFunc("/backups/{id}/download", downloadBackupHandler).Methods("GET")
+	router.HandleFunc("/backups/{id}/check", checkBackupHandler).Methods("POST")
+	if walStorage != nil {
+		router.HandleFunc("/wal/{name}", archiveWALHandler).Methods("PUT")
+		router.HandleFunc("/wal/{name}", restoreWALHandler).Methods("GET")
+		router.HandleFunc("/recoveries", startRecoveryHandler).Methods("POST")
+		router.HandleFunc("/recoveries/{id}", getRecoveryHandler).Methods("GET")
+	}
+	return router
+}
+
+func restoreBackupHandler(w http.ResponseWriter, r *http.Request) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	apiID := mux.Vars(r)["id"]
+	req := restoreRequest{}
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid restore request: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	resp, err := PostgresBackuper{}.RestoreDatabase(apiID, req.Database, req.TargetDatabase, req.Force)
+	if err != nil {
+		sugar.Warnf("Error restoring backup %s. err=%s", apiID, err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if resp == nil {
+		http.Error(w, fmt.Sprintf("Backup %s not found", apiID), http.StatusNotFound)
+		return
+	}
+	sendResponse(w, http.StatusAccepted, resp)
+}
+
+func getRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	apiID := mux.Vars(r)["id"]
+	resp, err := PostgresBackuper{}.GetRestore(apiID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if resp == nil {
+		http.Error(w, fmt.Sprintf("No restore of backup %s found", apiID), http.StatusNotFound)
+		return
+	}
+	sendResponse(w, http.StatusOK, resp)
+}
+
+func verifyBackupHandler(w http.ResponseWriter, r *http.Request) {
+	apiID := mux.Vars(r)["id"]
+	err := startVerification(apiID)
+	if err == errObjectNotFound {
+		http.Error(w, fmt.Sprintf("Backup %s not found", apiID), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	resp, err := PostgresBackuper{}.GetBackup(apiID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sendResponse(w, http.StatusAccepted, resp)
+}
+
+func checkBackupHandler(w http.ResponseWriter, r *http.Request) {
+	apiID := mux.Vars(r)["id"]
+	err := startIntegrityCheck(apiID)
+	if err == errObjectNotFound {
+		http.Error(w, fmt.Sprintf("Backup %s not found", apiID), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	resp, err := PostgresBackuper{}.GetBackup(apiID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sendResponse(w, http.StatusAccepted, resp)
+}
+
+//downloadBackupHandler sends the backup file as pg_dump wrote it, decrypted and decompressed. On cluster backups, the
+//`database` query parameter chooses the dump of a database instead of the globals
+func downloadBackupHandler(w http.ResponseWriter, r *http.Request) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	apiID := mux.Vars(r)["id"]
+	m, err := readManifest(apiID)
+	if err == errObjectNotFound {
+		http.Error(w, fmt.Sprintf("Backup %s not found", apiID), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if m.Status != statusAvailable {
+		http.Error(w, fmt.Sprintf("Backup %s is not available (status %s)", apiID, m.Status), http.StatusConflict)
+		return
+	}
+	rehydrating, err := rehydrateIfArchived(m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rehydrating {
+		res := rehydratingResponse(*m)
+		w.Header().Set("Retry-After", "3600")
+		sendResponse(w, http.StatusAccepted, &res)
+		return
+	}
+	if database := r.URL.Query().Get("database"); database != "" {
+		dump, ok := m.databaseManifest(database)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Backup %s has no database %s", apiID, database), http.StatusNotFound)
+			return
+		}
+		m = &dump
+	}
+
+	reader, err := openArtifact(*m, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+	decompressed, err := decompressStream(reader, m.Compression)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer decompressed.Close()
+	name := strings.TrimSuffix(m.Artifact, encryptionExtension(m.Encryption))
+	name = strings.TrimSuffix(name, compressionExtension(m.Compression))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	_, err = io.Copy(w, decompressed)
+	if err != nil {
+		//the status was already sent, so the client only sees a truncated response
+		sugar.Warnf("Error sending backup %s. err=%s", apiID, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+//startRecoveryHandler recovers the cluster to the point in time described by the recoveryRequest body
+func startRecoveryHandler(w http.ResponseWriter, r *http.Request) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	req := recoveryRequest{}
+	//options such as the restore_command are only taken from the provider args, so requests setting them are refused
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid recovery request: %s", err), http.StatusBadRequest)
+		return
+	}
+	resp, err := PostgresBackuper{}.RecoverToTarget(req)
+	if err != nil {
+		sugar.Warnf("Error starting recovery. err=%s", err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	sendResponse(w, http.StatusAccepted, resp)
+}
+
+func getRecoveryHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	resp, err := PostgresBackuper{}.GetRecovery(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if resp == nil {
+		http.Error(w, fmt.Sprintf("Recovery %s not found", id), http.StatusNotFound)
+		return
+	}
+	sendResponse(w, http.StatusOK, resp)
+}
+
+//archiveWALHandler stores the WAL file sent on the body, as in `archive_command = 'curl -sf -T %p http://provider:7071/wal/%f'`
+func archiveWALHandler(w http.ResponseWriter, r *http.Request) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	name := mux.Vars(r)["name"]
+	if !walFileName.MatchString(name) {
+		http.Error(w, fmt.Sprintf("Invalid WAL file name %s", name), http.StatusBadRequest)
+		return
+	}
+	archived, err := archiveWAL(name, r.Body)
+	if err != nil {
+		sugar.Warnf("Error archiving WAL file %s. err=%s", name, err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if archived {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	sugar.Debugf("WAL file %s archived", name)
+	w.WriteHeader(http.StatusCreated)
+}
+
+//restoreWALHandler sends an archived WAL file, as in `restore_command = 'curl -sf -o %p http://provider:7071/wal/%f'`
+func restoreWALHandler(w http.ResponseWriter, r *http.Request) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	name := mux.Vars(r)["name"]
+	if !walFileName.MatchString(name) {
+		http.Error(w, fmt.Sprintf("Invalid WAL file name %s", name), http.StatusBadRequest)
+		return
+	}
+	o, err := findWAL(name)
+	if err == errObjectNotFound {
+		http.Error(w, fmt.Sprintf("WAL file %s isn't archived", name), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	reader, err := openWAL(*o)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, err = io.Copy(w, reader)
+	if err != nil {
+		//a truncated WAL file must never be mistaken for a complete one by restore_command
+		sugar.Warnf("Error sending WAL file %s. err=%s", name, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func sendResponse(w http.ResponseWriter, httpStatus int, resp *schellyhook.SchellyResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(resp)
+}
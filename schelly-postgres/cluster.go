@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+//globalsExtension is appended to the artifact of cluster backups that holds the roles and tablespaces (pg_dumpall --globals-only)
+const globalsExtension = ".globals.sql"
+
+//clusterDatabasesQuery lists the databases dumped on cluster backups. Templates and databases that don't accept
+//connections (such as template0) are skipped, as pg_dumpall does
+const clusterDatabasesQuery = "SELECT datname FROM pg_database WHERE NOT datistemplate AND datallowconn ORDER BY datname"
+
+//clusterDatabase is the dump of one database of a cluster backup
+type clusterDatabase struct {
+	Name     string         `json:"name"`
+	Artifact string         `json:"artifact"`
+	Size     int64          `json:"size"`
+	SHA256   string         `json:"sha256,omitempty"`
+	PgDump   *commandResult `json:"pg_dump,omitempty"`
+}
+
+//validateClusterOptions checks the options of cluster backups
+func validateClusterOptions() error {
+	if !*clusterBackup {
+		if len(*includeDatabases) > 0 || len(*excludeDatabases) > 0 {
+			return fmt.Errorf("`--include-database` and `--exclude-database` require `--cluster`")
+		}
+		return nil
+	}
+	if *backupMode != backupKindLogical {
+		return fmt.Errorf("`--cluster` requires `--backup-mode=logical`. Physical backups always have the whole cluster")
+	}
+	if *verifyAfterBackup || *verifyInterval > 0 {
+		return fmt.Errorf("Cluster backups can't be verified by restoring them into a database")
+	}
+	for _, pattern := range append(append([]string{}, *includeDatabases...), *excludeDatabases...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid database pattern %q: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+//matchesAny tells whether name matches any of the glob patterns
+func matchesAny(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//clusterDatabases returns the databases of the server dumped on cluster backups, filtered by --include-database
+//and --exclude-database. Names that pg_dump would take as a connection string, which could point it elsewhere, fail the
+//backup instead of leaving the database out of it silently
+func clusterDatabases(ctx context.Context) ([]string, error) {
+	rows, err := sourceConnection().query(ctx, clusterDatabasesQuery)
+	if err != nil {
+		return nil, err
+	}
+	databases := make([]string, 0)
+	for _, row := range rows {
+		name := row[0]
+		if len(*includeDatabases) > 0 && !matchesAny(name, *includeDatabases) {
+			continue
+		}
+		if matchesAny(name, *excludeDatabases) {
+			continue
+		}
+		err = validateConnectionOptions(sourceConnection().withDatabase(name))
+		if err != nil {
+			return nil, fmt.Errorf("%s. Leave it out with `--exclude-database`", err)
+		}
+		databases = append(databases, name)
+	}
+	return databases, nil
+}
+
+//isCluster tells whether m is a cluster backup, with the globals on its artifact and one artifact per database
+func (m backupManifest) isCluster() bool {
+	return m.Cluster
+}
+
+//databaseManifest returns the manifest of the dump of database name on the cluster backup m, which is handled as the
+//backup of a single database. Tells whether the backup has that database
+func (m backupManifest) databaseManifest(name string) (backupManifest, bool) {
+	for _, database := range m.Databases {
+		if database.Name != name {
+			continue
+		}
+		m.Cluster = false
+		m.Databases = nil
+		m.PgDumpall = nil
+		m.Database = database.Name
+		m.Artifact = database.Artifact
+		m.Size = database.Size
+		m.SHA256 = database.SHA256
+		m.PgDump = database.PgDump
+		return m, true
+	}
+	return backupManifest{}, false
+}
+
+//artifacts returns the names of the files of the backup: the artifact and, on cluster backups, the dump of each database
+func (m backupManifest) artifacts() []string {
+	names := []string{m.Artifact}
+	for _, database := range m.Databases {
+		names = append(names, database.Artifact)
+	}
+	return names
+}
+
+//totalSize returns the size of all the files of the backup
+func (m backupManifest) totalSize() int64 {
+	size := m.Size
+	for _, database := range m.Databases {
+		size += database.Size
+	}
+	return size
+}
+
+//databaseNames returns the names of the databases of a cluster backup
+func (m backupManifest) databaseNames() []string {
+	names := make([]string, 0)
+	for _, database := range m.Databases {
+		names = append(names, database.Name)
+	}
+	return names
+}
+
+//clusterArtifactName returns the name of the dump of database on the cluster backup m
+func clusterArtifactName(m *backupManifest, database string) string {
+	return resolveFileName(m.APIID, m.PgDumpID) + "." + url.PathEscape(database) + dumpFormats[m.Format].extension +
+		compressionExtension(m.Compression) + encryptionExtension(m.Encryption)
+}
+
+//runClusterBackup stores the roles and tablespaces of the cluster with pg_dumpall --globals-only and then dumps each
+//database with pg_dump, one after the other. The timeout applies to the whole backup. Records the result of each
+//command, the size and SHA-256 of each stored file on m
+func runClusterBackup(ctx context.Context, m *backupManifest, timeout time.Duration) error {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	deadline := time.Now().Add(timeout)
+	remaining := func() time.Duration {
+		if timeout <= 0 {
+			return 0
+		}
+		return time.Until(deadline)
+	}
+
+	databases, err := clusterDatabases(ctx)
+	if err != nil {
+		return fmt.Errorf("Error listing the databases of the cluster: %s", err)
+	}
+	if len(databases) == 0 {
+		return fmt.Errorf("No database of the cluster matches `--include-database` and `--exclude-database`")
+	}
+	sugar.Infof("Backup %s dumps databases %s", m.APIID, strings.Join(databases, ", "))
+
+	err = storeGlobals(ctx, m, remaining())
+	if err != nil {
+		return err
+	}
+	for _, name := range databases {
+		if timeout > 0 && remaining() <= 0 {
+			return fmt.Errorf("Backup %s timed out before dumping database %s", m.APIID, name)
+		}
+		dump := *m
+		dump.Cluster = false
+		dump.Databases = nil
+		dump.Database = name
+		dump.Artifact = clusterArtifactName(m, name)
+		if *streamBackup {
+			err = streamNewBackup(ctx, &dump, "", remaining())
+		} else {
+			err = stageNewBackup(ctx, &dump, "", remaining())
+		}
+		m.PgDump = dump.PgDump
+		if err != nil {
+			return fmt.Errorf("Dump of database %s failed: %s", name, err)
+		}
+		m.Databases = append(m.Databases, clusterDatabase{Name: name, Artifact: dump.Artifact, Size: dump.Size, SHA256: dump.SHA256, PgDump: dump.PgDump})
+	}
+	//m.PgDump only tells about the last dump, which is recorded on its database
+	m.PgDump = nil
+	return nil
+}
+
+//storeGlobals pipes pg_dumpall --globals-only output to the storage backend as the artifact of m
+func storeGlobals(ctx context.Context, m *backupManifest, timeout time.Duration) error {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	dumpCtx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(dumpCtx, "pg_dumpall", pgDumpallArgs()...)
+	sugar.Debugf("Executing pg_dumpall command (streaming to %s): %s", m.Artifact, strings.Join(cmd.Args, " "))
+	reader, err := startCommandReader(cmd)
+	if err != nil {
+		return err
+	}
+	err = storeArtifact(m, reader)
+	if err != nil {
+		cmd.Process.Kill()
+	}
+	reader.wait()
+	m.PgDumpall = reader.result.withContext(ctx, dumpCtx)
+	if m.PgDumpall.Cancelled {
+		return fmt.Errorf("Backup %s cancelled", m.APIID)
+	}
+	if m.PgDumpall.TimedOut {
+		sugar.Warnf("PostgresProvider pg_dumpall command timeout enforced (%d seconds)", timeout/time.Second)
+	}
+	if err != nil {
+		return fmt.Errorf("Store globals with error: %s", err.Error())
+	}
+	return nil
+}
+
+//pgDumpallArgs returns the pg_dumpall arguments that dump the roles and tablespaces of the cluster to stdout
+func pgDumpallArgs() []string {
+	return []string{"--username=" + *username, "--database=" + *dbname, "--host=" + *host, "--port=" + strconv.Itoa(*port), "--no-password",
+		"--verbose", "--globals-only", "--quote-all-identifiers"}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flaviostutz/schelly-webhook/schellyhook"
+	"go.uber.org/zap"
+)
+
+//fakeClusterPsqlScript lists the databases analytics, app and postgres on pg_database, and works as fakePsqlScript otherwise
+const fakeClusterPsqlScript = `case "$*" in
+  *pg_database*) printf 'analytics\napp\npostgres\n'; exit 0 ;;
+esac
+` + fakePsqlScript
+
+//fakePgDumpallScript logs its args to $DUMPALL_LOG and writes the globals to stdout
+const fakePgDumpallScript = `echo "$*" >> "$DUMPALL_LOG"
+echo 'CREATE ROLE "app";'
+`
+
+func setupClusterTest(t *testing.T, dir string) string {
+	setupRestoreTest(t, dir)
+	installFakeCommand(t, dir, "psql", fakeClusterPsqlScript)
+	installFakeCommand(t, dir, "pg_dumpall", fakePgDumpallScript)
+	dumpallLog := filepath.Join(dir, "dumpall.log")
+	os.Setenv("DUMPALL_LOG", dumpallLog)
+	*clusterBackup = true
+	*dbname = maintenanceDatabase
+	return dumpallLog
+}
+
+//readDump returns the contents of the dump of database on the backup m, decrypted and decompressed
+func readDump(t *testing.T, m backupManifest, database string) string {
+	if database != "" {
+		var ok bool
+		m, ok = m.databaseManifest(database)
+		if !ok {
+			t.Fatalf("Backup %s should have database %s", m.APIID, database)
+		}
+	}
+	reader, err := openArtifact(m, nil)
+	if err != nil {
+		t.Fatalf("Error opening %s: %s", m.Artifact, err)
+	}
+	defer reader.Close()
+	decompressed, err := decompressStream(reader, m.Compression)
+	if err != nil {
+		t.Fatalf("Error decompressing %s: %s", m.Artifact, err)
+	}
+	defer decompressed.Close()
+	data, _ := ioutil.ReadAll(decompressed)
+	return string(data)
+}
+
+func TestClusterBackup(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestClusterBackup...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	dumpallLog := setupClusterTest(t, dir)
+	*compression = "gzip"
+	excludeDatabases.Set("post*")
+	storage := newMemoryStorage()
+	backupStorage = storage
+
+	backuper := PostgresBackuper{}
+	backuper.CreateNewBackup("c1", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("c1")
+	m, err := readManifest("c1")
+	if err != nil || m.Status != statusAvailable || !m.isCluster() || m.PgDumpall == nil {
+		t.Fatalf("Cluster backup should be available. m=%v err=%s", m, err)
+	}
+	if names := strings.Join(m.databaseNames(), ","); names != "analytics,app" {
+		t.Errorf("Every database but the excluded ones should be dumped. databases=%s", names)
+	}
+	if !strings.HasSuffix(m.Artifact, ".globals.sql.gz") || !strings.Contains(readDump(t, *m, ""), `CREATE ROLE "app"`) {
+		t.Errorf("Artifact should have the globals. artifact=%s", m.Artifact)
+	}
+	log, _ := ioutil.ReadFile(dumpallLog)
+	if !strings.Contains(string(log), "--database=postgres") || !strings.Contains(string(log), "--globals-only") {
+		t.Errorf("Unexpected pg_dumpall args: %s", log)
+	}
+	for _, database := range m.Databases {
+		if database.PgDump == nil || database.SHA256 == "" {
+			t.Errorf("Dump of %s should be recorded. database=%v", database.Name, database)
+		}
+		if dump := readDump(t, *m, database.Name); !strings.Contains(dump, "--dbname="+database.Name+" ") {
+			t.Errorf("Artifact of %s should have its dump: %s", database.Name, dump)
+		}
+	}
+	resp, _ := backuper.GetBackup("c1")
+	if resp == nil || !strings.Contains(resp.Message, "cluster backup of 2 databases: analytics, app") || resp.SizeMB != float64(m.totalSize()) {
+		t.Errorf("Cluster backups should be reported as such. resp=%v", resp)
+	}
+
+	//a database of the backup is restored on its own
+	_, err = backuper.RestoreBackup("c1", "")
+	if err == nil {
+		t.Errorf("A database of the cluster backup should be chosen")
+	}
+	_, err = backuper.RestoreDatabase("c1", "postgres", "restored", false)
+	if err == nil || !strings.Contains(err.Error(), "analytics, app") {
+		t.Errorf("Databases that aren't on the backup can't be restored. err=%s", err)
+	}
+	resp, err = backuper.RestoreDatabase("c1", "app", "", false)
+	if err != nil || resp.DataID != "app" {
+		t.Fatalf("Error restoring database app. resp=%v err=%s", resp, err)
+	}
+	restoreJobs.wait("c1")
+	resp, _ = backuper.GetRestore("c1")
+	if resp.Status != statusAvailable {
+		t.Errorf("Database app should be restored. resp=%v", resp)
+	}
+
+	//each database is checked
+	app, _ := m.databaseManifest("app")
+	storage.objects[app.Artifact][0] ^= 1
+	startIntegrityCheck("c1")
+	checkJobs.wait("c1")
+	m, _ = readManifest("c1")
+	if m.Status != statusCorrupt || !strings.Contains(m.Integrity.Message, "database app: checksum mismatch") {
+		t.Errorf("Cluster backup with a changed database dump should be corrupt. m=%v", m)
+	}
+
+	err = backuper.DeleteBackup("c1")
+	if err != nil {
+		t.Fatalf("Error deleting backup: %s", err)
+	}
+	if len(storage.objects) != 0 {
+		t.Errorf("Every file of the cluster backup should be deleted. objects=%v", storage.objects)
+	}
+
+	//streamed backups only dump the included databases
+	*streamBackup = true
+	includeDatabases.Set("app")
+	includeDatabases.Set("logs")
+	backuper.CreateNewBackup("c2", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("c2")
+	m, _ = readManifest("c2")
+	if m.Status != statusAvailable || strings.Join(m.databaseNames(), ",") != "app" {
+		t.Errorf("Only the included databases should be dumped. m=%v", m)
+	}
+
+	excludeDatabases.Set("app")
+	backuper.CreateNewBackup("c3", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("c3")
+	m, _ = readManifest("c3")
+	if m.Status != statusError || !strings.Contains(m.Message, "No database") {
+		t.Errorf("Backup without databases should fail. m=%v", m)
+	}
+
+	//names pg_dump would take as connection strings aren't dumped
+	installFakeCommand(t, dir, "psql", `case "$*" in
+  *pg_database*) printf 'app\nhost=attacker dbname=app\n'; exit 0 ;;
+esac
+`+fakePsqlScript)
+	*includeDatabases, *excludeDatabases = stringList{}, stringList{}
+	backuper.CreateNewBackup("c4", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("c4")
+	m, _ = readManifest("c4")
+	if m.Status != statusError || !strings.Contains(m.Message, `Invalid database name "host=attacker dbname=app"`) {
+		t.Errorf("Backup of a database with an unsafe name should fail. m=%v", m)
+	}
+	excludeDatabases.Set("host=*")
+	backuper.CreateNewBackup("c5", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("c5")
+	m, _ = readManifest("c5")
+	if m.Status != statusAvailable || strings.Join(m.databaseNames(), ",") != "app" {
+		t.Errorf("Excluded databases with unsafe names should be left out. m=%v", m)
+	}
+}
+
+func TestClusterBackupOptions(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestClusterBackupOptions...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+
+	includeDatabases.Set("app")
+	if validateClusterOptions() == nil {
+		t.Errorf("Database patterns require --cluster")
+	}
+	*clusterBackup = true
+	if err := validateClusterOptions(); err != nil {
+		t.Errorf("Cluster backups should be valid. err=%s", err)
+	}
+	excludeDatabases.Set("[app")
+	if validateClusterOptions() == nil {
+		t.Errorf("Invalid patterns should be rejected")
+	}
+	*excludeDatabases = stringList{}
+	*verifyAfterBackup = true
+	if validateClusterOptions() == nil {
+		t.Errorf("Cluster backups can't be verified")
+	}
+	*verifyAfterBackup = false
+	*backupMode = backupKindPhysical
+	if validateClusterOptions() == nil {
+		t.Errorf("Cluster backups are logical")
+	}
+}
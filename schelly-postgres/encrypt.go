@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	//encryptionAlgorithm is recorded on the manifest of encrypted backups
+	encryptionAlgorithm = "aes-256-gcm-chunked"
+	//encryptionChunkSize is the amount of plaintext sealed on each chunk
+	encryptionChunkSize = 64 * 1024
+)
+
+//encryptionMagic starts every encrypted file, followed by the chunk size and the nonce prefix
+var encryptionMagic = []byte("SCHELLY\x01")
+
+//encryptionInfo is recorded on the manifest of encrypted backups
+type encryptionInfo struct {
+	Algorithm  string `json:"algorithm"`
+	KeyID      string `json:"key_id"`
+	WrappedKey string `json:"wrapped_key,omitempty"`
+}
+
+//encryptionKey is a 256 bit key identified by a short fingerprint
+type encryptionKey struct {
+	ID  string
+	Key []byte
+}
+
+//backupEncryptionKey encrypts new backups. nil when encryption is disabled
+var backupEncryptionKey *encryptionKey
+
+//parseEncryptionKey accepts 32 bytes keys encoded as hex or base64
+func parseEncryptionKey(encoded string) (*encryptionKey, error) {
+	encoded = strings.TrimSpace(encoded)
+	key, err := hex.DecodeString(encoded)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(encoded)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("Encryption key must have 32 bytes, encoded as hex or base64")
+	}
+	return &encryptionKey{ID: keyFingerprint(key), Key: key}, nil
+}
+
+//keyFingerprint identifies a key on manifests without revealing it
+func keyFingerprint(key []byte) string {
+	fingerprint := sha256.Sum256(key)
+	return hex.EncodeToString(fingerprint[:8])
+}
+
+//loadEncryptionKey reads the key from keyFile or from the environment variable keyEnv. Returns nil when none is set
+func loadEncryptionKey(keyFile string, keyEnv string) (*encryptionKey, error) {
+	if keyFile != "" && keyEnv != "" {
+		return nil, fmt.Errorf("`--encryption-key-file` and `--encryption-key-env` can't be used together")
+	}
+	if keyFile != "" {
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading encryption key file: %s", err)
+		}
+		return parseEncryptionKey(string(data))
+	}
+	if keyEnv != "" {
+		value := os.Getenv(keyEnv)
+		if value == "" {
+			return nil, fmt.Errorf("Environment variable %s with the encryption key is empty", keyEnv)
+		}
+		return parseEncryptionKey(value)
+	}
+	return nil, nil
+}
+
+//chunkNonce derives a unique nonce for each chunk. The last byte tells whether it is the final chunk,
+//so that truncated files fail to decrypt
+func chunkNonce(prefix []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[7:11], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//encryptStream encrypts reader contents on the fly with AES-256-GCM, in chunks of encryptionChunkSize.
+//Each chunk is written as its length, a final chunk flag and the sealed data. The result must be closed by the caller
+func encryptStream(reader io.Reader, key []byte) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(encryptTo(pw, reader, key))
+	}()
+	return pr
+}
+
+func encryptTo(w io.Writer, reader io.Reader, key []byte) error {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, 7)
+	_, err = rand.Read(prefix)
+	if err != nil {
+		return err
+	}
+	header := bytes.NewBuffer(nil)
+	header.Write(encryptionMagic)
+	binary.Write(header, binary.BigEndian, uint32(encryptionChunkSize))
+	header.Write(prefix)
+	aad := header.Bytes()
+	_, err = w.Write(aad)
+	if err != nil {
+		return err
+	}
+
+	plain := make([]byte, encryptionChunkSize)
+	next := make([]byte, encryptionChunkSize)
+	n, err := io.ReadFull(reader, plain)
+	for counter := uint32(0); ; counter++ {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		//read ahead to know whether this is the last chunk
+		final := err != nil
+		nextN := 0
+		if !final {
+			nextN, err = io.ReadFull(reader, next)
+			final = err == io.EOF
+		}
+		sealed := gcm.Seal(nil, chunkNonce(prefix, counter, final), plain[:n], aad)
+		frame := make([]byte, 5)
+		binary.BigEndian.PutUint32(frame, uint32(len(sealed)))
+		if final {
+			frame[4] = 1
+		}
+		_, werr := w.Write(append(frame, sealed...))
+		if werr != nil {
+			return werr
+		}
+		if final {
+			return nil
+		}
+		plain, next = next, plain
+		n = nextN
+		if counter == ^uint32(0) {
+			return fmt.Errorf("Backup is too big to be encrypted")
+		}
+	}
+}
+
+//decryptReader reverts encryptStream, failing when the contents were changed, truncated or followed by other data
+type decryptReader struct {
+	reader  io.Reader
+	gcm     cipher.AEAD
+	aad     []byte
+	prefix  []byte
+	counter uint32
+	buffer  []byte
+	done    bool
+}
+
+//decryptStream returns a reader with the decrypted contents of reader
+func decryptStream(reader io.Reader, key []byte) (io.Reader, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(encryptionMagic)+4+7)
+	_, err = io.ReadFull(reader, header)
+	if err != nil || !bytes.Equal(header[:len(encryptionMagic)], encryptionMagic) {
+		return nil, fmt.Errorf("Backup file isn't encrypted by schelly-postgres")
+	}
+	return &decryptReader{reader: reader, gcm: gcm, aad: header, prefix: header[len(encryptionMagic)+4:]}, nil
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.buffer) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		err := dr.readChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dr.buffer)
+	dr.buffer = dr.buffer[n:]
+	return n, nil
+}
+
+func (dr *decryptReader) readChunk() error {
+	frame := make([]byte, 5)
+	_, err := io.ReadFull(dr.reader, frame)
+	if err != nil {
+		return fmt.Errorf("Encrypted backup file is truncated")
+	}
+	size := binary.BigEndian.Uint32(frame)
+	if size > encryptionChunkSize+uint32(dr.gcm.Overhead()) {
+		return fmt.Errorf("Encrypted backup file is corrupted")
+	}
+	sealed := make([]byte, size)
+	_, err = io.ReadFull(dr.reader, sealed)
+	if err != nil {
+		return fmt.Errorf("Encrypted backup file is truncated")
+	}
+	final := frame[4] == 1
+	plain, err := dr.gcm.Open(nil, chunkNonce(dr.prefix, dr.counter, final), sealed, dr.aad)
+	if err != nil {
+		return fmt.Errorf("Backup file can't be decrypted: wrong key or corrupted file")
+	}
+	if final {
+		//nothing is expected after the final chunk
+		n, _ := io.ReadFull(dr.reader, make([]byte, 1))
+		if n > 0 {
+			return fmt.Errorf("Encrypted backup file has data after its final chunk")
+		}
+	}
+	dr.counter++
+	dr.buffer = plain
+	dr.done = final
+	return nil
+}
+
+//newEncryptionInfo describes the encryption applied to new backups, or nil when it is disabled.
+//With a keyring, each backup gets its own data key, whose id is only known once it is created by newDataKey
+func newEncryptionInfo(apiID string) *encryptionInfo {
+	if backupKeyring != nil {
+		return &encryptionInfo{Algorithm: encryptionAlgorithm, WrappedKey: wrappedKeyName(apiID)}
+	}
+	if backupEncryptionKey == nil {
+		return nil
+	}
+	return &encryptionInfo{Algorithm: encryptionAlgorithm, KeyID: backupEncryptionKey.ID}
+}
+
+//encryptionExtension returns the file name extension for backups encrypted as described by info
+func encryptionExtension(info *encryptionInfo) string {
+	if info == nil {
+		return ""
+	}
+	return ".enc"
+}
+
+//keyFor returns the key that decrypts a backup encrypted as described by info
+func keyFor(info *encryptionInfo) ([]byte, error) {
+	if info.WrappedKey != "" {
+		if backupKeyring == nil {
+			return nil, fmt.Errorf("Data key %s of the backup is wrapped, but no keyring is loaded", info.KeyID)
+		}
+		wk, err := readWrappedKey(backupStorage, info.WrappedKey)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading data key %s of the backup: %s", info.KeyID, err)
+		}
+		dataKey, err := backupKeyring.unwrap(wk)
+		if err != nil {
+			return nil, err
+		}
+		if keyFingerprint(dataKey) != info.KeyID {
+			return nil, fmt.Errorf("Wrapped key %s isn't the data key %s of the backup", info.WrappedKey, info.KeyID)
+		}
+		return dataKey, nil
+	}
+	if backupEncryptionKey != nil && backupEncryptionKey.ID == info.KeyID {
+		return backupEncryptionKey.Key, nil
+	}
+	if backupKeyring != nil {
+		if key := backupKeyring.find(info.KeyID); key != nil {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("Encryption key %s of the backup isn't loaded", info.KeyID)
+}
+
+//encryptionKeyFor returns the key that encrypts a new backup, creating its data key when a keyring is used. Every file
+//of the backup is encrypted with the same data key
+func encryptionKeyFor(info *encryptionInfo) ([]byte, error) {
+	if info.WrappedKey != "" && info.KeyID == "" {
+		return newDataKey(backupStorage, info)
+	}
+	return keyFor(info)
+}
+
+//checkDecryption decrypts the first chunk of the stored backup file, to make sure its key can be found and fits it.
+//The whole file is checked against its SHA-256 by integrity checks
+func checkDecryption(m *backupManifest) error {
+	reader, err := openArtifact(*m, nil)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = reader.Read(make([]byte, 1))
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
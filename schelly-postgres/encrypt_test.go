@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flaviostutz/schelly-webhook/schellyhook"
+	"go.uber.org/zap"
+)
+
+const testEncryptionKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+func TestEncryptStream(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestEncryptStream...")
+	key, err := parseEncryptionKey(testEncryptionKey)
+	if err != nil {
+		t.Fatalf("Error parsing key: %s", err)
+	}
+	for _, size := range []int{0, 1, encryptionChunkSize, encryptionChunkSize + 1, 3*encryptionChunkSize + 10} {
+		data := make([]byte, size)
+		rand.Read(data)
+		encrypted, err := ioutil.ReadAll(encryptStream(bytes.NewReader(data), key.Key))
+		if err != nil {
+			t.Fatalf("Error encrypting %d bytes: %s", size, err)
+		}
+		if size >= 16 && bytes.Contains(encrypted, data) {
+			t.Errorf("Encrypted stream has the plaintext (size %d)", size)
+		}
+		reader, err := decryptStream(bytes.NewReader(encrypted), key.Key)
+		if err != nil {
+			t.Fatalf("Error decrypting %d bytes: %s", size, err)
+		}
+		decrypted, err := ioutil.ReadAll(reader)
+		if err != nil || !bytes.Equal(decrypted, data) {
+			t.Fatalf("Decrypted stream differs from the original (size %d). err=%s", size, err)
+		}
+
+		if size > encryptionChunkSize {
+			//truncated on a chunk boundary, so only the final chunk flag tells it is incomplete
+			truncated := encrypted[:len(encryptionMagic)+4+7+5+encryptionChunkSize+16]
+			reader, _ = decryptStream(bytes.NewReader(truncated), key.Key)
+			_, err = ioutil.ReadAll(reader)
+			if err == nil {
+				t.Errorf("Truncated stream should not decrypt (size %d)", size)
+			}
+		}
+		appended := append(append([]byte{}, encrypted...), 0)
+		reader, _ = decryptStream(bytes.NewReader(appended), key.Key)
+		_, err = ioutil.ReadAll(reader)
+		if err == nil || !strings.Contains(err.Error(), "after its final chunk") {
+			t.Errorf("Stream with data after the final chunk should not decrypt (size %d). err=%s", size, err)
+		}
+		tampered := append([]byte{}, encrypted...)
+		tampered[len(tampered)-1] ^= 1
+		reader, _ = decryptStream(bytes.NewReader(tampered), key.Key)
+		_, err = ioutil.ReadAll(reader)
+		if err == nil {
+			t.Errorf("Tampered stream should not decrypt (size %d)", size)
+		}
+	}
+
+	other, _ := parseEncryptionKey(strings.Repeat("ff", 32))
+	reader, _ := decryptStream(encryptStream(strings.NewReader("secret"), key.Key), other.Key)
+	_, err = ioutil.ReadAll(reader)
+	if err == nil {
+		t.Errorf("Stream should not decrypt with another key")
+	}
+}
+
+func TestLoadEncryptionKey(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestLoadEncryptionKey...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "key")
+	ioutil.WriteFile(keyFile, []byte(testEncryptionKey+"\n"), 0600)
+	fromFile, err := loadEncryptionKey(keyFile, "")
+	if err != nil || fromFile == nil || len(fromFile.ID) != 16 {
+		t.Fatalf("Error loading key from file. key=%v err=%s", fromFile, err)
+	}
+	//the same key encoded as base64
+	os.Setenv("SCHELLY_TEST_KEY", "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=")
+	defer os.Unsetenv("SCHELLY_TEST_KEY")
+	fromEnv, err := loadEncryptionKey("", "SCHELLY_TEST_KEY")
+	if err != nil || fromEnv == nil || fromEnv.ID != fromFile.ID {
+		t.Fatalf("Key from environment should match the key from file. key=%v err=%s", fromEnv, err)
+	}
+
+	none, err := loadEncryptionKey("", "")
+	if none != nil || err != nil {
+		t.Errorf("No key should be loaded without options. key=%v err=%s", none, err)
+	}
+	for _, invalid := range []string{"abc", strings.Repeat("ab", 16)} {
+		ioutil.WriteFile(keyFile, []byte(invalid), 0600)
+		_, err = loadEncryptionKey(keyFile, "")
+		if err == nil {
+			t.Errorf("Key %s should be rejected", invalid)
+		}
+	}
+}
+
+func TestEncryptedBackupRestore(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestEncryptedBackupRestore...")
+	for _, stream := range []bool{false, true} {
+		dir := setupTestFlags(t)
+		defer os.RemoveAll(dir)
+		_, restoreOut := setupRestoreTest(t, dir)
+		*streamBackup = stream
+		*compression = "gzip"
+		backupEncryptionKey, _ = parseEncryptionKey(testEncryptionKey)
+		storage := newMemoryStorage()
+		backupStorage = storage
+
+		backuper := PostgresBackuper{}
+		backuper.CreateNewBackup("e1", 0, &schellyhook.ShellContext{})
+		backupJobs.wait("e1")
+
+		m, err := readManifest("e1")
+		if err != nil || m.Status != statusAvailable || !strings.HasSuffix(m.Artifact, ".gz.enc") ||
+			m.Encryption == nil || m.Encryption.KeyID != backupEncryptionKey.ID || m.Encryption.Algorithm != encryptionAlgorithm {
+			t.Fatalf("Unexpected manifest for encrypted backup (stream=%t). manifest=%v err=%s", stream, m, err)
+		}
+		stored, _ := storage.Get(m.Artifact)
+		data, _ := ioutil.ReadAll(stored)
+		if !bytes.HasPrefix(data, encryptionMagic) || int64(len(data)) != m.Size {
+			t.Errorf("Backup file should be stored encrypted (stream=%t)", stream)
+		}
+
+		backuper.RestoreBackup("e1", "restored")
+		restoreJobs.wait("e1")
+		resp, _ := backuper.GetRestore("e1")
+		if resp == nil || resp.Status != statusAvailable {
+			t.Fatalf("Restore of encrypted backup should be finished (stream=%t). resp=%v", stream, resp)
+		}
+		restored, _ := ioutil.ReadFile(restoreOut)
+		if !strings.Contains(string(restored), `CREATE TABLE "public"."t"`) {
+			t.Errorf("Encrypted backup should be decrypted on restore (stream=%t): %s", stream, restored)
+		}
+
+		server := httptest.NewServer(newAPIRouter())
+		res, err := http.Get(server.URL + "/backups/e1/download")
+		if err != nil || res.StatusCode != http.StatusOK || !strings.Contains(res.Header.Get("Content-Disposition"), `filename="`+strings.TrimSuffix(m.Artifact, ".gz.enc")+`"`) {
+			t.Fatalf("Unexpected download response (stream=%t). res=%v err=%s", stream, res, err)
+		}
+		downloaded, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		server.Close()
+		if !strings.HasPrefix(string(downloaded), "-- fake dump of") {
+			t.Errorf("Unexpected downloaded backup contents (stream=%t): %s", stream, downloaded)
+		}
+
+		//without the key the backup can't be restored
+		backupEncryptionKey = nil
+		backuper.RestoreBackup("e1", "restored")
+		restoreJobs.wait("e1")
+		resp, _ = backuper.GetRestore("e1")
+		if resp == nil || resp.Status != statusError || !strings.Contains(resp.Message, m.Encryption.KeyID) {
+			t.Errorf("Restore without the key should fail (stream=%t). resp=%v", stream, resp)
+		}
+	}
+}
+
+//corruptingStorage flips the last byte of every backup file it stores
+type corruptingStorage struct {
+	*memoryStorage
+}
+
+func (cs corruptingStorage) Put(name string, reader io.Reader) error {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 && !strings.HasSuffix(name, manifestSuffix) {
+		data[len(data)-1] ^= 1
+	}
+	return cs.memoryStorage.Put(name, bytes.NewReader(data))
+}
+
+func TestEncryptedBackupNotDecryptable(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestEncryptedBackupNotDecryptable...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	installFakeCommand(t, dir, "pg_dump", fakePgDumpScript)
+	backupEncryptionKey, _ = parseEncryptionKey(testEncryptionKey)
+	storage := corruptingStorage{newMemoryStorage()}
+	backupStorage = storage
+
+	backuper := PostgresBackuper{}
+	backuper.CreateNewBackup("e2", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("e2")
+
+	resp, err := backuper.GetBackup("e2")
+	if err != nil || resp == nil || resp.Status != statusError || !strings.Contains(resp.Message, "can't be decrypted") {
+		t.Errorf("Backup that can't be decrypted should not be available. resp=%v err=%s", resp, err)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//maxStderrTail is how much of the end of stderr is kept on command results
+const maxStderrTail = 4096
+
+//commandResult is the structured outcome of a command run by the provider, such as pg_dump
+type commandResult struct {
+	Command   []string  `json:"command"`
+	ExitCode  int       `json:"exit_code"`
+	Signal    string    `json:"signal,omitempty"`
+	TimedOut  bool      `json:"timed_out,omitempty"`
+	Cancelled bool      `json:"cancelled,omitempty"`
+	Stderr    string    `json:"stderr,omitempty"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+}
+
+//newCommandResult describes cmd after it exited. runErr is the error returned by cmd.Run or cmd.Wait
+func newCommandResult(cmd *exec.Cmd, runErr error, startTime time.Time, stderr string) *commandResult {
+	r := &commandResult{
+		Command:   cmd.Args,
+		ExitCode:  -1,
+		StartTime: startTime,
+		EndTime:   time.Now(),
+		Stderr:    tail(stderr, maxStderrTail),
+	}
+	if cmd.ProcessState != nil {
+		r.ExitCode = cmd.ProcessState.ExitCode()
+		if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			r.Signal = status.Signal().String()
+		}
+	} else if runErr != nil && r.Stderr == "" {
+		//the command didn't even start
+		r.Stderr = runErr.Error()
+	}
+	return r
+}
+
+//withContext records whether ctx (the job context) was cancelled or dumpCtx (the job context with the timeout) expired
+func (r *commandResult) withContext(ctx context.Context, dumpCtx context.Context) *commandResult {
+	r.Cancelled = ctx.Err() != nil
+	r.TimedOut = !r.Cancelled && dumpCtx.Err() == context.DeadlineExceeded
+	return r
+}
+
+func (r *commandResult) success() bool {
+	return r.ExitCode == 0 && r.Signal == "" && !r.TimedOut && !r.Cancelled
+}
+
+//err returns nil when the command succeeded, or an error describing how it failed
+func (r *commandResult) err() error {
+	if r.success() {
+		return nil
+	}
+	reason := "exit=" + strconv.Itoa(r.ExitCode)
+	if r.Signal != "" {
+		reason += " signal=" + r.Signal
+	}
+	if r.TimedOut {
+		reason += " (timeout enforced)"
+	}
+	if r.Cancelled {
+		reason += " (cancelled)"
+	}
+	return fmt.Errorf("Failed to run command: '%s'; %s; stderr=%s", strings.Join(r.Command, " "), reason, r.Stderr)
+}
+
+//withTimeout returns a context that expires after timeout. A timeout of 0 means no timeout
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func tail(value string, size int) string {
+	if len(value) <= size {
+		return value
+	}
+	return "..." + value[len(value)-size:]
+}
+
+var hostRegexp = regexp.MustCompile(`^[A-Za-z0-9._:/\[\]%-]+$`)
+
+//validateConnectionOptions checks the values that are passed as pg_dump and psql arguments
+func validateConnectionOptions(conn pgConnection) error {
+	if !hostRegexp.MatchString(conn.Host) {
+		return fmt.Errorf("Invalid database host %q. It must be an IP address, a domain name or a socket directory", conn.Host)
+	}
+	if conn.Port <= 0 || conn.Port > 65535 {
+		return fmt.Errorf("Invalid database port %d", conn.Port)
+	}
+	if conn.Username == "" || hasControlChars(conn.Username) {
+		return fmt.Errorf("Invalid database user %q", conn.Username)
+	}
+	//pg_dump and psql take --dbname values with `=` or an URI prefix as connection strings, which could override the other options
+	if conn.Database == "" || hasControlChars(conn.Database) || strings.Contains(conn.Database, "=") ||
+		strings.HasPrefix(conn.Database, "postgresql://") || strings.HasPrefix(conn.Database, "postgres://") {
+		return fmt.Errorf("Invalid database name %q", conn.Database)
+	}
+	return nil
+}
+
+//validateFileName checks the name given to backup files
+func validateFileName(name string) error {
+	if name == "" || hasControlChars(name) || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("Invalid file name %q. It can't be empty, start with `.` or have path separators", name)
+	}
+	return nil
+}
+
+func hasControlChars(value string) bool {
+	for _, c := range value {
+		if c < 0x20 || c == 0x7f {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flaviostutz/schelly-webhook/schellyhook"
+	"go.uber.org/zap"
+)
+
+func TestValidateConnectionOptions(t *testing.T) {
+	valid := pgConnection{Host: "db.example.com", Port: 5432, Username: "postgres", Database: "my db; with spaces"}
+	if err := validateConnectionOptions(valid); err != nil {
+		t.Errorf("Database names are passed as a single argument and may have any printable character. err=%s", err)
+	}
+	invalid := []pgConnection{
+		valid.withDatabase("host=evil dbname=x"),
+		valid.withDatabase("postgresql://evil/x"),
+		valid.withDatabase("line\nbreak"),
+		valid.withDatabase(""),
+		{Host: "db;rm -rf /", Port: 5432, Username: "postgres", Database: "x"},
+		{Host: "db", Port: 70000, Username: "postgres", Database: "x"},
+		{Host: "db", Port: 5432, Username: "bad\x00user", Database: "x"},
+	}
+	for _, conn := range invalid {
+		if err := validateConnectionOptions(conn); err == nil {
+			t.Errorf("Connection options should be rejected: %v", conn)
+		}
+	}
+	for _, name := range []string{"../etc", ".hidden", "a/b", ""} {
+		if err := validateFileName(name); err == nil {
+			t.Errorf("File name should be rejected: %q", name)
+		}
+	}
+}
+
+func TestPgDumpArgumentVector(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestPgDumpArgumentVector...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	argsFile := filepath.Join(dir, "args")
+	os.Setenv("ARGS_FILE", argsFile)
+	installFakeCommand(t, dir, "pg_dump", "printf '%s\\n' \"$@\" > \"$ARGS_FILE\"\n"+fakePgDumpScript)
+	backupStorage = newMemoryStorage()
+	*dbname = "my db; touch pwned"
+
+	for _, stream := range []bool{false, true} {
+		*streamBackup = stream
+		backuper := PostgresBackuper{}
+		backuper.CreateNewBackup("e1", 0, &schellyhook.ShellContext{})
+		backupJobs.wait("e1")
+
+		data, _ := ioutil.ReadFile(argsFile)
+		if !hasFlag(strings.Split(string(data), "\n"), "--dbname=my db; touch pwned") {
+			t.Errorf("Database name should be a single pg_dump argument (stream=%t): %s", stream, data)
+		}
+		m, err := readManifest("e1")
+		if err != nil || m.Status != statusAvailable || m.PgDump == nil || m.PgDump.ExitCode != 0 || m.PgDump.Command[0] != "pg_dump" {
+			t.Errorf("pg_dump result should be recorded on the manifest (stream=%t). manifest=%v err=%s", stream, m, err)
+		}
+		backuper.DeleteBackup("e1")
+	}
+	if _, err := os.Stat("pwned"); err == nil {
+		os.Remove("pwned")
+		t.Errorf("Database name must not be interpreted by a shell")
+	}
+}
+
+func TestPgDumpFailureResult(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestPgDumpFailureResult...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	backupStorage = newMemoryStorage()
+	backuper := PostgresBackuper{}
+
+	cases := []struct {
+		script  string
+		timeout time.Duration
+		check   func(r *commandResult) bool
+	}{
+		{"echo 'dumped' ; echo 'permission denied' >&2 ; exit 3\n", 0, func(r *commandResult) bool {
+			return r.ExitCode == 3 && r.Signal == "" && strings.TrimSpace(r.Stderr) == "permission denied"
+		}},
+		{"kill -TERM $$\n", 0, func(r *commandResult) bool {
+			return r.ExitCode == -1 && r.Signal == "terminated"
+		}},
+		{"exec sleep 5\n", 300 * time.Millisecond, func(r *commandResult) bool {
+			return r.TimedOut && r.Signal == "killed" && !r.Cancelled
+		}},
+	}
+	for _, stream := range []bool{false, true} {
+		*streamBackup = stream
+		for i, c := range cases {
+			installFakeCommand(t, dir, "pg_dump", c.script)
+			backuper.CreateNewBackup("e2", c.timeout, &schellyhook.ShellContext{})
+			backupJobs.wait("e2")
+
+			m, err := readManifest("e2")
+			if err != nil || m.Status != statusError || m.PgDump == nil || !c.check(m.PgDump) {
+				t.Errorf("Unexpected pg_dump result for case %d (stream=%t). manifest=%v result=%v err=%s", i, stream, m, m.PgDump, err)
+			}
+			backuper.DeleteBackup("e2")
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+//stringList is a repeatable command line option. Each occurrence holds a single value, which may have commas, as pg_dump
+//patterns such as `sales_{2019,2020}` do. Empty values are ignored
+type stringList []string
+
+func (sl *stringList) String() string {
+	if sl == nil {
+		return ""
+	}
+	return strings.Join(*sl, ",")
+}
+
+func (sl *stringList) Set(value string) error {
+	if value != "" {
+		*sl = append(*sl, value)
+	}
+	return nil
+}
+
+//dumpFilters are the pg_dump object filters. Patterns follow pg_dump rules, so `*` and `?` work as globs
+type dumpFilters struct {
+	Schemas          []string `json:"schemas,omitempty"`
+	ExcludeSchemas   []string `json:"exclude_schemas,omitempty"`
+	Tables           []string `json:"tables,omitempty"`
+	ExcludeTables    []string `json:"exclude_tables,omitempty"`
+	ExcludeTableData []string `json:"exclude_table_data,omitempty"`
+}
+
+//currentDumpFilters returns the filters set on the command line, or nil when the whole database is dumped
+func currentDumpFilters() *dumpFilters {
+	f := dumpFilters{
+		Schemas:          *schemas,
+		ExcludeSchemas:   *excludeSchemas,
+		Tables:           *tables,
+		ExcludeTables:    *excludeTables,
+		ExcludeTableData: *excludeTableData,
+	}
+	if len(f.flags()) == 0 {
+		return nil
+	}
+	return &f
+}
+
+//flags returns the pg_dump options for the filters, one per pattern
+func (f dumpFilters) flags() []string {
+	flags := make([]string, 0)
+	add := func(name string, patterns []string) {
+		for _, pattern := range patterns {
+			flags = append(flags, "--"+name+"="+pattern)
+		}
+	}
+	add("schema", f.Schemas)
+	add("exclude-schema", f.ExcludeSchemas)
+	add("table", f.Tables)
+	add("exclude-table", f.ExcludeTables)
+	add("exclude-table-data", f.ExcludeTableData)
+	return flags
+}
+
+//validateFilterPatterns rejects patterns pg_dump can't receive
+func validateFilterPatterns(patterns ...[]string) error {
+	for _, list := range patterns {
+		for _, pattern := range list {
+			if strings.ContainsAny(pattern, "\x00\n\r") {
+				return fmt.Errorf("Invalid filter pattern %q", pattern)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flaviostutz/schelly-webhook/schellyhook"
+	"go.uber.org/zap"
+)
+
+func TestDumpFilters(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestDumpFilters...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	argsFile := filepath.Join(dir, "args")
+	os.Setenv("ARGS_FILE", argsFile)
+	installFakeCommand(t, dir, "pg_dump", "printf '%s\\n' \"$@\" > \"$ARGS_FILE\"\n"+fakePgDumpScript)
+	backupStorage = newMemoryStorage()
+
+	schemas.Set("tenant one")
+	tables.Set("audit_*")
+	tables.Set("public.log?")
+	tables.Set("sales_{2019,2020}")
+	tables.Set("")
+	tables.Set("x;touch pwned")
+	excludeTableData.Set("public.events")
+
+	backuper := PostgresBackuper{}
+	backuper.CreateNewBackup("f1", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("f1")
+
+	data, _ := ioutil.ReadFile(argsFile)
+	args := strings.Split(string(data), "\n")
+	for _, expected := range []string{"--schema=tenant one", "--table=audit_*", "--table=public.log?", "--table=sales_{2019,2020}", "--table=x;touch pwned", "--exclude-table-data=public.events"} {
+		if !hasFlag(args, expected) {
+			t.Errorf("pg_dump should receive %s as a single argument: %v", expected, args)
+		}
+	}
+	if _, err := os.Stat("pwned"); err == nil {
+		os.Remove("pwned")
+		t.Errorf("Filter patterns must not be interpreted by the shell")
+	}
+
+	m, err := readManifest("f1")
+	if err != nil || m.Filters == nil || len(m.Filters.Tables) != 4 || m.Filters.Schemas[0] != "tenant one" || m.Filters.ExcludeTableData[0] != "public.events" {
+		t.Fatalf("Filters should be recorded on the manifest. manifest=%v err=%s", m, err)
+	}
+	backup, _ := backuper.GetBackup("f1")
+	if backup == nil || !strings.Contains(backup.Message, "partial backup: --schema=tenant one --table=audit_*") {
+		t.Errorf("Partial backups should be reported as such: %v", backup)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+//basebackupManifestExtension is appended to the backup_manifest of physical backups, which is stored apart from the
+//artifact so that incremental backups can be taken against it without fetching the whole backup
+const basebackupManifestExtension = ".backup_manifest"
+
+//pgMajorVersion matches the major version on the output of `pg_basebackup --version`
+var pgMajorVersion = regexp.MustCompile(`\(PostgreSQL\) (\d+)`)
+
+//supportsIncremental tells whether pg_basebackup of the given version can take incremental backups (PostgreSQL 17+)
+func supportsIncremental(version string) bool {
+	match := pgMajorVersion.FindStringSubmatch(version)
+	if match == nil {
+		return false
+	}
+	major, _ := strconv.Atoi(match[1])
+	return major >= 17
+}
+
+//isIncremental tells whether m is an incremental physical backup, which can only be restored along with its parents
+func (m backupManifest) isIncremental() bool {
+	return m.Parent != ""
+}
+
+//backupChain returns the backups needed to restore m, from its full backup to m itself. Fails when any of them
+//isn't available
+func backupChain(m backupManifest) ([]backupManifest, error) {
+	chain := []backupManifest{m}
+	for m.isIncremental() {
+		parent, err := readManifest(m.Parent)
+		if err == errObjectNotFound {
+			return nil, fmt.Errorf("Backup %s, parent of %s, not found", m.Parent, m.APIID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if parent.Status != statusAvailable {
+			return nil, fmt.Errorf("Backup %s, parent of %s, isn't available. status=%s", parent.APIID, m.APIID, parent.Status)
+		}
+		chain = append([]backupManifest{*parent}, chain...)
+		m = *parent
+	}
+	return chain, nil
+}
+
+//incrementalChildren returns the apiIDs of the backups taken incremental to apiID, including the running ones
+func incrementalChildren(apiID string) ([]string, error) {
+	manifests, _, err := listManifests()
+	if err != nil {
+		return nil, err
+	}
+	children := make([]string, 0)
+	for _, m := range manifests {
+		if m.Parent == apiID && m.Status != statusError {
+			children = append(children, m.APIID)
+		}
+	}
+	return children, nil
+}
+
+//incrementalParent returns the backup the next physical backup is taken incremental to: the latest available physical
+//backup of the server, unless its chain already has --max-incremental-chain incremental backups. Returns nil when a full
+//backup must be taken
+func incrementalParent() (*backupManifest, error) {
+	manifests, _, err := listManifests()
+	if err != nil {
+		return nil, err
+	}
+	var latest *backupManifest
+	for i, m := range manifests {
+		if !m.isPhysical() || m.Status != statusAvailable || m.Host != *host || m.Port != *port {
+			continue
+		}
+		if latest == nil || m.StartTime.After(latest.StartTime) {
+			latest = &manifests[i]
+		}
+	}
+	if latest == nil {
+		return nil, nil
+	}
+	chain, err := backupChain(*latest)
+	if err != nil {
+		return nil, err
+	}
+	if *maxIncrementalChain > 0 && len(chain)-1 >= *maxIncrementalChain {
+		return nil, nil
+	}
+	return latest, nil
+}
+
+//incrementalLock is held while the parent of an incremental backup is chosen and recorded, and while a physical backup
+//is checked for incremental backups and deleted, so that a backup isn't deleted as another one is taken against it
+var incrementalLock sync.Mutex
+
+//fetchParentManifest writes to path the backup_manifest of the backup the physical backup m is taken incremental to,
+//and records that backup as the parent of m. Tells whether the backup is incremental. The parent is recorded on the
+//manifest right away, so that it can't be deleted while the backup runs
+func fetchParentManifest(m *backupManifest, path string) (bool, error) {
+	if !*incrementalBackup {
+		return false, nil
+	}
+	incrementalLock.Lock()
+	defer incrementalLock.Unlock()
+	parent, err := incrementalParent()
+	if err != nil || parent == nil {
+		return false, err
+	}
+	reader, err := openBasebackupManifest(*parent)
+	if err != nil {
+		return false, fmt.Errorf("Error fetching backup_manifest of %s: %s", parent.APIID, err)
+	}
+	defer reader.Close()
+	err = extractFile(reader, path)
+	if err != nil {
+		return false, err
+	}
+	m.Parent = parent.APIID
+	err = writeManifest(m)
+	if err != nil {
+		m.Parent = ""
+		return false, err
+	}
+	return true, nil
+}
+
+//storeBasebackupManifest stores the backup_manifest written by pg_basebackup at path, compressed and encrypted like
+//the artifact of m, and records its name on m. pg_basebackup only writes it since PostgreSQL 13
+func storeBasebackupManifest(m *backupManifest, path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	sidecar := *m
+	sidecar.Artifact = resolveFileName(m.APIID, m.PgDumpID) + basebackupManifestExtension + compressionExtension(m.Compression) + encryptionExtension(m.Encryption)
+	err = storeArtifact(&sidecar, file)
+	if err != nil {
+		return err
+	}
+	m.BasebackupManifest = sidecar.Artifact
+	return nil
+}
+
+//openBasebackupManifest fetches the backup_manifest of the physical backup m, decrypted and decompressed. Backups taken
+//before it was stored apart have it read from their artifact. The result must be closed by the caller
+func openBasebackupManifest(m backupManifest) (io.ReadCloser, error) {
+	if m.BasebackupManifest != "" {
+		m.Artifact = m.BasebackupManifest
+	}
+	reader, err := openArtifact(m, nil)
+	if err != nil {
+		return nil, err
+	}
+	decompressed, err := decompressStream(reader, m.Compression)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	if m.BasebackupManifest != "" {
+		return decompressedReader{decompressed, reader}, nil
+	}
+
+	bundle := tar.NewReader(decompressed)
+	for {
+		header, err := bundle.Next()
+		if err == io.EOF {
+			err = fmt.Errorf("Backup %s has no backup_manifest", m.APIID)
+		}
+		if err != nil {
+			decompressed.Close()
+			reader.Close()
+			return nil, err
+		}
+		if header.Name == "backup_manifest" {
+			return decompressedReader{readCloser{bundle, decompressed}, reader}, nil
+		}
+	}
+}
+
+//linkTablespaces turns the tablespace_map of a physical backup extracted into dir into the pg_tblspc links of a plain
+//format backup, pointing to the tablespaces extracted next to dir, as pg_combinebackup expects. Returns the OIDs of
+//the tablespaces
+func linkTablespaces(dir string) ([]string, error) {
+	mapPath := filepath.Join(dir, "tablespace_map")
+	data, err := ioutil.ReadFile(mapPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	oids := make([]string, 0)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		err = os.MkdirAll(filepath.Join(dir, "pg_tblspc"), 0700)
+		if err == nil {
+			err = os.Symlink(tablespaceDir(dir, fields[0]), filepath.Join(dir, "pg_tblspc", fields[0]))
+		}
+		if err != nil {
+			return nil, err
+		}
+		oids = append(oids, fields[0])
+	}
+	return oids, os.Remove(mapPath)
+}
+
+//combineBackupChain lays out an incremental backup on dataDir: each backup of its chain is extracted into a staging
+//directory and pg_combinebackup reconstructs the full backup from them, with the tablespaces next to dataDir
+func combineBackupChain(ctx context.Context, j *job, chain []backupManifest, dataDir string) error {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	stagingDir := filepath.Join(*backupsDir, ".staging", "recovery-"+j.ID)
+	defer os.RemoveAll(stagingDir)
+
+	dirs := make([]string, 0)
+	var oids []string
+	for _, m := range chain {
+		dir := filepath.Join(stagingDir, m.APIID)
+		err := extractBaseBackup(j, m, dir)
+		if err != nil {
+			return err
+		}
+		oids, err = linkTablespaces(dir)
+		if err != nil {
+			return fmt.Errorf("Error linking tablespaces of %s: %s", m.APIID, err)
+		}
+		dirs = append(dirs, dir)
+	}
+	//the tablespaces of the reconstructed backup are those of the last backup of the chain
+	args := []string{"--output=" + dataDir}
+	for _, oid := range oids {
+		args = append(args, "--tablespace-mapping="+tablespaceDir(dirs[len(dirs)-1], oid)+"="+tablespaceDir(dataDir, oid))
+	}
+	args = append(args, dirs...)
+
+	setRecoveryStep(j.ID, fmt.Sprintf("combining %d backups with pg_combinebackup", len(chain)))
+	cmd := exec.CommandContext(ctx, "pg_combinebackup", args...)
+	sugar.Debugf("Executing pg_combinebackup command: %s", strings.Join(cmd.Args, " "))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to run command: '%s'; err=%s; out=%s", strings.Join(cmd.Args, " "), err, out)
+	}
+	//PostgreSQL refuses data directories that others can read
+	return os.Chmod(dataDir, 0700)
+}
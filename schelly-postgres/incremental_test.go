@@ -0,0 +1,260 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flaviostutz/schelly-webhook/schellyhook"
+	"go.uber.org/zap"
+)
+
+//fakePgCombinebackupScript logs its args to $COMBINEBACKUP_LOG and copies the last backup to --output. Like
+//pg_combinebackup, it fails when a backup has no backup_manifest
+const fakePgCombinebackupScript = `for arg in "$@"; do
+  case "$arg" in
+    --output=*) output="${arg#--output=}" ;;
+    -*) ;;
+    *)
+      last="$arg"
+      if [ ! -f "$arg/backup_manifest" ]; then
+        echo "pg_combinebackup: error: could not open file \"$arg/backup_manifest\"" >&2
+        exit 1
+      fi ;;
+  esac
+done
+echo "$*" >> "$COMBINEBACKUP_LOG"
+mkdir -p "$output"
+cp -R "$last/." "$output"
+`
+
+func TestIncrementalBackup(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestIncrementalBackup...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	basebackupLog := setupPhysicalTest(t, dir)
+	*incrementalBackup = true
+	*maxIncrementalChain = 2
+	*compression = "gzip"
+	storage := newMemoryStorage()
+	backupStorage = storage
+
+	backuper := PostgresBackuper{}
+	parents := map[string]string{"i1": "", "i2": "i1", "i3": "i2", "i4": ""}
+	for _, apiID := range []string{"i1", "i2", "i3", "i4"} {
+		backuper.CreateNewBackup(apiID, 0, &schellyhook.ShellContext{})
+		backupJobs.wait(apiID)
+		m, err := readManifest(apiID)
+		if err != nil || m.Status != statusAvailable || m.Parent != parents[apiID] {
+			t.Fatalf("Backup %s should be incremental to %q. m=%v err=%s", apiID, parents[apiID], m, err)
+		}
+		if _, err = storage.Stat(m.BasebackupManifest); m.BasebackupManifest == "" || err != nil {
+			t.Errorf("backup_manifest of %s should be stored apart. name=%s err=%s", apiID, m.BasebackupManifest, err)
+		}
+	}
+	log, _ := ioutil.ReadFile(basebackupLog)
+	for _, label := range []string{"schelly-i1", "schelly-i2"} {
+		if !strings.Contains(string(log), `incremental to {"PostgreSQL-Backup-Manifest-Version": 1, "Label": "`+label+`"}`) {
+			t.Errorf("A backup should be taken incremental to the backup_manifest of %s: %s", label, log)
+		}
+	}
+	backup, _ := backuper.GetBackup("i2")
+	if backup == nil || !strings.Contains(backup.Message, "incremental physical backup of i1") {
+		t.Errorf("Incremental backups should be reported as such. backup=%v", backup)
+	}
+
+	for _, apiID := range []string{"i1", "i2"} {
+		err := backuper.DeleteBackup(apiID)
+		if err == nil || !strings.Contains(err.Error(), "incremental backups") {
+			t.Errorf("Backup %s has incremental backups and shouldn't be deleted. err=%s", apiID, err)
+		}
+	}
+	i1, _ := readManifest("i1")
+	for _, apiID := range []string{"i3", "i2", "i1"} {
+		err := backuper.DeleteBackup(apiID)
+		if err != nil {
+			t.Errorf("Error deleting backup %s: %s", apiID, err)
+		}
+	}
+	if _, err := storage.Stat(i1.BasebackupManifest); err != errObjectNotFound {
+		t.Errorf("backup_manifest should be deleted along with the backup. err=%s", err)
+	}
+
+	//backups taken before backup_manifest was stored apart have it read from their artifact
+	i4, _ := readManifest("i4")
+	storage.Delete(i4.BasebackupManifest)
+	i4.BasebackupManifest = ""
+	writeManifest(i4)
+	backuper.CreateNewBackup("i5", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("i5")
+	i5, _ := readManifest("i5")
+	log, _ = ioutil.ReadFile(basebackupLog)
+	if i5.Parent != "i4" || !strings.Contains(string(log), `"Label": "schelly-i4"`) {
+		t.Errorf("Backup should be incremental to the backup_manifest on the artifact of i4. m=%v log=%s", i5, log)
+	}
+
+	//a parent whose backup_manifest can't be read is replaced by a full backup
+	storage.Delete(i5.BasebackupManifest)
+	storage.Delete(i4.Artifact)
+	backuper.CreateNewBackup("i6", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("i6")
+	i6, _ := readManifest("i6")
+	if i6.Status != statusAvailable || i6.Parent != "" {
+		t.Errorf("A full backup should be taken when the chain is broken. m=%v", i6)
+	}
+
+	//the backup_manifest is encrypted with the data key of its backup
+	backupKeyring, _ = loadKeyring(writeKeyring(t, dir, "k1 "+testEncryptionKey+"\n"), "")
+	backuper.CreateNewBackup("i7", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("i7")
+	backuper.CreateNewBackup("i8", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("i8")
+	i8, _ := readManifest("i8")
+	log, _ = ioutil.ReadFile(basebackupLog)
+	if i8.Parent != "i7" || !strings.Contains(string(log), `"Label": "schelly-i7"`) {
+		t.Errorf("Backup should be incremental to the encrypted backup_manifest of i7. m=%v log=%s", i8, log)
+	}
+}
+
+//listCountingStorage counts the listings of the storage
+type listCountingStorage struct {
+	*memoryStorage
+	lists int
+}
+
+func (ls *listCountingStorage) List() ([]StorageObject, error) {
+	ls.lists++
+	return ls.memoryStorage.List()
+}
+
+func TestDeleteBackupListings(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestDeleteBackupListings...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	installFakeCommand(t, dir, "pg_dump", fakePgDumpScript)
+	storage := &listCountingStorage{memoryStorage: newMemoryStorage()}
+	backupStorage = storage
+	*incrementalBackup = true
+
+	//logical backups can't have incremental backups, so the other backups aren't listed to look for them
+	backuper := PostgresBackuper{}
+	backuper.CreateNewBackup("d1", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("d1")
+	storage.lists = 0
+	err := backuper.DeleteBackup("d1")
+	if err != nil || storage.lists != 0 {
+		t.Errorf("Logical backup should be deleted without listing the backups. lists=%d err=%s", storage.lists, err)
+	}
+
+	setupPhysicalTest(t, dir)
+	backuper.CreateNewBackup("d2", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("d2")
+	storage.lists = 0
+	err = backuper.DeleteBackup("d2")
+	if err != nil || storage.lists == 0 {
+		t.Errorf("Physical backup should be checked for incremental backups. lists=%d err=%s", storage.lists, err)
+	}
+}
+
+func TestIncrementalBackupOptions(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestIncrementalBackupOptions...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+
+	*incrementalBackup = true
+	if validatePhysicalOptions() == nil {
+		t.Errorf("Logical backups can't be incremental")
+	}
+	*backupMode = backupKindPhysical
+	*maxIncrementalChain = -1
+	if validatePhysicalOptions() == nil {
+		t.Errorf("Negative chain lengths should be rejected")
+	}
+	*maxIncrementalChain = 0
+	if err := validatePhysicalOptions(); err != nil {
+		t.Errorf("Incremental physical backups should be valid. err=%s", err)
+	}
+
+	versions := map[string]bool{
+		"pg_basebackup (PostgreSQL) 17.2":                           true,
+		"pg_basebackup (PostgreSQL) 18beta1":                        true,
+		"pg_basebackup (PostgreSQL) 16.4 (Debian 16.4-1.pgdg120+1)": false,
+		"pg_basebackup (PostgreSQL) 9.6.24":                         false,
+		"":                                                          false,
+	}
+	for version, supported := range versions {
+		if supportsIncremental(version) != supported {
+			t.Errorf("Incremental support of %q should be %t", version, supported)
+		}
+	}
+}
+
+func TestIncrementalRecovery(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestIncrementalRecovery...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	*incrementalBackup = true
+	setupRecoveryTest(t, dir)
+	installFakeCommand(t, dir, "pg_combinebackup", fakePgCombinebackupScript)
+	combineLog := filepath.Join(dir, "combinebackup.log")
+	os.Setenv("COMBINEBACKUP_LOG", combineLog)
+	defer os.Unsetenv("COMBINEBACKUP_LOG")
+
+	backuper := PostgresBackuper{}
+	dataDir := filepath.Join(dir, "recovered")
+	resp, err := backuper.RecoverToTarget(recoveryRequest{TargetTime: "2019-06-14T10:30:00Z", DataDir: "recovered", PrepareOnly: true})
+	if err != nil || resp.DataID != "r2" {
+		t.Fatalf("Recovery should start from r2. resp=%v err=%s", resp, err)
+	}
+	recoveryJobs.wait(resp.ID)
+	resp, _ = backuper.GetRecovery(resp.ID)
+	if resp.Status != statusAvailable {
+		t.Fatalf("Data directory should be prepared. resp=%v", resp)
+	}
+
+	stagingDir := filepath.Join(*backupsDir, ".staging", "recovery-"+resp.ID)
+	log, _ := ioutil.ReadFile(combineLog)
+	expected := "--output=" + dataDir + " --tablespace-mapping=" + tablespaceDir(filepath.Join(stagingDir, "r2"), "16384") + "=" +
+		tablespaceDir(dataDir, "16384") + " " + filepath.Join(stagingDir, "r1") + " " + filepath.Join(stagingDir, "r2") + "\n"
+	if string(log) != expected {
+		t.Errorf("pg_combinebackup should combine r1 and r2. expected=%s log=%s", expected, log)
+	}
+	if _, err := os.Lstat(filepath.Join(dataDir, "pg_tblspc", "16384")); err != nil {
+		t.Errorf("Tablespaces should be linked on pg_tblspc for pg_combinebackup. err=%s", err)
+	}
+	for _, name := range []string{"PG_VERSION", "recovery.signal", "backup_manifest"} {
+		if _, err := os.Stat(filepath.Join(dataDir, name)); err != nil {
+			t.Errorf("Data directory should have %s. err=%s", name, err)
+		}
+	}
+	if _, err := os.Stat(stagingDir); !os.IsNotExist(err) {
+		t.Errorf("Backups of the chain should be removed from staging. err=%s", err)
+	}
+
+	//a chain missing a backup can't be recovered
+	r1, _ := readManifest("r1")
+	r1.Status = statusCorrupt
+	writeManifest(r1)
+	_, err = backuper.RecoverToTarget(recoveryRequest{TargetTime: "2019-06-14T10:30:00Z", DataDir: "broken"})
+	if err == nil || !strings.Contains(err.Error(), "parent of r2") {
+		t.Errorf("Recovery of a broken chain should be refused. err=%s", err)
+	}
+}
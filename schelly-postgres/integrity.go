@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+//integrityCheck is the result of the last time the stored backup file was read back and compared with its checksum
+type integrityCheck struct {
+	Valid   bool      `json:"valid"`
+	Size    int64     `json:"size"`
+	SHA256  string    `json:"sha256"`
+	Message string    `json:"message,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+//checkJobs keeps the integrity checks started since the provider was launched
+var checkJobs = newJobRegistry()
+
+//startIntegrityCheck reads back the backup file of apiID in background and compares it with the checksum on its manifest
+func startIntegrityCheck(apiID string) error {
+	m, err := readManifest(apiID)
+	if err != nil {
+		return err
+	}
+	if m.Status != statusAvailable && m.Status != statusCorrupt {
+		return fmt.Errorf("Backup %s can't be checked because its status is %s", apiID, m.Status)
+	}
+	if m.Tier == tierArchive {
+		return fmt.Errorf("Backup %s can't be checked because its file is archived", apiID)
+	}
+	if m.Format == "directory" && m.Bundle == "" {
+		return fmt.Errorf("Backup %s is a legacy directory backup, which has no checksum", apiID)
+	}
+	j, ctx, err := checkJobs.start(apiID, m.PgDumpID)
+	if err != nil {
+		return err
+	}
+	checkJobs.setSize(j, m.totalSize())
+	go runIntegrityCheck(ctx, j)
+	return nil
+}
+
+//runIntegrityCheck checks the backup of job j and records the result on its manifest. A backup file that doesn't match
+//its checksum flips the backup status to corrupt
+func runIntegrityCheck(ctx context.Context, j *job) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	m, err := readManifest(j.ID)
+	if err == nil {
+		err = checkIntegrity(ctx, j, m)
+		if err == nil {
+			m, err = updateManifest(j.ID, func(current *backupManifest) error {
+				return mergeIntegrity(current, m)
+			})
+		}
+	}
+	if err != nil {
+		sugar.Warnf("Integrity check of backup %s failed. err=%s", j.ID, err)
+	} else if m.Status == statusCorrupt {
+		sugar.Warnf("Backup %s is corrupt: %s", j.ID, m.Integrity.Message)
+	} else {
+		sugar.Infof("Backup %s integrity checked", j.ID)
+	}
+	checkJobs.finish(j, err)
+}
+
+//mergeIntegrity records on the current manifest of a backup the result of the integrity check made on the copy checked,
+//leaving the changes made while the files were read, such as a new tier or verification, in place
+func mergeIntegrity(current *backupManifest, checked *backupManifest) error {
+	if current.Status != statusAvailable && current.Status != statusCorrupt {
+		return fmt.Errorf("Backup %s status changed to %s during the integrity check", current.APIID, current.Status)
+	}
+	current.Integrity = checked.Integrity
+	current.Status = checked.Status
+	current.Size = checked.Size
+	current.SHA256 = checked.SHA256
+	for i, database := range current.Databases {
+		for _, checkedDatabase := range checked.Databases {
+			if checkedDatabase.Name == database.Name {
+				current.Databases[i].Size = checkedDatabase.Size
+				current.Databases[i].SHA256 = checkedDatabase.SHA256
+			}
+		}
+	}
+	return nil
+}
+
+//checkIntegrity reads the backup files described by m and compares their size and SHA-256 with the ones recorded at backup time.
+//Backups without a checksum, such as legacy backups, get the current one recorded
+func checkIntegrity(ctx context.Context, j *job, m *backupManifest) error {
+	err := checkArtifactIntegrity(ctx, j, m)
+	if err != nil || m.Status == statusCorrupt {
+		return err
+	}
+	//the dump of each database of a cluster backup is checked like a backup of its own
+	for i, database := range m.Databases {
+		dump, _ := m.databaseManifest(database.Name)
+		err = checkArtifactIntegrity(ctx, j, &dump)
+		if err != nil {
+			return err
+		}
+		m.Databases[i].Size = dump.Size
+		m.Databases[i].SHA256 = dump.SHA256
+		if dump.Status == statusCorrupt {
+			m.Status = statusCorrupt
+			m.Integrity = dump.Integrity
+			m.Integrity.Message = "database " + database.Name + ": " + m.Integrity.Message
+			return nil
+		}
+	}
+	return nil
+}
+
+//checkArtifactIntegrity checks the artifact of m, recording the result on m
+func checkArtifactIntegrity(ctx context.Context, j *job, m *backupManifest) error {
+	reader, err := backupStorage.Get(m.Artifact)
+	if err == errObjectNotFound {
+		m.Status = statusCorrupt
+		m.Integrity = &integrityCheck{Message: "backup file " + m.Artifact + " is missing", Time: time.Now()}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error fetching backup file %s: %s", m.Artifact, err)
+	}
+	defer reader.Close()
+
+	cr := newChecksumReader(j.countReader(reader))
+	_, err = io.Copy(ioutil.Discard, contextReader{ctx, cr})
+	if err != nil {
+		return fmt.Errorf("Error reading backup file %s: %s", m.Artifact, err)
+	}
+
+	check := &integrityCheck{Valid: true, Size: cr.size, SHA256: cr.sum(), Time: time.Now()}
+	if m.SHA256 == "" {
+		m.SHA256 = check.SHA256
+		m.Size = check.Size
+		check.Message = "checksum recorded"
+	} else if check.SHA256 != m.SHA256 || check.Size != m.Size {
+		check.Valid = false
+		check.Message = fmt.Sprintf("checksum mismatch: stored file has %d bytes and SHA-256 %s, expected %d bytes and SHA-256 %s",
+			check.Size, check.SHA256, m.Size, m.SHA256)
+	}
+	m.Integrity = check
+	if check.Valid {
+		m.Status = statusAvailable
+	} else {
+		m.Status = statusCorrupt
+	}
+	return nil
+}
+
+//contextReader stops reading once ctx is cancelled
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if cr.ctx.Err() != nil {
+		return 0, cr.ctx.Err()
+	}
+	return cr.reader.Read(p)
+}
+
+//checkAllBackups checks every available or corrupt backup, one after the other
+func checkAllBackups() error {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	manifests, _, err := listManifests()
+	if err != nil {
+		return err
+	}
+	for _, m := range manifests {
+		if (m.Status != statusAvailable && m.Status != statusCorrupt) || m.Tier == tierArchive {
+			continue
+		}
+		err = startIntegrityCheck(m.APIID)
+		if err != nil {
+			sugar.Warnf("Couldn't start integrity check of backup %s. err=%s", m.APIID, err)
+			continue
+		}
+		checkJobs.wait(m.APIID)
+	}
+	return nil
+}
+
+//scheduleIntegrityChecks checks all backups every interval
+func scheduleIntegrityChecks(interval time.Duration) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	go func() {
+		for range time.Tick(interval) {
+			err := checkAllBackups()
+			if err != nil {
+				sugar.Warnf("Scheduled integrity check failed. err=%s", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/flaviostutz/schelly-webhook/schellyhook"
+	"go.uber.org/zap"
+)
+
+func TestIntegrityCheck(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestIntegrityCheck...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	installFakeCommand(t, dir, "pg_dump", fakePgDumpScript)
+	storage := newMemoryStorage()
+	backupStorage = storage
+
+	backuper := PostgresBackuper{}
+	backuper.CreateNewBackup("c1", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("c1")
+
+	err := startIntegrityCheck("c1")
+	if err != nil {
+		t.Fatalf("Error starting integrity check: %s", err)
+	}
+	checkJobs.wait("c1")
+	m, _ := readManifest("c1")
+	if m.Status != statusAvailable || m.Integrity == nil || !m.Integrity.Valid || m.Integrity.SHA256 != m.SHA256 {
+		t.Fatalf("Intact backup should pass the integrity check. manifest=%v", m)
+	}
+
+	//flip a byte of the stored file
+	storage.objects[m.Artifact][0] ^= 1
+	startIntegrityCheck("c1")
+	checkJobs.wait("c1")
+	resp, err := backuper.GetBackup("c1")
+	if err != nil || resp.Status != statusCorrupt || !strings.Contains(resp.Message, "checksum mismatch") {
+		t.Fatalf("Changed backup should be corrupt. resp=%v err=%s", resp, err)
+	}
+	_, err = backuper.RestoreBackup("c1", "restored")
+	if err == nil {
+		t.Errorf("Corrupt backups should not be restored")
+	}
+
+	//a fixed file makes the backup available again
+	storage.objects[m.Artifact][0] ^= 1
+	startIntegrityCheck("c1")
+	checkJobs.wait("c1")
+	m, _ = readManifest("c1")
+	if m.Status != statusAvailable {
+		t.Errorf("Backup should be available after its file is fixed. manifest=%v", m)
+	}
+
+	storage.Delete(m.Artifact)
+	checkAllBackups()
+	m, _ = readManifest("c1")
+	if m.Status != statusCorrupt || !strings.Contains(m.Integrity.Message, "is missing") {
+		t.Errorf("Backup with a missing file should be corrupt. manifest=%v", m)
+	}
+}
+
+//hookStorage calls onGet before fetching each file
+type hookStorage struct {
+	*memoryStorage
+	onGet func(name string)
+}
+
+func (hs hookStorage) Get(name string) (io.ReadCloser, error) {
+	hs.onGet(name)
+	return hs.memoryStorage.Get(name)
+}
+
+func TestIntegrityCheckKeepsConcurrentChanges(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestIntegrityCheckKeepsConcurrentChanges...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	installFakeCommand(t, dir, "pg_dump", fakePgDumpScript)
+	storage := newMemoryStorage()
+	backupStorage = storage
+	PostgresBackuper{}.CreateNewBackup("c4", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("c4")
+	m, _ := readManifest("c4")
+
+	//a verification finishes while the backup file is being read
+	backupStorage = hookStorage{storage, func(name string) {
+		if name == m.Artifact {
+			recordVerification("c4", &backupVerification{Status: statusAvailable})
+		}
+	}}
+	startIntegrityCheck("c4")
+	checkJobs.wait("c4")
+	m, _ = readManifest("c4")
+	if m.Integrity == nil || !m.Integrity.Valid || m.Verification == nil {
+		t.Errorf("Integrity check should keep the verification recorded meanwhile. manifest=%v", m)
+	}
+}
+
+func TestIntegrityCheckRecordsMissingChecksum(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestIntegrityCheckRecordsMissingChecksum...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	storage := newMemoryStorage()
+	backupStorage = storage
+	storage.Put("legacy.sql", strings.NewReader("-- legacy dump"))
+	writeManifest(&backupManifest{APIID: "c2", Status: statusAvailable, Artifact: "legacy.sql", Format: "plain"})
+
+	startIntegrityCheck("c2")
+	checkJobs.wait("c2")
+	m, _ := readManifest("c2")
+	if m.Status != statusAvailable || m.SHA256 == "" || m.Size != 14 || m.Integrity == nil || m.Integrity.Message != "checksum recorded" {
+		t.Errorf("Checksum of backups without one should be recorded. manifest=%v", m)
+	}
+}
+
+func TestIntegrityCheckAPI(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestIntegrityCheckAPI...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	installFakeCommand(t, dir, "pg_dump", fakePgDumpScript)
+	backupStorage = newMemoryStorage()
+	PostgresBackuper{}.CreateNewBackup("c3", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("c3")
+
+	server := httptest.NewServer(newAPIRouter())
+	defer server.Close()
+
+	res, err := http.Post(server.URL+"/backups/c3/check", "application/json", nil)
+	if err != nil || res.StatusCode != http.StatusAccepted {
+		t.Fatalf("Unexpected integrity check response. res=%v err=%s", res, err)
+	}
+	checkJobs.wait("c3")
+	res, _ = http.Post(server.URL+"/backups/nope/check", "application/json", nil)
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Check of a missing backup should return 404. status=%d", res.StatusCode)
+	}
+}
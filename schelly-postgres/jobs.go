@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	statusRunning   = "running"
+	statusAvailable = "available"
+	statusError     = "error"
+	statusCorrupt   = "corrupt"
+)
+
+//job tracks an operation (such as a backup) running in background
+type job struct {
+	ID        string
+	DataID    string
+	Status    string
+	StartTime time.Time
+	EndTime   time.Time
+	Err       error
+	Size      int64
+	progress  *int64
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+//jobRegistry keeps the jobs started since the provider was launched
+type jobRegistry struct {
+	mutex sync.Mutex
+	jobs  map[string]*job
+}
+
+var backupJobs = newJobRegistry()
+
+func newJobRegistry() *jobRegistry {
+	return &jobRegistry{jobs: make(map[string]*job)}
+}
+
+//start registers a running job. The returned context is cancelled when the job is cancelled
+func (r *jobRegistry) start(id string, dataID string) (*job, context.Context, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if j, ok := r.jobs[id]; ok && j.Status == statusRunning {
+		return nil, nil, fmt.Errorf("Job %s is already running", id)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		ID:        id,
+		DataID:    dataID,
+		Status:    statusRunning,
+		StartTime: time.Now(),
+		progress:  new(int64),
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	r.jobs[id] = j
+	return j, ctx, nil
+}
+
+//finish records the job result and wakes up whoever is waiting for it
+func (r *jobRegistry) finish(j *job, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	j.EndTime = time.Now()
+	j.Err = err
+	if err != nil {
+		j.Status = statusError
+	} else {
+		j.Status = statusAvailable
+	}
+	j.cancel()
+	close(j.done)
+}
+
+//setSize records the amount of bytes the job is expected to process
+func (r *jobRegistry) setSize(j *job, size int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	j.Size = size
+}
+
+//get returns a copy of the job, so that it can be read without holding the lock
+func (r *jobRegistry) get(id string) (job, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	j, ok := r.jobs[id]
+	if !ok {
+		return job{}, false
+	}
+	return *j, true
+}
+
+//running returns the jobs that didn't finish yet, oldest first
+func (r *jobRegistry) running() []job {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	jobs := make([]job, 0)
+	for _, j := range r.jobs {
+		if j.Status == statusRunning {
+			jobs = append(jobs, *j)
+		}
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].StartTime.Before(jobs[b].StartTime) })
+	return jobs
+}
+
+//cancel stops a running job and waits for it to finish. Returns false if the job isn't running
+func (r *jobRegistry) cancel(id string) bool {
+	r.mutex.Lock()
+	j, ok := r.jobs[id]
+	running := ok && j.Status == statusRunning
+	r.mutex.Unlock()
+
+	if !running {
+		return false
+	}
+	j.cancel()
+	<-j.done
+	return true
+}
+
+//wait blocks until the job finishes
+func (r *jobRegistry) wait(id string) {
+	r.mutex.Lock()
+	j, ok := r.jobs[id]
+	r.mutex.Unlock()
+
+	if ok {
+		<-j.done
+	}
+}
+
+func (r *jobRegistry) remove(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.jobs, id)
+}
+
+//Progress returns the number of bytes processed by the job so far
+func (j job) Progress() int64 {
+	return atomic.LoadInt64(j.progress)
+}
+
+//countReader returns a reader that adds everything read through it to the job progress
+func (j *job) countReader(reader io.Reader) io.Reader {
+	return &progressReader{reader: reader, counter: j.progress}
+}
+
+type progressReader struct {
+	reader  io.Reader
+	counter *int64
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.reader.Read(p)
+	atomic.AddInt64(pr.counter, int64(n))
+	return n, err
+}
+
+//describe returns a message with the job timing, suitable for Schelly responses
+func (j job) describe(message string) string {
+	return describeTiming(message, j.StartTime, j.EndTime)
+}
+
+//describeTiming appends start time and elapsed time to message. A zero endTime means it is still running
+func describeTiming(message string, startTime time.Time, endTime time.Time) string {
+	if endTime.IsZero() {
+		endTime = time.Now()
+	}
+	return fmt.Sprintf("%s (started=%s elapsed=%s)", message, startTime.Format(time.RFC3339), endTime.Sub(startTime).Round(time.Second))
+}
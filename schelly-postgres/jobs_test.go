@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flaviostutz/schelly-webhook/schellyhook"
+	"go.uber.org/zap"
+)
+
+//slowPgDumpScript waits for the file $RELEASE_FILE before writing the dump
+const slowPgDumpScript = `while [ ! -f "$RELEASE_FILE" ]; do sleep 0.1; done
+` + fakePgDumpScript
+
+func TestAsyncBackupStatus(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestAsyncBackupStatus...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	installFakeCommand(t, dir, "pg_dump", slowPgDumpScript)
+	releaseFile := filepath.Join(dir, "release")
+	os.Setenv("RELEASE_FILE", releaseFile)
+	backupStorage = newMemoryStorage()
+
+	backuper := PostgresBackuper{}
+	start := time.Now()
+	err := backuper.CreateNewBackup("async1", 0, &schellyhook.ShellContext{})
+	if err != nil {
+		t.Fatalf("Error starting backup: %s", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("CreateNewBackup should return before pg_dump finishes")
+	}
+
+	backup, err := backuper.GetBackup("async1")
+	if err != nil || backup == nil || backup.Status != statusRunning {
+		t.Fatalf("Backup should be running. backup=%v err=%s", backup, err)
+	}
+	if !strings.Contains(backup.Message, "started=") || !strings.Contains(backup.Message, "elapsed=") {
+		t.Errorf("Running backup message should have start and elapsed time: %s", backup.Message)
+	}
+	backups, _ := backuper.GetAllBackups()
+	if len(backups) != 1 || backups[0].Status != statusRunning {
+		t.Errorf("Running backup should be listed. backups=%v", backups)
+	}
+
+	ioutil.WriteFile(releaseFile, []byte{}, 0600)
+	backupJobs.wait("async1")
+
+	backup, err = backuper.GetBackup("async1")
+	if err != nil || backup == nil || backup.Status != statusAvailable {
+		t.Fatalf("Backup should be available. backup=%v err=%s", backup, err)
+	}
+}
+
+func TestCancelRunningBackup(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestCancelRunningBackup...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	installFakeCommand(t, dir, "pg_dump", slowPgDumpScript)
+	os.Setenv("RELEASE_FILE", filepath.Join(dir, "never"))
+	storage := newMemoryStorage()
+	backupStorage = storage
+
+	for _, stream := range []bool{false, true} {
+		*streamBackup = stream
+		backuper := PostgresBackuper{}
+		err := backuper.CreateNewBackup("cancel1", 0, &schellyhook.ShellContext{})
+		if err != nil {
+			t.Fatalf("Error starting backup: %s", err)
+		}
+		time.Sleep(200 * time.Millisecond)
+
+		err = backuper.DeleteBackup("cancel1")
+		if err != nil {
+			t.Errorf("Error deleting running backup (stream=%t): %s", stream, err)
+		}
+		objects, _ := storage.List()
+		if len(objects) != 0 {
+			t.Errorf("Cancelled backup should leave no files (stream=%t): %v", stream, objects)
+		}
+	}
+}
+
+func TestCancelFinishingJob(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestCancelFinishingJob...")
+	registry := newJobRegistry()
+	for i := 0; i < 100; i++ {
+		j, _, err := registry.start("job", "")
+		if err != nil {
+			t.Fatalf("Error starting job: %s", err)
+		}
+		//the job may finish while it is being cancelled
+		go registry.finish(j, nil)
+		registry.cancel("job")
+		registry.wait("job")
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+//wrappedKeySuffix names the file with the wrapped data key of a backup, stored next to its manifest
+const wrappedKeySuffix = ".key.json"
+
+//keyring holds the master keys that wrap backup data keys. New data keys are wrapped with the active key,
+//the others are kept to unwrap older backups
+type keyring struct {
+	keys   map[string][]byte
+	active string
+}
+
+//wrappedKey is the data key of a backup encrypted with a master key
+type wrappedKey struct {
+	MasterKeyID string `json:"master_key_id"`
+	Algorithm   string `json:"algorithm"`
+	Key         string `json:"key"`
+}
+
+//backupKeyring wraps the data keys of new backups. nil when envelope encryption is disabled
+var backupKeyring *keyring
+
+func wrappedKeyName(apiID string) string {
+	return apiID + wrappedKeySuffix
+}
+
+//loadKeyring reads a keyring file with one `<key id> <key>` pair per line, keys being 32 bytes encoded as hex or base64.
+//Empty lines and lines starting with `#` are ignored. The active key is activeID or, when empty, the last key of the file
+func loadKeyring(path string, activeID string) (*keyring, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading keyring file: %s", err)
+	}
+	defer file.Close()
+
+	ring := &keyring{keys: make(map[string][]byte)}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid keyring line %d. It must be `<key id> <key>`", line)
+		}
+		key, err := parseEncryptionKey(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key %s on keyring: %s", fields[0], err)
+		}
+		if _, ok := ring.keys[fields[0]]; ok {
+			return nil, fmt.Errorf("Key %s is repeated on keyring", fields[0])
+		}
+		ring.keys[fields[0]] = key.Key
+		ring.active = fields[0]
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading keyring file: %s", err)
+	}
+	if len(ring.keys) == 0 {
+		return nil, fmt.Errorf("Keyring file %s has no keys", path)
+	}
+	if activeID != "" {
+		if _, ok := ring.keys[activeID]; !ok {
+			return nil, fmt.Errorf("Master key %s is not on the keyring", activeID)
+		}
+		ring.active = activeID
+	}
+	return ring, nil
+}
+
+//wrap encrypts a data key with the active master key
+func (ring *keyring) wrap(dataKey []byte) (*wrappedKey, error) {
+	gcm, err := newGCM(ring.keys[ring.active])
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	sealed := gcm.Seal(nonce, nonce, dataKey, []byte(ring.active))
+	return &wrappedKey{MasterKeyID: ring.active, Algorithm: "aes-256-gcm", Key: base64.StdEncoding.EncodeToString(sealed)}, nil
+}
+
+//unwrap decrypts a data key with the master key that wrapped it
+func (ring *keyring) unwrap(wk *wrappedKey) ([]byte, error) {
+	masterKey, ok := ring.keys[wk.MasterKeyID]
+	if !ok {
+		return nil, fmt.Errorf("Master key %s is not on the keyring", wk.MasterKeyID)
+	}
+	gcm, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(wk.Key)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("Invalid wrapped key")
+	}
+	dataKey, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(wk.MasterKeyID))
+	if err != nil {
+		return nil, fmt.Errorf("Data key can't be unwrapped with master key %s", wk.MasterKeyID)
+	}
+	return dataKey, nil
+}
+
+//find returns the master key with the fingerprint keyID, so that backups encrypted directly with a key
+//(--encryption-key-file) can still be restored after the key is moved to the keyring
+func (ring *keyring) find(keyID string) []byte {
+	for _, key := range ring.keys {
+		if keyFingerprint(key) == keyID {
+			return key
+		}
+	}
+	return nil
+}
+
+func readWrappedKey(storage Storage, name string) (*wrappedKey, error) {
+	reader, err := storage.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	wk := &wrappedKey{}
+	err = json.NewDecoder(reader).Decode(wk)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid wrapped key %s: %s", name, err)
+	}
+	return wk, nil
+}
+
+func writeWrappedKey(storage Storage, name string, wk *wrappedKey) error {
+	data, err := json.MarshalIndent(wk, "", "  ")
+	if err != nil {
+		return err
+	}
+	return storage.Put(name, strings.NewReader(string(data)))
+}
+
+//newDataKey creates the data key of a new backup or WAL file and stores it on storage, wrapped with the active master
+//key, as info.WrappedKey
+func newDataKey(storage Storage, info *encryptionInfo) ([]byte, error) {
+	dataKey := make([]byte, 32)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	wk, err := backupKeyring.wrap(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	err = writeWrappedKey(storage, info.WrappedKey, wk)
+	if err != nil {
+		return nil, fmt.Errorf("Error storing data key %s: %s", info.WrappedKey, err)
+	}
+	info.KeyID = keyFingerprint(dataKey)
+	return dataKey, nil
+}
+
+//rewrapKeys wraps the data key of every backup or WAL file on storage with the active master key of ring.
+//Returns how many keys were rewrapped
+func rewrapKeys(storage Storage, ring *keyring) (int, error) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	objects, err := storage.List()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Name, wrappedKeySuffix) {
+			continue
+		}
+		wk, err := readWrappedKey(storage, object.Name)
+		if err != nil {
+			return count, err
+		}
+		if wk.MasterKeyID == ring.active {
+			continue
+		}
+		dataKey, err := ring.unwrap(wk)
+		if err != nil {
+			return count, fmt.Errorf("Error unwrapping %s: %s", object.Name, err)
+		}
+		rewrapped, err := ring.wrap(dataKey)
+		if err != nil {
+			return count, err
+		}
+		err = writeWrappedKey(storage, object.Name, rewrapped)
+		if err != nil {
+			return count, fmt.Errorf("Error storing %s: %s", object.Name, err)
+		}
+		//make sure the stored key can be unwrapped before moving on, as the previous one is gone
+		stored, err := readWrappedKey(storage, object.Name)
+		if err == nil {
+			_, err = ring.unwrap(stored)
+		}
+		if err != nil {
+			return count, fmt.Errorf("Rewrapped key %s can't be read back: %s", object.Name, err)
+		}
+		sugar.Debugf("Data key %s rewrapped from master key %s to %s", object.Name, wk.MasterKeyID, ring.active)
+		count++
+	}
+	return count, nil
+}
+
+//runRewrapCommand rewraps the data keys of the backups and archived WAL files on the storage backend with the master
+//key (--rewrap-keys). Backups kept on --backup-dir are rewrapped too when the backend isn't local, as they may date from
+//before the provider was moved to a remote backend
+func runRewrapCommand(backend string) error {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	if *keyringFile == "" {
+		return fmt.Errorf("`--rewrap-keys` requires `--keyring-file`")
+	}
+	ring, err := loadKeyring(*keyringFile, *masterKeyID)
+	if err != nil {
+		return err
+	}
+
+	storages := map[string]Storage{}
+	storage, err := newStorage(backend)
+	if err != nil {
+		return err
+	}
+	storages[backend] = storage
+	storages[backend+" WAL"], err = newWALStorage(backend)
+	if err != nil {
+		return err
+	}
+	if backend != "file" {
+		if _, err := os.Stat(*backupsDir); err == nil {
+			storages["file"], err = newLocalStorage(*backupsDir)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for name, storage := range storages {
+		count, err := rewrapKeys(storage, ring)
+		sugar.Infof("%d data keys rewrapped with master key %s on %s storage", count, ring.active, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flaviostutz/schelly-webhook/schellyhook"
+	"go.uber.org/zap"
+)
+
+const testMasterKey2 = "2021222324252627282920212223242526272829202122232425262728292021"
+
+func writeKeyring(t *testing.T, dir string, contents string) string {
+	path := filepath.Join(dir, "keyring")
+	err := ioutil.WriteFile(path, []byte(contents), 0600)
+	if err != nil {
+		t.Fatalf("Error writing keyring: %s", err)
+	}
+	return path
+}
+
+func TestLoadKeyring(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestLoadKeyring...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+
+	path := writeKeyring(t, dir, "# master keys\nk1 "+testEncryptionKey+"\n\nk2 "+testMasterKey2+"\n")
+	ring, err := loadKeyring(path, "")
+	if err != nil || len(ring.keys) != 2 || ring.active != "k2" {
+		t.Fatalf("Last key should be the active one. ring=%v err=%s", ring, err)
+	}
+	ring, err = loadKeyring(path, "k1")
+	if err != nil || ring.active != "k1" {
+		t.Fatalf("Master key id should select the active key. ring=%v err=%s", ring, err)
+	}
+	_, err = loadKeyring(path, "k3")
+	if err == nil {
+		t.Errorf("Unknown master key should be rejected")
+	}
+
+	for _, invalid := range []string{"", "k1\n", "k1 abc\n", "k1 " + testEncryptionKey + "\nk1 " + testMasterKey2 + "\n"} {
+		_, err = loadKeyring(writeKeyring(t, dir, invalid), "")
+		if err == nil {
+			t.Errorf("Keyring %q should be rejected", invalid)
+		}
+	}
+}
+
+func TestEnvelopeEncryptionRewrap(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestEnvelopeEncryptionRewrap...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	_, restoreOut := setupRestoreTest(t, dir)
+	storage := newMemoryStorage()
+	backupStorage = storage
+	backupKeyring, _ = loadKeyring(writeKeyring(t, dir, "k1 "+testEncryptionKey+"\n"), "")
+
+	backuper := PostgresBackuper{}
+	for _, apiID := range []string{"w1", "w2"} {
+		backuper.CreateNewBackup(apiID, 0, &schellyhook.ShellContext{})
+		backupJobs.wait(apiID)
+	}
+	m1, err := readManifest("w1")
+	if err != nil || m1.Status != statusAvailable || m1.Encryption == nil || m1.Encryption.WrappedKey != "w1.key.json" || len(m1.Encryption.KeyID) != 16 {
+		t.Fatalf("Unexpected manifest for envelope encrypted backup. manifest=%v err=%s", m1, err)
+	}
+	m2, _ := readManifest("w2")
+	if m2.Encryption.KeyID == m1.Encryption.KeyID {
+		t.Errorf("Each backup should have its own data key")
+	}
+	wk, err := readWrappedKey(storage, "w1.key.json")
+	if err != nil || wk.MasterKeyID != "k1" {
+		t.Fatalf("Data key should be wrapped by k1. key=%v err=%s", wk, err)
+	}
+
+	//rotate to k2, keeping k1 on the keyring to unwrap the existing keys
+	ring, _ := loadKeyring(writeKeyring(t, dir, "k1 "+testEncryptionKey+"\nk2 "+testMasterKey2+"\n"), "")
+	count, err := rewrapKeys(storage, ring)
+	if err != nil || count != 2 {
+		t.Fatalf("Both data keys should be rewrapped. count=%d err=%s", count, err)
+	}
+	count, err = rewrapKeys(storage, ring)
+	if err != nil || count != 0 {
+		t.Errorf("Keys already wrapped by the active key should be skipped. count=%d err=%s", count, err)
+	}
+	wk, _ = readWrappedKey(storage, "w1.key.json")
+	if wk.MasterKeyID != "k2" {
+		t.Errorf("Data key should be wrapped by k2 after rewrap. key=%v", wk)
+	}
+
+	//k1 can now be retired
+	backupKeyring, _ = loadKeyring(writeKeyring(t, dir, "k2 "+testMasterKey2+"\n"), "")
+	backuper.RestoreBackup("w1", "restored")
+	restoreJobs.wait("w1")
+	resp, _ := backuper.GetRestore("w1")
+	if resp == nil || resp.Status != statusAvailable {
+		t.Fatalf("Restore after rewrap should be finished. resp=%v", resp)
+	}
+	restored, _ := ioutil.ReadFile(restoreOut)
+	if !strings.Contains(string(restored), `CREATE TABLE "public"."t"`) {
+		t.Errorf("Backup should be decrypted with the rewrapped data key: %s", restored)
+	}
+
+	err = backuper.DeleteBackup("w1")
+	if _, err0 := storage.Stat("w1.key.json"); err != nil || err0 != errObjectNotFound {
+		t.Errorf("Data key should be deleted with the backup. err=%v", err)
+	}
+}
+
+func TestKeyringRestoresDirectlyEncryptedBackups(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestKeyringRestoresDirectlyEncryptedBackups...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	setupRestoreTest(t, dir)
+	backupStorage = newMemoryStorage()
+	backupEncryptionKey, _ = parseEncryptionKey(testEncryptionKey)
+
+	backuper := PostgresBackuper{}
+	backuper.CreateNewBackup("w3", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("w3")
+
+	//the key used with --encryption-key-file was moved to the keyring
+	backupEncryptionKey = nil
+	backupKeyring, _ = loadKeyring(writeKeyring(t, dir, "old "+testEncryptionKey+"\nnew "+testMasterKey2+"\n"), "")
+	backuper.RestoreBackup("w3", "restored")
+	restoreJobs.wait("w3")
+	resp, _ := backuper.GetRestore("w3")
+	if resp == nil || resp.Status != statusAvailable {
+		t.Errorf("Backup encrypted directly with a key on the keyring should be restored. resp=%v", resp)
+	}
+}
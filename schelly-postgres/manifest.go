@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+//manifestSuffix is appended to the apiID to name the manifest of a backup
+const manifestSuffix = ".manifest.json"
+
+//backupManifest is stored next to each backup artifact and is the single source of truth about the backup
+type backupManifest struct {
+	APIID         string         `json:"api_id"`
+	PgDumpID      string         `json:"pg_dump_id"`
+	Status        string         `json:"status"`
+	Message       string         `json:"message,omitempty"`
+	Artifact      string         `json:"artifact"`
+	Database      string         `json:"database"`
+	Host          string         `json:"host"`
+	Port          int            `json:"port"`
+	Format        string         `json:"format"`
+	Compression   string         `json:"compression"`
+	Bundle        string         `json:"bundle,omitempty"`
+	Jobs          int            `json:"jobs,omitempty"` //parallel pg_dump jobs, also used by pg_restore
+	Flags         []string       `json:"flags"`
+	Filters       *dumpFilters   `json:"filters,omitempty"`
+	Size          int64          `json:"size"`
+	SHA256        string         `json:"sha256,omitempty"`
+	StartTime     time.Time      `json:"start_time"`
+	EndTime       time.Time      `json:"end_time"`
+	PgDumpVersion string         `json:"pg_dump_version,omitempty"`
+	ServerVersion string         `json:"server_version,omitempty"`
+	PgDump        *commandResult `json:"pg_dump,omitempty"`
+
+	Kind                string         `json:"kind,omitempty"` //logical (pg_dump) or physical (pg_basebackup)
+	PgBasebackupVersion string         `json:"pg_basebackup_version,omitempty"`
+	PgBasebackup        *commandResult `json:"pg_basebackup,omitempty"`
+	WAL                 *walRange      `json:"wal,omitempty"`                 //WAL needed by the physical backup, once it is archived
+	Parent              string         `json:"parent,omitempty"`              //apiID of the backup an incremental physical backup is taken against
+	BasebackupManifest  string         `json:"basebackup_manifest,omitempty"` //backup_manifest of pg_basebackup, stored apart from the artifact
+
+	Cluster   bool              `json:"cluster,omitempty"`    //logical backup of the globals, on the artifact, and of every database
+	Databases []clusterDatabase `json:"databases,omitempty"`  //dumps of the databases of a cluster backup
+	PgDumpall *commandResult    `json:"pg_dumpall,omitempty"` //pg_dumpall --globals-only result of a cluster backup
+
+	Encryption   *encryptionInfo     `json:"encryption,omitempty"`
+	Verification *backupVerification `json:"verification,omitempty"`
+	TableCounts  map[string]int64    `json:"table_counts,omitempty"` //row count of each table when the dump started, checked by verifications
+	Integrity    *integrityCheck     `json:"integrity,omitempty"`
+
+	Tier          string     `json:"tier,omitempty"`           //access tier of the backup file, on backends with tiers
+	RehydrateTime *time.Time `json:"rehydrate_time,omitempty"` //when the backup file was last rehydrated from the archive tier
+}
+
+func manifestName(apiID string) string {
+	return apiID + manifestSuffix
+}
+
+//writeManifest stores the manifest, replacing any previous version of it
+func writeManifest(m *backupManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = backupStorage.Put(manifestName(m.APIID), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	labelBackup(m)
+	return nil
+}
+
+//backupLabels returns the labels that identify the objects of a backup on backends that keep labels
+func backupLabels(m *backupManifest) map[string]string {
+	labels := make(map[string]string)
+	values := map[string]string{
+		"api_id":     m.APIID,
+		"pg_dump_id": m.PgDumpID,
+		"database":   m.Database,
+		"status":     m.Status,
+	}
+	for key, value := range values {
+		if value != "" {
+			labels[key] = value
+		}
+	}
+	return labels
+}
+
+//labelBackup labels the manifest, artifacts and data key of a backup with backupLabels. Labels are only an index of the
+//manifests, so failing to set them is logged and doesn't fail the backup
+func labelBackup(m *backupManifest) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	ls, ok := unwrapStorage(backupStorage).(labelStorage)
+	if !ok {
+		return
+	}
+	names := []string{manifestName(m.APIID)}
+	if m.Artifact != "" && m.Status != statusRunning {
+		names = append(names, m.artifacts()...)
+	}
+	if m.BasebackupManifest != "" {
+		names = append(names, m.BasebackupManifest)
+	}
+	if m.Encryption != nil && m.Encryption.WrappedKey != "" {
+		names = append(names, m.Encryption.WrappedKey)
+	}
+	labels := backupLabels(m)
+	for _, name := range names {
+		err := ls.SetLabels(name, labels)
+		if err != nil && err != errObjectNotFound {
+			sugar.Warnf("Couldn't label %s of backup %s. err=%s", name, m.APIID, err)
+		}
+	}
+}
+
+//readManifest returns errObjectNotFound when there is no backup for apiID
+func readManifest(apiID string) (*backupManifest, error) {
+	reader, err := backupStorage.Get(manifestName(apiID))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	m := backupManifest{}
+	err = json.NewDecoder(reader).Decode(&m)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+//manifestLocks holds a lock per apiID, taken while a manifest is read, changed and written back by updateManifest
+var manifestLocks = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}{locks: make(map[string]*sync.Mutex)}
+
+func manifestLock(apiID string) *sync.Mutex {
+	manifestLocks.Lock()
+	defer manifestLocks.Unlock()
+	lock, ok := manifestLocks.locks[apiID]
+	if !ok {
+		lock = &sync.Mutex{}
+		manifestLocks.locks[apiID] = lock
+	}
+	return lock
+}
+
+//updateManifest reads the current manifest of apiID, changes it with update and writes it back, so that jobs that run
+//for long don't overwrite the changes made meanwhile by others with a stale copy. Updates of the same manifest are
+//serialized. The manifest isn't written when update fails. Returns the updated manifest
+func updateManifest(apiID string, update func(m *backupManifest) error) (*backupManifest, error) {
+	lock := manifestLock(apiID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	m, err := readManifest(apiID)
+	if err != nil {
+		return nil, err
+	}
+	err = update(m)
+	if err != nil {
+		return nil, err
+	}
+	return m, writeManifest(m)
+}
+
+//listManifests returns the manifests of all backups along with the storage objects, indexed by name
+func listManifests() ([]backupManifest, map[string]StorageObject, error) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	objects, err := backupStorage.List()
+	if err != nil {
+		return nil, nil, err
+	}
+	index := make(map[string]StorageObject)
+	manifests := make([]backupManifest, 0)
+	for _, object := range objects {
+		index[object.Name] = object
+		if !strings.HasSuffix(object.Name, manifestSuffix) {
+			continue
+		}
+		m, err := readManifest(strings.TrimSuffix(object.Name, manifestSuffix))
+		if err != nil {
+			sugar.Warnf("Ignoring unreadable manifest %s. err=%s", object.Name, err)
+			continue
+		}
+		manifests = append(manifests, *m)
+	}
+	return manifests, index, nil
+}
+
+//checksumReader counts and hashes (SHA-256) everything read through it
+type checksumReader struct {
+	reader io.Reader
+	hash   hash.Hash
+	size   int64
+}
+
+func newChecksumReader(reader io.Reader) *checksumReader {
+	return &checksumReader{reader: reader, hash: sha256.New()}
+}
+
+func (cr *checksumReader) Read(p []byte) (int, error) {
+	n, err := cr.reader.Read(p)
+	cr.hash.Write(p[:n])
+	cr.size += int64(n)
+	return n, err
+}
+
+func (cr *checksumReader) sum() string {
+	return hex.EncodeToString(cr.hash.Sum(nil))
+}
+
+//fileChecksum returns size and SHA-256 of a local file. Directories only have their total size
+func fileChecksum(filePath string) (int64, string, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return 0, "", err
+	}
+	if info.IsDir() {
+		size := int64(0)
+		err = filepath.Walk(filePath, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				size += info.Size()
+			}
+			return err
+		})
+		return size, "", err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+	cr := newChecksumReader(file)
+	_, err = io.Copy(ioutil.Discard, cr)
+	if err != nil {
+		return 0, "", err
+	}
+	return cr.size, cr.sum(), nil
+}
+
+//migrateLegacyBackups writes manifests for backups created before manifests existed, when the backup
+//identity was kept only on the file name (fileName---apiID---pgDumpID) and failures on `apiID.err` files
+func migrateLegacyBackups() error {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	objects, err := backupStorage.List()
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for _, object := range objects {
+		names[object.Name] = true
+	}
+
+	for _, object := range objects {
+		m := backupManifest{Database: *dbname, Host: *host, Port: *port}
+		if strings.HasSuffix(object.Name, ".err") {
+			m.APIID = strings.TrimSuffix(object.Name, ".err")
+			m.Status = statusError
+			m.Message = "backup failed before the provider recorded manifests"
+			reader, err := backupStorage.Get(object.Name)
+			if err == nil {
+				data, _ := ioutil.ReadAll(reader)
+				reader.Close()
+				m.PgDumpID = strings.TrimSpace(string(data))
+			}
+		} else {
+			parts := strings.Split(object.Name, dataStringSeparator)
+			if len(parts) != 3 {
+				continue
+			}
+			m.APIID = parts[1]
+			m.PgDumpID = parts[2]
+			m.Status = statusAvailable
+			m.Artifact = object.Name
+			m.Size = object.Size
+			//legacy backups don't record how they were taken. they were plain (or directory with --split-file)
+			//dumps taken with fixed flags
+			m.Format = "plain"
+			if *dumpFormat == "directory" {
+				m.Format = "directory"
+			}
+			m.Flags = []string{"--verbose", "--format=" + dumpFormats[m.Format].flag, "--jobs=1", "--compress=9", "--column-inserts", "--inserts", "--quote-all-identifiers", "--clean", "--create"}
+			m.Compression = "none"
+		}
+		if names[manifestName(m.APIID)] {
+			continue
+		}
+		m.StartTime, _ = time.Parse("20060102150405", m.PgDumpID)
+		m.EndTime = m.StartTime
+
+		sugar.Infof("Writing manifest for legacy backup %s (%s)", m.APIID, object.Name)
+		err = writeManifest(&m)
+		if err != nil {
+			return err
+		}
+		names[manifestName(m.APIID)] = true
+		if m.Status == statusError {
+			backupStorage.Delete(object.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/flaviostutz/schelly-webhook/schellyhook"
+	"go.uber.org/zap"
+)
+
+func TestManifestExactLookup(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestManifestExactLookup...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	installFakeCommand(t, dir, "pg_dump", fakePgDumpScript)
+
+	storage := newMemoryStorage()
+	backupStorage = storage
+	storage.Put(".pgpass", strings.NewReader("*:*:*:*:secret"))
+	storage.Put("notes.txt", strings.NewReader("not a backup"))
+	storage.Put("a---b", strings.NewReader("not a backup either"))
+
+	backuper := PostgresBackuper{}
+	backuper.CreateNewBackup("91234", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("91234")
+
+	backup, err := backuper.GetBackup("123")
+	if err != nil || backup != nil {
+		t.Errorf("apiID 123 must not match backup 91234. backup=%v err=%s", backup, err)
+	}
+	err = backuper.DeleteBackup("123")
+	if err == nil {
+		t.Errorf("Deleting apiID 123 must not delete backup 91234")
+	}
+
+	backups, err := backuper.GetAllBackups()
+	if err != nil || len(backups) != 1 || backups[0].ID != "91234" {
+		t.Fatalf("Only backup 91234 should be listed. backups=%v err=%s", backups, err)
+	}
+
+	m, err := readManifest("91234")
+	if err != nil {
+		t.Fatalf("Error reading manifest: %s", err)
+	}
+	data, _ := ioutil.ReadAll(mustGet(t, storage, m.Artifact))
+	sum := sha256.Sum256(data)
+	if m.SHA256 != hex.EncodeToString(sum[:]) || m.Size != int64(len(data)) {
+		t.Errorf("Manifest checksum/size don't match the artifact. manifest=%v", m)
+	}
+	if m.Database != "schelly" || m.Host != "localhost" || m.Format != "plain" || len(m.Flags) == 0 {
+		t.Errorf("Manifest doesn't describe the dump. manifest=%v", m)
+	}
+	if m.StartTime.IsZero() || m.EndTime.Before(m.StartTime) {
+		t.Errorf("Manifest has invalid times. manifest=%v", m)
+	}
+}
+
+func TestUpdateManifest(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestUpdateManifest...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	backupStorage = newMemoryStorage()
+	writeManifest(&backupManifest{APIID: "u1", Status: statusAvailable})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			updateManifest("u1", func(m *backupManifest) error {
+				m.Flags = append(m.Flags, strconv.Itoa(i))
+				return nil
+			})
+		}(i)
+	}
+	wg.Wait()
+	m, _ := readManifest("u1")
+	if len(m.Flags) != 20 {
+		t.Errorf("Concurrent updates should not be lost. flags=%v", m.Flags)
+	}
+
+	_, err := updateManifest("missing", func(m *backupManifest) error { return nil })
+	if err != errObjectNotFound {
+		t.Errorf("Missing manifests should not be created. err=%s", err)
+	}
+}
+
+func TestMigrateLegacyBackups(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestMigrateLegacyBackups...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+
+	storage := newMemoryStorage()
+	backupStorage = storage
+	storage.Put("database_dump---111---20190614092818", bytes.NewReader([]byte("dump")))
+	storage.Put("222.err", strings.NewReader("20190615092818"))
+
+	err := migrateLegacyBackups()
+	if err != nil {
+		t.Fatalf("Error migrating legacy backups: %s", err)
+	}
+
+	m, err := readManifest("111")
+	if err != nil || m.Status != statusAvailable || m.PgDumpID != "20190614092818" || m.Size != 4 {
+		t.Errorf("Unexpected manifest for legacy backup. manifest=%v err=%s", m, err)
+	}
+	m, err = readManifest("222")
+	if err != nil || m.Status != statusError || m.PgDumpID != "20190615092818" {
+		t.Errorf("Unexpected manifest for legacy failed backup. manifest=%v err=%s", m, err)
+	}
+	if _, err := storage.Stat("222.err"); err != errObjectNotFound {
+		t.Errorf("Legacy error file should be removed")
+	}
+}
+
+func mustGet(t *testing.T, storage Storage, name string) *bytes.Reader {
+	reader, err := storage.Get(name)
+	if err != nil {
+		t.Fatalf("Error getting %s: %s", name, err)
+	}
+	defer reader.Close()
+	data, _ := ioutil.ReadAll(reader)
+	return bytes.NewReader(data)
+}
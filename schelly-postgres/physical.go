@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+//kinds of backups recorded on manifests. Manifests without a kind are logical backups
+const (
+	backupKindLogical  = "logical"
+	backupKindPhysical = "physical"
+)
+
+//basebackupLabelPrefix starts the label of physical backups, followed by the apiID. PostgreSQL records the label on the
+//backup history file, which pairs the backup with the archived WAL
+const basebackupLabelPrefix = "schelly-"
+
+//basebackupExtension is appended to the artifact of physical backups, which bundles the tar files of pg_basebackup
+const basebackupExtension = ".basebackup.tar"
+
+// pg_basebackup version reported by `pg_basebackup --version`
+var pgBasebackupVersion string
+
+//isPhysical tells whether m describes a pg_basebackup backup of the whole cluster
+func (m backupManifest) isPhysical() bool {
+	return m.Kind == backupKindPhysical
+}
+
+//validatePhysicalOptions checks that the options of logical backups aren't used along with --backup-mode=physical
+func validatePhysicalOptions() error {
+	if *backupMode != backupKindLogical && *backupMode != backupKindPhysical {
+		return fmt.Errorf("`backup mode` (--backup-mode) arg must be `logical` or `physical`")
+	}
+	if *basebackupCheckpoint != "fast" && *basebackupCheckpoint != "spread" {
+		return fmt.Errorf("`--basebackup-checkpoint` must be `fast` or `spread`")
+	}
+	if *maxIncrementalChain < 0 {
+		return fmt.Errorf("`--max-incremental-chain` must be 0 or more")
+	}
+	if *backupMode != backupKindPhysical {
+		if *incrementalBackup {
+			return fmt.Errorf("`--incremental` requires `--backup-mode=physical`")
+		}
+		return nil
+	}
+	if *streamBackup {
+		return fmt.Errorf("`--stream` can't be used with physical backups because pg_basebackup writes one tar file per tablespace")
+	}
+	if *splitFile || *dataOnly || *schemaOnly || *dumpJobs > 1 || currentDumpFilters() != nil {
+		return fmt.Errorf("pg_dump options (such as `--split-file`, `--jobs` and object filters) can't be used with physical backups")
+	}
+	if *verifyAfterBackup || *verifyInterval > 0 {
+		return fmt.Errorf("Physical backups can't be verified by restoring them into a database")
+	}
+	return nil
+}
+
+//basebackupArgs returns the pg_basebackup arguments. The backup is written to outputDir as tar files, with the WAL
+//needed to make it consistent streamed into pg_wal.tar. When parentManifest is set, the backup is incremental to the
+//backup described by that backup_manifest
+func basebackupArgs(outputDir string, label string, parentManifest string) []string {
+	args := []string{"--username=" + *username, "--host=" + *host, "--port=" + strconv.Itoa(*port), "--no-password"}
+	args = append(args, basebackupFlags()...)
+	if parentManifest != "" {
+		args = append(args, "--incremental="+parentManifest)
+	}
+	return append(args, "--label="+label, "--pgdata="+outputDir)
+}
+
+//basebackupFlags returns the pg_basebackup options controlling the output, without connection options
+func basebackupFlags() []string {
+	return []string{"--verbose", "--format=tar", "--wal-method=stream", "--checkpoint=" + *basebackupCheckpoint}
+}
+
+//stagePhysicalBackup runs pg_basebackup into a local staging directory and then sends its tar files to the storage
+//backend, bundled as a single tar file. With --incremental, the backup is taken incremental to the previous one when
+//possible. Records the pg_basebackup result, parent, size and SHA-256 of the stored file on m
+func stagePhysicalBackup(ctx context.Context, m *backupManifest, timeout time.Duration) error {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	stagingDir := resolveStagingFilePath(m.APIID, m.PgDumpID)
+	defer os.RemoveAll(stagingDir)
+
+	parentManifest := stagingDir + basebackupManifestExtension
+	defer os.Remove(parentManifest)
+	incremental, err := fetchParentManifest(m, parentManifest)
+	if err != nil {
+		sugar.Warnf("Backup %s can't be incremental to the previous one. A full backup will be taken. err=%s", m.APIID, err)
+	}
+	if !incremental {
+		parentManifest = ""
+	}
+
+	backupCtx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(backupCtx, "pg_basebackup", basebackupArgs(stagingDir, basebackupLabelPrefix+m.APIID, parentManifest)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	sugar.Debugf("Executing pg_basebackup command: %s", strings.Join(cmd.Args, " "))
+	startTime := time.Now()
+	err = cmd.Run()
+	m.PgBasebackup = newCommandResult(cmd, err, startTime, stderr.String()).withContext(ctx, backupCtx)
+	if m.PgBasebackup.Cancelled {
+		return fmt.Errorf("Backup %s cancelled", m.APIID)
+	}
+	if !m.PgBasebackup.success() {
+		if m.PgBasebackup.TimedOut {
+			sugar.Warnf("PostgresProvider pg_basebackup command timeout enforced (%d seconds)", timeout/time.Second)
+		}
+		sugar.Debugf("PostgresProvider pg_basebackup error. result=%v", m.PgBasebackup)
+		return m.PgBasebackup.err()
+	}
+	sugar.Debugf("PostgresProvider pg_basebackup finished. Output log:")
+	sugar.Debugf(stderr.String())
+
+	err = storeBasebackupManifest(m, filepath.Join(stagingDir, "backup_manifest"))
+	if err != nil {
+		return fmt.Errorf("Store backup_manifest with error: %s", err.Error())
+	}
+	bundle := tarDirectory(stagingDir)
+	defer bundle.Close()
+	err = storeArtifact(m, bundle)
+	if err != nil {
+		sugar.Debugf("Store backup file with error: %s", err.Error())
+		return fmt.Errorf("Store backup file with error: %s", err.Error())
+	}
+	return nil
+}
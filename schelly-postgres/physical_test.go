@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flaviostutz/schelly-webhook/schellyhook"
+	"go.uber.org/zap"
+)
+
+//fakePgBasebackupScript writes the tar files of pg_basebackup into --pgdata and logs its args to $BASEBACKUP_LOG, along
+//with the label on the --incremental manifest. The data directory has the PostgreSQL version of $PG_MAJOR (16 by
+//default) and a tablespace
+const fakePgBasebackupScript = `for arg in "$@"; do
+  case "$arg" in
+    --pgdata=*) output="${arg#--pgdata=}" ;;
+    --label=*) label="${arg#--label=}" ;;
+    --incremental=*) parent="${arg#--incremental=}" ;;
+    --version) echo "pg_basebackup (PostgreSQL) ${PG_MAJOR:-16}.2"; exit 0 ;;
+  esac
+done
+echo "$*" >> "$BASEBACKUP_LOG"
+if [ -n "$parent" ]; then
+  echo "incremental to $(cat "$parent")" >> "$BASEBACKUP_LOG"
+fi
+mkdir -p "$output/base/global" "$output/base/pg_wal" "$output/wal" "$output/tblspc/PG_16"
+echo "${PG_MAJOR:-16}" > "$output/base/PG_VERSION"
+echo "control" > "$output/base/global/pg_control"
+echo "16384 /srv/tablespaces/fast" > "$output/base/tablespace_map"
+echo "segment" > "$output/wal/000000010000000000000002"
+echo "table" > "$output/tblspc/PG_16/16385"
+tar -cf "$output/base.tar" -C "$output/base" PG_VERSION global pg_wal tablespace_map
+tar -cf "$output/pg_wal.tar" -C "$output/wal" 000000010000000000000002
+tar -cf "$output/16384.tar" -C "$output/tblspc" PG_16
+rm -rf "$output/base" "$output/wal" "$output/tblspc"
+echo "{\"PostgreSQL-Backup-Manifest-Version\": 1, \"Label\": \"$label\"}" > "$output/backup_manifest"
+`
+
+func setupPhysicalTest(t *testing.T, dir string) string {
+	installFakeCommand(t, dir, "pg_basebackup", fakePgBasebackupScript)
+	basebackupLog := filepath.Join(dir, "basebackup.log")
+	os.Setenv("BASEBACKUP_LOG", basebackupLog)
+	*backupMode = backupKindPhysical
+	return basebackupLog
+}
+
+func TestPhysicalBackup(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestPhysicalBackup...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	basebackupLog := setupPhysicalTest(t, dir)
+	*compression = "gzip"
+	storage := newMemoryStorage()
+	backupStorage = storage
+
+	backuper := PostgresBackuper{}
+	err := backuper.CreateNewBackup("p1", 0, &schellyhook.ShellContext{})
+	if err != nil {
+		t.Fatalf("Error creating backup: %s", err)
+	}
+	backupJobs.wait("p1")
+
+	m, err := readManifest("p1")
+	if err != nil || m.Status != statusAvailable || !m.isPhysical() {
+		t.Fatalf("Physical backup should be available. m=%v err=%s", m, err)
+	}
+	if !strings.HasSuffix(m.Artifact, ".basebackup.tar.gz") || m.Bundle != bundleTar || m.PgBasebackup == nil || m.PgDump != nil {
+		t.Errorf("Unexpected physical backup manifest %v", m)
+	}
+	log, _ := ioutil.ReadFile(basebackupLog)
+	if !strings.Contains(string(log), "--format=tar --wal-method=stream --checkpoint=spread --label=schelly-p1 --pgdata=") ||
+		strings.Contains(string(log), "--dbname") {
+		t.Errorf("Unexpected pg_basebackup args: %s", log)
+	}
+
+	reader, err := storage.Get(m.Artifact)
+	if err != nil {
+		t.Fatalf("Error getting backup file: %s", err)
+	}
+	decompressed, err := decompressStream(reader, m.Compression)
+	if err != nil {
+		t.Fatalf("Error decompressing backup file: %s", err)
+	}
+	restoreDir := filepath.Join(dir, "restored")
+	err = untarDirectory(decompressed, restoreDir)
+	decompressed.Close()
+	if err != nil {
+		t.Fatalf("Error extracting backup bundle: %s", err)
+	}
+	for _, name := range []string{"base.tar", "pg_wal.tar", "backup_manifest"} {
+		if _, err := os.Stat(filepath.Join(restoreDir, name)); err != nil {
+			t.Errorf("Backup bundle should have %s. err=%s", name, err)
+		}
+	}
+
+	backup, err := backuper.GetBackup("p1")
+	if err != nil || backup == nil || backup.DataID != m.PgDumpID || !strings.Contains(backup.Message, "physical backup") {
+		t.Errorf("Physical backup should be reported as such. backup=%v err=%s", backup, err)
+	}
+	_, err = backuper.RestoreBackup("p1", "restored")
+	if err == nil {
+		t.Errorf("Physical backups can't be restored into a database")
+	}
+
+	//logical backups are told apart from physical ones
+	*backupMode = backupKindLogical
+	*compression = "none"
+	installFakeCommand(t, dir, "pg_dump", fakePgDumpScript)
+	backuper.CreateNewBackup("l1", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("l1")
+	logical, _ := readManifest("l1")
+	if logical.Kind != backupKindLogical || logical.isPhysical() {
+		t.Errorf("Unexpected kind of logical backup %s", logical.Kind)
+	}
+
+	err = backuper.DeleteBackup("p1")
+	if err != nil {
+		t.Errorf("Error deleting backup: %s", err)
+	}
+	if _, err = storage.Stat(m.Artifact); err != errObjectNotFound {
+		t.Errorf("Physical backup file should be deleted. err=%s", err)
+	}
+}
+
+func TestPhysicalBackupOptions(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestPhysicalBackupOptions...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+
+	err := validatePhysicalOptions()
+	if err != nil {
+		t.Errorf("Logical backups should be valid. err=%s", err)
+	}
+	*backupMode = "snapshot"
+	if validatePhysicalOptions() == nil {
+		t.Errorf("Unknown backup modes should be rejected")
+	}
+	*backupMode = backupKindPhysical
+	*streamBackup = true
+	if validatePhysicalOptions() == nil {
+		t.Errorf("Physical backups can't be streamed")
+	}
+	*streamBackup = false
+	*schemas = stringList{"public"}
+	if validatePhysicalOptions() == nil {
+		t.Errorf("Physical backups can't have object filters")
+	}
+	*schemas = stringList{}
+	*basebackupCheckpoint = "now"
+	if validatePhysicalOptions() == nil {
+		t.Errorf("Unknown checkpoint modes should be rejected")
+	}
+}
@@ -1,44 +1,90 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/flaviostutz/schelly-webhook/schellyhook"
 	"go.uber.org/zap"
 )
 
-var (
-	isCredentialCreated bool
-	credential          *azblob.SharedKeyCredential
-)
-
 var dataStringSeparator string
 
+// pg_dump version reported by `pg_dump --version`
+var pgDumpVersion string
+
 // backups directory where the backup files will be placed
 var backupsDir *string
 
+// storage backend where the backup files are kept (file, azure or s3)
+var targetDataBackend *string
+var backupStorage Storage
+
 // General options:
 var fileName *string //output file or directory name
 var splitFile *bool  //output file or directory name
 
+// Output format options:
+var dumpFormat *string        // pg_dump output format (plain, custom, directory or tar)
+var dumpCompressionLevel *int // pg_dump compression level for custom and directory formats (-1 uses pg_dump default)
+var dumpJobs *int             // parallel pg_dump jobs for directory format
+
+// Cluster backup options:
+var clusterBackup *bool          // logical backups of the globals and every database of the cluster
+var includeDatabases *stringList // dump only the databases matching these patterns on cluster backups
+var excludeDatabases *stringList // do NOT dump the databases matching these patterns on cluster backups
+
+// Physical backup options:
+var backupMode *string           // logical (pg_dump) or physical (pg_basebackup) backups
+var basebackupCheckpoint *string // pg_basebackup checkpoint mode (fast or spread)
+var incrementalBackup *bool      // take physical backups incremental to the previous one (pg_basebackup 17+)
+var maxIncrementalChain *int     // take a full backup once the chain has this many incremental backups (0 for no limit)
+
+// WAL archiving options:
+var walArchiving *bool     // accept WAL files on the provider API and prune the ones no physical backup needs
+var archiveWALPath *string // archive the WAL file at this path and exit (archive_command)
+var restoreWALName *string // restore this archived WAL file and exit (restore_command)
+var restoreWALPath *string // where the WAL file restored by --restore-wal is written
+
+// Point-in-time recovery options:
+var recoveryDir *string            // directory under which recovered clusters are laid out. Recoveries are disabled when empty
+var recoveryPort *int              // port of recovered servers. 0 keeps the port of the base backup
+var recoveryRestoreCommand *string // restore_command of recovered servers (defaults to curl on the provider API)
+var recoveryUser *string           // user that runs recovered servers when the provider runs as root
+
+// Streaming options:
+var streamBackup *bool    // pipe pg_dump output straight to the storage backend
+var compression *string   // compression codec applied before storing the backup (none, gzip, zstd or lz4)
+var compressionLevel *int // compression level for the codec
+
+// Encryption options:
+var encryptionKeyFile *string // file with the key used to encrypt backups
+var encryptionKeyEnv *string  // environment variable with the key used to encrypt backups
+var keyringFile *string       // file with the master keys that wrap backup data keys
+var masterKeyID *string       // master key that wraps new data keys (defaults to the last key of the keyring)
+var rewrapKeysOnly *bool      // rewrap the data keys of existing backups with the master key and exit
+
 // Options controlling the output content:
 var dataOnly *bool   // dump only the data, not the schema
 var schemaOnly *bool // dump only the schema, no data
 var encoding *string // dump the data in encoding ENCODING
-// var schema *string[]           // dump the named schema(s) only
-// var excludeSchema *string[]    // do NOT dump the named schema(s)
-// var table *string[]            // dump the named table(s) only
-// var excludeTable *string[]     // do NOT dump the named table(s)
-// var excludeTableData *string[] // do NOT dump data for the named table(s)
+
+// Object filters (repeatable):
+var schemas *stringList          // dump the named schema(s) only
+var excludeSchemas *stringList   // do NOT dump the named schema(s)
+var tables *stringList           // dump the named table(s) only
+var excludeTables *stringList    // do NOT dump the named table(s)
+var excludeTableData *stringList // do NOT dump data for the named table(s)
 
 // Connection options:
 var dbname *string   // database to dump
@@ -48,10 +94,64 @@ var username *string // connect as specified database user
 var password *string // force password prompt (should happen automatically)
 
 // Azure options:
-var azureStorage *bool    // azure storage active
+var azureStorage *bool    // azure storage active (same as --target-data-backend=azure)
 var accountName *string   // azure account name
 var accountKey *string    // azure account key
 var containerName *string // azure container name
+var azureBlockSize *int   // azure upload block size in MB
+var azureMaxRetries *int  // retries of failed azure operations
+var azureRetryDelay *int  // seconds before the first retry, doubled on each retry
+
+// Azure endpoint and authentication options:
+var azureEndpoint *string         // azure blob service endpoint
+var azureSASToken *string         // azure shared access signature
+var azureConnectionString *string // azure storage connection string
+
+// Azure lookup options:
+var azurePrefix *string  // virtual directory of the backups inside the container
+var azureIndexTags *bool // set blob index tags on backups
+
+// Azure access tier options:
+var azureAccessTier *string       // access tier of new backup files
+var azureCoolAfterDays *int       // days before a backup file is moved to the Cool tier
+var azureArchiveAfterDays *int    // days before a backup file is moved to the Archive tier
+var azureCoolAfterBackups *int    // newer backups before a backup file is moved to the Cool tier
+var azureArchiveAfterBackups *int // newer backups before a backup file is moved to the Archive tier
+var azureRehydrateTier *string    // tier of archived backup files that are restored or downloaded
+
+// S3 options:
+var s3Endpoint *string        // s3 endpoint url (empty for AWS)
+var s3Region *string          // s3 region
+var s3Bucket *string          // s3 bucket name
+var s3Prefix *string          // s3 key prefix
+var s3PathStyle *bool         // use path-style addressing (MinIO)
+var s3AccessKeyID *string     // s3 access key id
+var s3SecretAccessKey *string // s3 secret access key
+var s3PartSize *int           // multipart upload part size in MB
+var s3Concurrency *int        // parallel multipart uploads
+
+// Transfer limits (uploads and downloads on every storage backend):
+var simultaneousWrites *int // maximum number of backup files uploaded at the same time (0 for no limit)
+var maxBandwidthWrite *int  // maximum total upload bandwidth in KB/s (0 for no limit)
+var simultaneousReads *int  // maximum number of backup files downloaded at the same time (0 for no limit)
+var maxBandwidthRead *int   // maximum total download bandwidth in KB/s (0 for no limit)
+
+// Verification options:
+var verifyAfterBackup *bool     // verify each backup right after it is created
+var verifyInterval *int         // verify the latest backup every N minutes (0 disables it)
+var verifyHost *string          // verification server host (required to verify backups)
+var verifyPort *int             // verification server port (defaults to --port)
+var verifyUsername *string      // verification server user (defaults to --username)
+var verifyPassword *string      // verification server password (defaults to --password)
+var verifySQLFile *string       // file with SQL assertions run on the restored database
+var verifyRowTolerance *float64 // accepted row count difference between source and restored tables, in percent
+
+// Integrity check options:
+var checkInterval *int // check the checksum of all backups every N minutes (0 disables it)
+
+// API options:
+var apiListenPort *int  // port of the provider API (restores), 0 disables it
+var apiListenIP *string // address of the provider API (loopback by default, as it isn't authenticated)
 
 //PostgresBackuper sample backuper
 type PostgresBackuper struct{}
@@ -64,11 +164,73 @@ func (sb PostgresBackuper) Init() error {
 
 	dataStringSeparator = "---"
 
-	info, err := schellyhook.ExecShell("pg_dump --version")
+	backend := *targetDataBackend
+	if *azureStorage {
+		backend = "azure"
+	}
+	if *rewrapKeysOnly {
+		err := runRewrapCommand(backend)
+		if err != nil {
+			sugar.Errorf("Error rewrapping backup data keys. err=%s", err)
+			return err
+		}
+		os.Exit(0)
+	}
+	if *archiveWALPath != "" || *restoreWALName != "" {
+		err := runWALCommand(backend)
+		if err != nil {
+			sugar.Errorf("Error running WAL command. err=%s", err)
+			return err
+		}
+		os.Exit(0)
+	}
+
+	err := validatePhysicalOptions()
 	if err != nil {
-		sugar.Errorf("Couldn't retrieve pg_dump version. err=%s", err)
 		return err
 	}
+	err = validateClusterOptions()
+	if err != nil {
+		return err
+	}
+	if *walArchiving && *backupMode != backupKindPhysical {
+		return fmt.Errorf("`--wal-archiving` requires `--backup-mode=physical`, because WAL can only be replayed on physical backups")
+	}
+	if *recoveryPort < 0 || *recoveryPort > 65535 {
+		return fmt.Errorf("`--recovery-port` must be between 0 and 65535")
+	}
+	if *recoveryDir != "" {
+		*recoveryDir, err = filepath.Abs(*recoveryDir)
+		if err != nil {
+			return fmt.Errorf("Invalid `--recovery-dir`: %s", err)
+		}
+	}
+	tool := "pg_dump"
+	if *backupMode == backupKindPhysical {
+		tool = "pg_basebackup"
+	}
+	out, err := exec.Command(tool, "--version").Output()
+	if err != nil {
+		sugar.Errorf("Couldn't retrieve %s version. err=%s", tool, err)
+		return err
+	}
+	info := string(out)
+	if *backupMode == backupKindPhysical {
+		pgBasebackupVersion = strings.TrimSpace(info)
+		if *incrementalBackup && !supportsIncremental(pgBasebackupVersion) {
+			sugar.Warnf("%s can't take incremental backups, which need PostgreSQL 17+. Full physical backups will be taken", pgBasebackupVersion)
+			*incrementalBackup = false
+		}
+	} else {
+		pgDumpVersion = strings.TrimSpace(info)
+	}
+	if *clusterBackup {
+		_, err = exec.Command("pg_dumpall", "--version").Output()
+		if err != nil {
+			sugar.Errorf("Couldn't retrieve pg_dumpall version. err=%s", err)
+			return err
+		}
+	}
 
 	if *backupsDir == "" {
 		return fmt.Errorf("backup-dir arg must be defined")
@@ -76,12 +238,50 @@ func (sb PostgresBackuper) Init() error {
 	if strings.Contains(*fileName, "--") {
 		return fmt.Errorf("Cannot use `--` on file name. Please change the filename and try again; you can still use `-`")
 	}
+	if *splitFile {
+		if *dumpFormat != "plain" && *dumpFormat != "directory" {
+			return fmt.Errorf("`--split-file` can't be used with `--format=%s`", *dumpFormat)
+		}
+		*dumpFormat = "directory"
+	}
+	if _, ok := dumpFormats[*dumpFormat]; !ok {
+		return fmt.Errorf("`format` (--format) arg must be `plain`, `custom`, `directory` or `tar`")
+	}
+	if *dumpCompressionLevel < -1 || *dumpCompressionLevel > 9 {
+		return fmt.Errorf("`dump compression level` (--dump-compression-level) arg must be between 0 and 9, or -1 for pg_dump default")
+	}
+	if *dumpCompressionLevel >= 0 && *dumpFormat != "custom" && *dumpFormat != "directory" {
+		return fmt.Errorf("`--dump-compression-level` can only be used with custom and directory formats")
+	}
+	err = validateFilterPatterns(*schemas, *excludeSchemas, *tables, *excludeTables, *excludeTableData)
+	if err != nil {
+		return err
+	}
+	if *dumpJobs < 1 {
+		return fmt.Errorf("`jobs` (--jobs) arg must be at least 1")
+	}
+	if *dumpJobs > 1 && *dumpFormat != "directory" {
+		return fmt.Errorf("`--jobs` can only be used with the directory format")
+	}
+	if *streamBackup && *dumpFormat == "directory" {
+		return fmt.Errorf("`--stream` can't be used with the directory format because pg_dump can only write directories to disk")
+	}
+	err = validateCompression(*compression, *compressionLevel)
+	if err != nil {
+		return err
+	}
+	if *compression != "none" && *dumpFormat == "directory" {
+		return fmt.Errorf("`--compression` can't be used with the directory format")
+	}
 	if *host == "" {
 		return fmt.Errorf("`database host` (--host) arg must be set. It can be an IP address or a domain name")
 	}
 	if *port <= 0 {
 		return fmt.Errorf("`database port` (--port) arg must be a valid value, such as 5432")
 	}
+	if *dbname == "" && *clusterBackup {
+		*dbname = maintenanceDatabase
+	}
 	if *dbname == "" {
 		return fmt.Errorf("`dbname` (--dbname) arg must be set")
 	}
@@ -91,6 +291,36 @@ func (sb PostgresBackuper) Init() error {
 	if *password == "" {
 		return fmt.Errorf("`password` (--password) arg must be set")
 	}
+	if hasControlChars(*password) {
+		return fmt.Errorf("`password` (--password) arg can't have control characters")
+	}
+	err = validateConnectionOptions(sourceConnection())
+	if err != nil {
+		return err
+	}
+	err = validateFileName(*fileName)
+	if err != nil {
+		return err
+	}
+	backupEncryptionKey, err = loadEncryptionKey(*encryptionKeyFile, *encryptionKeyEnv)
+	if err != nil {
+		return err
+	}
+	if *keyringFile != "" {
+		backupKeyring, err = loadKeyring(*keyringFile, *masterKeyID)
+		if err != nil {
+			return err
+		}
+	}
+	if *verifyAfterBackup || *verifyInterval > 0 {
+		if *verifyHost == "" {
+			return fmt.Errorf("`--verify-host` must be set to verify backups, so that they are never restored on the database server being backed up")
+		}
+		err = validateConnectionOptions(verifyConnection().withDatabase(scratchDatabaseName("0")))
+		if err != nil {
+			return fmt.Errorf("Invalid verification server options: %s", err)
+		}
+	}
 	basicDir := "/var/backups"
 	err = mkDirs(basicDir)
 	if err != nil {
@@ -101,7 +331,7 @@ func (sb PostgresBackuper) Init() error {
 	// https://www.postgresql.org/docs/9.3/static/libpq-pgpass.html
 	pgPassFilePath := basicDir + "/.pgpass"
 	os.Setenv("PGPASSFILE", pgPassFilePath)
-	pgPassStringBytes := []byte("*:*:*:*:" + *password)
+	pgPassStringBytes := []byte("*:*:*:*:" + strings.NewReplacer(`\`, `\\`, ":", `\:`).Replace(*password))
 	err = ioutil.WriteFile(pgPassFilePath, pgPassStringBytes, 0600)
 	if err != nil {
 		sugar.Errorf("Error writing .pgpass file. err: %s", err)
@@ -115,16 +345,63 @@ func (sb PostgresBackuper) Init() error {
 	}
 	sugar.Debugf(pgPassFilePath+" file created. Contents: %s", pgPassFile)
 
-	err = mkDirs(*backupsDir)
+	err = mkDirs(filepath.Join(*backupsDir, ".staging"))
 	if err != nil {
 		return fmt.Errorf("Error creating backups `base-dir`. error: %s", err)
 	}
 
+	if *simultaneousWrites < 0 || *simultaneousReads < 0 || *maxBandwidthWrite < 0 || *maxBandwidthRead < 0 {
+		return fmt.Errorf("Transfer limits (--simultaneous-writes, --max-bandwidth-write, --simultaneous-reads and --max-bandwidth-read) can't be negative")
+	}
+	if *azureBlockSize <= 0 || *azureBlockSize > 100 {
+		return fmt.Errorf("`--azure-block-size` must be between 1 and 100 MB")
+	}
+	if *azureMaxRetries < 0 || *azureRetryDelay < 0 {
+		return fmt.Errorf("`--azure-max-retries` and `--azure-retry-delay` can't be negative")
+	}
+	err = validateTierOptions(backend)
+	if err != nil {
+		return err
+	}
+	backupStorage, err = newStorage(backend)
+	if err != nil {
+		return err
+	}
+	if *walArchiving {
+		walStorage, err = newWALStorage(backend)
+		if err != nil {
+			return err
+		}
+	}
+	err = migrateLegacyBackups()
+	if err != nil {
+		sugar.Errorf("Error writing manifests for legacy backups. err=%s", err)
+		return err
+	}
+
+	if *verifyInterval > 0 {
+		scheduleVerifications(time.Duration(*verifyInterval) * time.Minute)
+	}
+	if *checkInterval > 0 {
+		scheduleIntegrityChecks(time.Duration(*checkInterval) * time.Minute)
+	}
+	if *apiListenPort > 0 {
+		startAPIServer(*apiListenIP, *apiListenPort)
+	}
+
 	sugar.Infof("Postgres Provider ready to work. Version: %s", info)
-	sugar.Infof("Azure Storage: %b", *azureStorage)
+	sugar.Infof("Target data backend: %s", backend)
+	if backupKeyring != nil {
+		sugar.Infof("Backup data keys wrapped with master key %s", backupKeyring.active)
+	} else if backupEncryptionKey != nil {
+		sugar.Infof("Backups encrypted with key %s", backupEncryptionKey.ID)
+	}
 	sugar.Infof("Azure AccountName: %s", *accountName)
 	sugar.Infof("Azure AccountKey: %s", *accountKey)
 	sugar.Infof("Azure ContainerName: %s", *containerName)
+	if *azureEndpoint != "" {
+		sugar.Infof("Azure Endpoint: %s", *azureEndpoint)
+	}
 
 	return nil
 }
@@ -137,30 +414,104 @@ func (sb PostgresBackuper) RegisterFlags() error {
 
 	// General options:
 	backupsDir = flag.String("backup-dir", "/var/backups/database", "--backup-dir=FILENAME -> output file path and name")
+	targetDataBackend = flag.String("target-data-backend", "file", "--target-data-backend=file|azure|s3 -> storage backend where the backup files are kept")
 	fileName = flag.String("file-name", "database_dump", "--file-name=FILENAME -> output file path and name")
-	splitFile = flag.Bool("split-file", false, "--split-file -> split the backup on multiple files on a directory (pg_dump --format=d)")
+	splitFile = flag.Bool("split-file", false, "--split-file -> split the backup on multiple files on a directory (same as --format=directory)")
+	dumpFormat = flag.String("format", "plain", "--format=plain|custom|directory|tar -> pg_dump output format")
+	dumpJobs = flag.Int("jobs", 1, "--jobs=NUM -> number of parallel pg_dump jobs for directory format. Each job opens a database connection")
+	dumpCompressionLevel = flag.Int("dump-compression-level", -1, "--dump-compression-level=0-9 -> pg_dump compression level for custom and directory formats. -1 uses pg_dump default")
+
+	clusterBackup = flag.Bool("cluster", false, "--cluster -> logical backups of the whole cluster: roles and tablespaces with pg_dumpall --globals-only, and every database that isn't a template with pg_dump")
+	includeDatabases, excludeDatabases = &stringList{}, &stringList{}
+	flag.Var(includeDatabases, "include-database", "--include-database=DATABASE -> dump only the named database(s) on cluster backups. Repeatable, accepts globs")
+	flag.Var(excludeDatabases, "exclude-database", "--exclude-database=DATABASE -> do NOT dump the named database(s) on cluster backups. Repeatable, accepts globs")
+
+	backupMode = flag.String("backup-mode", "logical", "--backup-mode=MODE -> logical backups of --dbname with pg_dump, or physical backups of the whole cluster with pg_basebackup")
+	basebackupCheckpoint = flag.String("basebackup-checkpoint", "spread", "--basebackup-checkpoint=MODE -> checkpoint of physical backups: fast starts the backup right away, spread avoids an I/O spike")
+	incrementalBackup = flag.Bool("incremental", false, "--incremental -> take physical backups incremental to the previous one, on pg_basebackup 17+. The server needs summarize_wal = on")
+	maxIncrementalChain = flag.Int("max-incremental-chain", 6, "--max-incremental-chain=N -> take a full physical backup once the chain of the previous one has N incremental backups. 0 for no limit")
+	walArchiving = flag.Bool("wal-archiving", false, "--wal-archiving -> accept WAL files from archive_command on PUT /wal/{file} of the provider API, serve them to restore_command on GET /wal/{file} and prune the ones older than the oldest physical backup")
+	archiveWALPath = flag.String("archive-wal", "", "--archive-wal=PATH -> archive the WAL file at PATH and exit. Use as archive_command, with PATH set to %p")
+	restoreWALName = flag.String("restore-wal", "", "--restore-wal=FILE -> restore the archived WAL file FILE to --restore-wal-to and exit. Use as restore_command, with FILE set to %f")
+	restoreWALPath = flag.String("restore-wal-to", "", "--restore-wal-to=PATH -> where --restore-wal writes the WAL file. Use %p on restore_command")
+	recoveryDir = flag.String("recovery-dir", "", "--recovery-dir=DIR -> directory under which POST /recoveries lays out recovered clusters, on the data_dir of the request. Recoveries are refused when empty")
+	recoveryPort = flag.Int("recovery-port", 0, "--recovery-port=PORT -> port of servers recovered to a point in time. 0 keeps the port of the base backup")
+	recoveryRestoreCommand = flag.String("recovery-restore-command", "", "--recovery-restore-command=COMMAND -> restore_command of servers recovered to a point in time. Defaults to curl -sf -o %p http://localhost:API_LISTEN_PORT/wal/%f")
+	recoveryUser = flag.String("recovery-user", "postgres", "--recovery-user=USER -> user that runs servers recovered to a point in time when the provider runs as root")
+	streamBackup = flag.Bool("stream", false, "--stream -> pipe pg_dump output straight to the storage backend, without staging it on local disk")
+	compression = flag.String("compression", "none", "--compression=none|gzip|zstd|lz4 -> compress the backup file before storing it")
+	compressionLevel = flag.Int("compression-level", 0, "--compression-level=LEVEL -> compression level used by --compression (1-9 for gzip and lz4, 1-22 for zstd). 0 uses the codec default")
+	encryptionKeyFile = flag.String("encryption-key-file", "", "--encryption-key-file=FILE -> encrypt backups with the 32 bytes key in FILE, encoded as hex or base64")
+	encryptionKeyEnv = flag.String("encryption-key-env", "", "--encryption-key-env=NAME -> encrypt backups with the 32 bytes key in the environment variable NAME, encoded as hex or base64")
+	keyringFile = flag.String("keyring-file", "", "--keyring-file=FILE -> encrypt each backup with its own data key, wrapped by a master key from FILE (one key id and key per line)")
+	masterKeyID = flag.String("master-key-id", "", "--master-key-id=ID -> keyring master key that wraps new data keys. Defaults to the last key of the keyring")
+	rewrapKeysOnly = flag.Bool("rewrap-keys", false, "--rewrap-keys -> wrap the data keys of every existing backup and WAL file with the master key and exit")
 
 	// Options controlling the output content:
 	dataOnly = flag.Bool("data-only", false, "--data-only -> dump only the data, not the schema")
 	schemaOnly = flag.Bool("schema-only", false, "--schema-only -> dump only the schema, no data")
 	encoding = flag.String("encoding", "UTF-8", "--encoding=ENCODING -> dump the data in encoding ENCODING")
-	// schema = flag.Var("schema","","--schema=SCHEMA -> dump the named schema(s) only")
-	// excludeSchema = flag.Var("exclude-schema", "", "--exclude-schema=SCHEMA -> do NOT dump the named schema(s)")
-	// table = flag.Var("table", "", "--table=TABLE -> dump the named table(s) only")
-	// excludeTable = flag.Var("exclude-table", "", "--exclude-table=TABLE -> do NOT dump the named table(s)")
-	// excludeTableData = flag.Var("exclude-table-data", "", "--exclude-table-data=TABLE -> do NOT dump data for the named table(s)")
+	schemas, excludeSchemas, tables, excludeTables, excludeTableData = &stringList{}, &stringList{}, &stringList{}, &stringList{}, &stringList{}
+	flag.Var(schemas, "schema", "--schema=SCHEMA -> dump the named schema(s) only. Repeatable, accepts globs")
+	flag.Var(excludeSchemas, "exclude-schema", "--exclude-schema=SCHEMA -> do NOT dump the named schema(s). Repeatable, accepts globs")
+	flag.Var(tables, "table", "--table=TABLE -> dump the named table(s) only. Repeatable, accepts globs")
+	flag.Var(excludeTables, "exclude-table", "--exclude-table=TABLE -> do NOT dump the named table(s). Repeatable, accepts globs")
+	flag.Var(excludeTableData, "exclude-table-data", "--exclude-table-data=TABLE -> do NOT dump data for the named table(s), keeping their definition. Repeatable, accepts globs")
 
 	// Connection options:
-	dbname = flag.String("dbname", "", "--dbname=DBNAME -> database to dump")
+	dbname = flag.String("dbname", "", "--dbname=DBNAME -> database to dump. On cluster backups, the database to connect to (postgres by default)")
 	host = flag.String("host", "", "--host=HOSTNAME -> database server host or socket directory")
 	port = flag.Int("port", 5432, "--port=PORT -> database server port number")
 	username = flag.String("username", "postgres", "--username=NAME -> connect as specified database user")
 	password = flag.String("password", "", " --password -> password to be placed on ~/.pgpass")
 
-	azureStorage = flag.Bool("azure-storage", false, "--azure-storage -> dump only the data, not the schema")
+	azureStorage = flag.Bool("azure-storage", false, "--azure-storage -> same as --target-data-backend=azure (kept for compatibility)")
 	accountName = flag.String("account-name", "", " --account-name -> azure account name")
 	accountKey = flag.String("account-key", "", " --account-key -> azure account key")
 	containerName = flag.String("container-name", "", " --container-name -> azure container name")
+	azureEndpoint = flag.String("azure-endpoint", "", "--azure-endpoint=URL -> azure blob service endpoint, such as http://azurite:10000/devstoreaccount1. Defaults to https://ACCOUNT.blob.core.windows.net")
+	azureSASToken = flag.String("azure-sas-token", "", "--azure-sas-token=TOKEN -> azure shared access signature, used instead of the account key")
+	azureConnectionString = flag.String("azure-connection-string", "", "--azure-connection-string=STRING -> azure storage connection string, with the account name, key or SAS token and endpoint. UseDevelopmentStorage=true connects to Azurite")
+	azurePrefix = flag.String("azure-prefix", "", "--azure-prefix=PREFIX -> virtual directory of the backups inside the container, so that several providers can share it. {database} is replaced by --dbname")
+	azureIndexTags = flag.Bool("azure-index-tags", false, "--azure-index-tags=true -> set blob index tags with the api id, pg_dump id, database and status of each backup, besides blob metadata")
+	azureAccessTier = flag.String("azure-access-tier", "", "--azure-access-tier=TIER -> access tier of new backup files: Hot, Cool or Archive. Defaults to the tier of the storage account")
+	azureCoolAfterDays = flag.Int("azure-cool-after-days", 0, "--azure-cool-after-days=DAYS -> move backup files older than DAYS to the Cool tier. 0 never moves them")
+	azureArchiveAfterDays = flag.Int("azure-archive-after-days", 0, "--azure-archive-after-days=DAYS -> move backup files older than DAYS to the Archive tier. 0 never moves them")
+	azureCoolAfterBackups = flag.Int("azure-cool-after-backups", 0, "--azure-cool-after-backups=N -> move backup files to the Cool tier once there are N newer backups. 0 never moves them")
+	azureArchiveAfterBackups = flag.Int("azure-archive-after-backups", 0, "--azure-archive-after-backups=N -> move backup files to the Archive tier once there are N newer backups. 0 never moves them")
+	azureRehydrateTier = flag.String("azure-rehydrate-tier", "Hot", "--azure-rehydrate-tier=TIER -> tier archived backup files are moved to when they are restored or downloaded: Hot or Cool")
+	azureBlockSize = flag.Int("azure-block-size", 4, "--azure-block-size=MB -> block size of azure uploads in MB")
+	azureMaxRetries = flag.Int("azure-max-retries", 5, "--azure-max-retries=N -> retry failed azure operations up to N times, with exponential backoff. Failed uploads are resumed from the first missing block")
+	azureRetryDelay = flag.Int("azure-retry-delay", 2, "--azure-retry-delay=SECONDS -> wait before the first retry of a failed azure operation, doubled on each retry")
+
+	s3Endpoint = flag.String("s3-endpoint", "", "--s3-endpoint=URL -> S3 compatible endpoint, such as http://minio:9000. Leave empty for AWS S3")
+	s3Region = flag.String("s3-region", "us-east-1", "--s3-region=REGION -> S3 region")
+	s3Bucket = flag.String("s3-bucket", "", "--s3-bucket=BUCKET -> S3 bucket name")
+	s3Prefix = flag.String("s3-prefix", "", "--s3-prefix=PREFIX -> key prefix for the backup files inside the bucket")
+	s3PathStyle = flag.Bool("s3-path-style", false, "--s3-path-style -> use path-style addressing (required by MinIO)")
+	s3AccessKeyID = flag.String("s3-access-key-id", "", "--s3-access-key-id=KEY -> S3 access key id. Uses the default AWS credential chain when empty")
+	s3SecretAccessKey = flag.String("s3-secret-access-key", "", "--s3-secret-access-key=SECRET -> S3 secret access key")
+	s3PartSize = flag.Int("s3-part-size", 16, "--s3-part-size=MB -> multipart upload part size in MB (min 5)")
+	s3Concurrency = flag.Int("s3-concurrency", 4, "--s3-concurrency=NUM -> number of parts uploaded in parallel")
+
+	simultaneousWrites = flag.Int("simultaneous-writes", 3, "--simultaneous-writes=NUM -> maximum number of backup files uploaded to the storage backend at the same time. 0 for no limit")
+	maxBandwidthWrite = flag.Int("max-bandwidth-write", 0, "--max-bandwidth-write=KBPS -> maximum total upload bandwidth in kilobytes per second. 0 for no limit")
+	simultaneousReads = flag.Int("simultaneous-reads", 10, "--simultaneous-reads=NUM -> maximum number of backup files downloaded from the storage backend at the same time. 0 for no limit")
+	maxBandwidthRead = flag.Int("max-bandwidth-read", 0, "--max-bandwidth-read=KBPS -> maximum total download bandwidth in kilobytes per second. 0 for no limit")
+
+	verifyAfterBackup = flag.Bool("verify", false, "--verify -> restore each backup into a scratch database on the verification server and check it")
+	verifyInterval = flag.Int("verify-interval", 0, "--verify-interval=MINUTES -> verify the latest backup every MINUTES, if it wasn't verified yet. 0 disables it")
+	verifyHost = flag.String("verify-host", "", "--verify-host=HOSTNAME -> verification server host, where backups are restored into scratch databases. Required to verify backups")
+	verifyPort = flag.Int("verify-port", 0, "--verify-port=PORT -> verification server port. Defaults to --port")
+	verifyUsername = flag.String("verify-username", "", "--verify-username=NAME -> verification server user. Defaults to --username")
+	verifyPassword = flag.String("verify-password", "", "--verify-password=PASSWORD -> verification server password. Defaults to --password")
+	verifySQLFile = flag.String("verify-sql-file", "", "--verify-sql-file=FILE -> SQL assertions run on the restored database, one query per line. Each must return true")
+	verifyRowTolerance = flag.Float64("verify-row-tolerance", 0, "--verify-row-tolerance=PERCENT -> accepted row count difference between source and restored tables")
+
+	checkInterval = flag.Int("check-interval", 0, "--check-interval=MINUTES -> read back every backup file and compare it with its checksum every MINUTES. 0 disables it")
+
+	apiListenPort = flag.Int("api-listen-port", 7071, "--api-listen-port=PORT -> port of the provider API for restores. 0 disables it")
+	apiListenIP = flag.String("api-listen-ip", "127.0.0.1", "--api-listen-ip=IP -> address of the provider API. It isn't authenticated and sends decrypted backups, so only expose it to trusted networks")
 
 	// flag.Parse() //invoked by the hook
 	sugar.Infof("Flags registration completed")
@@ -168,567 +519,541 @@ func (sb PostgresBackuper) RegisterFlags() error {
 	return nil
 }
 
-//CreateNewBackup creates a new backup
+//CreateNewBackup starts a new backup in background. Its progress is reported by GetBackup and GetAllBackups
 func (sb PostgresBackuper) CreateNewBackup(apiID string, timeout time.Duration, shellContext *schellyhook.ShellContext) error {
 	logger, _ := zap.NewDevelopment()
 	defer logger.Sync() // flushes buffer, if any
 	sugar := logger.Sugar()
 
 	sugar.Infof("CreateNewBackup() apiID=%s timeout=%d s", apiID, timeout.Seconds)
-	sugar.Infof("Running Postgres pg_dump backup")
+	sugar.Infof("Running Postgres %s backup", *backupMode)
 
 	pgDumpID := time.Now().Format("20060102150405")
-	fileString := "--file=" + resolveFilePath(apiID, pgDumpID)
-
-	dataOnlyString := ""
-	if *dataOnly == true {
-		dataOnlyString = "--data-only"
-	}
-	schemaOnlyString := ""
-	if *schemaOnly == true {
-		schemaOnlyString = "--schema-only"
-	}
-	encodingString := ""
-	if encoding != nil {
-		encodingString = "--encoding=" + *encoding
-	}
-	backupFormat := "d"
-	if *splitFile == false {
-		backupFormat = "p"
-	}
-
-	pgDumpCommand := "pg_dump --username=" + *username + " --dbname=" + *dbname + " --host=" + *host + " --port=" + strconv.Itoa(*port) + " --verbose --format=" + backupFormat + " --jobs=1 --compress=9 --column-inserts --inserts --quote-all-identifiers --clean --create " + fileString + " " + dataOnlyString + " " + schemaOnlyString + " " + encodingString
-	sugar.Debugf("Executing pg_dump command: %s", pgDumpCommand)
-	out, err := schellyhook.ExecShellTimeout(pgDumpCommand, timeout, shellContext)
-
+	j, ctx, err := backupJobs.start(apiID, pgDumpID)
 	if err != nil {
-		status := (*shellContext).CmdRef.Status()
-		if status.Exit == -1 {
-			sugar.Warnf("PostgresProvider pg_dump command timeout enforced (%d seconds)", (status.StopTs-status.StartTs)/1000000000)
-		}
-		sugar.Debugf("PostgresProvider pg_dump error. out=%s; err=%s", out, err.Error())
-		errorFileBytes := []byte(pgDumpID)
-
-		errorFilePath := resolveErrorFilePath(apiID)
-		err := ioutil.WriteFile(errorFilePath, errorFileBytes, 0600)
-		if err != nil {
-			sugar.Errorf("Error writing .error file for %s. err: %s", apiID, err)
-			return err
-		}
-
-		if *azureStorage {
-			sugar.Debugf("Try to send file to Azure")
-			err = sendFileToAzure(*accountName, *accountKey, *containerName, resolveErrorFilePathAzure(apiID), resolveErrorFilePath(apiID))
-			if err != nil {
-				sugar.Debugf("Send error file to Azure with error: %s", err.Error())
-				return fmt.Errorf("Send errro file to Azure with error: %s", err.Error())
-			}
-		}
-
+		sugar.Errorf("Couldn't start backup %s. err=%s", apiID, err)
 		return err
 	}
-
-	sugar.Debugf("PostgresProvider pg_dump backup started. Output log:")
-	sugar.Debugf(out)
-	saveDataID(apiID, pgDumpID)
-
-	//## Send file to Azure Storage Blob
-	if *azureStorage {
-		err = sendFileToAzure(*accountName, *accountKey, *containerName, resolveFilePathAzure(apiID, pgDumpID), resolveFilePath(apiID, pgDumpID))
-		if err != nil {
-			sugar.Debugf("Send file to Azure with error: %s", err.Error())
-			return fmt.Errorf("Send file to Azure with error: %s", err.Error())
-		}
+	//the manifest is written before returning so that the backup is immediately visible as running
+	m := newBackupManifest(j)
+	err = writeManifest(m)
+	if err != nil {
+		sugar.Errorf("Couldn't write manifest for backup %s. err=%s", apiID, err)
+		backupJobs.finish(j, err)
+		return nil
 	}
+	go runBackupJob(ctx, j, m, timeout)
 
 	sugar.Infof("Postgres backup launched")
 	return nil
 }
 
-//GetAllBackups returns all backups from underlaying backuper. optional for Schelly
-func (sb PostgresBackuper) GetAllBackups() (result []schellyhook.SchellyResponse, err error) {
+//runBackupJob runs pg_dump for the backup job and records the result on the backup manifest
+func runBackupJob(ctx context.Context, j *job, m *backupManifest, timeout time.Duration) {
 	logger, _ := zap.NewDevelopment()
 	defer logger.Sync() // flushes buffer, if any
 	sugar := logger.Sugar()
 
-	sugar.Debugf("GetAllBackups")
+	snapshot := recordTableCounts(ctx, m)
+	var err error
+	if m.isPhysical() {
+		err = stagePhysicalBackup(ctx, m, timeout)
+	} else if m.isCluster() {
+		err = runClusterBackup(ctx, m, timeout)
+	} else if *streamBackup {
+		err = streamNewBackup(ctx, m, snapshot.snapshotID(), timeout)
+	} else {
+		err = stageNewBackup(ctx, m, snapshot.snapshotID(), timeout)
+	}
+	snapshot.close()
 
-	if *azureStorage {
-		result, err = listFilesFromAzure(*accountName, *accountKey, *containerName)
-		if err != nil {
-			sugar.Debugf("List files from Azure with error: %s", err.Error())
-			return nil, err
-		}
+	m.EndTime = time.Now()
+	if err != nil {
+		sugar.Warnf("Backup %s failed. err=%s", j.ID, err)
+		m.Status = statusError
+		m.Message = err.Error()
 	} else {
-		files, err := ioutil.ReadDir(*backupsDir)
-		if err != nil {
-			return nil, err
+		sugar.Infof("Backup %s finished", j.ID)
+		m.Status = statusAvailable
+		setUploadTier(m)
+	}
+	err0 := writeManifest(m)
+	if err0 != nil {
+		sugar.Errorf("Error writing manifest for %s. err: %s", j.ID, err0)
+		if err == nil {
+			err = err0
 		}
+	}
+	backupJobs.finish(j, err)
 
-		backups := make([]schellyhook.SchellyResponse, 0)
-		for _, fileName := range files {
-
-			id := strings.Split(fileName.Name(), dataStringSeparator)[1]
-			dataID := strings.Split(fileName.Name(), dataStringSeparator)[2]
-			sizeMB := fileName.Size()
-
-			backupFilePath := *backupsDir + "/" + fileName.Name()
-			_, err = os.Open(backupFilePath)
-			if err != nil {
-				return nil, err
-			}
-			sugar.Debugf("Found and opened backup file: %s", backupFilePath)
-			status := "available"
-
-			sr := schellyhook.SchellyResponse{
-				ID:      id,
-				DataID:  dataID,
-				Status:  status,
-				Message: backupFilePath,
-				SizeMB:  float64(sizeMB),
-			}
-			backups = append(backups, sr)
+	if err == nil && *verifyAfterBackup {
+		err = startVerification(j.ID)
+		if err != nil {
+			sugar.Warnf("Couldn't start verification of backup %s. err=%s", j.ID, err)
+		}
+	}
+	if tierLifecycleEnabled() {
+		err = applyTierLifecycle(time.Now())
+		if err != nil {
+			sugar.Warnf("Couldn't move older backups to colder tiers. err=%s", err)
 		}
-		result = backups
 	}
-	return result, nil
 }
 
-//GetBackup get an specific backup along with status
-func (sb PostgresBackuper) GetBackup(apiID string) (res *schellyhook.SchellyResponse, err error) {
+//newBackupManifest describes a backup that is about to start
+func newBackupManifest(j *job) *backupManifest {
 	logger, _ := zap.NewDevelopment()
 	defer logger.Sync() // flushes buffer, if any
 	sugar := logger.Sugar()
 
-	sugar.Debugf("GetBackup apiID=%s", apiID)
-
-	if *azureStorage {
-		pgDumpID, err0 := getDataIDFromAzure(*accountName, *accountName, *containerName, apiID)
-		if err0 != nil {
-			sugar.Debugf("Error finding pgDumpID for apiId %s. err=%s", apiID, err0)
-			return nil, err0
-		}
-		res, err = findFileFromAzure(*accountName, *accountKey, *containerName, resolveFilePathAzure(apiID, pgDumpID))
-		if err != nil {
-			sugar.Debugf("Error finding file with pgDumpID %s for apiId %s. err=%s", pgDumpID, apiID, err)
-			return nil, err
-		}
+	serverVersion := ""
+	rows, err := sourceConnection().query(context.Background(), "SHOW server_version")
+	if err != nil || len(rows) != 1 {
+		sugar.Warnf("Couldn't retrieve PostgreSQL server version. err=%s", err)
 	} else {
-		pgDumpID, err0 := getDataID(apiID)
-		if err0 != nil {
-			sugar.Debugf("Error finding pgDumpID for apiId %s. err=%s", apiID, err0)
-			return nil, err0
+		serverVersion = rows[0][0]
+	}
+
+	encryption := newEncryptionInfo(j.ID)
+	if *backupMode == backupKindPhysical {
+		return &backupManifest{
+			APIID:               j.ID,
+			PgDumpID:            j.DataID,
+			Kind:                backupKindPhysical,
+			Status:              statusRunning,
+			Artifact:            resolveFileName(j.ID, j.DataID) + basebackupExtension + compressionExtension(*compression) + encryptionExtension(encryption),
+			Database:            *dbname,
+			Host:                *host,
+			Port:                *port,
+			Format:              "tar",
+			Compression:         *compression,
+			Encryption:          encryption,
+			Bundle:              bundleTar,
+			Flags:               basebackupFlags(),
+			StartTime:           j.StartTime,
+			PgBasebackupVersion: pgBasebackupVersion,
+			ServerVersion:       serverVersion,
 		}
-		if pgDumpID == "" {
-			sugar.Debugf("pgDumpID not found for apiId %s.", apiID)
-			return nil, nil
+	}
+	bundle := ""
+	if *dumpFormat == "directory" {
+		bundle = bundleTar
+	}
+	if *clusterBackup {
+		//the artifact has the globals. each database is dumped to its own file
+		return &backupManifest{
+			APIID:         j.ID,
+			PgDumpID:      j.DataID,
+			Kind:          backupKindLogical,
+			Cluster:       true,
+			Status:        statusRunning,
+			Artifact:      resolveFileName(j.ID, j.DataID) + globalsExtension + compressionExtension(*compression) + encryptionExtension(encryption),
+			Host:          *host,
+			Port:          *port,
+			Format:        *dumpFormat,
+			Compression:   *compression,
+			Encryption:    encryption,
+			Bundle:        bundle,
+			Jobs:          *dumpJobs,
+			Flags:         pgDumpFlags(),
+			Filters:       currentDumpFilters(),
+			StartTime:     j.StartTime,
+			PgDumpVersion: pgDumpVersion,
+			ServerVersion: serverVersion,
 		}
+	}
 
-		sugar.Debugf("Found pgDumpID=" + pgDumpID + " for apiID: " + apiID + ". Finding Backup file...")
-		res, err = findBackup(apiID, pgDumpID)
-		if err != nil {
-			return nil, err
-		}
+	return &backupManifest{
+		APIID:         j.ID,
+		PgDumpID:      j.DataID,
+		Kind:          backupKindLogical,
+		Status:        statusRunning,
+		Artifact:      resolveFileName(j.ID, j.DataID) + dumpFormats[*dumpFormat].extension + compressionExtension(*compression) + encryptionExtension(encryption),
+		Database:      *dbname,
+		Host:          *host,
+		Port:          *port,
+		Format:        *dumpFormat,
+		Compression:   *compression,
+		Encryption:    encryption,
+		Bundle:        bundle,
+		Jobs:          *dumpJobs,
+		Flags:         pgDumpFlags(),
+		Filters:       currentDumpFilters(),
+		StartTime:     j.StartTime,
+		PgDumpVersion: pgDumpVersion,
+		ServerVersion: serverVersion,
 	}
-	return res, nil
 }
 
-//DeleteBackup removes current backup from underlaying backup storage
-func (sb PostgresBackuper) DeleteBackup(apiID string) error {
+//stageNewBackup runs pg_dump into a local staging file and then sends the file to the storage backend. pg_dump dumps the
+//exported snapshot when one is given. Records the pg_dump result, size and SHA-256 of the stored file on m
+func stageNewBackup(ctx context.Context, m *backupManifest, snapshot string, timeout time.Duration) error {
 	logger, _ := zap.NewDevelopment()
 	defer logger.Sync() // flushes buffer, if any
 	sugar := logger.Sugar()
 
-	sugar.Debugf("DeleteBackup apiID=%s", apiID)
-
-	if *azureStorage {
-		errorFilePath := resolveErrorFilePathAzure(apiID)
-		_, err := findFileFromAzure(*accountName, *accountKey, *containerName, errorFilePath)
-		if err == nil {
-			sugar.Debugf("Error file found: %s. The backup %s had problems during execution and will be considered as deleted", errorFilePath, apiID)
-			err = deleteFileFromAzure(*accountName, *accountKey, *containerName, errorFilePath)
-			if err != nil {
-				sugar.Debugf("Deleting backup file with problems %s from azure with error: %s", errorFilePath, err.Error())
-				return err
-			}
-			return nil
+	stagingFilePath := resolveStagingFilePath(m.APIID, m.PgDumpID)
+	defer os.RemoveAll(stagingFilePath)
+
+	dumpCtx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(dumpCtx, "pg_dump", pgDumpArgs(m.Database, stagingFilePath, snapshot)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	sugar.Debugf("Executing pg_dump command: %s", strings.Join(cmd.Args, " "))
+	startTime := time.Now()
+	err := cmd.Run()
+	m.PgDump = newCommandResult(cmd, err, startTime, stderr.String()).withContext(ctx, dumpCtx)
+	if m.PgDump.Cancelled {
+		return fmt.Errorf("Backup %s cancelled", m.APIID)
+	}
+	if !m.PgDump.success() {
+		if m.PgDump.TimedOut {
+			sugar.Warnf("PostgresProvider pg_dump command timeout enforced (%d seconds)", timeout/time.Second)
 		}
+		sugar.Debugf("PostgresProvider pg_dump error. result=%v", m.PgDump)
+		return m.PgDump.err()
+	}
 
-		pgDumpID, err0 := getDataIDFromAzure(*accountName, *accountKey, *containerName, apiID)
-		if err0 != nil {
-			sugar.Debugf("pgDumpID not found for apiId %s. err=%s", apiID, err0)
-			return err0
-		}
+	sugar.Debugf("PostgresProvider pg_dump backup finished. Output log:")
+	sugar.Debugf(stderr.String())
 
-		_, err0 = findFileFromAzure(*accountName, *accountKey, *containerName, resolveFilePathAzure(apiID, pgDumpID))
+	if *dumpFormat == "directory" {
+		//directories are sent as a single tar file, so that every backend can store them
+		bundle := tarDirectory(stagingFilePath)
+		defer bundle.Close()
+		err = storeArtifact(m, bundle)
+	} else if m.Compression != "none" || m.Encryption != nil {
+		file, err0 := os.Open(stagingFilePath)
 		if err0 != nil {
-			sugar.Debugf("Backup apiID %s, pgDumpID %s not found for removal", apiID, pgDumpID)
 			return err0
 		}
+		defer file.Close()
+		err = storeArtifact(m, file)
+	} else {
+		m.Size, m.SHA256, err = storeFile(backupStorage, m.Artifact, stagingFilePath)
+	}
+	if err != nil {
+		sugar.Debugf("Store backup file with error: %s", err.Error())
+		return fmt.Errorf("Store backup file with error: %s", err.Error())
+	}
+	return nil
+}
 
-		err = deleteFileFromAzure(*accountName, *accountKey, *containerName, resolveFilePathAzure(apiID, pgDumpID))
+//storeArtifact compresses and encrypts reader contents, as described by m, and sends them to the storage backend.
+//Records the size and SHA-256 of the stored file on m. The first chunk of encrypted files is read back, so that a backup
+//whose key can't be found is never reported as available
+func storeArtifact(m *backupManifest, reader io.Reader) error {
+	var stored io.ReadCloser = compressStream(reader, m.Compression, *compressionLevel)
+	defer stored.Close()
+	if m.Encryption != nil {
+		key, err := encryptionKeyFor(m.Encryption)
 		if err != nil {
-			sugar.Debugf("Deleting backup file %s from azure with error: %s", resolveFilePathAzure(apiID, pgDumpID), err.Error())
 			return err
 		}
-	} else {
-		errorFilePath := resolveErrorFilePath(apiID)
-		_, err := os.Open(errorFilePath)
-		if err == nil { //if the file exists, this backup should be discarded
-			sugar.Debugf("Error file found: %s. The backup %s had problems during execution and will be considered as deleted", errorFilePath, apiID)
-			os.Remove(errorFilePath) //try to remove the file
-			return nil
-		}
-
-		pgDumpID, err0 := getDataID(apiID)
-		if err0 != nil {
-			sugar.Debugf("pgDumpID not found for apiId %s. err=%s", apiID, err0)
-			return err0
-		}
-
-		_, err0 = findBackup(apiID, pgDumpID)
-		if err0 != nil {
-			sugar.Debugf("Backup apiID %s, pgDumpID %s not found for removal", apiID, pgDumpID)
-			return err0
-		}
-
-		sugar.Debugf("Backup apiID=%s pgDumpID=%s found. Proceeding to deletion", apiID, pgDumpID)
+		stored = encryptStream(stored, key)
+		defer stored.Close()
+	}
 
-		err1 := os.Remove(resolveFilePath(apiID, pgDumpID))
-		if err1 != nil {
-			return err1
+	var err error
+	m.Size, m.SHA256, err = putWithChecksum(backupStorage, m.Artifact, stored)
+	if err != nil {
+		return err
+	}
+	if m.Encryption != nil {
+		err = checkDecryption(m)
+		if err != nil {
+			return fmt.Errorf("Stored backup file can't be decrypted: %s", err)
 		}
-		sugar.Debugf("Delete apiID %s pgDumpID %s successful", apiID, pgDumpID)
 	}
 	return nil
 }
 
-func findBackup(apiID string, pgDumpID string) (*schellyhook.SchellyResponse, error) {
-	logger, _ := zap.NewDevelopment()
-	defer logger.Sync() // flushes buffer, if any
-	sugar := logger.Sugar()
-
-	backupFilePath := resolveFilePath(apiID, pgDumpID)
-	result, err := os.Open(backupFilePath)
-	if err != nil {
-		sugar.Errorf("File " + backupFilePath + " not found")
-		return nil, err
+//pgDumpArgs returns the pg_dump arguments that dump database, on snapshot if it isn't empty. pg_dump writes to stdout
+//when outputFile is empty
+func pgDumpArgs(database string, outputFile string, snapshot string) []string {
+	args := []string{"--username=" + *username, "--dbname=" + database, "--host=" + *host, "--port=" + strconv.Itoa(*port), "--no-password"}
+	args = append(args, pgDumpFlags()...)
+	if snapshot != "" {
+		args = append(args, "--snapshot="+snapshot)
 	}
-	file, err := result.Stat()
-	if err != nil {
-		return nil, err
+	if outputFile != "" {
+		args = append(args, "--file="+outputFile)
 	}
+	return args
+}
 
-	sugar.Debugf("pgDumpID found. Details: %s", file)
+//pgDumpFlags returns the pg_dump options controlling the output, without connection options
+func pgDumpFlags() []string {
+	flags := []string{"--verbose", "--format=" + dumpFormats[*dumpFormat].flag, "--jobs=" + strconv.Itoa(*dumpJobs)}
+	if *dumpCompressionLevel >= 0 {
+		flags = append(flags, "--compress="+strconv.Itoa(*dumpCompressionLevel))
+	}
+	flags = append(flags, "--column-inserts", "--inserts", "--quote-all-identifiers", "--clean", "--create")
+	if *dataOnly == true {
+		flags = append(flags, "--data-only")
+	}
+	if *schemaOnly == true {
+		flags = append(flags, "--schema-only")
+	}
+	if encoding != nil {
+		flags = append(flags, "--encoding="+*encoding)
+	}
+	if filters := currentDumpFilters(); filters != nil {
+		flags = append(flags, filters.flags()...)
+	}
+	return flags
+}
 
-	status := "available"
+//dumpFormatInfo describes a pg_dump output format
+type dumpFormatInfo struct {
+	flag      string
+	extension string
+}
 
-	return &schellyhook.SchellyResponse{
-		ID:      apiID,
-		DataID:  pgDumpID,
-		Status:  status,
-		Message: backupFilePath,
-		SizeMB:  float64(file.Size()),
-	}, nil
+var dumpFormats = map[string]dumpFormatInfo{
+	"plain":     {flag: "p", extension: ""},
+	"custom":    {flag: "c", extension: ".dump"},
+	"directory": {flag: "d", extension: ".dir.tar"},
+	"tar":       {flag: "t", extension: ".tar"},
 }
 
-func getDataID(apiID string) (string, error) {
+//GetAllBackups returns all backups from underlaying backuper, including the running ones. optional for Schelly
+func (sb PostgresBackuper) GetAllBackups() ([]schellyhook.SchellyResponse, error) {
 	logger, _ := zap.NewDevelopment()
 	defer logger.Sync() // flushes buffer, if any
 	sugar := logger.Sugar()
 
-	sugar.Debugf("Searching dataID (pgDumpID) for apiID: %s", apiID)
-	files, err := ioutil.ReadDir(*backupsDir)
+	sugar.Debugf("GetAllBackups")
+
+	manifests, objects, err := listManifests()
 	if err != nil {
-		return "", err
-	}
-	for _, file := range files {
-		sugar.Debugf("Backup File <Loop>: %s", file.Name())
-		if strings.Contains(file.Name(), apiID) && strings.Contains(file.Name(), dataStringSeparator) {
-			if _, err := os.Stat(*backupsDir + "/" + file.Name()); err == nil {
-				sugar.Debugf("Found file for apiID reference: %s", apiID)
-				_, err0 := ioutil.ReadFile(*backupsDir + "/" + file.Name())
-				if err0 != nil {
-					return "", err0
-				}
-				pgDumpID := strings.Split(file.Name(), dataStringSeparator)[2]
-				sugar.Debugf("apiID %s <-> pgDumpID %s", apiID, pgDumpID)
-				return pgDumpID, nil
-			}
+		sugar.Debugf("List backup files with error: %s", err.Error())
+		return nil, err
+	}
+
+	backups := make([]schellyhook.SchellyResponse, 0)
+	for _, m := range manifests {
+		location := m.Artifact
+		if object, ok := objects[m.Artifact]; ok {
+			location = object.Location
 		}
+		backups = append(backups, manifestResponse(m, location))
 	}
-	return "", fmt.Errorf("pgDumpID for %s not found", apiID)
+	return backups, nil
 }
 
-func saveDataID(apiID string, pgDumpID string) error {
+//GetBackup get an specific backup along with status
+func (sb PostgresBackuper) GetBackup(apiID string) (*schellyhook.SchellyResponse, error) {
 	logger, _ := zap.NewDevelopment()
 	defer logger.Sync() // flushes buffer, if any
 	sugar := logger.Sugar()
 
-	sugar.Debugf("IDs already saved apiID %s <-> pgDumpID %s", apiID, pgDumpID)
-	return nil
-}
-
-func resolveFilePath(apiID string, pgDumpID string) string {
-	return *backupsDir + "/" + *fileName + dataStringSeparator + apiID + dataStringSeparator + pgDumpID
-}
-
-func resolveFilePathAzure(apiID string, pgDumpID string) string {
-	return *fileName + dataStringSeparator + apiID + dataStringSeparator + pgDumpID
-}
-
-func resolveErrorFilePath(apiID string) string {
-	return *backupsDir + "/" + apiID + ".err"
-}
-
-func resolveErrorFilePathAzure(apiID string) string {
-	return apiID + ".err"
-}
+	sugar.Debugf("GetBackup apiID=%s", apiID)
 
-func mkDirs(path string) error {
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return os.MkdirAll(path, os.ModePerm)
+	m, err := readManifest(apiID)
+	if err == errObjectNotFound {
+		sugar.Debugf("Backup manifest not found for apiId %s.", apiID)
+		return nil, nil
+	}
+	if err != nil {
+		sugar.Debugf("Error reading manifest for apiId %s. err=%s", apiID, err)
+		return nil, err
 	}
-	return nil
-}
-
-func handleErrors(err *error) {
-	logger, _ := zap.NewDevelopment()
-	defer logger.Sync() // flushes buffer, if any
-	sugar := logger.Sugar()
 
-	if *err != nil {
-		if serr, ok := (*err).(azblob.StorageError); ok { // This error is a Service-specific
-			switch serr.ServiceCode() { // Compare serviceCode to ServiceCodeXxx constants
-			case azblob.ServiceCodeContainerAlreadyExists:
-				sugar.Debugf("Received 409. Container already exists")
-				(*err) = nil
-			default:
-				sugar.Debugf("Handle Errors: %s", (*err).Error())
+	location := m.Artifact
+	if m.Status == statusAvailable {
+		for i, artifact := range m.artifacts() {
+			object, err := backupStorage.Stat(artifact)
+			if err == errObjectNotFound {
+				sugar.Warnf("Backup file %s of apiID %s is missing", artifact, apiID)
+				m.Status = statusError
+				m.Message = "backup file " + artifact + " is missing"
+				break
+			} else if err != nil {
+				return nil, err
+			} else if i == 0 {
+				location = object.Location
 			}
 		}
 	}
+
+	res := manifestResponse(*m, location)
+	return &res, nil
 }
 
-func connectToAzureContainer(accountName string, accountKey string, containerName string) (azblob.ContainerURL, context.Context, error) {
+//DeleteBackup removes current backup from underlaying backup storage. A running backup is cancelled first. Physical
+//backups with incremental backups taken against them can't be deleted while incremental backups are enabled
+func (sb PostgresBackuper) DeleteBackup(apiID string) error {
 	logger, _ := zap.NewDevelopment()
 	defer logger.Sync() // flushes buffer, if any
 	sugar := logger.Sugar()
-	var err error
 
-	// Create a default request pipeline using your storage account name and account key.
-	sugar.Debugf("Connecting with Azure -> AccountName: %s", accountName)
+	sugar.Debugf("DeleteBackup apiID=%s", apiID)
 
-	if !isCredentialCreated {
-		credential, err = azblob.NewSharedKeyCredential(accountName, accountKey)
+	//a running backup has no incremental backups yet, as they are only taken against available ones
+	if backupJobs.cancel(apiID) {
+		sugar.Debugf("Running backup %s cancelled", apiID)
+	}
+	m, err := readManifest(apiID)
+	if err == nil && m.isPhysical() && *incrementalBackup {
+		//no incremental backup can pick this one as its parent until it is deleted
+		incrementalLock.Lock()
+		defer incrementalLock.Unlock()
+		children, err := incrementalChildren(apiID)
 		if err != nil {
-			sugar.Debugf("Invalid credentials with error: %s", err.Error())
-			return azblob.ContainerURL{}, nil, fmt.Errorf("Invalid credentials with error: %s", err.Error())
+			return err
+		}
+		if len(children) > 0 {
+			return fmt.Errorf("Backup %s can't be deleted while its incremental backups %s exist", apiID, strings.Join(children, ", "))
 		}
-		isCredentialCreated = true
 	}
-	p := azblob.NewPipeline(credential, azblob.PipelineOptions{})
-
-	// From the Azure portal, get your storage account blob service URL endpoint.
-	URL, _ := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net/%s", accountName, containerName))
-
-	// Create a ContainerURL object that wraps the container URL and a request
-	// pipeline to make requests.
-	containerURL := azblob.NewContainerURL(*URL, p)
-	ctx := context.Background()
-
-	return containerURL, ctx, nil
-}
-
-func sendFileToAzure(accountName string, accountKey string, containerName string, fileName string, filePath string) error {
-	logger, _ := zap.NewDevelopment()
-	defer logger.Sync() // flushes buffer, if any
-	sugar := logger.Sugar()
-
-	containerURL, ctx, err := connectToAzureContainer(accountName, accountKey, containerName)
-	if err != nil {
-		sugar.Debugf("Connect to Azure with error: %s", err.Error())
-		return fmt.Errorf("Connect to Azure with error: %s", err.Error())
+	if verifyJobs.cancel(apiID) {
+		sugar.Debugf("Running verification of backup %s cancelled", apiID)
 	}
-
-	_, err = containerURL.Create(ctx, azblob.Metadata{}, azblob.PublicAccessNone)
-	handleErrors(&err)
-	if err != nil {
-		sugar.Debugf("Create Container with error: %s", err.Error())
-		return fmt.Errorf("Create Container with error: %s", err.Error())
+	if checkJobs.cancel(apiID) {
+		sugar.Debugf("Running integrity check of backup %s cancelled", apiID)
 	}
 
-	// Here's how to upload a blob.
-	blobURL := containerURL.NewBlockBlobURL(fileName)
-	file, err := os.Open(filePath)
-	handleErrors(&err)
-	if err != nil {
-		sugar.Debugf("Open file with error: %s", err.Error())
-		return fmt.Errorf("Open file with error: %s", err.Error())
-	}
-
-	// You can use the low-level PutBlob API to upload files. Low-level APIs are simple wrappers for the Azure Storage REST APIs.
-	// Note that PutBlob can upload up to 256MB data in one shot. Details: https://docs.microsoft.com/en-us/rest/api/storageservices/put-blob
-	// Following is commented out intentionally because we will instead use UploadFileToBlockBlob API to upload the blob
-	// _, err = blobURL.PutBlob(ctx, file, azblob.BlobHTTPHeaders{}, azblob.Metadata{}, azblob.BlobAccessConditions{})
-	// handleErrors(err)
-
-	// The high-level API UploadFileToBlockBlob function uploads blocks in parallel for optimal performance, and can handle large files as well.
-	// This function calls PutBlock/PutBlockList for files larger 256 MBs, and calls PutBlob for any file smaller
-	sugar.Debugf("Uploading the file with blob name: %s\n", fileName)
-	_, err = azblob.UploadFileToBlockBlob(ctx, file, blobURL, azblob.UploadToBlockBlobOptions{
-		BlockSize:   4 * 1024 * 1024,
-		Parallelism: 16})
-	handleErrors(&err)
-	if err != nil {
-		sugar.Debugf("Upload file with error: %s", err.Error())
-		return fmt.Errorf("Upload file with error: %s", err.Error())
+	if err == errObjectNotFound && deleteLabeledObjects(apiID) {
+		backupJobs.remove(apiID)
+		sugar.Debugf("Delete orphan objects of apiID %s successful", apiID)
+		return nil
 	}
-
-	return nil
-}
-
-func deleteFileFromAzure(accountName string, accountKey string, containerName string, fileName string) error {
-	logger, _ := zap.NewDevelopment()
-	defer logger.Sync() // flushes buffer, if any
-	sugar := logger.Sugar()
-
-	containerURL, ctx, err := connectToAzureContainer(accountName, accountKey, containerName)
 	if err != nil {
-		sugar.Debugf("Connect to Azure with error: %s", err.Error())
-		return fmt.Errorf("Connect to Azure with error: %s", err.Error())
+		sugar.Debugf("Backup manifest not found for apiId %s. err=%s", apiID, err)
+		return err
 	}
 
-	blobURL := containerURL.NewBlockBlobURL(fileName)
-	_, err = blobURL.Delete(ctx, azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
-
+	sugar.Debugf("Backup apiID=%s pgDumpID=%s found. Proceeding to deletion", apiID, m.PgDumpID)
+	for _, artifact := range m.artifacts() {
+		err = backupStorage.Delete(artifact)
+		if err != nil && err != errObjectNotFound {
+			sugar.Debugf("Deleting backup file %s with error: %s", artifact, err.Error())
+			return err
+		}
+	}
+	if m.BasebackupManifest != "" {
+		err = backupStorage.Delete(m.BasebackupManifest)
+		if err != nil && err != errObjectNotFound {
+			sugar.Debugf("Deleting backup_manifest %s with error: %s", m.BasebackupManifest, err.Error())
+			return err
+		}
+	}
+	if m.Encryption != nil && m.Encryption.WrappedKey != "" {
+		err = backupStorage.Delete(m.Encryption.WrappedKey)
+		if err != nil && err != errObjectNotFound {
+			sugar.Debugf("Deleting backup data key %s with error: %s", m.Encryption.WrappedKey, err.Error())
+			return err
+		}
+	}
+	err = backupStorage.Delete(manifestName(apiID))
 	if err != nil {
-		sugar.Debugf("Delete file %s at container %s with error: %s", fileName, containerName, err.Error())
-		return fmt.Errorf("Delete file %s at container %s with error: %s", fileName, containerName, err.Error())
+		return err
+	}
+	backupJobs.remove(apiID)
+	sugar.Debugf("Delete apiID %s pgDumpID %s successful", apiID, m.PgDumpID)
+	if walStorage != nil && m.isPhysical() {
+		_, err = pruneWAL()
+		if err != nil {
+			sugar.Warnf("Couldn't prune archived WAL. err=%s", err)
+		}
 	}
-
 	return nil
 }
 
-func listFilesFromAzure(accountName string, accountKey string, containerName string) ([]schellyhook.SchellyResponse, error) {
+//deleteLabeledObjects deletes the objects labeled with apiID on backends that find objects by labels, such as the
+//artifact of a backup whose manifest was lost. It tells whether any object was deleted
+func deleteLabeledObjects(apiID string) bool {
 	logger, _ := zap.NewDevelopment()
 	defer logger.Sync() // flushes buffer, if any
 	sugar := logger.Sugar()
 
-	containerURL, ctx, err := connectToAzureContainer(accountName, accountKey, containerName)
+	ls, ok := unwrapStorage(backupStorage).(labelStorage)
+	if !ok {
+		return false
+	}
+	objects, err := ls.FindByLabels(map[string]string{"api_id": apiID})
 	if err != nil {
-		sugar.Debugf("Connect to Azure with error: %s", err.Error())
-		return nil, fmt.Errorf("Connect to Azure with error: %s", err.Error())
+		if err != errLabelsNotIndexed {
+			sugar.Warnf("Couldn't find objects labeled with apiID %s. err=%s", apiID, err)
+		}
+		return false
 	}
-
-	backups := make([]schellyhook.SchellyResponse, 0)
-	for marker := (azblob.Marker{}); marker.NotDone(); {
-		// Get a result segment starting with the blob indicated by the current Marker.
-		listBlob, err := containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{})
-		handleErrors(&err)
-
-		// ListBlobs returns the start of the next segment; you MUST use this to get
-		// the next segment (after processing the current result segment).
-		marker = listBlob.NextMarker
-
-		// Process the blobs returned in this result segment (if the segment is empty, the loop body won't execute)
-		for _, blobInfo := range listBlob.Segment.BlobItems {
-			sugar.Debugf("	Blob name: %s", blobInfo.Name)
-			id := strings.Split(blobInfo.Name, dataStringSeparator)[1]
-			dataID := strings.Split(blobInfo.Name, dataStringSeparator)[2]
-			sizeMB := blobInfo.Properties.ContentLength
-
-			blobURL := containerURL.NewBlockBlobURL(blobInfo.Name)
-			backupFilePath := blobURL.String()
-			// sugar.Debugf("Found and opened backup file: %s", backupFilePath)
-			var status string
-			if blobInfo.Deleted {
-				status = "deleted"
-			} else {
-				status = "available"
-			}
-
-			sr := schellyhook.SchellyResponse{
-				ID:      id,
-				DataID:  dataID,
-				Status:  status,
-				Message: backupFilePath,
-				SizeMB:  float64(*sizeMB),
-			}
-			backups = append(backups, sr)
+	deleted := false
+	for _, object := range objects {
+		sugar.Debugf("Deleting orphan object %s of apiID %s", object.Name, apiID)
+		err = backupStorage.Delete(object.Name)
+		if err != nil && err != errObjectNotFound {
+			sugar.Warnf("Deleting orphan object %s with error: %s", object.Name, err)
+			continue
 		}
-
+		deleted = true
 	}
-
-	return backups, nil
+	return deleted
 }
 
-func getDataIDFromAzure(accountName string, accountKey string, containerName string, apiID string) (string, error) {
-	logger, _ := zap.NewDevelopment()
-	defer logger.Sync() // flushes buffer, if any
-	sugar := logger.Sugar()
-
-	containerURL, ctx, err := connectToAzureContainer(accountName, accountKey, containerName)
-	if err != nil {
-		sugar.Debugf("Connect to Azure with error: %s", err.Error())
-		return "", fmt.Errorf("Connect to Azure with error: %s", err.Error())
-	}
-
-	for marker := (azblob.Marker{}); marker.NotDone(); {
-		// Get a result segment starting with the blob indicated by the current Marker.
-		listBlob, err := containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{})
-		handleErrors(&err)
-
-		// ListBlobs returns the start of the next segment; you MUST use this to get
-		// the next segment (after processing the current result segment).
-		marker = listBlob.NextMarker
-
-		// Process the blobs returned in this result segment (if the segment is empty, the loop body won't execute)
-		for _, blobInfo := range listBlob.Segment.BlobItems {
-			fmt.Print("	Blob name: " + blobInfo.Name + "\n")
-			if strings.Contains(blobInfo.Name, apiID) && strings.Contains(blobInfo.Name, dataStringSeparator) {
-				pgDumpID := strings.Split(blobInfo.Name, dataStringSeparator)[2]
-				sugar.Debugf("apiID %s <-> pgDumpID %s", apiID, pgDumpID)
-				return pgDumpID, nil
+//manifestResponse converts a manifest to a Schelly response. A manifest left running by a previous provider instance is reported as an error
+func manifestResponse(m backupManifest, location string) schellyhook.SchellyResponse {
+	res := schellyhook.SchellyResponse{
+		ID:     m.APIID,
+		DataID: m.PgDumpID,
+		Status: m.Status,
+		SizeMB: -1,
+	}
+	switch m.Status {
+	case statusRunning:
+		j, ok := backupJobs.get(m.APIID)
+		if ok && j.Status == statusRunning {
+			res.Message = j.describe("backup is running")
+		} else {
+			res.Status = statusError
+			res.Message = describeTiming("backup was interrupted", m.StartTime, m.EndTime)
+		}
+	case statusAvailable:
+		res.Message = describeTiming(location, m.StartTime, m.EndTime)
+		res.SizeMB = float64(m.totalSize())
+		if m.isCluster() {
+			res.Message += fmt.Sprintf(" cluster backup of %d databases: %s", len(m.Databases), strings.Join(m.databaseNames(), ", "))
+		} else if m.isIncremental() {
+			res.Message += " incremental physical backup of " + m.Parent
+		} else if m.isPhysical() {
+			res.Message += " physical backup"
+		}
+		if m.Filters != nil {
+			res.Message += " partial backup: " + strings.Join(m.Filters.flags(), " ")
+		}
+		if m.Verification != nil {
+			res.Message += " " + verificationMessage(m.APIID, *m.Verification)
+			if m.Verification.Status == verificationFailed {
+				res.Status = statusError
 			}
 		}
+		if j, ok := checkJobs.get(m.APIID); ok && j.Status == statusRunning {
+			res.Message += " " + j.describe("integrity check is running")
+		}
+		if m.Tier != "" {
+			res.Message += " tier: " + m.Tier
+		}
+	case statusCorrupt:
+		res.Message = describeTiming("backup is corrupt: "+m.Integrity.Message, m.StartTime, m.EndTime)
+	default:
+		res.Message = describeTiming("backup failed: "+m.Message, m.StartTime, m.EndTime)
 	}
-
-	return "", fmt.Errorf("pgDumpID for %s not found", apiID)
+	return res
 }
 
-func findFileFromAzure(accountName string, accountKey string, containerName string, fileName string) (*schellyhook.SchellyResponse, error) {
-	logger, _ := zap.NewDevelopment()
-	defer logger.Sync() // flushes buffer, if any
-	sugar := logger.Sugar()
-
-	containerURL, ctx, err := connectToAzureContainer(accountName, accountKey, containerName)
-	if err != nil {
-		sugar.Debugf("Connect to Azure with error: %s", err.Error())
-		return &schellyhook.SchellyResponse{}, fmt.Errorf("Connect to Azure with error: %s", err.Error())
-	}
+func resolveFileName(apiID string, pgDumpID string) string {
+	return *fileName + dataStringSeparator + apiID + dataStringSeparator + pgDumpID
+}
 
-	blobURL := containerURL.NewBlockBlobURL(fileName)
-	blobInfo, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{})
+func resolveStagingFilePath(apiID string, pgDumpID string) string {
+	return filepath.Join(*backupsDir, ".staging", resolveFileName(apiID, pgDumpID))
+}
 
-	if err != nil {
-		sugar.Debugf("Error at get properties of: %s", fileName)
-		return &schellyhook.SchellyResponse{}, err
+func mkDirs(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return os.MkdirAll(path, os.ModePerm)
 	}
-
-	id := strings.Split(fileName, dataStringSeparator)[1]
-	dataID := strings.Split(fileName, dataStringSeparator)[2]
-	sizeMB := blobInfo.ContentLength()
-	backupFilePath := blobURL.String()
-
-	sugar.Debugf("Found and opened backup file: %s", backupFilePath)
-	status := "available"
-
-	return &schellyhook.SchellyResponse{
-		ID:      id,
-		DataID:  dataID,
-		Status:  status,
-		Message: backupFilePath,
-		SizeMB:  float64(sizeMB),
-	}, nil
+	return nil
 }
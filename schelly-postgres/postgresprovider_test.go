@@ -50,7 +50,7 @@ func TestCreateFileName(t *testing.T) {
 	dataStringSeparator = "---"
 	sugar.Infof("Starting TestSendFileToAzure...")
 	pgDumpID := time.Now().Format("20060102150405")
-	result := resolveFilePathAzure("12345", pgDumpID)
+	result := resolveFileName("12345", pgDumpID)
 	sugar.Debugf("Filename: %s", result)
 }
 
@@ -107,13 +107,14 @@ func TestGetFileInfoFromAzure(t *testing.T) {
 	fileName = &file
 	dataStringSeparator = "---"
 
-	resp, err := getDataIDFromAzure(accountNameTest, accountKeyTest, containerNameTest, "12345")
+	backupStorage, _ = newAzureStorage(accountNameTest, accountKeyTest, containerNameTest)
+	resp, err := readManifest("12345")
 	if err != nil {
 		sugar.Infof("Test list files from azure with error!")
 		sugar.Infof("%s", err.Error())
 		panic(err)
 	}
-	respInfo, err := findFileFromAzure(accountNameTest, accountKeyTest, containerNameTest, resolveFilePathAzure("12345", resp))
+	respInfo, err := findFileFromAzure(accountNameTest, accountKeyTest, containerNameTest, resp.Artifact)
 	if err != nil {
 		sugar.Infof("Test list files from azure with error!")
 		sugar.Infof("%s", err.Error())
@@ -0,0 +1,685 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/flaviostutz/schelly-webhook/schellyhook"
+	"go.uber.org/zap"
+)
+
+//recoveryLogName is the log of the recovered server, inside its data directory
+const recoveryLogName = "schelly-recovery.log"
+
+var recoveryJobs = newJobRegistry()
+
+//recoveryPollInterval is how often the log of the recovered server is read
+var recoveryPollInterval = time.Second
+
+//recoveryLSN matches WAL locations, such as 0/2000028
+var recoveryLSN = regexp.MustCompile(`^[0-9A-Fa-f]{1,8}/[0-9A-Fa-f]{1,8}$`)
+
+//recoveryLogLine matches the messages of the server log, leaving out the prefix set by log_line_prefix
+var recoveryLogLine = regexp.MustCompile(`(LOG|FATAL|PANIC):\s+(.*)$`)
+
+//recoveryRequest is the body of POST /recoveries
+type recoveryRequest struct {
+	TargetTime   string `json:"target_time"`   //RFC 3339 timestamp
+	TargetLSN    string `json:"target_lsn"`    //WAL location, such as 0/2000028
+	TargetName   string `json:"target_name"`   //restore point created with pg_create_restore_point()
+	TargetAction string `json:"target_action"` //pause (the default), promote or shutdown
+	BackupID     string `json:"backup_id"`     //physical backup to start from, instead of the latest one before the target
+	DataDir      string `json:"data_dir"`      //where the cluster is recovered, relative to --recovery-dir. It must not exist or be empty
+	PrepareOnly  bool   `json:"prepare_only"`  //lay out the data directory without starting the server
+}
+
+//recoveryTarget is where a point-in-time recovery stops. Without time, LSN or name, all archived WAL is replayed
+type recoveryTarget struct {
+	Time   time.Time
+	LSN    string
+	Name   string
+	Action string
+}
+
+//recoveryInfo describes a recovery on its status
+type recoveryInfo struct {
+	Target  string
+	DataDir string
+	Step    string //last recovery step found on the server log
+}
+
+//recoveries keeps the details of the recovery jobs, by job id
+var recoveries = struct {
+	sync.Mutex
+	info map[string]recoveryInfo
+}{info: make(map[string]recoveryInfo)}
+
+func setRecoveryStep(id string, step string) {
+	recoveries.Lock()
+	defer recoveries.Unlock()
+	info := recoveries.info[id]
+	info.Step = step
+	recoveries.info[id] = info
+}
+
+func getRecoveryInfo(id string) recoveryInfo {
+	recoveries.Lock()
+	defer recoveries.Unlock()
+	return recoveries.info[id]
+}
+
+//parseRecoveryTarget checks that at most one of target time, LSN and name are set
+func parseRecoveryTarget(req recoveryRequest) (recoveryTarget, error) {
+	target := recoveryTarget{LSN: strings.ToUpper(req.TargetLSN), Name: req.TargetName, Action: req.TargetAction}
+	targets := 0
+	for _, t := range []string{req.TargetTime, req.TargetLSN, req.TargetName} {
+		if t != "" {
+			targets++
+		}
+	}
+	if targets > 1 {
+		return target, fmt.Errorf("Only one of target_time, target_lsn and target_name can be set")
+	}
+	if req.TargetTime != "" {
+		var err error
+		target.Time, err = time.Parse(time.RFC3339Nano, req.TargetTime)
+		if err != nil {
+			return target, fmt.Errorf("Invalid target_time %s. It must be a RFC 3339 timestamp, such as 2019-06-14T09:28:18Z", req.TargetTime)
+		}
+	}
+	if req.TargetLSN != "" && !recoveryLSN.MatchString(req.TargetLSN) {
+		return target, fmt.Errorf("Invalid target_lsn %s. It must be a WAL location, such as 0/2000028", req.TargetLSN)
+	}
+	if target.Action == "" {
+		target.Action = "pause"
+	}
+	if target.Action != "pause" && target.Action != "promote" && target.Action != "shutdown" {
+		return target, fmt.Errorf("target_action must be pause, promote or shutdown")
+	}
+	return target, nil
+}
+
+func (t recoveryTarget) isSet() bool {
+	return !t.Time.IsZero() || t.LSN != "" || t.Name != ""
+}
+
+func (t recoveryTarget) String() string {
+	switch {
+	case !t.Time.IsZero():
+		return "time " + t.Time.Format(time.RFC3339Nano)
+	case t.LSN != "":
+		return "lsn " + t.LSN
+	case t.Name != "":
+		return "restore point " + t.Name
+	}
+	return "end of archived WAL"
+}
+
+//settings returns the recovery parameters of PostgreSQL that fetch WAL with restoreCommand and stop at the target
+func (t recoveryTarget) settings(restoreCommand string) []string {
+	settings := []string{"restore_command = " + quoteSetting(restoreCommand)}
+	switch {
+	case !t.Time.IsZero():
+		settings = append(settings, "recovery_target_time = "+quoteSetting(t.Time.UTC().Format("2006-01-02 15:04:05.999999-07")))
+	case t.LSN != "":
+		settings = append(settings, "recovery_target_lsn = "+quoteSetting(t.LSN))
+	case t.Name != "":
+		settings = append(settings, "recovery_target_name = "+quoteSetting(t.Name))
+	}
+	if t.isSet() {
+		settings = append(settings, "recovery_target_action = "+quoteSetting(t.Action))
+	}
+	return settings
+}
+
+//quoteSetting quotes a string value of a PostgreSQL configuration file
+func quoteSetting(value string) string {
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+//parseLSN returns a WAL location as a number, so that locations can be compared
+func parseLSN(lsn string) (uint64, error) {
+	parts := strings.Split(lsn, "/")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("Invalid WAL location %s", lsn)
+	}
+	hi, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid WAL location %s", lsn)
+	}
+	lo, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid WAL location %s", lsn)
+	}
+	return hi<<32 | lo, nil
+}
+
+//backupPrecedes tells whether the physical backup m was consistent before the target, so that recovery can reach it
+func backupPrecedes(m backupManifest, target recoveryTarget) bool {
+	switch {
+	case !target.Time.IsZero():
+		stopTime := m.WAL.StopTime
+		if stopTime.IsZero() {
+			stopTime = m.EndTime
+		}
+		return !stopTime.After(target.Time)
+	case target.LSN != "":
+		stop, err := parseLSN(m.WAL.StopLSN)
+		if err != nil {
+			return false
+		}
+		lsn, _ := parseLSN(target.LSN)
+		return stop <= lsn
+	}
+	//the WAL location of restore points isn't known, so the latest backup is used
+	return true
+}
+
+//pickBaseBackup returns backupID or, when empty, the latest physical backup with archived WAL that was consistent
+//before the target
+func pickBaseBackup(backupID string, target recoveryTarget) (*backupManifest, error) {
+	if backupID != "" {
+		m, err := readManifest(backupID)
+		if err == errObjectNotFound {
+			return nil, fmt.Errorf("Backup %s not found", backupID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !m.isPhysical() || m.Status != statusAvailable {
+			return nil, fmt.Errorf("Backup %s isn't an available physical backup", backupID)
+		}
+		return m, nil
+	}
+
+	wals, err := listWAL()
+	if err != nil {
+		return nil, err
+	}
+	paired, _, err := pairArchivedWAL(wals)
+	if err != nil {
+		return nil, err
+	}
+	//backups are ordered by their WAL, as the clocks of the provider and the server may differ
+	var latest *backupManifest
+	for i, m := range paired {
+		if backupPrecedes(m, target) && (latest == nil || m.WAL.startsAfter(*latest.WAL)) {
+			latest = &paired[i]
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("No physical backup with archived WAL was taken before the target %s", target)
+	}
+	return latest, nil
+}
+
+//RecoverToTarget recovers the cluster to a point in time in background: the base backup is laid out on req.DataDir,
+//under --recovery-dir, configured to fetch the archived WAL from the provider and stop at the target, and started with pg_ctl. Incremental
+//backups are combined with their parents first. The recovery progress, read from the server log, is reported by
+//GetRecovery. A base backup whose file is archived isn't recovered: its file, along with any archived file of its
+//parents, is rehydrated instead, and the response has the rehydrating status
+func (sb PostgresBackuper) RecoverToTarget(req recoveryRequest) (*schellyhook.SchellyResponse, error) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	if walStorage == nil {
+		return nil, fmt.Errorf("Point-in-time recovery requires `--wal-archiving`")
+	}
+	target, err := parseRecoveryTarget(req)
+	if err != nil {
+		return nil, err
+	}
+	req.DataDir, err = recoveryDataDir(req.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	err = checkEmptyDir(req.DataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := pickBaseBackup(req.BackupID, target)
+	if err != nil {
+		return nil, err
+	}
+	sugar.Infof("RecoverToTarget() backup=%s target=%s dataDir=%s", m.APIID, target, req.DataDir)
+	chain, err := backupChain(*m)
+	if err != nil {
+		return nil, err
+	}
+	//every backup of the chain is rehydrated at once, and the first one still rehydrating is reported
+	var rehydrating *backupManifest
+	size := int64(0)
+	for i := range chain {
+		archived, err := rehydrateIfArchived(&chain[i])
+		if err != nil {
+			return nil, fmt.Errorf("Error checking the tier of backup %s: %s", chain[i].APIID, err)
+		}
+		if archived && rehydrating == nil {
+			rehydrating = &chain[i]
+		}
+		size += chain[i].Size
+	}
+	if rehydrating != nil {
+		res := rehydratingResponse(*rehydrating)
+		return &res, nil
+	}
+
+	id, err := newRecoveryID()
+	if err != nil {
+		return nil, err
+	}
+	j, ctx, err := recoveryJobs.start(id, m.APIID)
+	if err != nil {
+		sugar.Errorf("Couldn't start recovery of %s. err=%s", m.APIID, err)
+		return nil, err
+	}
+	recoveryJobs.setSize(j, size)
+	recoveries.Lock()
+	recoveries.info[id] = recoveryInfo{Target: target.String(), DataDir: req.DataDir, Step: "laying out the base backup"}
+	recoveries.Unlock()
+	go runRecoveryJob(ctx, j, chain, req, target)
+
+	res := recoveryResponse(*j)
+	return &res, nil
+}
+
+//newRecoveryID returns the start time of a recovery followed by a random suffix, so that recoveries started on the
+//same second don't share their ID, job and staging directory
+func newRecoveryID() (string, error) {
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return "", err
+	}
+	return time.Now().Format("20060102150405") + "-" + hex.EncodeToString(suffix), nil
+}
+
+//GetRecovery returns the status of a recovery started since the provider was launched
+func (sb PostgresBackuper) GetRecovery(id string) (*schellyhook.SchellyResponse, error) {
+	j, ok := recoveryJobs.get(id)
+	if !ok {
+		return nil, nil
+	}
+	res := recoveryResponse(j)
+	return &res, nil
+}
+
+func recoveryResponse(j job) schellyhook.SchellyResponse {
+	info := getRecoveryInfo(j.ID)
+	res := schellyhook.SchellyResponse{
+		ID:     j.ID,
+		DataID: j.DataID,
+		Status: j.Status,
+		SizeMB: float64(j.Size),
+	}
+	switch j.Status {
+	case statusRunning:
+		res.Message = j.describe(fmt.Sprintf("recovering backup %s to %s in %s: %s", j.DataID, info.Target, info.DataDir, info.Step))
+	case statusAvailable:
+		res.Message = j.describe(fmt.Sprintf("backup %s recovered to %s in %s: %s", j.DataID, info.Target, info.DataDir, info.Step))
+	default:
+		res.Message = j.describe("recovery failed: " + j.Err.Error())
+	}
+	return res
+}
+
+//runRecoveryJob lays out the base backup, writes the recovery configuration and follows the recovery until the target
+//is reached
+func runRecoveryJob(ctx context.Context, j *job, chain []backupManifest, req recoveryRequest, target recoveryTarget) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	err := layoutBaseBackup(ctx, j, chain, req.DataDir)
+	if err == nil {
+		err = writeRecoveryConfig(req.DataDir, j.DataID, target, recoveryCommand(), *recoveryPort)
+	}
+	if err == nil && req.PrepareOnly {
+		setRecoveryStep(j.ID, "data directory is ready. Start PostgreSQL on it to recover")
+	} else if err == nil {
+		err = startRecoveryServer(ctx, req.DataDir)
+		if err == nil {
+			err = watchRecovery(ctx, j.ID, req.DataDir, target)
+		}
+	}
+	if ctx.Err() != nil {
+		err = fmt.Errorf("Recovery of %s cancelled", j.DataID)
+	}
+
+	if err != nil {
+		sugar.Warnf("Recovery of %s into %s failed. err=%s", j.DataID, req.DataDir, err)
+	} else {
+		sugar.Infof("Recovery of %s into %s finished", j.DataID, req.DataDir)
+	}
+	recoveryJobs.finish(j, err)
+}
+
+//recoveryDataDir returns where the cluster is recovered: dataDir, relative to --recovery-dir. Anything that would lay
+//it out elsewhere is refused, as data_dir comes from the body of POST /recoveries
+func recoveryDataDir(dataDir string) (string, error) {
+	if *recoveryDir == "" {
+		return "", fmt.Errorf("Point-in-time recovery requires `--recovery-dir`")
+	}
+	if dataDir == "" || filepath.IsAbs(dataDir) {
+		return "", fmt.Errorf("data_dir must be a path relative to `--recovery-dir`")
+	}
+	for _, element := range strings.Split(filepath.ToSlash(dataDir), "/") {
+		if element == ".." {
+			return "", fmt.Errorf("data_dir can't have `..`")
+		}
+	}
+	if filepath.Clean(dataDir) == "." {
+		return "", fmt.Errorf("data_dir must be a directory under `--recovery-dir`")
+	}
+	return filepath.Join(*recoveryDir, dataDir), nil
+}
+
+//recoveryCommand returns the restore_command of recovered servers: --recovery-restore-command or, by default, curl on
+//the provider API
+func recoveryCommand() string {
+	if *recoveryRestoreCommand != "" {
+		return *recoveryRestoreCommand
+	}
+	return fmt.Sprintf("curl -sf -o %%p http://localhost:%d/wal/%%f", *apiListenPort)
+}
+
+//checkEmptyDir fails unless dir doesn't exist or is an empty directory
+func checkEmptyDir(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		return fmt.Errorf("Data directory %s isn't empty", dir)
+	}
+	return nil
+}
+
+//tablespaceDir returns where a tablespace of the recovered cluster is laid out, next to its data directory
+func tablespaceDir(dataDir string, oid string) string {
+	return filepath.Join(dataDir+"_tablespaces", oid)
+}
+
+//layoutBaseBackup lays out the last backup of chain on dataDir, with its tablespaces next to it. Incremental backups
+//are combined with their parents by pg_combinebackup
+func layoutBaseBackup(ctx context.Context, j *job, chain []backupManifest, dataDir string) error {
+	if len(chain) > 1 {
+		return combineBackupChain(ctx, j, chain, dataDir)
+	}
+	err := extractBaseBackup(j, chain[0], dataDir)
+	if err != nil {
+		return err
+	}
+	return relocateTablespaces(dataDir)
+}
+
+//extractBaseBackup extracts the tar files of a physical backup: base.tar into dataDir, pg_wal.tar into its pg_wal
+//directory and each tablespace next to it. The backup file is streamed, without staging it
+func extractBaseBackup(j *job, m backupManifest, dataDir string) error {
+	err := os.MkdirAll(dataDir, 0700)
+	if err == nil {
+		//PostgreSQL refuses data directories that others can read
+		err = os.Chmod(dataDir, 0700)
+	}
+	if err != nil {
+		return err
+	}
+	reader, err := openArtifact(m, j)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	decompressed, err := decompressStream(reader, m.Compression)
+	if err != nil {
+		return err
+	}
+	defer decompressed.Close()
+
+	bundle := tar.NewReader(decompressed)
+	for {
+		header, err := bundle.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading backup file %s: %s", m.Artifact, err)
+		}
+		setRecoveryStep(j.ID, "extracting "+header.Name)
+		switch {
+		case header.Name == "base.tar":
+			err = untarDirectory(bundle, dataDir)
+		case header.Name == "pg_wal.tar":
+			err = untarDirectory(bundle, filepath.Join(dataDir, "pg_wal"))
+		case header.Name == "backup_manifest":
+			//pg_combinebackup reads the backup_manifest of each backup it combines
+			err = extractFile(bundle, filepath.Join(dataDir, header.Name))
+		case strings.HasSuffix(header.Name, ".tar"):
+			err = untarDirectory(bundle, tablespaceDir(dataDir, strings.TrimSuffix(header.Name, ".tar")))
+		}
+		if err != nil {
+			return fmt.Errorf("Error extracting %s: %s", header.Name, err)
+		}
+	}
+	return nil
+}
+
+//relocateTablespaces points the tablespace_map of the backup, which has the tablespace locations of the source server,
+//to the tablespaces laid out next to dataDir
+func relocateTablespaces(dataDir string) error {
+	mapPath := filepath.Join(dataDir, "tablespace_map")
+	data, err := ioutil.ReadFile(mapPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lines := make([]string, 0)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) == 2 {
+			line = fields[0] + " " + tablespaceDir(dataDir, fields[0])
+		}
+		lines = append(lines, line)
+	}
+	return ioutil.WriteFile(mapPath, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
+
+//writeRecoveryConfig configures the laid out base backup to recover up to target. PostgreSQL 12+ reads the recovery
+//parameters from postgresql.auto.conf when recovery.signal exists, older versions from recovery.conf. Archiving is
+//disabled, so that the recovered server never sends WAL to the archive of the source server
+func writeRecoveryConfig(dataDir string, apiID string, target recoveryTarget, restoreCommand string, port int) error {
+	version, err := ioutil.ReadFile(filepath.Join(dataDir, "PG_VERSION"))
+	if err != nil {
+		return fmt.Errorf("Base backup has no PG_VERSION: %s", err)
+	}
+	major, _ := strconv.Atoi(strings.TrimSpace(string(version)))
+
+	settings := []string{"# point-in-time recovery of backup " + apiID + " to " + target.String() + " by schelly-postgres", "archive_mode = 'off'"}
+	if port > 0 {
+		settings = append(settings, "port = "+strconv.Itoa(port))
+	}
+	if major >= 12 {
+		settings = append(settings, target.settings(restoreCommand)...)
+		err = ioutil.WriteFile(filepath.Join(dataDir, "recovery.signal"), nil, 0600)
+	} else {
+		err = ioutil.WriteFile(filepath.Join(dataDir, "recovery.conf"), []byte(strings.Join(target.settings(restoreCommand), "\n")+"\n"), 0600)
+	}
+	if err != nil {
+		return err
+	}
+	autoConf, err := os.OpenFile(filepath.Join(dataDir, "postgresql.auto.conf"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = autoConf.WriteString("\n" + strings.Join(settings, "\n") + "\n")
+	autoConf.Close()
+	if err != nil {
+		return err
+	}
+
+	//servers whose configuration files are kept outside the data directory need these to start
+	defaults := map[string]string{
+		"postgresql.conf": "",
+		"pg_hba.conf":     "local all all peer\n",
+	}
+	for name, contents := range defaults {
+		path := filepath.Join(dataDir, name)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			err = ioutil.WriteFile(path, []byte(contents), 0600)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//startRecoveryServer starts PostgreSQL on dataDir with pg_ctl, without waiting for the recovery. PostgreSQL can't run
+//as root, so when the provider does, the server is run as --recovery-user
+func startRecoveryServer(ctx context.Context, dataDir string) error {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	cmd := exec.CommandContext(ctx, "pg_ctl", "start", "--pgdata="+dataDir, "--log="+filepath.Join(dataDir, recoveryLogName), "--no-wait")
+	if os.Geteuid() == 0 {
+		credential, err := recoveryCredential(dataDir)
+		if err != nil {
+			return err
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+	}
+	sugar.Debugf("Executing pg_ctl command: %s", strings.Join(cmd.Args, " "))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to run command: '%s'; err=%s; out=%s", strings.Join(cmd.Args, " "), err, out)
+	}
+	return nil
+}
+
+//recoveryCredential gives the data directory and tablespaces of the recovered server to --recovery-user and returns
+//the credential the server is run with
+func recoveryCredential(dataDir string) (*syscall.Credential, error) {
+	u, err := user.Lookup(*recoveryUser)
+	if err != nil {
+		return nil, fmt.Errorf("Recovered servers can't run as root and `--recovery-user` %s isn't usable: %s", *recoveryUser, err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	for _, dir := range []string{dataDir, dataDir + "_tablespaces"} {
+		err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			return os.Lchown(path, uid, gid)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
+
+//serverRunning tells whether the postmaster of dataDir is alive
+func serverRunning(dataDir string) bool {
+	data, err := ioutil.ReadFile(filepath.Join(dataDir, "postmaster.pid"))
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.SplitN(string(data), "\n", 2)[0])
+	if err != nil {
+		return false
+	}
+	err = syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+//watchRecovery follows the log of the recovered server until it reaches the target, fails or stops
+func watchRecovery(ctx context.Context, id string, dataDir string, target recoveryTarget) error {
+	logPath := filepath.Join(dataDir, recoveryLogName)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(recoveryPollInterval):
+		}
+		running := serverRunning(dataDir)
+		log, _ := ioutil.ReadFile(logPath)
+		step, reached, err := recoveryProgress(string(log), target)
+		if step != "" {
+			setRecoveryStep(id, step)
+		}
+		if err != nil || reached {
+			return err
+		}
+		if !running {
+			return fmt.Errorf("PostgreSQL stopped before reaching the target. log=%s", tail(string(log), maxStderrTail))
+		}
+	}
+}
+
+//recoveryProgress reads the log of a recovered server and returns its last recovery step and whether the target was
+//reached. Before PostgreSQL 13, recovery ends without errors when it runs out of WAL before the target, so the end of
+//recovery only means the target was reached when it was the end of the archived WAL
+func recoveryProgress(log string, target recoveryTarget) (string, bool, error) {
+	step := ""
+	stopped := ""
+	for _, line := range strings.Split(log, "\n") {
+		match := recoveryLogLine.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		//FATAL messages about client connections are common while recovering, so failures are only told apart by the
+		//server stopping, except for this one
+		message := match[2]
+		switch {
+		case strings.HasPrefix(message, "recovery ended before configured recovery target was reached"):
+			return message, false, fmt.Errorf("Recovery replayed all archived WAL without reaching the target %s", target)
+		case strings.HasPrefix(message, "recovery stopping"):
+			stopped = message
+			step = message
+		case strings.HasPrefix(message, "restored log file"), strings.HasPrefix(message, "consistent recovery state reached"),
+			strings.HasPrefix(message, "redo starts at"), strings.HasPrefix(message, "redo done at"):
+			step = message
+		case strings.HasPrefix(message, "archive recovery complete"), strings.HasPrefix(message, "database system is ready to accept connections"):
+			if target.isSet() && stopped == "" {
+				return message, false, fmt.Errorf("Recovery replayed all archived WAL without reaching the target %s. The server was promoted", target)
+			}
+			return message, true, nil
+		}
+	}
+	if stopped == "" {
+		return step, false, nil
+	}
+	switch target.Action {
+	case "pause":
+		return stopped + ". Replay is paused at the target: run SELECT pg_wal_replay_resume() to promote the server", true, nil
+	case "shutdown":
+		return stopped + ". The server is shut down at the target", true, nil
+	}
+	return stopped, true, nil
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flaviostutz/schelly-webhook/schellyhook"
+	"go.uber.org/zap"
+)
+
+//fakePgCtlScript writes $RECOVERY_LOG_LINES to the --log file of the server it "starts"
+const fakePgCtlScript = `for arg in "$@"; do
+  case "$arg" in
+    --log=*) log="${arg#--log=}" ;;
+  esac
+done
+printf '%s\n' "$RECOVERY_LOG_LINES" > "$log"
+`
+
+//setupRecoveryTest takes two physical backups, paired with archived WAL: r1 finished at 09:00 (up to 0/3000100) and
+//r2 at 10:00 (up to 0/6000100)
+func setupRecoveryTest(t *testing.T, dir string) {
+	setupPhysicalTest(t, dir)
+	installFakeCommand(t, dir, "pg_ctl", fakePgCtlScript)
+	u, _ := user.Current()
+	*recoveryUser = u.Username
+	*recoveryDir = dir
+	recoveryPollInterval = 10 * time.Millisecond
+	backupStorage = newMemoryStorage()
+	walStorage = newMemoryStorage()
+
+	backuper := PostgresBackuper{}
+	for _, apiID := range []string{"r1", "r2"} {
+		backuper.CreateNewBackup(apiID, 0, &schellyhook.ShellContext{})
+		backupJobs.wait(apiID)
+	}
+	files := map[string]string{
+		"000000010000000000000003.00000028.backup": backupHistory("schelly-r1", "000000010000000000000003", "000000010000000000000003", "2019-06-14 09:00:00"),
+		"000000010000000000000005.00000028.backup": backupHistory("schelly-r2", "000000010000000000000005", "000000010000000000000006", "2019-06-14 10:00:00"),
+	}
+	for name, contents := range files {
+		_, err := archiveWAL(name, strings.NewReader(contents))
+		if err != nil {
+			t.Fatalf("Error archiving %s: %s", name, err)
+		}
+	}
+}
+
+func TestRecoveryBaseBackup(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestRecoveryBaseBackup...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	setupRecoveryTest(t, dir)
+
+	expected := map[string]recoveryRequest{
+		"r1": {TargetTime: "2019-06-14T09:30:00Z"},
+		"r2": {TargetTime: "2019-06-14T12:30:00+02:00"},
+	}
+	expected["r1 "] = recoveryRequest{TargetLSN: "0/5000000"}
+	expected["r2 "] = recoveryRequest{TargetName: "before_migration"}
+	expected["r1  "] = recoveryRequest{TargetTime: "2019-06-15T00:00:00Z", BackupID: "r1"}
+	for apiID, req := range expected {
+		target, err := parseRecoveryTarget(req)
+		if err != nil {
+			t.Fatalf("Invalid recovery target %v: %s", req, err)
+		}
+		m, err := pickBaseBackup(req.BackupID, target)
+		if err != nil || m.APIID != strings.TrimSpace(apiID) {
+			t.Errorf("Recovery to %s should start from %s. m=%v err=%s", target, apiID, m, err)
+		}
+	}
+	target, _ := parseRecoveryTarget(recoveryRequest{TargetTime: "2019-06-14T08:00:00Z"})
+	_, err := pickBaseBackup("", target)
+	if err == nil {
+		t.Errorf("Targets before the first backup can't be reached")
+	}
+
+	for _, invalid := range []recoveryRequest{
+		{TargetTime: "yesterday"},
+		{TargetLSN: "0/XYZ"},
+		{TargetTime: "2019-06-14T08:00:00Z", TargetName: "point"},
+		{TargetAction: "resume"},
+	} {
+		_, err = parseRecoveryTarget(invalid)
+		if err == nil {
+			t.Errorf("Recovery request %v should be rejected", invalid)
+		}
+	}
+}
+
+func TestRecoveryLayout(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestRecoveryLayout...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	setupRecoveryTest(t, dir)
+
+	backuper := PostgresBackuper{}
+	dataDir := filepath.Join(dir, "recovered")
+	*recoveryPort = 5433
+	resp, err := backuper.RecoverToTarget(recoveryRequest{TargetTime: "2019-06-14T09:30:00Z", DataDir: "recovered", PrepareOnly: true})
+	if err != nil || resp.DataID != "r1" || resp.Status != statusRunning {
+		t.Fatalf("Recovery should start from r1. resp=%v err=%s", resp, err)
+	}
+	//recoveries started on the same second don't share their ID
+	other, err := backuper.RecoverToTarget(recoveryRequest{TargetTime: "2019-06-14T09:30:00Z", DataDir: "other", PrepareOnly: true})
+	if err != nil || other.ID == resp.ID {
+		t.Fatalf("Recoveries should have their own ID. ids=%s,%v err=%s", resp.ID, other, err)
+	}
+	recoveryJobs.wait(other.ID)
+	recoveryJobs.wait(resp.ID)
+	resp, _ = backuper.GetRecovery(resp.ID)
+	if resp.Status != statusAvailable || !strings.Contains(resp.Message, "Start PostgreSQL") {
+		t.Fatalf("Data directory should be prepared. resp=%v", resp)
+	}
+	if other, _ = backuper.GetRecovery(other.ID); other.Status != statusAvailable {
+		t.Errorf("Other data directory should be prepared. resp=%v", other)
+	}
+
+	for _, name := range []string{"PG_VERSION", "global/pg_control", "pg_wal/000000010000000000000002", "recovery.signal"} {
+		if _, err := os.Stat(filepath.Join(dataDir, name)); err != nil {
+			t.Errorf("Data directory should have %s. err=%s", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tablespaceDir(dataDir, "16384"), "PG_16", "16385")); err != nil {
+		t.Errorf("Tablespace should be laid out next to the data directory. err=%s", err)
+	}
+	tablespaceMap, _ := ioutil.ReadFile(filepath.Join(dataDir, "tablespace_map"))
+	if string(tablespaceMap) != "16384 "+tablespaceDir(dataDir, "16384")+"\n" {
+		t.Errorf("Tablespace map should point to the laid out tablespace: %s", tablespaceMap)
+	}
+	autoConf, _ := ioutil.ReadFile(filepath.Join(dataDir, "postgresql.auto.conf"))
+	for _, setting := range []string{"archive_mode = 'off'", "port = 5433", "restore_command = 'curl -sf -o %p http://localhost:0/wal/%f'",
+		"recovery_target_time = '2019-06-14 09:30:00+00'", "recovery_target_action = 'pause'"} {
+		if !strings.Contains(string(autoConf), setting+"\n") {
+			t.Errorf("Recovery configuration should have %s: %s", setting, autoConf)
+		}
+	}
+	if info, err := os.Stat(dataDir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("Data directory should only be readable by its owner. info=%v err=%s", info, err)
+	}
+
+	_, err = backuper.RecoverToTarget(recoveryRequest{DataDir: "recovered"})
+	if err == nil {
+		t.Errorf("Recovery into a data directory that isn't empty should be refused")
+	}
+	for _, invalid := range []string{"", ".", dataDir, "../recovered", "x/../../recovered"} {
+		_, err = backuper.RecoverToTarget(recoveryRequest{DataDir: invalid})
+		if err == nil {
+			t.Errorf("Recovery into %q should be refused", invalid)
+		}
+	}
+
+	//the restore_command and port of recovered servers can't be set by API clients
+	server := httptest.NewServer(newAPIRouter())
+	defer server.Close()
+	for _, body := range []string{`{"data_dir": "api", "restore_command": "touch /tmp/pwned"}`, `{"data_dir": "api", "port": 5434}`} {
+		res, err := http.Post(server.URL+"/recoveries", "application/json", strings.NewReader(body))
+		if err != nil || res.StatusCode != http.StatusBadRequest {
+			t.Errorf("Recovery request %s should be refused. res=%v err=%s", body, res, err)
+		}
+	}
+
+	//servers before PostgreSQL 12 read recovery.conf
+	os.Setenv("PG_MAJOR", "10")
+	defer os.Unsetenv("PG_MAJOR")
+	backuper.CreateNewBackup("r3", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("r3")
+	dataDir = filepath.Join(dir, "recovered10")
+	*recoveryRestoreCommand = "cp /archive/%f %p"
+	resp, err = backuper.RecoverToTarget(recoveryRequest{BackupID: "r3", TargetLSN: "0/7000000", DataDir: "recovered10", PrepareOnly: true})
+	if err != nil {
+		t.Fatalf("Error starting recovery: %s", err)
+	}
+	recoveryJobs.wait(resp.ID)
+	recoveryConf, _ := ioutil.ReadFile(filepath.Join(dataDir, "recovery.conf"))
+	if string(recoveryConf) != "restore_command = 'cp /archive/%f %p'\nrecovery_target_lsn = '0/7000000'\nrecovery_target_action = 'pause'\n" {
+		t.Errorf("Unexpected recovery.conf: %s", recoveryConf)
+	}
+}
+
+func TestRecoveryProgress(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestRecoveryProgress...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	setupRecoveryTest(t, dir)
+
+	backuper := PostgresBackuper{}
+	os.Setenv("RECOVERY_LOG_LINES", `2019-06-14 11:00:00.000 UTC [42] LOG:  starting archive recovery
+2019-06-14 11:00:01.000 UTC [42] LOG:  restored log file "000000010000000000000005" from archive
+2019-06-14 11:00:01.000 UTC [43] FATAL:  the database system is starting up
+2019-06-14 11:00:02.000 UTC [42] LOG:  consistent recovery state reached at 0/6000100
+2019-06-14 11:00:03.000 UTC [42] LOG:  recovery stopping before commit of transaction 600, time 2019-06-14 10:30:01.5+00
+2019-06-14 11:00:03.000 UTC [42] LOG:  pausing at the end of recovery`)
+	defer os.Unsetenv("RECOVERY_LOG_LINES")
+	resp, err := backuper.RecoverToTarget(recoveryRequest{TargetTime: "2019-06-14T10:30:00Z", DataDir: "recovered"})
+	if err != nil {
+		t.Fatalf("Error starting recovery: %s", err)
+	}
+	recoveryJobs.wait(resp.ID)
+	resp, _ = backuper.GetRecovery(resp.ID)
+	if resp.Status != statusAvailable || resp.DataID != "r2" || !strings.Contains(resp.Message, "recovery stopping before commit of transaction 600") ||
+		!strings.Contains(resp.Message, "pg_wal_replay_resume()") {
+		t.Errorf("Recovery should report the target was reached. resp=%v", resp)
+	}
+
+	//before PostgreSQL 13, running out of WAL ends the recovery as if there was no target
+	os.Setenv("RECOVERY_LOG_LINES", `LOG:  restored log file "000000010000000000000005" from archive
+LOG:  redo done at 0/6000100
+LOG:  archive recovery complete`)
+	resp, _ = backuper.RecoverToTarget(recoveryRequest{TargetLSN: "0/9000000", DataDir: "recovered2"})
+	recoveryJobs.wait(resp.ID)
+	resp, _ = backuper.GetRecovery(resp.ID)
+	if resp.Status != statusError || !strings.Contains(resp.Message, "without reaching the target") {
+		t.Errorf("Recovery should fail when the target isn't reached. resp=%v", resp)
+	}
+
+	os.Setenv("RECOVERY_LOG_LINES", `LOG:  restored log file "000000010000000000000005" from archive`)
+	resp, _ = backuper.RecoverToTarget(recoveryRequest{DataDir: "recovered3"})
+	recoveryJobs.wait(resp.ID)
+	resp, _ = backuper.GetRecovery(resp.ID)
+	if resp.Status != statusError || !strings.Contains(resp.Message, "stopped before reaching the target") {
+		t.Errorf("Recovery should fail when the server stops. resp=%v", resp)
+	}
+}
+
+//TestRecoveryPostgreSQL recovers a PostgreSQL cluster started in a temp dir to a point in time between two inserts.
+//It is skipped when PostgreSQL isn't installed or the tests run as root
+func TestRecoveryPostgreSQL(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	for _, command := range []string{"initdb", "pg_ctl", "pg_basebackup", "psql", "curl"} {
+		if _, err := exec.LookPath(command); err != nil {
+			t.Skipf("%s isn't installed", command)
+		}
+	}
+	if os.Geteuid() == 0 {
+		t.Skip("PostgreSQL can't run as root")
+	}
+
+	sugar.Infof("Starting TestRecoveryPostgreSQL...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	storage, err := newStorage("file")
+	if err != nil {
+		t.Fatalf("Error creating storage: %s", err)
+	}
+	backupStorage = storage
+	walStorage, err = newWALStorage("file")
+	if err != nil {
+		t.Fatalf("Error creating WAL storage: %s", err)
+	}
+	server := httptest.NewServer(newAPIRouter())
+	defer server.Close()
+
+	run := func(name string, args ...string) string {
+		out, err := exec.Command(name, args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("Error running %s %s: %s. out=%s", name, strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	freePort := func() int {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Error finding a free port: %s", err)
+		}
+		defer listener.Close()
+		return listener.Addr().(*net.TCPAddr).Port
+	}
+	sql := func(port int, query string) string {
+		return run("psql", "--host="+dir, fmt.Sprintf("--port=%d", port), "--username=postgres", "--dbname=postgres", "--no-align", "--tuples-only", "--command="+query)
+	}
+
+	primary := filepath.Join(dir, "primary")
+	primaryPort := freePort()
+	run("initdb", "--pgdata="+primary, "--username=postgres", "--auth=trust")
+	conf := fmt.Sprintf("port = %d\nlisten_addresses = ''\nunix_socket_directories = '%s'\nwal_level = replica\narchive_mode = on\n"+
+		"archive_command = 'curl -sf -T %%p %s/wal/%%f'\n", primaryPort, dir, server.URL)
+	file, _ := os.OpenFile(filepath.Join(primary, "postgresql.conf"), os.O_APPEND|os.O_WRONLY, 0600)
+	file.WriteString(conf)
+	file.Close()
+	run("pg_ctl", "start", "--pgdata="+primary, "--log="+filepath.Join(dir, "primary.log"), "--wait")
+	defer exec.Command("pg_ctl", "stop", "--pgdata="+primary, "--mode=immediate").Run()
+
+	*host, *port, *dbname, *backupMode = dir, primaryPort, "postgres", backupKindPhysical
+	sql(primaryPort, "CREATE TABLE items (id int)")
+	sql(primaryPort, "INSERT INTO items VALUES (1)")
+	backuper := PostgresBackuper{}
+	backuper.CreateNewBackup("pitr1", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("pitr1")
+	if m, err := readManifest("pitr1"); err != nil || m.Status != statusAvailable {
+		t.Fatalf("Physical backup should be available. m=%v err=%s", m, err)
+	}
+
+	sql(primaryPort, "INSERT INTO items VALUES (2)")
+	time.Sleep(time.Second)
+	target := time.Now()
+	time.Sleep(time.Second)
+	sql(primaryPort, "INSERT INTO items VALUES (3)")
+	switched := sql(primaryPort, "SELECT pg_walfile_name(pg_switch_wal())")
+	for i := 0; sql(primaryPort, "SELECT last_archived_wal FROM pg_stat_archiver") < switched; i++ {
+		if i > 100 {
+			t.Fatalf("WAL file %s wasn't archived", switched)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	recoveredPort := freePort()
+	recovered := filepath.Join(dir, "recovered")
+	*recoveryDir, *recoveryPort = dir, recoveredPort
+	*recoveryRestoreCommand = fmt.Sprintf("curl -sf -o %%p %s/wal/%%f", server.URL)
+	resp, err := backuper.RecoverToTarget(recoveryRequest{TargetTime: target.Format(time.RFC3339Nano), DataDir: "recovered"})
+	if err != nil || resp.DataID != "pitr1" {
+		t.Fatalf("Recovery should start from pitr1. resp=%v err=%s", resp, err)
+	}
+	defer exec.Command("pg_ctl", "stop", "--pgdata="+recovered, "--mode=immediate").Run()
+	recoveryJobs.wait(resp.ID)
+	resp, _ = backuper.GetRecovery(resp.ID)
+	if resp.Status != statusAvailable || !strings.Contains(resp.Message, "recovery stopping") {
+		log, _ := ioutil.ReadFile(filepath.Join(recovered, recoveryLogName))
+		t.Fatalf("Recovery should reach the target. resp=%v log=%s", resp, log)
+	}
+	count := sql(recoveredPort, "SELECT count(*) FROM items")
+	if count != "2" {
+		t.Errorf("Recovered cluster should have the rows inserted before the target. count=%s", count)
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/flaviostutz/schelly-webhook/schellyhook"
+	"go.uber.org/zap"
+)
+
+//maintenanceDatabase is used to connect to the server while the restore target database is (re)created
+const maintenanceDatabase = "postgres"
+
+var restoreJobs = newJobRegistry()
+
+//pgConnection holds what is needed to run PostgreSQL client tools against a server
+type pgConnection struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	Database string
+}
+
+//sourceConnection returns the connection to the database being backed up. Its password comes from the .pgpass file
+func sourceConnection() pgConnection {
+	return pgConnection{Host: *host, Port: *port, Username: *username, Database: *dbname}
+}
+
+func (c pgConnection) withDatabase(database string) pgConnection {
+	c.Database = database
+	return c
+}
+
+//command returns a PostgreSQL client command connected to c, followed by args
+func (c pgConnection) command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	connArgs := []string{"--username=" + c.Username, "--host=" + c.Host, "--port=" + strconv.Itoa(c.Port), "--dbname=" + c.Database, "--no-password"}
+	cmd := exec.CommandContext(ctx, name, append(connArgs, args...)...)
+	if c.Password != "" {
+		cmd.Env = append(os.Environ(), "PGPASSWORD="+c.Password)
+	}
+	return cmd
+}
+
+//run runs a PostgreSQL client command and returns its output
+func (c pgConnection) run(ctx context.Context, name string, args ...string) (string, error) {
+	cmd := c.command(ctx, name, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("Failed to run command: '%s'; err=%s; out=%s", strings.Join(cmd.Args, " "), err, out)
+	}
+	return string(out), nil
+}
+
+//quoteIdentifier quotes a SQL identifier, such as a database name
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+//RestoreBackup restores the backup apiID into targetDatabase in background. targetDatabase is required and can't be --dbname,
+//the database being backed up. The target database is dropped and created again before the restore. Its progress is reported by GetRestore.
+//A backup whose file is archived isn't restored: its file is rehydrated instead, and the response has the rehydrating status
+func (sb PostgresBackuper) RestoreBackup(apiID string, targetDatabase string) (*schellyhook.SchellyResponse, error) {
+	return sb.RestoreDatabase(apiID, "", targetDatabase, false)
+}
+
+//RestoreDatabase works as RestoreBackup, restoring the dump of database when apiID is a cluster backup. On cluster backups,
+//database and targetDatabase default to each other. The globals of the cluster are never restored. With force, the backup
+//can be restored into --dbname, replacing the database being backed up
+func (sb PostgresBackuper) RestoreDatabase(apiID string, database string, targetDatabase string, force bool) (*schellyhook.SchellyResponse, error) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("RestoreBackup() apiID=%s database=%s targetDatabase=%s", apiID, database, targetDatabase)
+
+	m, err := readManifest(apiID)
+	if err == errObjectNotFound {
+		sugar.Debugf("Backup manifest not found for apiId %s.", apiID)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.Status != statusAvailable {
+		return nil, fmt.Errorf("Backup %s can't be restored because its status is %s", apiID, m.Status)
+	}
+	if m.isPhysical() {
+		return nil, fmt.Errorf("Backup %s is a physical backup of the cluster, which can't be restored into a database", apiID)
+	}
+	dump := *m
+	if m.isCluster() {
+		if database == "" {
+			database = targetDatabase
+		}
+		if targetDatabase == "" {
+			targetDatabase = database
+		}
+		var ok bool
+		dump, ok = m.databaseManifest(database)
+		if !ok {
+			return nil, fmt.Errorf("Backup %s has no database %q. Its databases are %s", apiID, database, strings.Join(m.databaseNames(), ", "))
+		}
+	} else if database != "" {
+		return nil, fmt.Errorf("Backup %s isn't a cluster backup, so a database can't be chosen", apiID)
+	}
+	if targetDatabase == "" {
+		return nil, fmt.Errorf("The target database of the restore of %s must be set", apiID)
+	}
+	//the target database is passed to psql as --dbname, which could override the connection options
+	err = validateConnectionOptions(sourceConnection().withDatabase(targetDatabase))
+	if err != nil {
+		return nil, err
+	}
+	if targetDatabase == maintenanceDatabase {
+		return nil, fmt.Errorf("Can't restore into the maintenance database %s", maintenanceDatabase)
+	}
+	if targetDatabase == *dbname && !force {
+		return nil, fmt.Errorf("Restoring into %s would replace the database being backed up. Set force to do it anyway", targetDatabase)
+	}
+	rehydrating, err := rehydrateIfArchived(m)
+	if err != nil {
+		return nil, fmt.Errorf("Error checking the tier of backup %s: %s", apiID, err)
+	}
+	if rehydrating {
+		res := rehydratingResponse(*m)
+		res.DataID = targetDatabase
+		return &res, nil
+	}
+
+	j, ctx, err := restoreJobs.start(apiID, targetDatabase)
+	if err != nil {
+		sugar.Errorf("Couldn't start restore of %s. err=%s", apiID, err)
+		return nil, err
+	}
+	restoreJobs.setSize(j, dump.Size)
+	go runRestoreJob(ctx, j, dump)
+
+	res := restoreResponse(*j)
+	return &res, nil
+}
+
+//GetRestore returns the status of the last restore of the backup apiID since the provider was started
+func (sb PostgresBackuper) GetRestore(apiID string) (*schellyhook.SchellyResponse, error) {
+	j, ok := restoreJobs.get(apiID)
+	if !ok {
+		return nil, nil
+	}
+	res := restoreResponse(j)
+	return &res, nil
+}
+
+func restoreResponse(j job) schellyhook.SchellyResponse {
+	res := schellyhook.SchellyResponse{
+		ID:     j.ID,
+		DataID: j.DataID,
+		Status: j.Status,
+		SizeMB: float64(j.Size),
+	}
+	switch j.Status {
+	case statusRunning:
+		res.Message = j.describe(fmt.Sprintf("restoring into %s: %d of %d bytes", j.DataID, j.Progress(), j.Size))
+	case statusAvailable:
+		res.Message = j.describe("restored into " + j.DataID)
+	default:
+		res.Message = j.describe("restore failed: " + j.Err.Error())
+	}
+	return res
+}
+
+//runRestoreJob recreates the target database and loads the backup into it
+func runRestoreJob(ctx context.Context, j *job, m backupManifest) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	target := sourceConnection().withDatabase(j.DataID)
+	err := recreateDatabase(ctx, target)
+	if err == nil {
+		err = restoreManifest(ctx, j, m, target)
+	}
+	if ctx.Err() != nil {
+		err = fmt.Errorf("Restore of %s cancelled", j.ID)
+	}
+
+	if err != nil {
+		sugar.Warnf("Restore of %s into %s failed. err=%s", j.ID, j.DataID, err)
+	} else {
+		sugar.Infof("Restore of %s into %s finished", j.ID, j.DataID)
+	}
+	restoreJobs.finish(j, err)
+}
+
+//recreateDatabase drops the database of conn, if it exists, and creates it empty
+func recreateDatabase(ctx context.Context, conn pgConnection) error {
+	maintenance := conn.withDatabase(maintenanceDatabase)
+	_, err := maintenance.run(ctx, "psql", "--command=DROP DATABASE IF EXISTS "+quoteIdentifier(conn.Database))
+	if err != nil {
+		return err
+	}
+	_, err = maintenance.run(ctx, "psql", "--command=CREATE DATABASE "+quoteIdentifier(conn.Database))
+	return err
+}
+
+//restoreManifest loads the backup described by m into the database of conn, using psql for plain dumps and pg_restore for archives
+func restoreManifest(ctx context.Context, j *job, m backupManifest, conn pgConnection) error {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	if m.Format == "directory" && m.Bundle == bundleTar {
+		return restoreDirectoryBundle(ctx, j, m, conn)
+	}
+	if m.Format == "directory" {
+		ls, ok := unwrapStorage(backupStorage).(*localStorage)
+		if !ok {
+			return fmt.Errorf("Backups with directory format can only be restored from local storage")
+		}
+		out, err := conn.run(ctx, "pg_restore", "--verbose", "--exit-on-error", filepath.Join(ls.dir, m.Artifact))
+		sugar.Debugf("pg_restore output: %s", out)
+		return err
+	}
+
+	reader, err := openArtifact(m, j)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	decompressed, err := decompressStream(reader, m.Compression)
+	if err != nil {
+		return err
+	}
+	defer decompressed.Close()
+
+	var cmd *exec.Cmd
+	var input io.Reader = decompressed
+	if m.Format == "plain" {
+		//pg_dump compresses plain dumps by itself when --compress is used
+		input, err = gunzipIfCompressed(input)
+		if err != nil {
+			return err
+		}
+		if hasFlag(m.Flags, "--create") {
+			input = skipDatabaseCreation(input)
+		}
+		cmd = conn.command(ctx, "psql", "--set=ON_ERROR_STOP=1", "--quiet")
+	} else {
+		cmd = conn.command(ctx, "pg_restore", "--verbose", "--exit-on-error")
+	}
+	sugar.Debugf("Executing restore command: %s", strings.Join(cmd.Args, " "))
+	return runWithInput(cmd, input)
+}
+
+//restoreDirectoryBundle extracts a directory format backup stored as a tar file to the staging area and
+//restores it with as many parallel pg_restore jobs as pg_dump had
+func restoreDirectoryBundle(ctx context.Context, j *job, m backupManifest, conn pgConnection) error {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	dir, err := ioutil.TempDir(filepath.Join(*backupsDir, ".staging"), "restore-"+j.ID+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	reader, err := openArtifact(m, j)
+	if err != nil {
+		return err
+	}
+	err = untarDirectory(reader, dir)
+	reader.Close()
+	if err != nil {
+		return fmt.Errorf("Error extracting backup file %s: %s", m.Artifact, err)
+	}
+
+	//the backup is restored with the jobs it was taken with, whatever --jobs is now
+	jobs := m.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	out, err := conn.run(ctx, "pg_restore", "--verbose", "--exit-on-error", "--jobs="+strconv.Itoa(jobs), dir)
+	sugar.Debugf("pg_restore output: %s", out)
+	return err
+}
+
+//openArtifact fetches the backup file described by m from the storage backend and decrypts it, if needed.
+//What is read from the backend is added to the progress of j, when given. The result must be closed by the caller
+func openArtifact(m backupManifest, j *job) (io.ReadCloser, error) {
+	var key []byte
+	if m.Encryption != nil {
+		var err error
+		key, err = keyFor(m.Encryption)
+		if err != nil {
+			return nil, err
+		}
+	}
+	reader, err := backupStorage.Get(m.Artifact)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching backup file %s: %s", m.Artifact, err)
+	}
+	if m.Encryption == nil && j == nil {
+		return reader, nil
+	}
+	var input io.Reader = reader
+	if j != nil {
+		input = j.countReader(input)
+	}
+	if m.Encryption != nil {
+		input, err = decryptStream(input, key)
+		if err != nil {
+			reader.Close()
+			return nil, err
+		}
+	}
+	return readCloser{input, reader}, nil
+}
+
+//readCloser reads from Reader and closes Closer, usually the source of Reader
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+//runWithInput feeds input to the stdin of cmd. If input can't be read to the end, the command is killed
+//so that a partial backup isn't left committed. A command that exits before reading all of its input, such as psql
+//stopping on an error, fails with its own output
+func runWithInput(cmd *exec.Cmd, input io.Reader) error {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	var output strings.Builder
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	source := &inputReader{reader: input}
+	_, copyErr := io.Copy(stdin, source)
+	if source.err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("Error reading backup file: %s", source.err)
+	}
+	stdin.Close()
+	err = cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("Failed to run command: '%s'; err=%s; out=%s", strings.Join(cmd.Args, " "), err, output.String())
+	}
+	if copyErr != nil {
+		return fmt.Errorf("Command '%s' didn't read the whole backup file: %s; out=%s", strings.Join(cmd.Args, " "), copyErr, output.String())
+	}
+	return nil
+}
+
+//inputReader keeps the error returned by reader, other than io.EOF, to tell it apart from errors writing what was read
+type inputReader struct {
+	reader io.Reader
+	err    error
+}
+
+func (ir *inputReader) Read(p []byte) (int, error) {
+	n, err := ir.reader.Read(p)
+	if err != nil && err != io.EOF {
+		ir.err = err
+	}
+	return n, err
+}
+
+//skipDatabaseCreation drops the statements a plain dump taken with --create uses to recreate and connect to the
+//original database (everything up to the first \connect), so that it can be restored into another database
+func skipDatabaseCreation(reader io.Reader) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		br := bufio.NewReader(reader)
+		for {
+			line, err := br.ReadString('\n')
+			if strings.HasPrefix(line, "\\connect ") {
+				break
+			}
+			if err == io.EOF {
+				pw.CloseWithError(fmt.Errorf("Backup file doesn't have a \\connect to the database"))
+				return
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		_, err := io.Copy(pw, br)
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+//gunzipIfCompressed decompresses reader contents when they start with the gzip magic number
+func gunzipIfCompressed(reader io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(reader)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flaviostutz/schelly-webhook/schellyhook"
+	"go.uber.org/zap"
+)
+
+//fakePsqlScript logs commands to $PSQL_LOG and appends scripts read from stdin to $RESTORE_OUT
+const fakePsqlScript = `command=""
+for arg in "$@"; do
+  case "$arg" in
+    --command=*) command="$arg" ;;
+  esac
+done
+echo "$*" >> "$PSQL_LOG"
+if [ -z "$command" ]; then
+  cat >> "$RESTORE_OUT"
+fi
+`
+
+func setupRestoreTest(t *testing.T, dir string) (string, string) {
+	installFakeCommand(t, dir, "pg_dump", fakePgDumpScript)
+	installFakeCommand(t, dir, "psql", fakePsqlScript)
+	psqlLog := filepath.Join(dir, "psql.log")
+	restoreOut := filepath.Join(dir, "restore.sql")
+	os.Setenv("PSQL_LOG", psqlLog)
+	os.Setenv("RESTORE_OUT", restoreOut)
+	return psqlLog, restoreOut
+}
+
+func TestRestoreBackup(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestRestoreBackup...")
+	for _, codec := range []string{"none", "gzip", "zstd", "lz4"} {
+		dir := setupTestFlags(t)
+		defer os.RemoveAll(dir)
+		psqlLog, restoreOut := setupRestoreTest(t, dir)
+		*compression = codec
+		backupStorage = newMemoryStorage()
+
+		backuper := PostgresBackuper{}
+		backuper.CreateNewBackup("r1", 0, &schellyhook.ShellContext{})
+		backupJobs.wait("r1")
+
+		resp, err := backuper.RestoreBackup("r1", "restored")
+		if err != nil || resp == nil || resp.Status != statusRunning {
+			t.Fatalf("Restore should be running. resp=%v err=%s", resp, err)
+		}
+		restoreJobs.wait("r1")
+
+		resp, err = backuper.GetRestore("r1")
+		if err != nil || resp == nil || resp.Status != statusAvailable || !strings.Contains(resp.Message, "restored into restored") {
+			t.Fatalf("Restore should be finished (compression=%s). resp=%v err=%s", codec, resp, err)
+		}
+
+		log, _ := ioutil.ReadFile(psqlLog)
+		if !strings.Contains(string(log), "--dbname=postgres --no-password --command=DROP DATABASE IF EXISTS \"restored\"") ||
+			!strings.Contains(string(log), "--command=CREATE DATABASE \"restored\"") ||
+			!strings.Contains(string(log), "--dbname=restored --no-password --set=ON_ERROR_STOP=1") {
+			t.Errorf("Unexpected psql invocations (compression=%s): %s", codec, log)
+		}
+		restored, _ := ioutil.ReadFile(restoreOut)
+		if !strings.Contains(string(restored), `CREATE TABLE "public"."t"`) || strings.Contains(string(restored), "CREATE DATABASE") || strings.Contains(string(restored), "\\connect") {
+			t.Errorf("Restored script should skip the original database creation (compression=%s): %s", codec, restored)
+		}
+	}
+}
+
+func TestRestoreCustomFormat(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestRestoreCustomFormat...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	psqlLog, restoreOut := setupRestoreTest(t, dir)
+	installFakeCommand(t, dir, "pg_restore", fakePsqlScript)
+	*dumpFormat = "custom"
+	*dumpCompressionLevel = 9
+	backupStorage = newMemoryStorage()
+
+	backuper := PostgresBackuper{}
+	backuper.CreateNewBackup("r4", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("r4")
+
+	m, err := readManifest("r4")
+	if err != nil || m.Format != "custom" || !strings.HasSuffix(m.Artifact, ".dump") || !hasFlag(m.Flags, "--format=c") || !hasFlag(m.Flags, "--compress=9") {
+		t.Fatalf("Unexpected manifest for custom format backup. manifest=%v err=%s", m, err)
+	}
+
+	backuper.RestoreBackup("r4", "other")
+	restoreJobs.wait("r4")
+	resp, _ := backuper.GetRestore("r4")
+	if resp == nil || resp.Status != statusAvailable {
+		t.Fatalf("Restore should be finished. resp=%v", resp)
+	}
+	log, _ := ioutil.ReadFile(psqlLog)
+	if !strings.Contains(string(log), "--dbname=other --no-password --verbose --exit-on-error") {
+		t.Errorf("Custom format should be restored with pg_restore: %s", log)
+	}
+	restored, _ := ioutil.ReadFile(restoreOut)
+	if !strings.Contains(string(restored), "CREATE DATABASE") {
+		t.Errorf("Archives should be sent to pg_restore untouched: %s", restored)
+	}
+}
+
+//fakePgRestoreScript logs commands to $PSQL_LOG and the files of the directory being restored to $RESTORE_OUT
+const fakePgRestoreScript = `echo "$*" >> "$PSQL_LOG"
+for arg in "$@"; do
+  dir="$arg"
+done
+ls "$dir" >> "$RESTORE_OUT"
+`
+
+func TestRestoreDirectoryBundle(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestRestoreDirectoryBundle...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	psqlLog, restoreOut := setupRestoreTest(t, dir)
+	installFakeCommand(t, dir, "pg_restore", fakePgRestoreScript)
+	*dumpFormat = "directory"
+	*dumpJobs = 4
+	storage := newMemoryStorage()
+	backupStorage = storage
+
+	backuper := PostgresBackuper{}
+	backuper.CreateNewBackup("r5", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("r5")
+
+	m, err := readManifest("r5")
+	if err != nil || m.Status != statusAvailable || m.Bundle != bundleTar || !strings.HasSuffix(m.Artifact, ".dir.tar") || !hasFlag(m.Flags, "--jobs=4") || m.Jobs != 4 {
+		t.Fatalf("Unexpected manifest for directory format backup. manifest=%v err=%s", m, err)
+	}
+	reader, _ := storage.Get(m.Artifact)
+	tr := tar.NewReader(reader)
+	names := make([]string, 0)
+	for header, err := tr.Next(); err == nil; header, err = tr.Next() {
+		names = append(names, header.Name)
+	}
+	if strings.Join(names, ",") != "3001.dat,toc.dat" {
+		t.Errorf("Unexpected files on directory bundle: %v", names)
+	}
+
+	//the backup is restored with the jobs it was taken with
+	*dumpJobs = 1
+	backuper.RestoreBackup("r5", "other")
+	restoreJobs.wait("r5")
+	resp, _ := backuper.GetRestore("r5")
+	if resp == nil || resp.Status != statusAvailable {
+		t.Fatalf("Restore should be finished. resp=%v", resp)
+	}
+	log, _ := ioutil.ReadFile(psqlLog)
+	if !strings.Contains(string(log), "--dbname=other --no-password --verbose --exit-on-error --jobs=4 "+filepath.Join(*backupsDir, ".staging", "restore-r5-")) {
+		t.Errorf("Directory bundle should be restored from the staging area with parallel jobs: %s", log)
+	}
+	restored, _ := ioutil.ReadFile(restoreOut)
+	if string(restored) != "3001.dat\ntoc.dat\n" {
+		t.Errorf("Unexpected restored directory contents: %s", restored)
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(*backupsDir, ".staging"))
+	if len(files) != 0 {
+		t.Errorf("Staging area should be cleaned up: %v", files)
+	}
+}
+
+func TestRestoreBackupFailure(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestRestoreBackupFailure...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	setupRestoreTest(t, dir)
+	backupStorage = newMemoryStorage()
+
+	backuper := PostgresBackuper{}
+	resp, err := backuper.RestoreBackup("missing", "")
+	if err != nil || resp != nil {
+		t.Errorf("Restore of a missing backup should return nil. resp=%v err=%s", resp, err)
+	}
+
+	backuper.CreateNewBackup("r2", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("r2")
+	installFakeCommand(t, dir, "psql", fakePsqlScript+"[ -z \"$command\" ] && echo 'relation already exists' >&2 && exit 3\nexit 0\n")
+
+	for _, target := range []string{"", "schelly", "host=attacker dbname=x"} {
+		_, err = backuper.RestoreBackup("r2", target)
+		if err == nil {
+			t.Errorf("Restore into %q should be refused", target)
+		}
+	}
+	backuper.RestoreDatabase("r2", "", "schelly", true)
+	restoreJobs.wait("r2")
+	resp, _ = backuper.GetRestore("r2")
+	if resp == nil || resp.Status != statusError || !strings.Contains(resp.Message, "relation already exists") || resp.DataID != "schelly" {
+		t.Errorf("Restore should fail with psql output. resp=%v", resp)
+	}
+}
+
+//failingReader returns err after the data of reader
+type failingReader struct {
+	reader io.Reader
+	err    error
+}
+
+func (fr failingReader) Read(p []byte) (int, error) {
+	n, err := fr.reader.Read(p)
+	if err == io.EOF {
+		return n, fr.err
+	}
+	return n, err
+}
+
+func TestRunWithInput(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestRunWithInput...")
+	input := bytes.Repeat([]byte("INSERT INTO t VALUES (1);\n"), 100000)
+
+	//psql stops on the first error, without reading the rest of the backup
+	cmd := exec.Command("sh", "-c", "head -c 10 > /dev/null; echo 'ERROR:  relation \"t\" does not exist' >&2; exit 3")
+	err := runWithInput(cmd, bytes.NewReader(input))
+	if err == nil || !strings.Contains(err.Error(), `out=ERROR:  relation "t" does not exist`) || strings.Contains(err.Error(), "reading backup file") {
+		t.Errorf("Command that stops reading should fail with its output. err=%s", err)
+	}
+
+	cmd = exec.Command("sh", "-c", "exec cat > /dev/null")
+	err = runWithInput(cmd, failingReader{bytes.NewReader(input), fmt.Errorf("checksum mismatch")})
+	if err == nil || !strings.Contains(err.Error(), "Error reading backup file: checksum mismatch") {
+		t.Errorf("Backup file that can't be read should fail the command. err=%s", err)
+	}
+
+	cmd = exec.Command("sh", "-c", "exec cat > /dev/null")
+	err = runWithInput(cmd, bytes.NewReader(input))
+	if err != nil {
+		t.Errorf("Command should read the whole backup file. err=%s", err)
+	}
+}
+
+func TestRestoreAPI(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestRestoreAPI...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	setupRestoreTest(t, dir)
+	backupStorage = newMemoryStorage()
+	PostgresBackuper{}.CreateNewBackup("r3", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("r3")
+
+	server := httptest.NewServer(newAPIRouter())
+	defer server.Close()
+
+	res, err := http.Post(server.URL+"/backups/r3/restore", "application/json", strings.NewReader(`{"target_database": "other"}`))
+	if err != nil || res.StatusCode != http.StatusAccepted {
+		t.Fatalf("Unexpected restore response. res=%v err=%s", res, err)
+	}
+	restoreJobs.wait("r3")
+
+	res, err = http.Get(server.URL + "/backups/r3/restore")
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected restore status response. res=%v err=%s", res, err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if !strings.Contains(string(body), `"status":"available"`) || !strings.Contains(string(body), `"data_id":"other"`) {
+		t.Errorf("Unexpected restore status: %s", body)
+	}
+
+	res, _ = http.Post(server.URL+"/backups/r3/restore", "application/json", nil)
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("Restore without a target database should be refused. status=%d", res.StatusCode)
+	}
+
+	res, _ = http.Post(server.URL+"/backups/nope/restore", "application/json", nil)
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Restore of a missing backup should return 404. status=%d", res.StatusCode)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+//Storage keeps backup artifacts on a backend such as a local directory or an Azure Blob container
+type Storage interface {
+	//Put stores the contents read from reader under name, replacing any previous object
+	Put(name string, reader io.Reader) error
+	//Get opens the object stored under name for streaming reads
+	Get(name string) (io.ReadCloser, error)
+	//List returns all objects kept on the backend
+	List() ([]StorageObject, error)
+	//Stat returns the details of the object stored under name
+	Stat(name string) (*StorageObject, error)
+	//Delete removes the object stored under name
+	Delete(name string) error
+}
+
+//fileStorage is implemented by backends that can store a local file (or directory) more efficiently than by streaming it
+type fileStorage interface {
+	PutFile(name string, filePath string) error
+}
+
+//labelStorage is implemented by backends that can attach labels to objects and find objects by them
+type labelStorage interface {
+	//SetLabels replaces the labels of the object stored under name
+	SetLabels(name string, labels map[string]string) error
+	//FindByLabels returns the objects that have all labels
+	FindByLabels(labels map[string]string) ([]StorageObject, error)
+}
+
+//StorageObject describes an object kept on a Storage backend
+type StorageObject struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Location string `json:"location"` //file path or URL of the object
+}
+
+//tierStorage is implemented by backends with access tiers, where the files of older backups can be kept for less
+type tierStorage interface {
+	//SetTier moves the object stored under name to tier. Moving an archived object to another tier rehydrates it
+	SetTier(name string, tier string) error
+	//Tier returns the tier of the object stored under name and whether it is being rehydrated from the archive tier
+	Tier(name string) (string, bool, error)
+}
+
+//errObjectNotFound is returned by Storage backends when the requested object doesn't exist
+var errObjectNotFound = errors.New("object not found")
+
+//errLabelsNotIndexed is returned by FindByLabels when the backend keeps labels but can't search them
+var errLabelsNotIndexed = errors.New("labels aren't indexed")
+
+//newStorage creates the Storage backend selected by --target-data-backend, limited by the transfer options
+//(--simultaneous-writes, --max-bandwidth-write, --simultaneous-reads and --max-bandwidth-read)
+func newStorage(backend string) (Storage, error) {
+	storage, err := newBackendStorage(backend)
+	if err != nil {
+		return nil, err
+	}
+	return newLimitedStorage(storage), nil
+}
+
+func newBackendStorage(backend string) (Storage, error) {
+	switch backend {
+	case "file":
+		return newLocalStorage(*backupsDir)
+	case "azure":
+		err := applyAzureConnectionString(*azureConnectionString)
+		if err != nil {
+			return nil, err
+		}
+		return newAzureStorage(*accountName, *accountKey, *containerName)
+	case "s3":
+		return newS3Storage(s3Options{
+			Endpoint:        *s3Endpoint,
+			Region:          *s3Region,
+			Bucket:          *s3Bucket,
+			Prefix:          *s3Prefix,
+			PathStyle:       *s3PathStyle,
+			AccessKeyID:     *s3AccessKeyID,
+			SecretAccessKey: *s3SecretAccessKey,
+			PartSizeMB:      *s3PartSize,
+			Concurrency:     *s3Concurrency,
+		})
+	default:
+		return nil, fmt.Errorf("Unsupported target data backend `%s`. Use `file`, `azure` or `s3`", backend)
+	}
+}
+
+//storeFile sends a local file to the storage backend, using PutFile when the backend supports it.
+//Returns the size and SHA-256 of the stored file
+func storeFile(storage Storage, name string, filePath string) (int64, string, error) {
+	if fs, ok := storage.(fileStorage); ok {
+		size, checksum, err := fileChecksum(filePath)
+		if err != nil {
+			return 0, "", err
+		}
+		return size, checksum, fs.PutFile(name, filePath)
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+	return putWithChecksum(storage, name, file)
+}
+
+//putWithChecksum stores the contents of reader and returns their size and SHA-256
+func putWithChecksum(storage Storage, name string, reader io.Reader) (int64, string, error) {
+	cr := newChecksumReader(reader)
+	err := storage.Put(name, cr)
+	if err != nil {
+		return 0, "", err
+	}
+	return cr.size, cr.sum(), nil
+}
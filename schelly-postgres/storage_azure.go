@@ -0,0 +1,713 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"go.uber.org/zap"
+)
+
+//azureMaxRetryDelay caps the wait between retries of an Azure operation
+const azureMaxRetryDelay = 5 * time.Minute
+
+//azuriteAccountKey is the well known key of the devstoreaccount1 account of the Azure storage emulators
+const azuriteAccountKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+var (
+	isCredentialCreated bool
+	credential          azblob.Credential
+)
+
+//azureBlobStorage keeps backup artifacts on an Azure Blob Storage container, under the prefix virtual directory
+type azureBlobStorage struct {
+	accountName   string
+	accountKey    string
+	containerName string
+	prefix        string
+	indexTags     bool
+}
+
+func newAzureStorage(accountName string, accountKey string, containerName string) (*azureBlobStorage, error) {
+	if containerName == "" {
+		return nil, fmt.Errorf("`container-name` arg must be set when using Azure storage")
+	}
+	if accountKey == "" && *azureSASToken == "" {
+		return nil, fmt.Errorf("`account-key`, `azure-sas-token` or `azure-connection-string` arg must be set when using Azure storage")
+	}
+	if accountKey != "" && *azureSASToken != "" {
+		return nil, fmt.Errorf("`account-key` and `azure-sas-token` args can't be used together")
+	}
+	if accountName == "" && (accountKey != "" || *azureEndpoint == "") {
+		return nil, fmt.Errorf("`account-name` arg must be set when using an Azure account key or the default endpoint")
+	}
+	return &azureBlobStorage{
+		accountName:   accountName,
+		accountKey:    accountKey,
+		containerName: containerName,
+		prefix:        azurePrefixFor(*azurePrefix, *dbname),
+		indexTags:     *azureIndexTags,
+	}, nil
+}
+
+//azurePrefixFor returns the virtual directory of --azure-prefix, with {database} replaced by the database name
+func azurePrefixFor(prefix string, database string) string {
+	prefix = strings.Trim(strings.Replace(prefix, "{database}", database, -1), "/")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/"
+}
+
+func (as *azureBlobStorage) Put(name string, reader io.Reader) error {
+	return sendStreamToAzure(as.accountName, as.accountKey, as.containerName, as.prefix+name, reader)
+}
+
+func (as *azureBlobStorage) PutFile(name string, filePath string) error {
+	return sendFileToAzure(as.accountName, as.accountKey, as.containerName, as.prefix+name, filePath)
+}
+
+func (as *azureBlobStorage) Get(name string) (io.ReadCloser, error) {
+	return downloadFileFromAzure(as.accountName, as.accountKey, as.containerName, as.prefix+name)
+}
+
+//List returns the blobs right under the prefix, leaving out the virtual directories of other providers
+func (as *azureBlobStorage) List() ([]StorageObject, error) {
+	objects, err := listDirectoryFromAzure(as.accountName, as.accountKey, as.containerName, as.prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i := range objects {
+		objects[i].Name = strings.TrimPrefix(objects[i].Name, as.prefix)
+	}
+	return objects, nil
+}
+
+func (as *azureBlobStorage) Stat(name string) (*StorageObject, error) {
+	object, err := findFileFromAzure(as.accountName, as.accountKey, as.containerName, as.prefix+name)
+	if err != nil {
+		return nil, err
+	}
+	object.Name = name
+	return object, nil
+}
+
+func (as *azureBlobStorage) Delete(name string) error {
+	return deleteFileFromAzure(as.accountName, as.accountKey, as.containerName, as.prefix+name)
+}
+
+//SetLabels stores labels as blob metadata and, with --azure-index-tags, as blob index tags
+func (as *azureBlobStorage) SetLabels(name string, labels map[string]string) error {
+	err := setMetadataOnAzure(as.accountName, as.accountKey, as.containerName, as.prefix+name, labels)
+	if err != nil || !as.indexTags {
+		return err
+	}
+	return setTagsOnAzure(as.accountName, as.accountKey, as.containerName, as.prefix+name, labels)
+}
+
+//FindByLabels queries the blob index tags of the container for the blobs under the prefix that have all labels
+func (as *azureBlobStorage) FindByLabels(labels map[string]string) ([]StorageObject, error) {
+	if !as.indexTags {
+		return nil, errLabelsNotIndexed
+	}
+	names, err := findByTagsOnAzure(as.accountName, as.accountKey, as.containerName, labels)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]StorageObject, 0)
+	for _, name := range names {
+		if !strings.HasPrefix(name, as.prefix) || strings.Contains(strings.TrimPrefix(name, as.prefix), "/") {
+			continue
+		}
+		objects = append(objects, StorageObject{Name: strings.TrimPrefix(name, as.prefix)})
+	}
+	return objects, nil
+}
+
+//SetTier sets the access tier of a blob. Rehydrating a blob from the Archive tier takes up to 15 hours
+func (as *azureBlobStorage) SetTier(name string, tier string) error {
+	return setTierOnAzure(as.accountName, as.accountKey, as.containerName, as.prefix+name, tier)
+}
+
+//Tier returns the access tier of a blob and whether it is being rehydrated
+func (as *azureBlobStorage) Tier(name string) (string, bool, error) {
+	return getTierFromAzure(as.accountName, as.accountKey, as.containerName, as.prefix+name)
+}
+
+func handleErrors(err *error) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	if *err != nil {
+		if serr, ok := (*err).(azblob.StorageError); ok { // This error is a Service-specific
+			switch serr.ServiceCode() { // Compare serviceCode to ServiceCodeXxx constants
+			case azblob.ServiceCodeContainerAlreadyExists:
+				sugar.Debugf("Received 409. Container already exists")
+				(*err) = nil
+			default:
+				sugar.Debugf("Handle Errors: %s", (*err).Error())
+			}
+		}
+	}
+}
+
+//azureStatusCode returns the HTTP status of an Azure error response, or 0 when err isn't one
+func azureStatusCode(err error) int {
+	if serr, ok := err.(azblob.StorageError); ok && serr.Response() != nil {
+		return serr.Response().StatusCode
+	}
+	if rerr, ok := err.(*azureRESTError); ok {
+		return rerr.status
+	}
+	return 0
+}
+
+//isAzureNotFound tells if err is an Azure response for a missing blob
+func isAzureNotFound(err error) bool {
+	return azureStatusCode(err) == http.StatusNotFound
+}
+
+//azureTransferOptions returns the block size of uploads (--azure-block-size) and how many blocks of a file are
+//uploaded in parallel, which follows --simultaneous-writes so that a single upload doesn't take the whole uplink
+func azureTransferOptions() (int64, int) {
+	parallelism := *simultaneousWrites
+	if parallelism <= 0 {
+		parallelism = 16
+	}
+	return int64(*azureBlockSize) * 1024 * 1024, parallelism
+}
+
+//retryDelay returns how long to wait before retry number attempt (starting at 1): base doubled on each attempt up to
+//azureMaxRetryDelay, give or take 25%, so that blocks failing together aren't retried all at once
+func retryDelay(base time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < azureMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > azureMaxRetryDelay {
+		delay = azureMaxRetryDelay
+	}
+	return delay - delay/4 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+//isTransientAzureError tells whether err may go away by retrying, as network errors, timeouts, throttling and server errors do.
+//Cancelled operations and errors that don't come from Azure or the network, such as failing to read the data sent, are final
+func isTransientAzureError(err error) bool {
+	if err == nil || err == errObjectNotFound {
+		return false
+	}
+	status := azureStatusCode(err)
+	if status != 0 {
+		return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+	}
+	cause := pipeline.Cause(err)
+	if uerr, ok := cause.(*url.Error); ok {
+		//the HTTP client reports cancelled requests as url errors too
+		cause = uerr.Err
+	}
+	if cause == context.Canceled {
+		return false
+	}
+	if cause == context.DeadlineExceeded || cause == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := cause.(net.Error)
+	return ok
+}
+
+//retryAzure runs operation until it succeeds, fails with an error that isn't transient or runs out of retries
+//(--azure-max-retries). Retries wait with exponential backoff starting at --azure-retry-delay
+func retryAzure(description string, operation func() error) error {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	for attempt := 1; ; attempt++ {
+		err := operation()
+		if err == nil || attempt > *azureMaxRetries || !isTransientAzureError(err) {
+			return err
+		}
+		delay := retryDelay(time.Duration(*azureRetryDelay)*time.Second, attempt)
+		sugar.Warnf("%s failed. Retrying in %s (%d/%d). err=%s", description, delay, attempt, *azureMaxRetries, err)
+		time.Sleep(delay)
+	}
+}
+
+//applyAzureConnectionString sets the account name, account key, endpoint and SAS token args from an Azure storage
+//connection string, such as the ones shown on the Azure portal. Args set to other values are an error
+func applyAzureConnectionString(connectionString string) error {
+	if connectionString == "" {
+		return nil
+	}
+	conn, err := parseAzureConnectionString(connectionString)
+	if err != nil {
+		return err
+	}
+	args := []struct {
+		name  string
+		value *string
+		conn  string
+	}{
+		{"account-name", accountName, conn.AccountName},
+		{"account-key", accountKey, conn.AccountKey},
+		{"azure-endpoint", azureEndpoint, conn.Endpoint},
+		{"azure-sas-token", azureSASToken, conn.SASToken},
+	}
+	for _, arg := range args {
+		if arg.conn == "" {
+			continue
+		}
+		if *arg.value != "" && *arg.value != arg.conn {
+			return fmt.Errorf("`%s` arg doesn't match `azure-connection-string`", arg.name)
+		}
+		*arg.value = arg.conn
+	}
+	return nil
+}
+
+//azureConnection holds the settings of an Azure storage connection string
+type azureConnection struct {
+	AccountName string
+	AccountKey  string
+	Endpoint    string
+	SASToken    string
+}
+
+//parseAzureConnectionString reads a connection string made of `key=value` pairs separated by `;`. The blob endpoint is
+//BlobEndpoint or, when missing, the one of AccountName with DefaultEndpointsProtocol and EndpointSuffix.
+//UseDevelopmentStorage=true connects to Azurite on its default address
+func parseAzureConnectionString(connectionString string) (*azureConnection, error) {
+	settings := make(map[string]string)
+	for _, pair := range strings.Split(connectionString, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid azure connection string setting %s. It must be `key=value`", kv[0])
+		}
+		settings[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+	}
+
+	if strings.EqualFold(settings["usedevelopmentstorage"], "true") {
+		return &azureConnection{
+			AccountName: "devstoreaccount1",
+			AccountKey:  azuriteAccountKey,
+			Endpoint:    "http://127.0.0.1:10000/devstoreaccount1",
+		}, nil
+	}
+
+	conn := &azureConnection{
+		AccountName: settings["accountname"],
+		AccountKey:  settings["accountkey"],
+		Endpoint:    settings["blobendpoint"],
+		SASToken:    settings["sharedaccesssignature"],
+	}
+	if conn.Endpoint == "" && conn.AccountName != "" {
+		protocol := settings["defaultendpointsprotocol"]
+		if protocol == "" {
+			protocol = "https"
+		}
+		suffix := settings["endpointsuffix"]
+		if suffix == "" {
+			suffix = "core.windows.net"
+		}
+		conn.Endpoint = fmt.Sprintf("%s://%s.blob.%s", protocol, conn.AccountName, suffix)
+	}
+	if conn.Endpoint == "" {
+		return nil, fmt.Errorf("Azure connection string must have AccountName or BlobEndpoint")
+	}
+	if conn.AccountKey == "" && conn.SASToken == "" {
+		return nil, fmt.Errorf("Azure connection string must have AccountKey or SharedAccessSignature")
+	}
+	return conn, nil
+}
+
+//azureContainerURL returns the URL of containerName on --azure-endpoint or, when it isn't set, on the Azure public cloud.
+//The SAS token (--azure-sas-token) is sent as the URL query string
+func azureContainerURL(accountName string, containerName string) (*url.URL, error) {
+	endpoint := fmt.Sprintf("https://%s.blob.core.windows.net", accountName)
+	if *azureEndpoint != "" {
+		endpoint = strings.TrimSuffix(*azureEndpoint, "/")
+	}
+	URL, err := url.Parse(endpoint + "/" + containerName)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid azure endpoint %s: %s", endpoint, err)
+	}
+	URL.RawQuery = strings.TrimPrefix(*azureSASToken, "?")
+	return URL, nil
+}
+
+//azureLocation returns the URL of a blob without the SAS token, which must not show up on listings and manifests
+func azureLocation(blobURL azblob.BlockBlobURL) string {
+	location := blobURL.URL()
+	location.RawQuery = ""
+	return location.String()
+}
+
+func connectToAzureContainer(accountName string, accountKey string, containerName string) (azblob.ContainerURL, context.Context, error) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	// Create a default request pipeline using your storage account name and account key.
+	sugar.Debugf("Connecting with Azure -> AccountName: %s", accountName)
+	p, err := newAzurePipeline(accountName, accountKey)
+	if err != nil {
+		return azblob.ContainerURL{}, nil, err
+	}
+
+	URL, err := azureContainerURL(accountName, containerName)
+	if err != nil {
+		return azblob.ContainerURL{}, nil, err
+	}
+
+	// Create a ContainerURL object that wraps the container URL and a request
+	// pipeline to make requests.
+	containerURL := azblob.NewContainerURL(*URL, p)
+	ctx := context.Background()
+
+	return containerURL, ctx, nil
+}
+
+//newAzurePipeline returns a request pipeline authorized by accountKey or, when it is empty, by the SAS token on the URLs
+func newAzurePipeline(accountName string, accountKey string) (pipeline.Pipeline, error) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+	var err error
+
+	if !isCredentialCreated {
+		if accountKey == "" {
+			// requests are authorized by the SAS token on the URL
+			credential = azblob.NewAnonymousCredential()
+		} else {
+			credential, err = azblob.NewSharedKeyCredential(accountName, accountKey)
+			if err != nil {
+				sugar.Debugf("Invalid credentials with error: %s", err.Error())
+				return nil, fmt.Errorf("Invalid credentials with error: %s", err.Error())
+			}
+		}
+		isCredentialCreated = true
+	}
+	// requests are tried only once by the pipeline, as they are retried by retryAzure
+	return azblob.NewPipeline(credential, azblob.PipelineOptions{Retry: azblob.RetryOptions{MaxTries: 1}}), nil
+}
+
+func createAzureContainer(containerURL azblob.ContainerURL, ctx context.Context) error {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	err := retryAzure("Create container", func() error {
+		_, err := containerURL.Create(ctx, azblob.Metadata{}, azblob.PublicAccessNone)
+		handleErrors(&err)
+		return err
+	})
+	if err != nil {
+		sugar.Debugf("Create Container with error: %s", err.Error())
+		return fmt.Errorf("Create Container with error: %s", err.Error())
+	}
+	return nil
+}
+
+func sendFileToAzure(accountName string, accountKey string, containerName string, fileName string, filePath string) error {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	containerURL, ctx, err := connectToAzureContainer(accountName, accountKey, containerName)
+	if err != nil {
+		sugar.Debugf("Connect to Azure with error: %s", err.Error())
+		return fmt.Errorf("Connect to Azure with error: %s", err.Error())
+	}
+
+	err = createAzureContainer(containerURL, ctx)
+	if err != nil {
+		return err
+	}
+
+	blob := azureBlockBlob{containerURL.NewBlockBlobURL(fileName)}
+	file, err := os.Open(filePath)
+	if err != nil {
+		sugar.Debugf("Open file with error: %s", err.Error())
+		return fmt.Errorf("Open file with error: %s", err.Error())
+	}
+	defer file.Close()
+
+	// blocks are staged and committed one by one, so that an upload that fails is resumed from the first missing block.
+	// Content-MD5 is stored on the blob, so that the file can be checked by other tools
+	sugar.Debugf("Uploading the file with blob name: %s\n", fileName)
+	blockSize, parallelism := azureTransferOptions()
+	err = uploadFileBlocks(ctx, blob, file, blockSize, parallelism)
+	if err != nil {
+		sugar.Debugf("Upload file with error: %s", err.Error())
+		return fmt.Errorf("Upload file with error: %s", err.Error())
+	}
+
+	return nil
+}
+
+func sendStreamToAzure(accountName string, accountKey string, containerName string, fileName string, reader io.Reader) error {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	containerURL, ctx, err := connectToAzureContainer(accountName, accountKey, containerName)
+	if err != nil {
+		sugar.Debugf("Connect to Azure with error: %s", err.Error())
+		return fmt.Errorf("Connect to Azure with error: %s", err.Error())
+	}
+
+	err = createAzureContainer(containerURL, ctx)
+	if err != nil {
+		return err
+	}
+
+	// the stream is read in blocks, which are kept until staged so that each one can be retried
+	sugar.Debugf("Uploading stream with blob name: %s", fileName)
+	blob := azureBlockBlob{containerURL.NewBlockBlobURL(fileName)}
+	blockSize, parallelism := azureTransferOptions()
+	err = uploadBlocks(ctx, blob, reader, blockSize, parallelism, nil)
+	if err != nil {
+		sugar.Debugf("Upload stream with error: %s", err.Error())
+		return fmt.Errorf("Upload stream with error: %s", err.Error())
+	}
+
+	return nil
+}
+
+func downloadFileFromAzure(accountName string, accountKey string, containerName string, fileName string) (io.ReadCloser, error) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	containerURL, ctx, err := connectToAzureContainer(accountName, accountKey, containerName)
+	if err != nil {
+		sugar.Debugf("Connect to Azure with error: %s", err.Error())
+		return nil, fmt.Errorf("Connect to Azure with error: %s", err.Error())
+	}
+
+	blobURL := containerURL.NewBlockBlobURL(fileName)
+	var resp *azblob.DownloadResponse
+	err = retryAzure("Download file "+fileName, func() error {
+		resp, err = blobURL.Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false)
+		return err
+	})
+	if isAzureNotFound(err) {
+		return nil, errObjectNotFound
+	}
+	if err != nil {
+		sugar.Debugf("Download file %s at container %s with error: %s", fileName, containerName, err.Error())
+		return nil, fmt.Errorf("Download file %s at container %s with error: %s", fileName, containerName, err.Error())
+	}
+
+	return resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: *azureMaxRetries}), nil
+}
+
+func deleteFileFromAzure(accountName string, accountKey string, containerName string, fileName string) error {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	containerURL, ctx, err := connectToAzureContainer(accountName, accountKey, containerName)
+	if err != nil {
+		sugar.Debugf("Connect to Azure with error: %s", err.Error())
+		return fmt.Errorf("Connect to Azure with error: %s", err.Error())
+	}
+
+	blobURL := containerURL.NewBlockBlobURL(fileName)
+	err = retryAzure("Delete file "+fileName, func() error {
+		_, err := blobURL.Delete(ctx, azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
+		return err
+	})
+	if isAzureNotFound(err) {
+		return errObjectNotFound
+	}
+	if err != nil {
+		sugar.Debugf("Delete file %s at container %s with error: %s", fileName, containerName, err.Error())
+		return fmt.Errorf("Delete file %s at container %s with error: %s", fileName, containerName, err.Error())
+	}
+
+	return nil
+}
+
+func listFilesFromAzure(accountName string, accountKey string, containerName string) ([]StorageObject, error) {
+	return listDirectoryFromAzure(accountName, accountKey, containerName, "")
+}
+
+//listDirectoryFromAzure lists the blobs of the prefix virtual directory, without descending into its subdirectories.
+//Blob names keep the prefix
+func listDirectoryFromAzure(accountName string, accountKey string, containerName string, prefix string) ([]StorageObject, error) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	containerURL, ctx, err := connectToAzureContainer(accountName, accountKey, containerName)
+	if err != nil {
+		sugar.Debugf("Connect to Azure with error: %s", err.Error())
+		return nil, fmt.Errorf("Connect to Azure with error: %s", err.Error())
+	}
+
+	objects := make([]StorageObject, 0)
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		// Get a result segment starting with the blob indicated by the current Marker.
+		var listBlob *azblob.ListBlobsHierarchySegmentResponse
+		err := retryAzure("List files", func() error {
+			var err error
+			listBlob, err = containerURL.ListBlobsHierarchySegment(ctx, marker, "/", azblob.ListBlobsSegmentOptions{Prefix: prefix})
+			return err
+		})
+		handleErrors(&err)
+		if err != nil {
+			sugar.Debugf("List files at container %s with error: %s", containerName, err.Error())
+			return nil, fmt.Errorf("List files at container %s with error: %s", containerName, err.Error())
+		}
+
+		// ListBlobs returns the start of the next segment; you MUST use this to get
+		// the next segment (after processing the current result segment).
+		marker = listBlob.NextMarker
+
+		// Process the blobs returned in this result segment (if the segment is empty, the loop body won't execute)
+		for _, blobInfo := range listBlob.Segment.BlobItems {
+			sugar.Debugf("	Blob name: %s", blobInfo.Name)
+			blobURL := containerURL.NewBlockBlobURL(blobInfo.Name)
+			objects = append(objects, StorageObject{
+				Name:     blobInfo.Name,
+				Size:     *blobInfo.Properties.ContentLength,
+				Location: azureLocation(blobURL),
+			})
+		}
+	}
+
+	return objects, nil
+}
+
+func findFileFromAzure(accountName string, accountKey string, containerName string, fileName string) (*StorageObject, error) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	containerURL, ctx, err := connectToAzureContainer(accountName, accountKey, containerName)
+	if err != nil {
+		sugar.Debugf("Connect to Azure with error: %s", err.Error())
+		return nil, fmt.Errorf("Connect to Azure with error: %s", err.Error())
+	}
+
+	blobURL := containerURL.NewBlockBlobURL(fileName)
+	var blobInfo *azblob.BlobGetPropertiesResponse
+	err = retryAzure("Get properties of "+fileName, func() error {
+		blobInfo, err = blobURL.GetProperties(ctx, azblob.BlobAccessConditions{})
+		return err
+	})
+	if isAzureNotFound(err) {
+		return nil, errObjectNotFound
+	}
+	if err != nil {
+		sugar.Debugf("Error at get properties of: %s", fileName)
+		return nil, err
+	}
+
+	backupFilePath := azureLocation(blobURL)
+	sugar.Debugf("Found backup file: %s", backupFilePath)
+
+	return &StorageObject{
+		Name:     fileName,
+		Size:     blobInfo.ContentLength(),
+		Location: backupFilePath,
+	}, nil
+}
+
+func setMetadataOnAzure(accountName string, accountKey string, containerName string, fileName string, metadata map[string]string) error {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	containerURL, ctx, err := connectToAzureContainer(accountName, accountKey, containerName)
+	if err != nil {
+		sugar.Debugf("Connect to Azure with error: %s", err.Error())
+		return fmt.Errorf("Connect to Azure with error: %s", err.Error())
+	}
+
+	blobURL := containerURL.NewBlockBlobURL(fileName)
+	err = retryAzure("Set metadata of "+fileName, func() error {
+		_, err := blobURL.SetMetadata(ctx, azblob.Metadata(metadata), azblob.BlobAccessConditions{})
+		return err
+	})
+	if isAzureNotFound(err) {
+		return errObjectNotFound
+	}
+	if err != nil {
+		sugar.Debugf("Set metadata of file %s at container %s with error: %s", fileName, containerName, err.Error())
+		return fmt.Errorf("Set metadata of file %s at container %s with error: %s", fileName, containerName, err.Error())
+	}
+
+	return nil
+}
+
+func setTierOnAzure(accountName string, accountKey string, containerName string, fileName string, tier string) error {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	containerURL, ctx, err := connectToAzureContainer(accountName, accountKey, containerName)
+	if err != nil {
+		sugar.Debugf("Connect to Azure with error: %s", err.Error())
+		return fmt.Errorf("Connect to Azure with error: %s", err.Error())
+	}
+
+	blobURL := containerURL.NewBlockBlobURL(fileName)
+	err = retryAzure("Set tier of "+fileName, func() error {
+		_, err := blobURL.SetTier(ctx, azblob.AccessTierType(tier), azblob.LeaseAccessConditions{})
+		return err
+	})
+	if isAzureNotFound(err) {
+		return errObjectNotFound
+	}
+	if err != nil {
+		sugar.Debugf("Set tier of file %s at container %s with error: %s", fileName, containerName, err.Error())
+		return fmt.Errorf("Set tier of file %s at container %s with error: %s", fileName, containerName, err.Error())
+	}
+
+	return nil
+}
+
+//getTierFromAzure returns the access tier of a blob and whether it is being rehydrated from the Archive tier
+func getTierFromAzure(accountName string, accountKey string, containerName string, fileName string) (string, bool, error) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	containerURL, ctx, err := connectToAzureContainer(accountName, accountKey, containerName)
+	if err != nil {
+		sugar.Debugf("Connect to Azure with error: %s", err.Error())
+		return "", false, fmt.Errorf("Connect to Azure with error: %s", err.Error())
+	}
+
+	blobURL := containerURL.NewBlockBlobURL(fileName)
+	var blobInfo *azblob.BlobGetPropertiesResponse
+	err = retryAzure("Get properties of "+fileName, func() error {
+		blobInfo, err = blobURL.GetProperties(ctx, azblob.BlobAccessConditions{})
+		return err
+	})
+	if isAzureNotFound(err) {
+		return "", false, errObjectNotFound
+	}
+	if err != nil {
+		sugar.Debugf("Get tier of file %s at container %s with error: %s", fileName, containerName, err.Error())
+		return "", false, fmt.Errorf("Get tier of file %s at container %s with error: %s", fileName, containerName, err.Error())
+	}
+
+	// the archive status is set while the blob is rehydrated, such as rehydrate-pending-to-hot
+	return blobInfo.AccessTier(), strings.HasPrefix(blobInfo.ArchiveStatus(), "rehydrate-pending"), nil
+}
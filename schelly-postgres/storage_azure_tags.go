@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"go.uber.org/zap"
+)
+
+//azureTagsVersion is the first version of the Azure Blob API with blob index tags, which azblob doesn't implement yet
+const azureTagsVersion = "2019-12-12"
+
+//azureRESTError is an Azure response with an unexpected status to a request not made by azblob
+type azureRESTError struct {
+	status int
+	code   string
+}
+
+func (e *azureRESTError) Error() string {
+	return fmt.Sprintf("Azure responded %d %s", e.status, e.code)
+}
+
+type azureTag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+type azureTags struct {
+	XMLName xml.Name   `xml:"Tags"`
+	TagSet  []azureTag `xml:"TagSet>Tag"`
+}
+
+type azureFilterBlobs struct {
+	XMLName    xml.Name `xml:"EnumerationResults"`
+	Blobs      []string `xml:"Blobs>Blob>Name"`
+	NextMarker string   `xml:"NextMarker"`
+}
+
+//expectAzureStatus is the method factory of the requests sent by doAzureRequest. Responses with other statuses are
+//turned into an azureRESTError
+func expectAzureStatus(statuses ...int) pipeline.Factory {
+	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			resp, err := next.Do(ctx, request)
+			if err != nil {
+				return resp, err
+			}
+			for _, status := range statuses {
+				if resp.Response().StatusCode == status {
+					return resp, nil
+				}
+			}
+			defer resp.Response().Body.Close()
+			ioutil.ReadAll(resp.Response().Body)
+			return resp, &azureRESTError{status: resp.Response().StatusCode, code: resp.Response().Header.Get("x-ms-error-code")}
+		}
+	})
+}
+
+//doAzureRequest sends a request to the Azure Blob API through the pipeline of the account, with retries, and returns
+//the body of the response
+func doAzureRequest(accountName string, accountKey string, description string, method string, URL url.URL, body []byte, status int) ([]byte, error) {
+	p, err := newAzurePipeline(accountName, accountKey)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	err = retryAzure(description, func() error {
+		request, err := pipeline.NewRequest(method, URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		request.Header.Set("x-ms-version", azureTagsVersion)
+		if body != nil {
+			request.Header.Set("Content-Type", "application/xml")
+		}
+		resp, err := p.Do(context.Background(), expectAzureStatus(status), request)
+		if err != nil {
+			return err
+		}
+		defer resp.Response().Body.Close()
+		data, err = ioutil.ReadAll(resp.Response().Body)
+		return err
+	})
+	return data, err
+}
+
+//setTagsOnAzure replaces the blob index tags of a blob
+func setTagsOnAzure(accountName string, accountKey string, containerName string, fileName string, tags map[string]string) error {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	URL, err := azureContainerURL(accountName, containerName)
+	if err != nil {
+		return err
+	}
+	URL.Path = URL.Path + "/" + fileName
+	query := URL.Query()
+	query.Set("comp", "tags")
+	URL.RawQuery = query.Encode()
+
+	keys := make([]string, 0)
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	body := azureTags{}
+	for _, key := range keys {
+		body.TagSet = append(body.TagSet, azureTag{Key: key, Value: tags[key]})
+	}
+	data, err := xml.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	_, err = doAzureRequest(accountName, accountKey, "Set tags of "+fileName, "PUT", *URL, data, http.StatusNoContent)
+	if isAzureNotFound(err) {
+		return errObjectNotFound
+	}
+	if err != nil {
+		sugar.Debugf("Set tags of file %s at container %s with error: %s", fileName, containerName, err.Error())
+		return fmt.Errorf("Set tags of file %s at container %s with error: %s", fileName, containerName, err.Error())
+	}
+	return nil
+}
+
+//findByTagsOnAzure returns the names of the blobs of the container whose index tags have all tags. The tag index is
+//updated in the background, so blobs tagged moments ago may be missing
+func findByTagsOnAzure(accountName string, accountKey string, containerName string, tags map[string]string) ([]string, error) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	//blobs are found on the account, which is the parent of the container on the URL
+	URL, err := azureContainerURL(accountName, containerName)
+	if err != nil {
+		return nil, err
+	}
+	URL.Path = path.Dir(URL.Path)
+	if URL.Path == "." {
+		URL.Path = "/"
+	}
+
+	keys := make([]string, 0)
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	conditions := []string{fmt.Sprintf("@container='%s'", containerName)}
+	for _, key := range keys {
+		conditions = append(conditions, fmt.Sprintf("\"%s\"='%s'", key, strings.Replace(tags[key], "'", "''", -1)))
+	}
+
+	names := make([]string, 0)
+	for marker := ""; ; {
+		query := URL.Query()
+		query.Set("comp", "blobs")
+		query.Set("where", strings.Join(conditions, " AND "))
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		pageURL := *URL
+		pageURL.RawQuery = query.Encode()
+		data, err := doAzureRequest(accountName, accountKey, "Find blobs by tags", "GET", pageURL, nil, http.StatusOK)
+		if err != nil {
+			sugar.Debugf("Find blobs by tags at container %s with error: %s", containerName, err.Error())
+			return nil, fmt.Errorf("Find blobs by tags at container %s with error: %s", containerName, err.Error())
+		}
+		result := azureFilterBlobs{}
+		err = xml.Unmarshal(data, &result)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid response to find blobs by tags: %s", err)
+		}
+		names = append(names, result.Blobs...)
+		marker = result.NextMarker
+		if marker == "" {
+			break
+		}
+	}
+	return names, nil
+}
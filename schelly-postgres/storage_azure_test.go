@@ -0,0 +1,716 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/flaviostutz/schelly-webhook/schellyhook"
+	"go.uber.org/zap"
+)
+
+//fakeAzure implements the subset of the Azure Blob API used by azureBlobStorage, on the path-style URLs used by Azurite
+//(http://host/account/container/blob). When sasToken is set, requests must carry it instead of a shared key
+type fakeAzure struct {
+	mutex       sync.Mutex
+	account     string
+	sasToken    string
+	containers  map[string]bool
+	blobs       map[string][]byte
+	contentMD5  map[string]string
+	metadata    map[string]http.Header
+	tags        map[string]map[string]string
+	tiers       map[string]string
+	rehydrating map[string]string
+	tierChanges map[string]int
+	uncommitted map[string]map[string][]byte
+}
+
+func newFakeAzure(account string) *fakeAzure {
+	return &fakeAzure{
+		account:     account,
+		containers:  make(map[string]bool),
+		blobs:       make(map[string][]byte),
+		contentMD5:  make(map[string]string),
+		metadata:    make(map[string]http.Header),
+		tags:        make(map[string]map[string]string),
+		tiers:       make(map[string]string),
+		rehydrating: make(map[string]string),
+		tierChanges: make(map[string]int),
+		uncommitted: make(map[string]map[string][]byte),
+	}
+}
+
+type fakeAzureBlockList struct {
+	XMLName xml.Name `xml:"BlockList"`
+	Latest  []string `xml:"Latest"`
+}
+
+type fakeAzureBlock struct {
+	Name string `xml:"Name"`
+	Size int    `xml:"Size"`
+}
+
+type fakeAzureBlockListResult struct {
+	XMLName           xml.Name         `xml:"BlockList"`
+	CommittedBlocks   []fakeAzureBlock `xml:"CommittedBlocks>Block"`
+	UncommittedBlocks []fakeAzureBlock `xml:"UncommittedBlocks>Block"`
+}
+
+type fakeAzureListResult struct {
+	XMLName       xml.Name        `xml:"EnumerationResults"`
+	ContainerName string          `xml:"ContainerName,attr"`
+	Blobs         []fakeAzureBlob `xml:"Blobs>Blob"`
+	BlobPrefixes  []string        `xml:"Blobs>BlobPrefix>Name"`
+	NextMarker    string          `xml:"NextMarker"`
+}
+
+type fakeAzureFindResult struct {
+	XMLName    xml.Name             `xml:"EnumerationResults"`
+	Blobs      []fakeAzureFoundBlob `xml:"Blobs>Blob"`
+	NextMarker string               `xml:"NextMarker"`
+}
+
+type fakeAzureFoundBlob struct {
+	Name          string `xml:"Name"`
+	ContainerName string `xml:"ContainerName"`
+}
+
+type fakeAzureBlob struct {
+	Name          string `xml:"Name"`
+	LastModified  string `xml:"Properties>Last-Modified"`
+	ContentLength int    `xml:"Properties>Content-Length"`
+}
+
+func (fa *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fa.mutex.Lock()
+	defer fa.mutex.Unlock()
+
+	query := r.URL.Query()
+	if fa.sasToken != "" && query.Get("sig") == "" {
+		fa.sendError(w, http.StatusForbidden, "AuthenticationFailed")
+		return
+	}
+	if fa.sasToken == "" && !strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey "+fa.account+":") {
+		fa.sendError(w, http.StatusForbidden, "AuthenticationFailed")
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	if len(parts) == 1 && parts[0] == fa.account && query.Get("comp") == "blobs" {
+		fa.findBlobs(w, query.Get("where"))
+		return
+	}
+	if len(parts) < 2 || parts[0] != fa.account {
+		fa.sendError(w, http.StatusBadRequest, "InvalidUri")
+		return
+	}
+	container := parts[1]
+	if query.Get("restype") == "container" && r.Method == "PUT" {
+		if fa.containers[container] {
+			fa.sendError(w, http.StatusConflict, "ContainerAlreadyExists")
+			return
+		}
+		fa.containers[container] = true
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	if !fa.containers[container] {
+		fa.sendError(w, http.StatusNotFound, "ContainerNotFound")
+		return
+	}
+	if len(parts) == 2 {
+		if query.Get("comp") != "list" {
+			fa.sendError(w, http.StatusNotImplemented, "NotImplemented")
+			return
+		}
+		result := fakeAzureListResult{ContainerName: container}
+		prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+		names := make([]string, 0)
+		for name := range fa.blobs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			rest := strings.TrimPrefix(name, prefix)
+			if delimiter != "" && strings.Contains(rest, delimiter) {
+				dir := prefix + rest[:strings.Index(rest, delimiter)+len(delimiter)]
+				if len(result.BlobPrefixes) == 0 || result.BlobPrefixes[len(result.BlobPrefixes)-1] != dir {
+					result.BlobPrefixes = append(result.BlobPrefixes, dir)
+				}
+				continue
+			}
+			result.Blobs = append(result.Blobs, fakeAzureBlob{
+				Name:          name,
+				LastModified:  time.Now().UTC().Format(http.TimeFormat),
+				ContentLength: len(fa.blobs[name]),
+			})
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(result)
+		return
+	}
+
+	name := parts[2]
+	body, _ := ioutil.ReadAll(r.Body)
+	switch {
+	case r.Method == "PUT" && query.Get("comp") == "block":
+		if fa.uncommitted[name] == nil {
+			fa.uncommitted[name] = make(map[string][]byte)
+		}
+		fa.uncommitted[name][query.Get("blockid")] = body
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "PUT" && query.Get("comp") == "blocklist":
+		list := fakeAzureBlockList{}
+		xml.Unmarshal(body, &list)
+		var data bytes.Buffer
+		for _, id := range list.Latest {
+			block, ok := fa.uncommitted[name][id]
+			if !ok {
+				fa.sendError(w, http.StatusBadRequest, "InvalidBlockList")
+				return
+			}
+			data.Write(block)
+		}
+		fa.blobs[name] = data.Bytes()
+		fa.contentMD5[name] = r.Header.Get("x-ms-blob-content-md5")
+		delete(fa.uncommitted, name)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "PUT" && query.Get("comp") == "metadata":
+		if _, ok := fa.blobs[name]; !ok {
+			fa.sendError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		fa.metadata[name] = make(http.Header)
+		for key, values := range r.Header {
+			if strings.HasPrefix(strings.ToLower(key), "x-ms-meta-") {
+				fa.metadata[name][key] = values
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	case r.Method == "PUT" && query.Get("comp") == "tags":
+		if _, ok := fa.blobs[name]; !ok {
+			fa.sendError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		tags := azureTags{}
+		xml.Unmarshal(body, &tags)
+		fa.tags[name] = make(map[string]string)
+		for _, tag := range tags.TagSet {
+			fa.tags[name][tag.Key] = tag.Value
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "PUT" && query.Get("comp") == "tier":
+		if _, ok := fa.blobs[name]; !ok {
+			fa.sendError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		tier := r.Header.Get("x-ms-access-tier")
+		fa.tierChanges[name]++
+		if fa.rehydrating[name] != "" {
+			fa.sendError(w, http.StatusConflict, "BlobBeingRehydrated")
+			return
+		}
+		if fa.tiers[name] == "Archive" && tier != "Archive" {
+			//rehydration finishes when the test calls rehydrate
+			fa.rehydrating[name] = tier
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		fa.tiers[name] = tier
+		w.WriteHeader(http.StatusOK)
+	case r.Method == "GET" && query.Get("comp") == "blocklist":
+		if _, ok := fa.uncommitted[name]; !ok {
+			fa.sendError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		result := fakeAzureBlockListResult{}
+		for id, block := range fa.uncommitted[name] {
+			result.UncommittedBlocks = append(result.UncommittedBlocks, fakeAzureBlock{Name: id, Size: len(block)})
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == "GET" || r.Method == "HEAD":
+		data, ok := fa.blobs[name]
+		if !ok {
+			fa.sendError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		if r.Method == "GET" && fa.tiers[name] == "Archive" {
+			fa.sendError(w, http.StatusConflict, "BlobArchived")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Content-MD5", fa.contentMD5[name])
+		if fa.tiers[name] != "" {
+			w.Header().Set("x-ms-access-tier", fa.tiers[name])
+		}
+		if fa.rehydrating[name] != "" {
+			w.Header().Set("x-ms-archive-status", "rehydrate-pending-to-"+strings.ToLower(fa.rehydrating[name]))
+		}
+		for key, values := range fa.metadata[name] {
+			w.Header()[key] = values
+		}
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+	case r.Method == "DELETE":
+		if _, ok := fa.blobs[name]; !ok {
+			fa.sendError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		delete(fa.blobs, name)
+		delete(fa.metadata, name)
+		delete(fa.tags, name)
+		delete(fa.tiers, name)
+		delete(fa.rehydrating, name)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		fa.sendError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+//rehydrate finishes the rehydration of a blob, which takes hours on Azure
+func (fa *fakeAzure) rehydrate(name string) {
+	fa.mutex.Lock()
+	defer fa.mutex.Unlock()
+	fa.tiers[name] = fa.rehydrating[name]
+	delete(fa.rehydrating, name)
+}
+
+//findBlobs answers a Find Blobs by Tags request. where only supports conditions on equality joined by AND
+func (fa *fakeAzure) findBlobs(w http.ResponseWriter, where string) {
+	container := ""
+	conditions := make(map[string]string)
+	for _, condition := range strings.Split(where, " AND ") {
+		kv := strings.SplitN(condition, "=", 2)
+		if len(kv) != 2 {
+			fa.sendError(w, http.StatusBadRequest, "InvalidQueryParameterValue")
+			return
+		}
+		value := strings.Replace(strings.Trim(kv[1], "'"), "''", "'", -1)
+		if kv[0] == "@container" {
+			container = value
+			continue
+		}
+		conditions[strings.Trim(kv[0], "\"")] = value
+	}
+	result := fakeAzureFindResult{}
+	names := make([]string, 0)
+	for name := range fa.tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		matches := true
+		for key, value := range conditions {
+			if fa.tags[name][key] != value {
+				matches = false
+			}
+		}
+		if matches {
+			result.Blobs = append(result.Blobs, fakeAzureFoundBlob{Name: name, ContainerName: container})
+		}
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func (fa *fakeAzure) sendError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+//newTestAzureStorage connects to the Azurite instance of the AZURITE_CONNECTION_STRING environment variable
+//(such as UseDevelopmentStorage=true) or, when it isn't set, to a fakeAzure server
+func newTestAzureStorage(t *testing.T) (Storage, func()) {
+	connectionString := os.Getenv("AZURITE_CONNECTION_STRING")
+	if connectionString == "" {
+		storage, _, close := newFakeAzureStorage(t)
+		return storage, close
+	}
+	*azureConnectionString = connectionString
+	*containerName = fmt.Sprintf("schelly-test-%d", time.Now().UnixNano())
+	storage, err := newStorage("azure")
+	if err != nil {
+		t.Fatalf("Error creating Azure storage: %s", err)
+	}
+	return storage, func() {}
+}
+
+//newFakeAzureStorage connects to a new fakeAzure server, which is returned so that tests can look at the blobs
+func newFakeAzureStorage(t *testing.T) (Storage, *fakeAzure, func()) {
+	fake := newFakeAzure("devstoreaccount1")
+	server := httptest.NewServer(fake)
+	close := server.Close
+	*azureConnectionString = "DefaultEndpointsProtocol=http;AccountName=devstoreaccount1;AccountKey=" + azuriteAccountKey +
+		";BlobEndpoint=" + server.URL + "/devstoreaccount1;"
+	*containerName = fmt.Sprintf("schelly-test-%d", time.Now().UnixNano())
+	storage, err := newStorage("azure")
+	if err != nil {
+		close()
+		t.Fatalf("Error creating Azure storage: %s", err)
+	}
+	return storage, fake, close
+}
+
+func TestParseAzureConnectionString(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestParseAzureConnectionString...")
+	conn, err := parseAzureConnectionString("DefaultEndpointsProtocol=https;AccountName=acme;AccountKey=a2V5==;EndpointSuffix=core.usgovcloudapi.net")
+	if err != nil || conn.AccountName != "acme" || conn.AccountKey != "a2V5==" || conn.Endpoint != "https://acme.blob.core.usgovcloudapi.net" {
+		t.Errorf("Unexpected connection %v. err=%s", conn, err)
+	}
+
+	conn, err = parseAzureConnectionString("BlobEndpoint=https://acme.blob.core.windows.net/;SharedAccessSignature=sv=2018-03-28&sig=abc%3D")
+	if err != nil || conn.AccountKey != "" || conn.SASToken != "sv=2018-03-28&sig=abc%3D" || conn.Endpoint != "https://acme.blob.core.windows.net/" {
+		t.Errorf("Unexpected SAS connection %v. err=%s", conn, err)
+	}
+
+	conn, err = parseAzureConnectionString("UseDevelopmentStorage=true")
+	if err != nil || conn.AccountName != "devstoreaccount1" || conn.Endpoint != "http://127.0.0.1:10000/devstoreaccount1" {
+		t.Errorf("Unexpected development storage connection %v. err=%s", conn, err)
+	}
+
+	for _, invalid := range []string{"AccountName=acme", "AccountKey=a2V5", "AccountName"} {
+		_, err = parseAzureConnectionString(invalid)
+		if err == nil {
+			t.Errorf("Connection string %s should be invalid", invalid)
+		}
+	}
+}
+
+func TestAzureEndpointAndSASToken(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestAzureEndpointAndSASToken...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+
+	URL, err := azureContainerURL("acme", "backups")
+	if err != nil || URL.String() != "https://acme.blob.core.windows.net/backups" {
+		t.Errorf("Default endpoint should be the Azure public cloud. url=%s err=%s", URL, err)
+	}
+
+	fake := newFakeAzure("devstoreaccount1")
+	fake.sasToken = "sv=2018-03-28&sig=abc"
+	fake.containers["backups"] = true
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	*azureEndpoint = server.URL + "/devstoreaccount1/"
+	*azureSASToken = "?" + fake.sasToken
+	storage, err := newStorage("azure")
+	if err == nil {
+		t.Errorf("Container name should be required")
+	}
+	*containerName = "backups"
+	storage, err = newStorage("azure")
+	if err != nil {
+		t.Fatalf("SAS token should be enough to connect without account name and key. err=%s", err)
+	}
+
+	err = storage.Put("sas", strings.NewReader("sas content"))
+	if err != nil {
+		t.Fatalf("Error putting object with SAS token: %s", err)
+	}
+	object, err := storage.Stat("sas")
+	if err != nil || object.Size != int64(len("sas content")) {
+		t.Fatalf("Unexpected object info %v. err=%s", object, err)
+	}
+	if strings.Contains(object.Location, "sig=") || object.Location != server.URL+"/devstoreaccount1/backups/sas" {
+		t.Errorf("Object location shouldn't show the SAS token. location=%s", object.Location)
+	}
+
+	*azureConnectionString = "AccountName=other;AccountKey=" + azuriteAccountKey
+	_, err = newStorage("azure")
+	if err == nil {
+		t.Errorf("Connection string shouldn't override a different endpoint arg")
+	}
+}
+
+func TestAzureStorage(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestAzureStorage...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	*azureBlockSize = 1
+	storage, close := newTestAzureStorage(t)
+	defer close()
+
+	err := storage.Put("small", strings.NewReader("small content"))
+	if err != nil {
+		t.Fatalf("Error putting small object: %s", err)
+	}
+
+	big := bytes.Repeat([]byte("0123456789"), 250*1024)
+	bigFile := dir + "/big"
+	ioutil.WriteFile(bigFile, big, 0644)
+	_, _, err = storeFile(storage, "big", bigFile)
+	if err != nil {
+		t.Fatalf("Error putting big file: %s", err)
+	}
+
+	reader, err := storage.Get("big")
+	if err != nil {
+		t.Fatalf("Error getting object: %s", err)
+	}
+	data, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	if !bytes.Equal(data, big) {
+		t.Errorf("Block blob contents differ. size=%d", len(data))
+	}
+
+	objects, err := storage.List()
+	if err != nil {
+		t.Fatalf("Error listing objects: %s", err)
+	}
+	if len(objects) != 2 || objects[0].Name != "big" || objects[1].Name != "small" {
+		t.Errorf("Unexpected objects list: %v", objects)
+	}
+
+	object, err := storage.Stat("small")
+	if err != nil || object.Size != int64(len("small content")) {
+		t.Errorf("Unexpected object info %v. err=%s", object, err)
+	}
+	_, err = storage.Stat("missing")
+	if err != errObjectNotFound {
+		t.Errorf("Expected errObjectNotFound for missing object. err=%s", err)
+	}
+	_, err = storage.Get("missing")
+	if err != errObjectNotFound {
+		t.Errorf("Expected errObjectNotFound getting a missing object. err=%s", err)
+	}
+
+	err = storage.Delete("small")
+	if err != nil {
+		t.Errorf("Error deleting object: %s", err)
+	}
+	err = storage.Delete("small")
+	if err != errObjectNotFound {
+		t.Errorf("Expected errObjectNotFound deleting a removed object. err=%s", err)
+	}
+}
+
+func TestBackupFlowWithAzureStorage(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestBackupFlowWithAzureStorage...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	installFakeCommand(t, dir, "pg_dump", fakePgDumpScript)
+	storage, close := newTestAzureStorage(t)
+	defer close()
+	backupStorage = storage
+
+	backuper := PostgresBackuper{}
+	err := backuper.CreateNewBackup("789", 0, &schellyhook.ShellContext{})
+	if err != nil {
+		t.Fatalf("Error creating backup: %s", err)
+	}
+	backupJobs.wait("789")
+
+	backup, err := backuper.GetBackup("789")
+	if err != nil || backup == nil || backup.Status != statusAvailable {
+		t.Fatalf("Backup should be available. backup=%v err=%s", backup, err)
+	}
+	m, err := readManifest("789")
+	if err != nil {
+		t.Fatalf("Error reading manifest: %s", err)
+	}
+	md5, err := azureContentMD5(m.Artifact)
+	if err != nil || md5 == "" {
+		t.Errorf("Backup blob should have Content-MD5. err=%s", err)
+	}
+
+	err = backuper.DeleteBackup("789")
+	if err != nil {
+		t.Errorf("Error deleting backup: %s", err)
+	}
+	backup, err = backuper.GetBackup("789")
+	if err != nil || backup != nil {
+		t.Errorf("Backup should be deleted. backup=%v err=%s", backup, err)
+	}
+}
+
+func TestAzurePrefix(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestAzurePrefix...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	if azurePrefixFor("/backups/{database}/", "schelly") != "backups/schelly/" || azurePrefixFor("", "schelly") != "" {
+		t.Errorf("Unexpected prefix %s", azurePrefixFor("/backups/{database}/", "schelly"))
+	}
+
+	//both providers share the container of the root storage
+	root, close := newTestAzureStorage(t)
+	defer close()
+	*azurePrefix = "backups/{database}"
+	first, err := newStorage("azure")
+	if err != nil {
+		t.Fatalf("Error creating Azure storage: %s", err)
+	}
+	*dbname = "other"
+	second, err := newStorage("azure")
+	if err != nil {
+		t.Fatalf("Error creating Azure storage: %s", err)
+	}
+
+	for _, storage := range []Storage{root, first, second} {
+		err = storage.Put("123.manifest.json", strings.NewReader(fmt.Sprintf("%p", storage)))
+		if err != nil {
+			t.Fatalf("Error putting object: %s", err)
+		}
+	}
+	for _, storage := range []Storage{root, first, second} {
+		objects, err := storage.List()
+		if err != nil || len(objects) != 1 || objects[0].Name != "123.manifest.json" {
+			t.Errorf("Each storage should only list its own objects. objects=%v err=%s", objects, err)
+		}
+		reader, err := storage.Get("123.manifest.json")
+		if err != nil {
+			t.Fatalf("Error getting object: %s", err)
+		}
+		data, _ := ioutil.ReadAll(reader)
+		reader.Close()
+		if string(data) != fmt.Sprintf("%p", storage) {
+			t.Errorf("Storage should get its own object. data=%s", data)
+		}
+	}
+
+	object, err := second.Stat("123.manifest.json")
+	if err != nil || object.Name != "123.manifest.json" || !strings.HasSuffix(object.Location, "/backups/other/123.manifest.json") {
+		t.Errorf("Object should be stored under the prefix. object=%v err=%s", object, err)
+	}
+	err = second.Delete("123.manifest.json")
+	if err != nil {
+		t.Errorf("Error deleting object: %s", err)
+	}
+	_, err = first.Stat("123.manifest.json")
+	if err != nil {
+		t.Errorf("Deleting an object shouldn't touch other prefixes. err=%s", err)
+	}
+}
+
+func TestAzureLabels(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestAzureLabels...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	installFakeCommand(t, dir, "pg_dump", fakePgDumpScript)
+	*azurePrefix = "{database}"
+	storage, fake, close := newFakeAzureStorage(t)
+	defer close()
+	backupStorage = storage
+
+	_, err := unwrapStorage(storage).(labelStorage).FindByLabels(map[string]string{"api_id": "321"})
+	if err != errLabelsNotIndexed {
+		t.Errorf("Labels shouldn't be searchable without index tags. err=%s", err)
+	}
+
+	backuper := PostgresBackuper{}
+	err = backuper.CreateNewBackup("321", 0, &schellyhook.ShellContext{})
+	if err != nil {
+		t.Fatalf("Error creating backup: %s", err)
+	}
+	backupJobs.wait("321")
+	m, err := readManifest("321")
+	if err != nil || m.Status != statusAvailable {
+		t.Fatalf("Backup should be available. m=%v err=%s", m, err)
+	}
+	for _, name := range []string{"schelly/" + manifestName("321"), "schelly/" + m.Artifact} {
+		metadata := fake.metadata[name]
+		if metadata.Get("x-ms-meta-api_id") != "321" || metadata.Get("x-ms-meta-pg_dump_id") != m.PgDumpID ||
+			metadata.Get("x-ms-meta-database") != "schelly" || metadata.Get("x-ms-meta-status") != statusAvailable {
+			t.Errorf("Blob %s should have the backup labels as metadata. metadata=%v", name, metadata)
+		}
+		if fake.tags[name] != nil {
+			t.Errorf("Blob %s shouldn't have index tags unless enabled. tags=%v", name, fake.tags[name])
+		}
+	}
+
+	*azureIndexTags = true
+	storage, err = newStorage("azure")
+	if err != nil {
+		t.Fatalf("Error creating Azure storage: %s", err)
+	}
+	backupStorage = storage
+	err = writeManifest(m)
+	if err != nil {
+		t.Fatalf("Error writing manifest: %s", err)
+	}
+	tags := fake.tags["schelly/"+m.Artifact]
+	if tags["api_id"] != "321" || tags["status"] != statusAvailable || tags["database"] != "schelly" {
+		t.Errorf("Backup file should have the backup labels as index tags. tags=%v", tags)
+	}
+	objects, err := unwrapStorage(storage).(labelStorage).FindByLabels(map[string]string{"api_id": "321", "status": statusAvailable})
+	if err != nil || len(objects) != 2 {
+		t.Fatalf("Manifest and backup file should be found by their labels. objects=%v err=%s", objects, err)
+	}
+	for _, object := range objects {
+		if object.Name != manifestName("321") && object.Name != m.Artifact {
+			t.Errorf("Unexpected object found by labels %s", object.Name)
+		}
+	}
+
+	//a backup whose manifest was lost is still deleted, by its labels
+	err = storage.Delete(manifestName("321"))
+	if err != nil {
+		t.Fatalf("Error deleting manifest: %s", err)
+	}
+	err = backuper.DeleteBackup("321")
+	if err != nil {
+		t.Errorf("Orphan backup file should be deleted. err=%s", err)
+	}
+	if len(fake.blobs) != 0 {
+		t.Errorf("All blobs of the backup should be deleted. blobs=%d", len(fake.blobs))
+	}
+	err = backuper.DeleteBackup("321")
+	if err != errObjectNotFound {
+		t.Errorf("Deleting a missing backup should fail. err=%s", err)
+	}
+}
+
+//azureContentMD5 returns the Content-MD5 of a blob, encoded as base64
+func azureContentMD5(name string) (string, error) {
+	containerURL, ctx, err := connectToAzureContainer(*accountName, *accountKey, *containerName)
+	if err != nil {
+		return "", err
+	}
+	properties, err := containerURL.NewBlockBlobURL(name).GetProperties(ctx, azblob.BlobAccessConditions{})
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(properties.ContentMD5()), nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+//azureMaxBlocks is the largest number of blocks a block blob can have
+const azureMaxBlocks = 50000
+
+//blockBlob stages and commits the blocks of a block blob
+type blockBlob interface {
+	stageBlock(ctx context.Context, id string, data []byte) error
+	uncommittedBlocks(ctx context.Context) (map[string]bool, error)
+	commitBlocks(ctx context.Context, ids []string, contentMD5 []byte) error
+}
+
+//azureBlockBlob is a blockBlob on an Azure container
+type azureBlockBlob struct {
+	url azblob.BlockBlobURL
+}
+
+func (b azureBlockBlob) stageBlock(ctx context.Context, id string, data []byte) error {
+	sum := md5.Sum(data)
+	_, err := b.url.StageBlock(ctx, id, bytes.NewReader(data), azblob.LeaseAccessConditions{}, sum[:])
+	return err
+}
+
+//uncommittedBlocks returns the ids of the blocks staged by a previous upload that wasn't committed
+func (b azureBlockBlob) uncommittedBlocks(ctx context.Context) (map[string]bool, error) {
+	ids := make(map[string]bool)
+	list, err := b.url.GetBlockList(ctx, azblob.BlockListUncommitted, azblob.LeaseAccessConditions{})
+	if isAzureNotFound(err) {
+		return ids, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, block := range list.UncommittedBlocks {
+		ids[block.Name] = true
+	}
+	return ids, nil
+}
+
+func (b azureBlockBlob) commitBlocks(ctx context.Context, ids []string, contentMD5 []byte) error {
+	_, err := b.url.CommitBlockList(ctx, ids, azblob.BlobHTTPHeaders{ContentMD5: contentMD5}, azblob.Metadata{}, azblob.BlobAccessConditions{})
+	return err
+}
+
+//blockID names a block after its position and the MD5 of its data, so that a resumed upload recognizes the blocks
+//staged by the previous attempt. Azure requires all block ids of a blob to have the same length
+func blockID(index int, data []byte) string {
+	sum := md5.Sum(data)
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d-%x", index, sum)))
+}
+
+//uploadBlocks reads reader in blocks of blockSize and stages up to parallelism blocks at once. Blocks found in staged
+//are already on Azure and are skipped. Once all blocks are staged they are committed, with the MD5 of the whole contents
+//as Content-MD5. Streams, which can't be read again, have a nil staged: each of their blocks is retried on its own.
+//Files are retried as a whole by uploadFileBlocks instead, so their blocks are tried once
+func uploadBlocks(ctx context.Context, blob blockBlob, reader io.Reader, blockSize int64, parallelism int, staged map[string]bool) error {
+	try := func(description string, operation func() error) error {
+		if staged != nil {
+			return operation()
+		}
+		return retryAzure(description, operation)
+	}
+	hash := md5.New()
+	ids := make([]string, 0)
+	slots := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var stageErr error
+	failed := func() error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return stageErr
+	}
+
+	var err error
+	for index := 0; err == nil && failed() == nil; index++ {
+		data := make([]byte, blockSize)
+		n, readErr := io.ReadFull(reader, data)
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil && readErr != io.ErrUnexpectedEOF {
+			err = fmt.Errorf("Read block %d with error: %s", index, readErr)
+			break
+		}
+		if index >= azureMaxBlocks {
+			err = fmt.Errorf("Blob would have more than %d blocks. Increase `--azure-block-size`", azureMaxBlocks)
+			break
+		}
+		data = data[:n]
+		hash.Write(data)
+		id := blockID(index, data)
+		ids = append(ids, id)
+		if !staged[id] {
+			slots <- struct{}{}
+			wg.Add(1)
+			go func(index int, id string, data []byte) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				err := try(fmt.Sprintf("Stage block %d", index), func() error {
+					return blob.stageBlock(ctx, id, data)
+				})
+				mutex.Lock()
+				if err != nil && stageErr == nil {
+					//the error is kept as is, so that the caller can tell whether it is transient
+					stageErr = err
+				}
+				mutex.Unlock()
+			}(index, id, data)
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	wg.Wait()
+	if err == nil {
+		err = failed()
+	}
+	if err != nil {
+		return err
+	}
+
+	return try("Commit block list", func() error {
+		return blob.commitBlocks(ctx, ids, hash.Sum(nil))
+	})
+}
+
+//uploadFileBlocks uploads a file with uploadBlocks. When the upload fails, it is resumed from the first block
+//that isn't staged on Azure yet, as long as there are retries left. This is the only level the upload is retried at
+func uploadFileBlocks(ctx context.Context, blob blockBlob, file io.ReadSeeker, blockSize int64, parallelism int) error {
+	return retryAzure("Upload file", func() error {
+		staged, err := blob.uncommittedBlocks(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = file.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		return uploadBlocks(ctx, blob, file, blockSize, parallelism, staged)
+	})
+}
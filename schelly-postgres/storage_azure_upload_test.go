@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"go.uber.org/zap"
+)
+
+func TestAzureRetryDelay(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestAzureRetryDelay...")
+	expected := time.Second
+	for attempt := 1; attempt <= 12; attempt++ {
+		delay := retryDelay(time.Second, attempt)
+		if delay < expected*3/4 || delay > expected*5/4 {
+			t.Errorf("Retry %d should wait about %s. delay=%s", attempt, expected, delay)
+		}
+		expected *= 2
+		if expected > azureMaxRetryDelay {
+			expected = azureMaxRetryDelay
+		}
+	}
+}
+
+//errConnectionReset is a transient network error
+var errConnectionReset = &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+
+func TestTransientAzureError(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestTransientAzureError...")
+	transient := []error{
+		errConnectionReset,
+		pipeline.NewError(errConnectionReset, "Stage block"),
+		&url.Error{Op: "Put", URL: "https://account.blob.core.windows.net", Err: errConnectionReset},
+		context.DeadlineExceeded,
+		&azureRESTError{status: 503},
+		&azureRESTError{status: 429},
+	}
+	for _, err := range transient {
+		if !isTransientAzureError(err) {
+			t.Errorf("Error should be retried. err=%s", err)
+		}
+	}
+	final := []error{
+		context.Canceled,
+		&url.Error{Op: "Put", URL: "https://account.blob.core.windows.net", Err: context.Canceled},
+		fmt.Errorf("Read block 3 with error: file already closed"),
+		errObjectNotFound,
+		&azureRESTError{status: 403},
+	}
+	for _, err := range final {
+		if isTransientAzureError(err) {
+			t.Errorf("Error should not be retried. err=%s", err)
+		}
+	}
+}
+
+func TestAzureRetry(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestAzureRetry...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	*azureMaxRetries = 2
+
+	calls := 0
+	err := retryAzure("Flaky operation", func() error {
+		calls++
+		if calls < 3 {
+			return errConnectionReset
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("Operation should succeed on the last retry. calls=%d err=%s", calls, err)
+	}
+
+	calls = 0
+	err = retryAzure("Failing operation", func() error {
+		calls++
+		return errConnectionReset
+	})
+	if err == nil || calls != 3 {
+		t.Errorf("Operation should fail after 2 retries. calls=%d err=%s", calls, err)
+	}
+
+	calls = 0
+	err = retryAzure("Missing blob", func() error {
+		calls++
+		return errObjectNotFound
+	})
+	if err != errObjectNotFound || calls != 1 {
+		t.Errorf("Missing blobs shouldn't be retried. calls=%d err=%s", calls, err)
+	}
+}
+
+//fakeBlockBlob keeps staged blocks in memory. Staging the block failID fails the first failures times
+type fakeBlockBlob struct {
+	mutex      sync.Mutex
+	staged     map[string][]byte
+	stageCount map[string]int
+	failID     string
+	failures   int
+	content    []byte
+	contentMD5 []byte
+}
+
+func newFakeBlockBlob() *fakeBlockBlob {
+	return &fakeBlockBlob{staged: make(map[string][]byte), stageCount: make(map[string]int)}
+}
+
+func (fb *fakeBlockBlob) stageBlock(ctx context.Context, id string, data []byte) error {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	if id == fb.failID && fb.failures > 0 {
+		fb.failures--
+		return errConnectionReset
+	}
+	fb.staged[id] = append([]byte{}, data...)
+	fb.stageCount[id]++
+	return nil
+}
+
+func (fb *fakeBlockBlob) uncommittedBlocks(ctx context.Context) (map[string]bool, error) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	ids := make(map[string]bool)
+	for id := range fb.staged {
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+func (fb *fakeBlockBlob) commitBlocks(ctx context.Context, ids []string, contentMD5 []byte) error {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	content := make([]byte, 0)
+	for _, id := range ids {
+		data, ok := fb.staged[id]
+		if !ok {
+			return fmt.Errorf("Block %s isn't staged", id)
+		}
+		content = append(content, data...)
+	}
+	fb.content = content
+	fb.contentMD5 = contentMD5
+	fb.staged = make(map[string][]byte)
+	return nil
+}
+
+func TestAzureResumableUpload(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestAzureResumableUpload...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	*azureMaxRetries = 2
+
+	blockSize := 1024
+	data := make([]byte, 10*blockSize+100)
+	rand.Read(data)
+	sum := md5.Sum(data)
+
+	//block 3 fails twice, so the first two uploads fail and the third one resumes them
+	blob := newFakeBlockBlob()
+	blob.failID = blockID(3, data[3*blockSize:4*blockSize])
+	blob.failures = 2
+	err := uploadFileBlocks(context.Background(), blob, bytes.NewReader(data), int64(blockSize), 1)
+	if err != nil {
+		t.Fatalf("Upload should be resumed. err=%s", err)
+	}
+	if !bytes.Equal(blob.content, data) || !bytes.Equal(blob.contentMD5, sum[:]) {
+		t.Errorf("Committed blob should have the uploaded contents and their MD5")
+	}
+	if len(blob.stageCount) != 11 {
+		t.Errorf("Every block should be staged. blocks=%d", len(blob.stageCount))
+	}
+	for id, count := range blob.stageCount {
+		if count != 1 {
+			t.Errorf("Block %s should be staged once when the upload is resumed. count=%d", id, count)
+		}
+	}
+
+	//files are retried as a whole, without retrying each block too
+	blob = newFakeBlockBlob()
+	blob.failID = blockID(3, data[3*blockSize:4*blockSize])
+	blob.failures = 10
+	err = uploadFileBlocks(context.Background(), blob, bytes.NewReader(data), int64(blockSize), 1)
+	if err == nil || blob.failures != 7 {
+		t.Errorf("Failing block should be tried once per upload attempt. failures left=%d err=%s", blob.failures, err)
+	}
+
+	//a stream can't be resumed, so a block failing beyond its retries fails the upload
+	blob = newFakeBlockBlob()
+	blob.failID = blockID(3, data[3*blockSize:4*blockSize])
+	blob.failures = 3
+	err = uploadBlocks(context.Background(), blob, bytes.NewReader(data), int64(blockSize), 4, nil)
+	if err == nil || blob.content != nil {
+		t.Errorf("Stream upload should fail without committing. err=%s", err)
+	}
+
+	blob = newFakeBlockBlob()
+	err = uploadBlocks(context.Background(), blob, bytes.NewReader(nil), int64(blockSize), 4, nil)
+	if err != nil || blob.content == nil || len(blob.content) != 0 {
+		t.Errorf("Empty stream should be committed as an empty blob. err=%s", err)
+	}
+}
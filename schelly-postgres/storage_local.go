@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//localStorage keeps backup artifacts on a local directory (--backup-dir)
+type localStorage struct {
+	dir string
+}
+
+func newLocalStorage(dir string) (*localStorage, error) {
+	err := mkDirs(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &localStorage{dir: dir}, nil
+}
+
+func (ls *localStorage) path(name string) string {
+	return filepath.Join(ls.dir, name)
+}
+
+//Put writes to a temporary file first, so that a partially written object is never visible
+func (ls *localStorage) Put(name string, reader io.Reader) error {
+	tmpFile, err := ioutil.TempFile(ls.dir, ".tmp-"+name+"-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmpFile, reader)
+	if err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	return os.Rename(tmpFile.Name(), ls.path(name))
+}
+
+//PutFile moves the file (or directory) into the backups dir instead of copying it
+func (ls *localStorage) PutFile(name string, filePath string) error {
+	return os.Rename(filePath, ls.path(name))
+}
+
+func (ls *localStorage) Get(name string) (io.ReadCloser, error) {
+	file, err := os.Open(ls.path(name))
+	if os.IsNotExist(err) {
+		return nil, errObjectNotFound
+	}
+	return file, err
+}
+
+//List ignores hidden entries such as staging files and temporary uploads
+func (ls *localStorage) List() ([]StorageObject, error) {
+	files, err := ioutil.ReadDir(ls.dir)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]StorageObject, 0)
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		objects = append(objects, StorageObject{
+			Name:     file.Name(),
+			Size:     file.Size(),
+			Location: ls.path(file.Name()),
+		})
+	}
+	return objects, nil
+}
+
+func (ls *localStorage) Stat(name string) (*StorageObject, error) {
+	info, err := os.Stat(ls.path(name))
+	if os.IsNotExist(err) {
+		return nil, errObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &StorageObject{
+		Name:     name,
+		Size:     info.Size(),
+		Location: ls.path(name),
+	}, nil
+}
+
+func (ls *localStorage) Delete(name string) error {
+	_, err := os.Stat(ls.path(name))
+	if os.IsNotExist(err) {
+		return errObjectNotFound
+	}
+	return os.RemoveAll(ls.path(name))
+}
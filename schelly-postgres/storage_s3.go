@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"go.uber.org/zap"
+)
+
+//s3Storage keeps backup artifacts on an S3 compatible bucket (AWS S3, MinIO, ...)
+type s3Storage struct {
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
+	prefix   string
+}
+
+//s3Options holds the settings used to connect to the S3 bucket
+type s3Options struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	Prefix          string
+	PathStyle       bool
+	AccessKeyID     string
+	SecretAccessKey string
+	PartSizeMB      int
+	Concurrency     int
+}
+
+func newS3Storage(opts s3Options) (*s3Storage, error) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("`s3-bucket` arg must be set when using S3 storage")
+	}
+	if opts.PartSizeMB < 5 {
+		return nil, fmt.Errorf("`s3-part-size` arg must be at least 5 (MB)")
+	}
+
+	config := aws.NewConfig().
+		WithRegion(opts.Region).
+		WithS3ForcePathStyle(opts.PathStyle)
+	if opts.Endpoint != "" {
+		config = config.WithEndpoint(opts.Endpoint)
+	}
+	if opts.AccessKeyID != "" {
+		//when not set, the default AWS credential chain is used (AWS_ACCESS_KEY_ID env, shared config, instance role...)
+		config = config.WithCredentials(credentials.NewStaticCredentials(opts.AccessKeyID, opts.SecretAccessKey, ""))
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		sugar.Debugf("Create S3 session with error: %s", err.Error())
+		return nil, fmt.Errorf("Create S3 session with error: %s", err.Error())
+	}
+
+	client := s3.New(sess)
+	uploader := s3manager.NewUploaderWithClient(client, func(u *s3manager.Uploader) {
+		u.PartSize = int64(opts.PartSizeMB) * 1024 * 1024
+		u.Concurrency = opts.Concurrency
+	})
+
+	prefix := strings.Trim(opts.Prefix, "/")
+	if prefix != "" {
+		prefix = prefix + "/"
+	}
+
+	return &s3Storage{
+		client:   client,
+		uploader: uploader,
+		bucket:   opts.Bucket,
+		prefix:   prefix,
+	}, nil
+}
+
+func (ss *s3Storage) key(name string) string {
+	return ss.prefix + name
+}
+
+func (ss *s3Storage) location(name string) string {
+	return fmt.Sprintf("s3://%s/%s", ss.bucket, ss.key(name))
+}
+
+//Put uses multipart uploads for streams larger than one part
+func (ss *s3Storage) Put(name string, reader io.Reader) error {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Debugf("Uploading stream to %s", ss.location(name))
+	_, err := ss.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(ss.bucket),
+		Key:    aws.String(ss.key(name)),
+		Body:   reader,
+	})
+	if err != nil {
+		sugar.Debugf("Upload to S3 with error: %s", err.Error())
+		return fmt.Errorf("Upload to S3 with error: %s", err.Error())
+	}
+	return nil
+}
+
+func (ss *s3Storage) Get(name string) (io.ReadCloser, error) {
+	output, err := ss.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(ss.bucket),
+		Key:    aws.String(ss.key(name)),
+	})
+	if isS3NotFound(err) {
+		return nil, errObjectNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Download %s from S3 with error: %s", ss.location(name), err.Error())
+	}
+	return output.Body, nil
+}
+
+func (ss *s3Storage) List() ([]StorageObject, error) {
+	objects := make([]StorageObject, 0)
+	err := ss.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(ss.bucket),
+		Prefix:    aws.String(ss.prefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, item := range page.Contents {
+			name := strings.TrimPrefix(aws.StringValue(item.Key), ss.prefix)
+			objects = append(objects, StorageObject{
+				Name:     name,
+				Size:     aws.Int64Value(item.Size),
+				Location: ss.location(name),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("List objects from S3 with error: %s", err.Error())
+	}
+	return objects, nil
+}
+
+func (ss *s3Storage) Stat(name string) (*StorageObject, error) {
+	output, err := ss.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(ss.bucket),
+		Key:    aws.String(ss.key(name)),
+	})
+	if isS3NotFound(err) {
+		return nil, errObjectNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Get %s info from S3 with error: %s", ss.location(name), err.Error())
+	}
+	return &StorageObject{
+		Name:     name,
+		Size:     aws.Int64Value(output.ContentLength),
+		Location: ss.location(name),
+	}, nil
+}
+
+//Delete checks the object first because S3 doesn't fail when deleting missing keys
+func (ss *s3Storage) Delete(name string) error {
+	_, err := ss.Stat(name)
+	if err != nil {
+		return err
+	}
+	_, err = ss.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(ss.bucket),
+		Key:    aws.String(ss.key(name)),
+	})
+	if err != nil {
+		return fmt.Errorf("Delete %s from S3 with error: %s", ss.location(name), err.Error())
+	}
+	return nil
+}
+
+//isS3NotFound tells if err is an S3 response for a missing key
+func isS3NotFound(err error) bool {
+	if rerr, ok := err.(awserr.RequestFailure); ok {
+		return rerr.StatusCode() == http.StatusNotFound
+	}
+	return false
+}
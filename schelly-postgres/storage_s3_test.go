@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/flaviostutz/schelly-webhook/schellyhook"
+	"go.uber.org/zap"
+)
+
+//fakeS3 implements the subset of the S3 API used by s3Storage (path-style addressing only)
+type fakeS3 struct {
+	mutex      sync.Mutex
+	bucket     string
+	objects    map[string][]byte
+	uploads    map[string]map[int][]byte
+	partsCount int
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{
+		bucket:  bucket,
+		objects: make(map[string][]byte),
+		uploads: make(map[string]map[int][]byte),
+	}
+}
+
+type fakeS3ListResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string
+	Prefix      string
+	KeyCount    int
+	IsTruncated bool
+	Contents    []fakeS3Content
+}
+
+type fakeS3Content struct {
+	Key  string
+	Size int
+}
+
+func (fs *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if !strings.HasPrefix(path, fs.bucket) {
+		fs.sendError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(path, fs.bucket), "/")
+	query := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+
+	switch {
+	case r.Method == "GET" && key == "":
+		prefix := query.Get("prefix")
+		result := fakeS3ListResult{Name: fs.bucket, Prefix: prefix}
+		keys := make([]string, 0)
+		for k := range fs.objects {
+			if strings.HasPrefix(k, prefix) && !strings.Contains(strings.TrimPrefix(k, prefix), "/") {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			result.Contents = append(result.Contents, fakeS3Content{Key: k, Size: len(fs.objects[k])})
+		}
+		result.KeyCount = len(result.Contents)
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == "POST" && hasQueryParam(query, "uploads"):
+		uploadID := fmt.Sprintf("upload-%d", len(fs.uploads)+1)
+		fs.uploads[uploadID] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", fs.bucket, key, uploadID)
+	case r.Method == "POST" && query.Get("uploadId") != "":
+		parts := fs.uploads[query.Get("uploadId")]
+		numbers := make([]int, 0)
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var data bytes.Buffer
+		for _, n := range numbers {
+			data.Write(parts[n])
+		}
+		fs.objects[key] = data.Bytes()
+		delete(fs.uploads, query.Get("uploadId"))
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>\"etag\"</ETag></CompleteMultipartUploadResult>", fs.bucket, key)
+	case r.Method == "PUT" && query.Get("uploadId") != "":
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		fs.uploads[query.Get("uploadId")][number] = body
+		fs.partsCount++
+		w.Header().Set("ETag", fmt.Sprintf("\"part-%d\"", number))
+	case r.Method == "PUT" && key != "":
+		fs.objects[key] = body
+		w.Header().Set("ETag", "\"etag\"")
+	case r.Method == "DELETE" && query.Get("uploadId") != "":
+		delete(fs.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "GET" || r.Method == "HEAD":
+		data, ok := fs.objects[key]
+		if !ok {
+			fs.sendError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+	case r.Method == "DELETE":
+		delete(fs.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fs.sendError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func hasQueryParam(query url.Values, name string) bool {
+	_, ok := query[name]
+	return ok
+}
+
+func (fs *fakeS3) sendError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func newTestS3Storage(t *testing.T, endpoint string, prefix string) *s3Storage {
+	storage, err := newS3Storage(s3Options{
+		Endpoint:        endpoint,
+		Region:          "us-east-1",
+		Bucket:          "backups",
+		Prefix:          prefix,
+		PathStyle:       true,
+		AccessKeyID:     "test",
+		SecretAccessKey: "test",
+		PartSizeMB:      5,
+		Concurrency:     2,
+	})
+	if err != nil {
+		t.Fatalf("Error creating S3 storage: %s", err)
+	}
+	return storage
+}
+
+func TestS3Storage(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestS3Storage...")
+	fake := newFakeS3("backups")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	storage := newTestS3Storage(t, server.URL, "/db1/")
+
+	err := storage.Put("small", strings.NewReader("small content"))
+	if err != nil {
+		t.Fatalf("Error putting small object: %s", err)
+	}
+	if _, ok := fake.objects["db1/small"]; !ok {
+		t.Errorf("Object not stored with prefix. objects=%v", fake.objects)
+	}
+
+	big := bytes.Repeat([]byte("0123456789"), 1200*1024)
+	err = storage.Put("big", bytes.NewReader(big))
+	if err != nil {
+		t.Fatalf("Error putting big object: %s", err)
+	}
+	if fake.partsCount < 3 {
+		t.Errorf("Big object should use multipart upload. parts=%d", fake.partsCount)
+	}
+
+	reader, err := storage.Get("big")
+	if err != nil {
+		t.Fatalf("Error getting object: %s", err)
+	}
+	data, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	if !bytes.Equal(data, big) {
+		t.Errorf("Multipart object contents differ. size=%d", len(data))
+	}
+
+	objects, err := storage.List()
+	if err != nil {
+		t.Fatalf("Error listing objects: %s", err)
+	}
+	if len(objects) != 2 || objects[0].Name != "big" || objects[1].Name != "small" {
+		t.Errorf("Unexpected objects list: %v", objects)
+	}
+
+	object, err := storage.Stat("small")
+	if err != nil || object.Size != int64(len("small content")) {
+		t.Errorf("Unexpected object info %v. err=%s", object, err)
+	}
+	_, err = storage.Stat("missing")
+	if err != errObjectNotFound {
+		t.Errorf("Expected errObjectNotFound for missing object. err=%s", err)
+	}
+
+	err = storage.Delete("small")
+	if err != nil {
+		t.Errorf("Error deleting object: %s", err)
+	}
+	err = storage.Delete("small")
+	if err != errObjectNotFound {
+		t.Errorf("Expected errObjectNotFound deleting a removed object. err=%s", err)
+	}
+}
+
+func TestBackupFlowWithS3Storage(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestBackupFlowWithS3Storage...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	installFakeCommand(t, dir, "pg_dump", fakePgDumpScript)
+
+	server := httptest.NewServer(newFakeS3("backups"))
+	defer server.Close()
+	backupStorage = newTestS3Storage(t, server.URL, "")
+
+	backuper := PostgresBackuper{}
+	err := backuper.CreateNewBackup("789", 0, &schellyhook.ShellContext{})
+	if err != nil {
+		t.Fatalf("Error creating backup: %s", err)
+	}
+	backupJobs.wait("789")
+
+	backups, err := backuper.GetAllBackups()
+	if err != nil || len(backups) != 1 || backups[0].ID != "789" {
+		t.Fatalf("Unexpected backups list %v. err=%s", backups, err)
+	}
+
+	err = backuper.DeleteBackup("789")
+	if err != nil {
+		t.Errorf("Error deleting backup: %s", err)
+	}
+	backup, err := backuper.GetBackup("789")
+	if err != nil || backup != nil {
+		t.Errorf("Backup should be deleted. backup=%v err=%s", backup, err)
+	}
+}
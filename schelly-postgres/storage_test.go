@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/flaviostutz/schelly-webhook/schellyhook"
+	"go.uber.org/zap"
+)
+
+//memoryStorage keeps objects in memory so that the backup flow can be tested without external services
+type memoryStorage struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{objects: make(map[string][]byte)}
+}
+
+func (ms *memoryStorage) Put(name string, reader io.Reader) error {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.objects[name] = data
+	return nil
+}
+
+func (ms *memoryStorage) Get(name string) (io.ReadCloser, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	data, ok := ms.objects[name]
+	if !ok {
+		return nil, errObjectNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (ms *memoryStorage) List() ([]StorageObject, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	objects := make([]StorageObject, 0)
+	for name, data := range ms.objects {
+		objects = append(objects, StorageObject{Name: name, Size: int64(len(data)), Location: "memory://" + name})
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects, nil
+}
+
+func (ms *memoryStorage) Stat(name string) (*StorageObject, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	data, ok := ms.objects[name]
+	if !ok {
+		return nil, errObjectNotFound
+	}
+	return &StorageObject{Name: name, Size: int64(len(data)), Location: "memory://" + name}, nil
+}
+
+func (ms *memoryStorage) Delete(name string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if _, ok := ms.objects[name]; !ok {
+		return errObjectNotFound
+	}
+	delete(ms.objects, name)
+	return nil
+}
+
+//setupTestFlags points the command line options to test values without registering flags again
+func setupTestFlags(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "schelly-postgres-test")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	strs := map[**string]string{
+		&backupsDir:        filepath.Join(dir, "backups"),
+		&targetDataBackend: "file",
+		&fileName:          "database_dump",
+		&encoding:          "UTF-8",
+		&dbname:            "schelly",
+		&host:              "localhost",
+		&username:          "postgres",
+		&password:          "postgres",
+		&accountName:       "",
+		&accountKey:        "",
+		&containerName:     "",
+		&compression:       "none",
+		&dumpFormat:        "plain",
+		&verifyHost:        "",
+		&verifyUsername:    "",
+		&verifyPassword:    "",
+		&verifySQLFile:     "",
+		&encryptionKeyFile: "",
+		&encryptionKeyEnv:  "",
+		&keyringFile:       "",
+		&masterKeyID:       "",
+		&azureEndpoint:     "",
+		&azureSASToken:     "",
+		&azurePrefix:       "",
+		&azureAccessTier:   "",
+		&apiListenIP:       "127.0.0.1",
+		&recoveryDir:       "",
+	}
+	for ptr, value := range strs {
+		v := value
+		*ptr = &v
+	}
+	bools := []**bool{&splitFile, &dataOnly, &schemaOnly, &azureStorage, &streamBackup, &verifyAfterBackup, &rewrapKeysOnly, &azureIndexTags, &walArchiving, &clusterBackup}
+	for _, ptr := range bools {
+		v := false
+		*ptr = &v
+	}
+	p := 5432
+	port = &p
+	level := 6
+	compressionLevel = &level
+	dumpLevel := -1
+	dumpCompressionLevel = &dumpLevel
+	jobs := 1
+	dumpJobs = &jobs
+	schemas, excludeSchemas, tables, excludeTables, excludeTableData = &stringList{}, &stringList{}, &stringList{}, &stringList{}, &stringList{}
+	includeDatabases, excludeDatabases = &stringList{}, &stringList{}
+	verifyInterval = new(int)
+	checkInterval = new(int)
+	simultaneousWrites, maxBandwidthWrite, simultaneousReads, maxBandwidthRead = new(int), new(int), new(int), new(int)
+	blockSize := 4
+	azureBlockSize = &blockSize
+	azureMaxRetries, azureRetryDelay = new(int), new(int)
+	azureConnectionString = new(string)
+	mode, checkpoint := backupKindLogical, "spread"
+	backupMode, basebackupCheckpoint = &mode, &checkpoint
+	incrementalBackup, maxIncrementalChain = new(bool), new(int)
+	rehydrateTier := tierHot
+	azureRehydrateTier = &rehydrateTier
+	azureCoolAfterDays, azureArchiveAfterDays, azureCoolAfterBackups, azureArchiveAfterBackups = new(int), new(int), new(int), new(int)
+	isCredentialCreated = false
+	verifyPort = new(int)
+	verifyRowTolerance = new(float64)
+	archiveWALPath, restoreWALName, restoreWALPath = new(string), new(string), new(string)
+	walStorage = nil
+	recoveryRestoreCommand, recoveryUser = new(string), new(string)
+	recoveryPort = new(int)
+	apiListenPort = new(int)
+	backupEncryptionKey = nil
+	backupKeyring = nil
+	dataStringSeparator = "---"
+	mkDirs(filepath.Join(*backupsDir, ".staging"))
+	return dir
+}
+
+//installFakeCommand places an executable script with the given name in front of PATH
+func installFakeCommand(t *testing.T, dir string, name string, script string) {
+	binDir := filepath.Join(dir, "bin")
+	mkDirs(binDir)
+	err := ioutil.WriteFile(filepath.Join(binDir, name), []byte("#!/bin/bash\n"+script), 0755)
+	if err != nil {
+		t.Fatalf("Error writing fake %s: %s", name, err)
+	}
+	os.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+const fakePgDumpScript = `output=/dev/stdout
+for arg in "$@"; do
+  case "$arg" in
+    --file=*) output="${arg#--file=}" ;;
+    --format=d) directory=1 ;;
+  esac
+done
+if [ -n "$directory" ]; then
+  mkdir -p "$output"
+  echo "toc" > "$output/toc.dat"
+  echo "data" > "$output/3001.dat"
+  exit 0
+fi
+{
+  echo "-- fake dump of $*"
+  echo 'DROP DATABASE "schelly";'
+  echo 'CREATE DATABASE "schelly";'
+  echo '\connect "schelly"'
+  echo 'CREATE TABLE "public"."t" ("id" integer);'
+} > "$output"
+`
+
+func TestLocalStorage(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestLocalStorage...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+
+	storage, err := newLocalStorage(*backupsDir)
+	if err != nil {
+		t.Fatalf("Error creating local storage: %s", err)
+	}
+
+	err = storage.Put("object1", bytes.NewReader([]byte("content1")))
+	if err != nil {
+		t.Errorf("Error putting object: %s", err)
+	}
+	reader, err := storage.Get("object1")
+	if err != nil {
+		t.Fatalf("Error getting object: %s", err)
+	}
+	data, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	if string(data) != "content1" {
+		t.Errorf("Unexpected object contents: %s", data)
+	}
+
+	objects, err := storage.List()
+	if err != nil {
+		t.Errorf("Error listing objects: %s", err)
+	}
+	if len(objects) != 1 || objects[0].Name != "object1" || objects[0].Size != 8 {
+		t.Errorf("Unexpected objects list (hidden staging dir should be ignored): %v", objects)
+	}
+
+	_, err = storage.Stat("missing")
+	if err != errObjectNotFound {
+		t.Errorf("Expected errObjectNotFound for missing object. err=%s", err)
+	}
+
+	err = storage.Delete("object1")
+	if err != nil {
+		t.Errorf("Error deleting object: %s", err)
+	}
+	err = storage.Delete("object1")
+	if err != errObjectNotFound {
+		t.Errorf("Expected errObjectNotFound deleting a removed object. err=%s", err)
+	}
+}
+
+func TestBackupFlowWithMemoryStorage(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestBackupFlowWithMemoryStorage...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	installFakeCommand(t, dir, "pg_dump", fakePgDumpScript)
+
+	storage := newMemoryStorage()
+	backupStorage = storage
+	storage.Put(".pgpass", bytes.NewReader([]byte("not a backup")))
+
+	backuper := PostgresBackuper{}
+	err := backuper.CreateNewBackup("123", 0, &schellyhook.ShellContext{})
+	if err != nil {
+		t.Fatalf("Error creating backup: %s", err)
+	}
+	backupJobs.wait("123")
+
+	backups, err := backuper.GetAllBackups()
+	if err != nil {
+		t.Fatalf("Error listing backups: %s", err)
+	}
+	if len(backups) != 1 || backups[0].ID != "123" || backups[0].Status != "available" {
+		t.Fatalf("Unexpected backups list: %v", backups)
+	}
+
+	backup, err := backuper.GetBackup("123")
+	if err != nil || backup == nil {
+		t.Fatalf("Error getting backup. err=%s", err)
+	}
+	if backup.DataID != backups[0].DataID {
+		t.Errorf("Unexpected pgDumpID %s", backup.DataID)
+	}
+
+	backup, err = backuper.GetBackup("12")
+	if err != nil || backup != nil {
+		t.Errorf("Backup 12 should not be found. backup=%v err=%s", backup, err)
+	}
+
+	err = backuper.DeleteBackup("123")
+	if err != nil {
+		t.Errorf("Error deleting backup: %s", err)
+	}
+	backups, _ = backuper.GetAllBackups()
+	if len(backups) != 0 {
+		t.Errorf("Backup was not deleted: %v", backups)
+	}
+}
+
+func TestFailedBackupWithMemoryStorage(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestFailedBackupWithMemoryStorage...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	installFakeCommand(t, dir, "pg_dump", "exit 1\n")
+
+	storage := newMemoryStorage()
+	backupStorage = storage
+
+	backuper := PostgresBackuper{}
+	err := backuper.CreateNewBackup("456", 0, &schellyhook.ShellContext{})
+	if err != nil {
+		t.Fatalf("Error starting backup: %s", err)
+	}
+	backupJobs.wait("456")
+
+	backup, err := backuper.GetBackup("456")
+	if err != nil || backup == nil || backup.Status != statusError {
+		t.Fatalf("Backup should fail when pg_dump fails. backup=%v err=%s", backup, err)
+	}
+	m, err := readManifest("456")
+	if err != nil || m.Status != statusError {
+		t.Errorf("Failure not recorded on the manifest. manifest=%v err=%s", m, err)
+	}
+
+	err = backuper.DeleteBackup("456")
+	if err != nil {
+		t.Errorf("Error deleting failed backup: %s", err)
+	}
+	if _, err := storage.Stat(manifestName("456")); err != errObjectNotFound {
+		t.Errorf("Manifest should be removed. err=%s", err)
+	}
+}
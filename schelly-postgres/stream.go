@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"go.uber.org/zap"
+)
+
+//streamNewBackup pipes pg_dump output straight to the storage backend, so that nothing is written to local disk. pg_dump
+//dumps the exported snapshot when one is given. Records the pg_dump result, size and SHA-256 of the stored file on m
+func streamNewBackup(ctx context.Context, m *backupManifest, snapshot string, timeout time.Duration) error {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	dumpCtx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(dumpCtx, "pg_dump", pgDumpArgs(m.Database, "", snapshot)...)
+	sugar.Debugf("Executing pg_dump command (streaming to %s): %s", m.Artifact, strings.Join(cmd.Args, " "))
+	reader, err := startCommandReader(cmd)
+	if err != nil {
+		sugar.Debugf("PostgresProvider pg_dump start error. err=%s", err.Error())
+		return err
+	}
+
+	err = storeArtifact(m, reader)
+	if err != nil {
+		//the backend gave up before the end of the stream. make sure pg_dump doesn't stay blocked writing to stdout
+		cmd.Process.Kill()
+		reader.wait()
+		m.PgDump = reader.result.withContext(ctx, dumpCtx)
+		if m.PgDump.TimedOut {
+			sugar.Warnf("PostgresProvider pg_dump command timeout enforced (%d seconds)", timeout/time.Second)
+		}
+		sugar.Debugf("PostgresProvider streaming backup error. err=%s", err.Error())
+		return fmt.Errorf("Stream backup with error: %s", err.Error())
+	}
+	reader.wait()
+	m.PgDump = reader.result.withContext(ctx, dumpCtx)
+
+	sugar.Debugf("PostgresProvider pg_dump backup streamed. Output log:")
+	sugar.Debugf(reader.stderr.String())
+	return nil
+}
+
+//commandReader reads the stdout of a command and only reports EOF after the command exited successfully.
+//This way a failing command makes the upload fail instead of storing a truncated backup
+type commandReader struct {
+	cmd       *exec.Cmd
+	stdout    io.ReadCloser
+	stderr    bytes.Buffer
+	startTime time.Time
+	once      sync.Once
+	result    *commandResult
+}
+
+func startCommandReader(cmd *exec.Cmd) (*commandReader, error) {
+	reader := &commandReader{cmd: cmd}
+	cmd.Stderr = &reader.stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	reader.stdout = stdout
+	reader.startTime = time.Now()
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+func (cr *commandReader) Read(p []byte) (int, error) {
+	n, err := cr.stdout.Read(p)
+	if err == io.EOF {
+		werr := cr.wait()
+		if werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+//wait waits for the command to exit (only once) and returns an error describing how it failed
+func (cr *commandReader) wait() error {
+	cr.once.Do(func() {
+		err := cr.cmd.Wait()
+		cr.result = newCommandResult(cr.cmd, err, cr.startTime, cr.stderr.String())
+	})
+	return cr.result.err()
+}
+
+//compressionCodec is a compression applied by the provider to backup files before storing them
+type compressionCodec struct {
+	extension string
+	maxLevel  int
+	//newWriter compresses with the given level. Level 0 uses the codec default
+	newWriter func(w io.Writer, level int) (io.WriteCloser, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+//compressionCodecs are the values accepted by --compression, besides none
+var compressionCodecs = map[string]compressionCodec{
+	"gzip": {
+		extension: ".gz",
+		maxLevel:  9,
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			if level == 0 {
+				level = gzip.DefaultCompression
+			}
+			return gzip.NewWriterLevel(w, level)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	"zstd": {
+		extension: ".zst",
+		maxLevel:  22,
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			if level == 0 {
+				return zstd.NewWriter(w)
+			}
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			decoder, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		},
+	},
+	"lz4": {
+		extension: ".lz4",
+		maxLevel:  9,
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			lw := lz4.NewWriter(w)
+			//levels above 0 use the high compression mode, searching deeper for matches
+			lw.Header.CompressionLevel = level
+			return lw, nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(lz4.NewReader(r)), nil
+		},
+	},
+}
+
+//validateCompression checks the --compression and --compression-level options
+func validateCompression(codec string, level int) error {
+	if codec == "none" {
+		return nil
+	}
+	c, ok := compressionCodecs[codec]
+	if !ok {
+		return fmt.Errorf("`compression` (--compression) arg must be `none`, `gzip`, `zstd` or `lz4`")
+	}
+	if level < 0 || level > c.maxLevel {
+		return fmt.Errorf("`compression level` (--compression-level) arg must be between 1 and %d for %s, or 0 for the codec default", c.maxLevel, codec)
+	}
+	return nil
+}
+
+//compressStream compresses reader contents on the fly with the given codec. The result must be closed by the caller
+func compressStream(reader io.Reader, codec string, level int) io.ReadCloser {
+	if codec == "none" {
+		return ioutil.NopCloser(reader)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		c, ok := compressionCodecs[codec]
+		if !ok {
+			pw.CloseWithError(fmt.Errorf("Unsupported compression %s", codec))
+			return
+		}
+		cw, err := c.newWriter(pw, level)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		_, err = io.Copy(cw, reader)
+		if err == nil {
+			err = cw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+//decompressStream reverts compressStream for the given codec. The result must be closed by the caller
+func decompressStream(reader io.Reader, codec string) (io.ReadCloser, error) {
+	if codec == "" || codec == "none" {
+		return ioutil.NopCloser(reader), nil
+	}
+	c, ok := compressionCodecs[codec]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported compression %s", codec)
+	}
+	return c.newReader(reader)
+}
+
+//compressionExtension returns the file name extension for the compression codec
+func compressionExtension(codec string) string {
+	return compressionCodecs[codec].extension
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/flaviostutz/schelly-webhook/schellyhook"
+	"go.uber.org/zap"
+)
+
+func TestStreamBackupWithCompression(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestStreamBackupWithCompression...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	installFakeCommand(t, dir, "pg_dump", fakePgDumpScript)
+	*streamBackup = true
+	*compression = "gzip"
+
+	storage := newMemoryStorage()
+	backupStorage = storage
+
+	backuper := PostgresBackuper{}
+	err := backuper.CreateNewBackup("123", 0, &schellyhook.ShellContext{})
+	if err != nil {
+		t.Fatalf("Error creating streamed backup: %s", err)
+	}
+	backupJobs.wait("123")
+
+	m, err := readManifest("123")
+	if err != nil || m.Status != statusAvailable {
+		t.Fatalf("Streamed backup not available. manifest=%v err=%s", m, err)
+	}
+	if !strings.HasSuffix(m.Artifact, ".gz") || m.Compression != "gzip" {
+		t.Errorf("Unexpected backup name %s (compression %s)", m.Artifact, m.Compression)
+	}
+
+	reader, _ := storage.Get(m.Artifact)
+	gr, err := gzip.NewReader(reader)
+	if err != nil {
+		t.Fatalf("Backup is not gzip compressed: %s", err)
+	}
+	data, _ := ioutil.ReadAll(gr)
+	if !strings.HasPrefix(string(data), "-- fake dump of") || strings.Contains(string(data), "--file=") {
+		t.Errorf("Unexpected streamed dump contents: %s", data)
+	}
+
+	if _, err := os.Stat(resolveStagingFilePath("123", m.PgDumpID)); !os.IsNotExist(err) {
+		t.Errorf("Streamed backup should not be staged on local disk")
+	}
+}
+
+func TestStreamBackupFailure(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestStreamBackupFailure...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	installFakeCommand(t, dir, "pg_dump", "echo 'partial dump'\necho 'connection lost' >&2\nexit 1\n")
+	*streamBackup = true
+
+	storage := newMemoryStorage()
+	backupStorage = storage
+
+	backuper := PostgresBackuper{}
+	err := backuper.CreateNewBackup("456", 0, &schellyhook.ShellContext{})
+	if err != nil {
+		t.Fatalf("Error starting streamed backup: %s", err)
+	}
+	backupJobs.wait("456")
+
+	j, _ := backupJobs.get("456")
+	if j.Status != statusError || !strings.Contains(j.Err.Error(), "connection lost") {
+		t.Fatalf("Streamed backup should fail with pg_dump stderr. job=%v", j)
+	}
+
+	objects, _ := storage.List()
+	if len(objects) != 1 || objects[0].Name != manifestName("456") {
+		t.Errorf("Only the manifest should be stored for a failed streamed backup: %v", objects)
+	}
+}
+
+func TestCompressionCodecs(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestCompressionCodecs...")
+	data := strings.Repeat("INSERT INTO \"public\".\"t\" (\"id\") VALUES (1);\n", 10000)
+	for codec, c := range compressionCodecs {
+		for _, level := range []int{0, 1, c.maxLevel} {
+			compressed, err := ioutil.ReadAll(compressStream(strings.NewReader(data), codec, level))
+			if err != nil || len(compressed) >= len(data)/10 {
+				t.Fatalf("Error compressing with %s level %d. size=%d err=%s", codec, level, len(compressed), err)
+			}
+			reader, err := decompressStream(bytes.NewReader(compressed), codec)
+			if err != nil {
+				t.Fatalf("Error decompressing %s: %s", codec, err)
+			}
+			decompressed, err := ioutil.ReadAll(reader)
+			reader.Close()
+			if err != nil || string(decompressed) != data {
+				t.Errorf("Decompressed %s data differs from the original. err=%s", codec, err)
+			}
+		}
+		if validateCompression(codec, c.maxLevel+1) == nil || validateCompression(codec, -1) == nil {
+			t.Errorf("Invalid levels should be rejected for %s", codec)
+		}
+	}
+	if validateCompression("brotli", 0) == nil || validateCompression("none", 0) != nil {
+		t.Errorf("Only known codecs should be accepted")
+	}
+	if compressionExtension("zstd") != ".zst" || compressionExtension("lz4") != ".lz4" || compressionExtension("none") != "" {
+		t.Errorf("Unexpected compression extensions")
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//tokenBucket limits a transfer rate. Tokens (bytes) are added at rate per second, up to one second worth of them
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+//newTokenBucket returns a bucket for bytesPerSecond, or nil (no limit) when it is 0
+func newTokenBucket(bytesPerSecond int64) *tokenBucket {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond), last: time.Now()}
+}
+
+//take blocks until n bytes can be transferred. n must not be larger than the bucket capacity
+func (b *tokenBucket) take(n int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens < 0 {
+		//the lock is kept while waiting, so that transfers sharing the bucket queue up
+		wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+		time.Sleep(wait)
+		b.tokens = 0
+		b.last = time.Now()
+	}
+}
+
+//maxRead is the largest chunk read at once through a bucket
+func (b *tokenBucket) maxRead() int {
+	max := int(b.rate) / 10
+	if max < 1024 {
+		max = 1024
+	}
+	if max > int(b.rate) {
+		max = int(b.rate)
+	}
+	return max
+}
+
+//throttledReader reads no faster than its bucket allows
+type throttledReader struct {
+	reader io.Reader
+	bucket *tokenBucket
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > tr.bucket.maxRead() {
+		p = p[:tr.bucket.maxRead()]
+	}
+	n, err := tr.reader.Read(p)
+	if n > 0 {
+		tr.bucket.take(n)
+	}
+	return n, err
+}
+
+//throttle returns reader limited by bucket, or reader itself when bucket is nil
+func throttle(reader io.Reader, bucket *tokenBucket) io.Reader {
+	if bucket == nil {
+		return reader
+	}
+	return &throttledReader{reader: reader, bucket: bucket}
+}
+
+//transferLimits caps the number of simultaneous transfers in one direction and their total bandwidth
+type transferLimits struct {
+	slots  chan struct{}
+	bucket *tokenBucket
+}
+
+//newTransferLimits allows up to simultaneous transfers (unlimited when 0) sharing bytesPerSecond (unlimited when 0)
+func newTransferLimits(simultaneous int, bytesPerSecond int64) *transferLimits {
+	limits := &transferLimits{bucket: newTokenBucket(bytesPerSecond)}
+	if simultaneous > 0 {
+		limits.slots = make(chan struct{}, simultaneous)
+	}
+	return limits
+}
+
+func (l *transferLimits) acquire() {
+	if l.slots != nil {
+		l.slots <- struct{}{}
+	}
+}
+
+func (l *transferLimits) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+//limitedStorage applies the write limits to uploads and the read limits to downloads of a storage backend
+type limitedStorage struct {
+	Storage
+	writes *transferLimits
+	reads  *transferLimits
+}
+
+func newLimitedStorage(storage Storage) *limitedStorage {
+	return &limitedStorage{
+		Storage: storage,
+		writes:  newTransferLimits(*simultaneousWrites, int64(*maxBandwidthWrite)*1024),
+		reads:   newTransferLimits(*simultaneousReads, int64(*maxBandwidthRead)*1024),
+	}
+}
+
+//isMetadata tells whether name is a small file that describes a backup, such as its manifest. These files aren't limited,
+//so that a backup is never kept waiting for another one to update its status
+func isMetadata(name string) bool {
+	return strings.HasSuffix(name, manifestSuffix) || strings.HasSuffix(name, wrappedKeySuffix)
+}
+
+func (ls *limitedStorage) Put(name string, reader io.Reader) error {
+	if isMetadata(name) {
+		return ls.Storage.Put(name, reader)
+	}
+	ls.writes.acquire()
+	defer ls.writes.release()
+	return ls.Storage.Put(name, throttle(reader, ls.writes.bucket))
+}
+
+//PutFile moves files into local storage, as that isn't a transfer. Other backends receive the file as a limited stream
+func (ls *limitedStorage) PutFile(name string, filePath string) error {
+	if local, ok := ls.Storage.(*localStorage); ok {
+		return local.PutFile(name, filePath)
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return ls.Put(name, file)
+}
+
+//Get holds a read slot until the returned reader is closed
+func (ls *limitedStorage) Get(name string) (io.ReadCloser, error) {
+	if isMetadata(name) {
+		return ls.Storage.Get(name)
+	}
+	ls.reads.acquire()
+	reader, err := ls.Storage.Get(name)
+	if err != nil {
+		ls.reads.release()
+		return nil, err
+	}
+	return &limitedReadCloser{Reader: throttle(reader, ls.reads.bucket), closer: reader, limits: ls.reads}, nil
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	closer io.Closer
+	limits *transferLimits
+	once   sync.Once
+}
+
+func (lr *limitedReadCloser) Close() error {
+	err := lr.closer.Close()
+	lr.once.Do(lr.limits.release)
+	return err
+}
+
+//unwrapStorage returns the backend behind the transfer limits
+func unwrapStorage(storage Storage) Storage {
+	if ls, ok := storage.(*limitedStorage); ok {
+		return ls.Storage
+	}
+	return storage
+}
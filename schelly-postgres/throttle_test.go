@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestThrottledReader(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestThrottledReader...")
+	//the first second worth of bytes is the bucket burst, the rest must take about one more second
+	bucket := newTokenBucket(64 * 1024)
+	data := make([]byte, 128*1024)
+	start := time.Now()
+	read, err := ioutil.ReadAll(throttle(bytes.NewReader(data), bucket))
+	elapsed := time.Since(start)
+	if err != nil || len(read) != len(data) {
+		t.Fatalf("Throttled reader should read everything. read=%d err=%s", len(read), err)
+	}
+	if elapsed < 900*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("128 KB at 64 KB/s should take about 1 second. elapsed=%s", elapsed)
+	}
+
+	if throttle(bytes.NewReader(data), newTokenBucket(0)) == nil {
+		t.Errorf("No bandwidth limit should keep the reader")
+	}
+}
+
+//blockingStorage keeps every Put waiting until release is closed
+type blockingStorage struct {
+	*memoryStorage
+	mutex   sync.Mutex
+	active  int
+	maxSeen int
+	release chan struct{}
+}
+
+func (bs *blockingStorage) Put(name string, reader io.Reader) error {
+	bs.mutex.Lock()
+	bs.active++
+	if bs.active > bs.maxSeen {
+		bs.maxSeen = bs.active
+	}
+	bs.mutex.Unlock()
+	<-bs.release
+	bs.mutex.Lock()
+	bs.active--
+	bs.mutex.Unlock()
+	return bs.memoryStorage.Put(name, reader)
+}
+
+func TestSimultaneousWrites(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestSimultaneousWrites...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	*simultaneousWrites = 2
+	backend := &blockingStorage{memoryStorage: newMemoryStorage(), release: make(chan struct{})}
+	storage := newLimitedStorage(backend)
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"a.sql", "b.sql", "c.sql", "d.sql"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			storage.Put(name, bytes.NewReader([]byte(name)))
+		}(name)
+	}
+	//manifests aren't limited, so a running backup can always be reported
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		storage.Put(manifestName("a"), bytes.NewReader([]byte("{}")))
+	}()
+	time.Sleep(200 * time.Millisecond)
+	close(backend.release)
+	wg.Wait()
+
+	if backend.maxSeen != 3 {
+		t.Errorf("Only 2 backup files and the manifest should be written at the same time. max=%d", backend.maxSeen)
+	}
+	objects, _ := storage.List()
+	if len(objects) != 5 {
+		t.Errorf("All files should be stored: %v", objects)
+	}
+}
+
+func TestSimultaneousReads(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestSimultaneousReads...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	*simultaneousReads = 1
+	backend := newMemoryStorage()
+	backend.Put("a.sql", bytes.NewReader([]byte("a")))
+	storage := newLimitedStorage(backend)
+
+	first, err := storage.Get("a.sql")
+	if err != nil {
+		t.Fatalf("Error reading file: %s", err)
+	}
+	second := make(chan struct{})
+	go func() {
+		reader, err := storage.Get("a.sql")
+		if err == nil {
+			reader.Close()
+		}
+		close(second)
+	}()
+	select {
+	case <-second:
+		t.Fatalf("Second download should wait for the first one to be closed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	first.Close()
+	first.Close()
+	select {
+	case <-second:
+	case <-time.After(time.Second):
+		t.Errorf("Second download should start once the first one is closed")
+	}
+
+	_, err = storage.Get("missing.sql")
+	if err != errObjectNotFound {
+		t.Errorf("Missing files should be reported. err=%v", err)
+	}
+	reader, err := storage.Get("a.sql")
+	if err != nil {
+		t.Errorf("A failed download should release its slot. err=%s", err)
+	} else {
+		reader.Close()
+	}
+}
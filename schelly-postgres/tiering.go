@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/flaviostutz/schelly-webhook/schellyhook"
+	"go.uber.org/zap"
+)
+
+//access tiers of backup files. An empty tier is the default tier of the storage account
+const (
+	tierHot     = "Hot"
+	tierCool    = "Cool"
+	tierArchive = "Archive"
+)
+
+//statusRehydrating is reported by restores and downloads of backups whose file is being moved out of the archive tier
+const statusRehydrating = "rehydrating"
+
+//rehydratedRetention keeps rehydrated backup files out of the archive tier for a while, so that they can be restored
+const rehydratedRetention = 7 * 24 * time.Hour
+
+//parseAccessTier returns tier with the capitalization used by Azure
+func parseAccessTier(tier string) (string, error) {
+	for _, t := range []string{tierHot, tierCool, tierArchive} {
+		if strings.EqualFold(tier, t) {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("Invalid access tier %s. It must be Hot, Cool or Archive", tier)
+}
+
+//validateTierOptions checks the access tier args, which are only supported by Azure storage
+func validateTierOptions(backend string) error {
+	var err error
+	*azureRehydrateTier, err = parseAccessTier(*azureRehydrateTier)
+	if err != nil || *azureRehydrateTier == tierArchive {
+		return fmt.Errorf("`--azure-rehydrate-tier` must be Hot or Cool")
+	}
+	if *azureAccessTier != "" {
+		*azureAccessTier, err = parseAccessTier(*azureAccessTier)
+		if err != nil {
+			return fmt.Errorf("`--azure-access-tier` is invalid: %s", err)
+		}
+	}
+	if *azureCoolAfterDays < 0 || *azureArchiveAfterDays < 0 || *azureCoolAfterBackups < 0 || *azureArchiveAfterBackups < 0 {
+		return fmt.Errorf("`--azure-cool-after-days`, `--azure-archive-after-days`, `--azure-cool-after-backups` and `--azure-archive-after-backups` can't be negative")
+	}
+	if (*azureAccessTier != "" || tierLifecycleEnabled()) && backend != "azure" {
+		return fmt.Errorf("Access tiers can only be used with Azure storage")
+	}
+	if *azureAccessTier == tierArchive && *verifyAfterBackup {
+		return fmt.Errorf("`--verify-after-backup` can't be used with `--azure-access-tier=Archive` because archived files can't be read")
+	}
+	return nil
+}
+
+//tierLifecycleEnabled tells whether older backups are moved to colder tiers
+func tierLifecycleEnabled() bool {
+	return *azureCoolAfterDays > 0 || *azureArchiveAfterDays > 0 || *azureCoolAfterBackups > 0 || *azureArchiveAfterBackups > 0
+}
+
+//tierRank orders tiers from the hottest to the coldest
+func tierRank(tier string) int {
+	switch tier {
+	case tierCool:
+		return 1
+	case tierArchive:
+		return 2
+	}
+	return 0
+}
+
+//setUploadTier moves the file of a new backup to --azure-access-tier. The backup is kept when the tier can't be set
+func setUploadTier(m *backupManifest) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	ts, ok := unwrapStorage(backupStorage).(tierStorage)
+	if *azureAccessTier == "" || !ok {
+		return
+	}
+	for _, artifact := range m.artifacts() {
+		err := ts.SetTier(artifact, *azureAccessTier)
+		if err != nil {
+			sugar.Warnf("Couldn't move backup %s to the %s tier. err=%s", m.APIID, *azureAccessTier, err)
+			return
+		}
+	}
+	m.Tier = *azureAccessTier
+}
+
+//lifecycleTier returns the tier a backup should be on, given its age and how many backups are newer than it.
+//An empty tier leaves the backup where it is
+func lifecycleTier(m backupManifest, newer int, now time.Time) string {
+	age := now.Sub(m.StartTime)
+	olderThan := func(days int) bool {
+		return days > 0 && age >= time.Duration(days)*24*time.Hour
+	}
+	afterBackups := func(backups int) bool {
+		return backups > 0 && newer >= backups
+	}
+	if olderThan(*azureArchiveAfterDays) || afterBackups(*azureArchiveAfterBackups) {
+		return tierArchive
+	}
+	if olderThan(*azureCoolAfterDays) || afterBackups(*azureCoolAfterBackups) {
+		return tierCool
+	}
+	return ""
+}
+
+//applyTierLifecycle moves the files of older backups to the Cool or Archive tier, by age (--azure-cool-after-days and
+//--azure-archive-after-days) or by the number of newer backups (--azure-cool-after-backups and --azure-archive-after-backups).
+//Files are never moved to a hotter tier, and backups being restored, verified, checked or rehydrated are left alone
+func applyTierLifecycle(now time.Time) error {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	ts, ok := unwrapStorage(backupStorage).(tierStorage)
+	if !ok {
+		return nil
+	}
+	manifests, _, err := listManifests()
+	if err != nil {
+		return err
+	}
+	available := make([]backupManifest, 0)
+	for _, m := range manifests {
+		if m.Status == statusAvailable {
+			available = append(available, m)
+		}
+	}
+	sort.Slice(available, func(i, j int) bool {
+		return available[i].StartTime.After(available[j].StartTime)
+	})
+
+	for newer, m := range available {
+		tier := lifecycleTier(m, newer, now)
+		if tierRank(tier) <= tierRank(m.Tier) || isBackupBusy(m.APIID) {
+			continue
+		}
+		//the manifest listed may be stale by now, so the move is decided again on the current one
+		_, err = updateManifest(m.APIID, func(current *backupManifest) error {
+			return moveToTier(ts, current, tier, now)
+		})
+		if err != nil && err != errTierKept {
+			sugar.Warnf("Couldn't move backup %s to the %s tier. err=%s", m.APIID, tier, err)
+		}
+	}
+	return nil
+}
+
+//errTierKept tells that moveToTier left a backup on its tier
+var errTierKept = fmt.Errorf("Backup is kept on its tier")
+
+//moveToTier moves the files of the available backup m to a colder tier, recording it on m. Returns errTierKept when
+//the backup was rehydrated recently or is being rehydrated, which moving it would defeat
+func moveToTier(ts tierStorage, m *backupManifest, tier string, now time.Time) error {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	if m.Status != statusAvailable || tierRank(tier) <= tierRank(m.Tier) {
+		return errTierKept
+	}
+	if tier == tierArchive && m.RehydrateTime != nil && now.Sub(*m.RehydrateTime) < rehydratedRetention {
+		return errTierKept
+	}
+	for _, artifact := range m.artifacts() {
+		_, rehydrating, err := ts.Tier(artifact)
+		if err != nil {
+			return err
+		}
+		if rehydrating {
+			sugar.Infof("Backup %s is being rehydrated. It is left on its tier", m.APIID)
+			return errTierKept
+		}
+	}
+	sugar.Infof("Moving backup %s to the %s tier", m.APIID, tier)
+	for _, artifact := range m.artifacts() {
+		err := ts.SetTier(artifact, tier)
+		if err != nil {
+			return err
+		}
+	}
+	m.Tier = tier
+	return nil
+}
+
+//isBackupBusy tells whether the file of a backup is being read by a restore, verification or integrity check
+func isBackupBusy(apiID string) bool {
+	for _, jobs := range []*jobRegistry{restoreJobs, verifyJobs, checkJobs} {
+		if j, ok := jobs.get(apiID); ok && j.Status == statusRunning {
+			return true
+		}
+	}
+	return false
+}
+
+//rehydrateIfArchived tells whether the files of a backup are archived, and so can't be read. Archived files that aren't
+//being rehydrated yet are moved to --azure-rehydrate-tier, which takes hours. The manifest follows the tier of the files
+func rehydrateIfArchived(m *backupManifest) (bool, error) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	ts, ok := unwrapStorage(backupStorage).(tierStorage)
+	if !ok {
+		return false, nil
+	}
+	tier := ""
+	pending := false
+	archived := make([]string, 0)
+	for _, artifact := range m.artifacts() {
+		artifactTier, rehydrating, err := ts.Tier(artifact)
+		if err != nil {
+			return false, err
+		}
+		if tier == "" {
+			tier = artifactTier
+		}
+		if rehydrating {
+			pending = true
+		} else if artifactTier == tierArchive {
+			archived = append(archived, artifact)
+		}
+	}
+	if len(archived) == 0 && pending {
+		return true, nil
+	}
+	if len(archived) == 0 {
+		if m.Tier == tierArchive {
+			sugar.Infof("Backup %s was rehydrated to the %s tier", m.APIID, tier)
+			m.Tier = tier
+			_, err := updateManifest(m.APIID, func(current *backupManifest) error {
+				current.Tier = tier
+				return nil
+			})
+			return false, err
+		}
+		return false, nil
+	}
+
+	sugar.Infof("Rehydrating backup %s to the %s tier", m.APIID, *azureRehydrateTier)
+	for _, artifact := range archived {
+		err := ts.SetTier(artifact, *azureRehydrateTier)
+		if err != nil {
+			return false, err
+		}
+	}
+	//the manifest has the tier the file is moved to, so that it can be archived again by the lifecycle
+	now := time.Now()
+	m.Tier = *azureRehydrateTier
+	m.RehydrateTime = &now
+	_, err := updateManifest(m.APIID, func(current *backupManifest) error {
+		current.Tier = m.Tier
+		current.RehydrateTime = m.RehydrateTime
+		return nil
+	})
+	return true, err
+}
+
+//rehydratingResponse tells that a backup can't be read until its file is rehydrated
+func rehydratingResponse(m backupManifest) schellyhook.SchellyResponse {
+	message := "backup file is being rehydrated from the archive tier, which can take up to 15 hours. Try again later"
+	if m.RehydrateTime != nil {
+		message = fmt.Sprintf("backup file is being rehydrated from the archive tier since %s, which can take up to 15 hours. Try again later",
+			m.RehydrateTime.Format(time.RFC3339))
+	}
+	return schellyhook.SchellyResponse{
+		ID:      m.APIID,
+		DataID:  m.PgDumpID,
+		Status:  statusRehydrating,
+		Message: message,
+		SizeMB:  float64(m.Size),
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/flaviostutz/schelly-webhook/schellyhook"
+	"go.uber.org/zap"
+)
+
+func TestTierOptions(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestTierOptions...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+
+	*azureAccessTier = "cool"
+	*azureRehydrateTier = "hot"
+	err := validateTierOptions("azure")
+	if err != nil || *azureAccessTier != tierCool || *azureRehydrateTier != tierHot {
+		t.Errorf("Tiers should be accepted in any case. tier=%s rehydrate=%s err=%s", *azureAccessTier, *azureRehydrateTier, err)
+	}
+	err = validateTierOptions("local")
+	if err == nil {
+		t.Errorf("Access tiers should require Azure storage")
+	}
+
+	*azureAccessTier = ""
+	*azureArchiveAfterBackups = 3
+	err = validateTierOptions("s3")
+	if err == nil {
+		t.Errorf("Tier lifecycle should require Azure storage")
+	}
+	*azureArchiveAfterBackups = -1
+	err = validateTierOptions("azure")
+	if err == nil {
+		t.Errorf("Tier lifecycle args can't be negative")
+	}
+	*azureArchiveAfterBackups = 0
+
+	*azureRehydrateTier = "Archive"
+	err = validateTierOptions("azure")
+	if err == nil {
+		t.Errorf("Backups can't be rehydrated to the Archive tier")
+	}
+	*azureRehydrateTier = "Hot"
+	*azureAccessTier = "Glacier"
+	err = validateTierOptions("azure")
+	if err == nil {
+		t.Errorf("Unknown tiers should be rejected")
+	}
+	*azureAccessTier = "Archive"
+	*verifyAfterBackup = true
+	err = validateTierOptions("azure")
+	if err == nil {
+		t.Errorf("Archived backups can't be verified after backup")
+	}
+}
+
+func TestAzureTierLifecycle(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestAzureTierLifecycle...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	installFakeCommand(t, dir, "pg_dump", fakePgDumpScript)
+	storage, fake, close := newFakeAzureStorage(t)
+	defer close()
+	backupStorage = storage
+
+	backuper := PostgresBackuper{}
+	*azureAccessTier = tierCool
+	for _, apiID := range []string{"t1", "t2", "t3"} {
+		err := backuper.CreateNewBackup(apiID, 0, &schellyhook.ShellContext{})
+		if err != nil {
+			t.Fatalf("Error creating backup: %s", err)
+		}
+		backupJobs.wait(apiID)
+		*azureAccessTier = ""
+	}
+	m, _ := readManifest("t1")
+	if m.Tier != tierCool || fake.tiers[m.Artifact] != tierCool {
+		t.Errorf("Backup should be uploaded to the Cool tier. tier=%s blob tier=%s", m.Tier, fake.tiers[m.Artifact])
+	}
+	m, _ = readManifest("t2")
+	if m.Tier != "" || fake.tiers[m.Artifact] != "" {
+		t.Errorf("Backup should be left on the default tier. tier=%s blob tier=%s", m.Tier, fake.tiers[m.Artifact])
+	}
+
+	//the newest backup stays on the default tier, the other ones are moved to Cool
+	*azureCoolAfterBackups = 1
+	*azureArchiveAfterDays = 30
+	err := applyTierLifecycle(time.Now())
+	if err != nil {
+		t.Fatalf("Error applying tier lifecycle: %s", err)
+	}
+	expected := map[string]string{"t1": tierCool, "t2": tierCool, "t3": ""}
+	for apiID, tier := range expected {
+		m, _ = readManifest(apiID)
+		if m.Tier != tier || fake.tiers[m.Artifact] != tier {
+			t.Errorf("Backup %s should be on tier %q. tier=%s blob tier=%s", apiID, tier, m.Tier, fake.tiers[m.Artifact])
+		}
+	}
+
+	//a month later, every backup is archived
+	err = applyTierLifecycle(time.Now().Add(31 * 24 * time.Hour))
+	if err != nil {
+		t.Fatalf("Error applying tier lifecycle: %s", err)
+	}
+	for _, apiID := range []string{"t1", "t2", "t3"} {
+		m, _ = readManifest(apiID)
+		if m.Tier != tierArchive || fake.tiers[m.Artifact] != tierArchive {
+			t.Errorf("Backup %s should be archived. tier=%s blob tier=%s", apiID, m.Tier, fake.tiers[m.Artifact])
+		}
+	}
+	resp, err := backuper.GetBackup("t1")
+	if err != nil || resp.Status != statusAvailable {
+		t.Errorf("Archived backups should still be available. resp=%v err=%s", resp, err)
+	}
+	err = startIntegrityCheck("t1")
+	if err == nil {
+		t.Errorf("Archived backups can't be checked")
+	}
+}
+
+func TestAzureRehydration(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestAzureRehydration...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	setupRestoreTest(t, dir)
+	storage, fake, close := newFakeAzureStorage(t)
+	defer close()
+	backupStorage = storage
+
+	backuper := PostgresBackuper{}
+	*azureAccessTier = tierArchive
+	backuper.CreateNewBackup("h1", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("h1")
+	m, _ := readManifest("h1")
+	if m.Status != statusAvailable || fake.tiers[m.Artifact] != tierArchive {
+		t.Fatalf("Backup should be archived. m=%v", m)
+	}
+	*azureAccessTier = ""
+	backuper.CreateNewBackup("h2", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("h2")
+
+	resp, err := backuper.RestoreBackup("h1", "restored")
+	if err != nil || resp == nil || resp.Status != statusRehydrating {
+		t.Fatalf("Restore should start the rehydration. resp=%v err=%s", resp, err)
+	}
+	if fake.rehydrating[m.Artifact] != tierHot {
+		t.Errorf("Backup file should be rehydrated to the Hot tier. rehydrating=%s", fake.rehydrating[m.Artifact])
+	}
+	m, _ = readManifest("h1")
+	if m.RehydrateTime == nil || m.Tier != tierHot {
+		t.Errorf("Rehydration should be recorded on the manifest. tier=%s", m.Tier)
+	}
+
+	server := httptest.NewServer(newAPIRouter())
+	defer server.Close()
+	res, err := http.Get(server.URL + "/backups/h1/download")
+	if err != nil || res.StatusCode != http.StatusAccepted || res.Header.Get("Retry-After") == "" {
+		t.Errorf("Download of a rehydrating backup should be accepted for later. res=%v err=%s", res, err)
+	}
+
+	//backups being rehydrated are left alone, even when the rehydration isn't recorded on the manifest
+	*azureArchiveAfterBackups = 1
+	updateManifest("h1", func(current *backupManifest) error {
+		current.RehydrateTime = nil
+		return nil
+	})
+	changes := fake.tierChanges[m.Artifact]
+	err = applyTierLifecycle(time.Now())
+	if err != nil || fake.tierChanges[m.Artifact] != changes || fake.rehydrating[m.Artifact] != tierHot {
+		t.Errorf("Backup being rehydrated shouldn't be moved. tier changes=%d err=%s", fake.tierChanges[m.Artifact]-changes, err)
+	}
+	updateManifest("h1", func(current *backupManifest) error {
+		current.RehydrateTime = m.RehydrateTime
+		return nil
+	})
+
+	//rehydrated backups aren't archived again right away
+	fake.rehydrate(m.Artifact)
+	err = applyTierLifecycle(time.Now())
+	if err != nil || fake.tiers[m.Artifact] != tierHot {
+		t.Errorf("Rehydrated backup shouldn't be archived again. tier=%s err=%s", fake.tiers[m.Artifact], err)
+	}
+
+	resp, err = backuper.RestoreBackup("h1", "restored")
+	if err != nil || resp == nil || resp.Status != statusRunning {
+		t.Fatalf("Rehydrated backup should be restored. resp=%v err=%s", resp, err)
+	}
+	restoreJobs.wait("h1")
+	resp, _ = backuper.GetRestore("h1")
+	if resp.Status != statusAvailable {
+		t.Errorf("Restore of the rehydrated backup should finish. resp=%v", resp)
+	}
+	m, _ = readManifest("h1")
+	if m.Tier != tierHot {
+		t.Errorf("Manifest should follow the tier of the rehydrated file. tier=%s", m.Tier)
+	}
+}
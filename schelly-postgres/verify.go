@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	verificationVerified = "verified"
+	verificationFailed   = "failed"
+)
+
+//backupVerification is the result of restoring a backup into a scratch database and checking its contents
+type backupVerification struct {
+	Status    string    `json:"status"`
+	Message   string    `json:"message,omitempty"`
+	Server    string    `json:"server"`
+	Tables    int       `json:"tables"`
+	Rows      int64     `json:"rows"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+}
+
+var verifyJobs = newJobRegistry()
+
+//tableCountsQuery returns the exact row count of each table, as `schema.table|count`
+const tableCountsQuery = `SELECT table_schema || '.' || table_name, (xpath('/row/c/text()', query_to_xml(format('SELECT count(*) AS c FROM %I.%I', table_schema, table_name), false, true, '')))[1]::text
+FROM information_schema.tables WHERE table_type = 'BASE TABLE' AND table_schema NOT IN ('pg_catalog', 'information_schema') ORDER BY 1`
+
+var scratchNameRegexp = regexp.MustCompile("[^a-z0-9_]")
+
+//verifyConnection returns the connection to the verification server, on --verify-host. Other options that aren't set fall back
+//to the source database ones
+func verifyConnection() pgConnection {
+	conn := sourceConnection()
+	conn.Host = *verifyHost
+	if *verifyPort > 0 {
+		conn.Port = *verifyPort
+	}
+	if *verifyUsername != "" {
+		conn.Username = *verifyUsername
+	}
+	if *verifyPassword != "" {
+		conn.Password = *verifyPassword
+	}
+	return conn
+}
+
+//scratchDatabaseName returns the name of the throwaway database used to verify the backup apiID
+func scratchDatabaseName(apiID string) string {
+	return "schelly_verify_" + scratchNameRegexp.ReplaceAllString(strings.ToLower(apiID), "_")
+}
+
+//query runs sql with psql and returns the rows, with columns separated by |
+func (c pgConnection) query(ctx context.Context, sql string) ([][]string, error) {
+	cmd := c.command(ctx, "psql", "--tuples-only", "--no-align", "--field-separator=|", "--set=ON_ERROR_STOP=1", "--command="+sql)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to run query '%s'; err=%s; stderr=%s", sql, err, stderr.String())
+	}
+	rows := make([][]string, 0)
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		rows = append(rows, strings.Split(line, "|"))
+	}
+	return rows, nil
+}
+
+//tableCounts returns the row count of each table of the database of conn
+func tableCounts(ctx context.Context, conn pgConnection) (map[string]int64, error) {
+	rows, err := conn.query(ctx, tableCountsQuery)
+	if err != nil {
+		return nil, err
+	}
+	return parseTableCounts(rows)
+}
+
+//parseTableCounts reads the rows returned by tableCountsQuery
+func parseTableCounts(rows [][]string) (map[string]int64, error) {
+	counts := make(map[string]int64)
+	for _, row := range rows {
+		if len(row) != 2 {
+			return nil, fmt.Errorf("Unexpected table count row %v", row)
+		}
+		count, err := strconv.ParseInt(row[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid row count for table %s: %s", row[0], row[1])
+		}
+		counts[row[0]] = count
+	}
+	return counts, nil
+}
+
+//snapshotEndMarker is echoed by psql after the output of the queries run by exportSnapshot
+const snapshotEndMarker = "schelly-snapshot-end"
+
+//dumpSnapshot is an open transaction on the source database that exported its snapshot. pg_dump dumps the database
+//with `--snapshot`, so that it sees the same rows as the transaction
+type dumpSnapshot struct {
+	ID     string
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+}
+
+//exportSnapshot starts a repeatable read transaction with psql on the database of conn, exports its snapshot and counts
+//the rows of each table in it. The transaction is kept open until close
+func exportSnapshot(ctx context.Context, conn pgConnection) (*dumpSnapshot, map[string]int64, error) {
+	s := &dumpSnapshot{cmd: conn.command(ctx, "psql", "--tuples-only", "--no-align", "--field-separator=|", "--quiet", "--set=ON_ERROR_STOP=1")}
+	s.cmd.Stderr = &s.stderr
+	var err error
+	s.stdin, err = s.cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	s.stdout, err = s.cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = s.cmd.Start()
+	if err != nil {
+		return nil, nil, err
+	}
+	io.WriteString(s.stdin, "BEGIN ISOLATION LEVEL REPEATABLE READ READ ONLY;\nSELECT pg_export_snapshot();\n"+tableCountsQuery+";\n\\echo "+snapshotEndMarker+"\n")
+
+	//psql exits on the first error, leaving the output without the marker
+	rows := make([][]string, 0)
+	ended := false
+	scanner := bufio.NewScanner(s.stdout)
+	for !ended && scanner.Scan() {
+		line := scanner.Text()
+		ended = line == snapshotEndMarker
+		if !ended && strings.TrimSpace(line) != "" {
+			rows = append(rows, strings.Split(line, "|"))
+		}
+	}
+	if !ended || len(rows) == 0 || len(rows[0]) != 1 {
+		s.close()
+		return nil, nil, fmt.Errorf("Failed to export snapshot with '%s'; stderr=%s", strings.Join(s.cmd.Args, " "), s.stderr.String())
+	}
+	s.ID = rows[0][0]
+	counts, err := parseTableCounts(rows[1:])
+	if err != nil {
+		s.close()
+		return nil, nil, err
+	}
+	return s, counts, nil
+}
+
+//snapshotID returns the ID pg_dump imports the snapshot with, or an empty string when there is no snapshot
+func (s *dumpSnapshot) snapshotID() string {
+	if s == nil {
+		return ""
+	}
+	return s.ID
+}
+
+//close ends the transaction of the snapshot, once pg_dump is done with it. Closing a nil snapshot does nothing
+func (s *dumpSnapshot) close() {
+	if s == nil {
+		return
+	}
+	io.WriteString(s.stdin, "COMMIT;\n")
+	s.stdin.Close()
+	io.Copy(ioutil.Discard, s.stdout)
+	s.cmd.Wait()
+}
+
+//recordTableCounts records on m the row count of each table of the source database, which verifications compare with the
+//restored database. Counts are only taken when backups can be verified, and not for partial or schema only dumps, which
+//can't be compared with the whole database. They are taken on a snapshot that pg_dump has to dump, so that rows written
+//meanwhile aren't counted on one side only. Returns the snapshot, or nil when counts aren't taken. A failure is logged and
+//leaves the counts out
+func recordTableCounts(ctx context.Context, m *backupManifest) *dumpSnapshot {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	if *verifyHost == "" || m.isPhysical() || m.isCluster() || m.Filters != nil || hasFlag(m.Flags, "--schema-only") {
+		return nil
+	}
+	snapshot, counts, err := exportSnapshot(ctx, sourceConnection().withDatabase(m.Database))
+	if err != nil {
+		sugar.Warnf("Couldn't count the rows of the tables of %s. Verification won't compare them. err=%s", m.Database, err)
+		return nil
+	}
+	m.TableCounts = counts
+	return snapshot
+}
+
+//compareTableCounts checks that the restored database has the same tables as counted when the backup was taken and that
+//their row counts differ at most by tolerance percent
+func compareTableCounts(source map[string]int64, restored map[string]int64, tolerance float64) error {
+	problems := make([]string, 0)
+	if len(source) != len(restored) {
+		problems = append(problems, fmt.Sprintf("%d tables restored, %d at backup time", len(restored), len(source)))
+	}
+	for table, sourceCount := range source {
+		restoredCount, ok := restored[table]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("table %s missing", table))
+			continue
+		}
+		diff := float64(sourceCount - restoredCount)
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff > float64(sourceCount)*tolerance/100 {
+			problems = append(problems, fmt.Sprintf("table %s has %d rows, %d at backup time", table, restoredCount, sourceCount))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+//readAssertions reads the user supplied SQL assertions: one query per line, each one must return true
+func readAssertions(path string) ([]string, error) {
+	if path == "" {
+		return []string{}, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading verification SQL file: %s", err)
+	}
+	assertions := make([]string, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "--") {
+			continue
+		}
+		assertions = append(assertions, line)
+	}
+	return assertions, nil
+}
+
+//checkAssertions runs each assertion on the database of conn
+func checkAssertions(ctx context.Context, conn pgConnection, assertions []string) error {
+	for _, assertion := range assertions {
+		rows, err := conn.query(ctx, assertion)
+		if err != nil {
+			return err
+		}
+		if len(rows) != 1 || len(rows[0]) != 1 || rows[0][0] != "t" {
+			return fmt.Errorf("assertion failed: %s", assertion)
+		}
+	}
+	return nil
+}
+
+//startVerification verifies the backup apiID in background. The result is recorded on the backup manifest
+func startVerification(apiID string) error {
+	m, err := readManifest(apiID)
+	if err != nil {
+		return err
+	}
+	if m.Status != statusAvailable {
+		return fmt.Errorf("Backup %s can't be verified because its status is %s", apiID, m.Status)
+	}
+	if m.Tier == tierArchive {
+		return fmt.Errorf("Backup %s can't be verified because its file is archived", apiID)
+	}
+	if m.isPhysical() {
+		return fmt.Errorf("Backup %s can't be verified because it is a physical backup", apiID)
+	}
+	if m.isCluster() {
+		return fmt.Errorf("Backup %s can't be verified because it is a cluster backup", apiID)
+	}
+	if *verifyHost == "" {
+		return fmt.Errorf("Backup %s can't be verified because `--verify-host` isn't set", apiID)
+	}
+	j, ctx, err := verifyJobs.start(apiID, scratchDatabaseName(apiID))
+	if err != nil {
+		return err
+	}
+	verifyJobs.setSize(j, m.Size)
+	go runVerifyJob(ctx, j)
+	return nil
+}
+
+//runVerifyJob restores the backup into a scratch database on the verification server, checks it and drops it
+func runVerifyJob(ctx context.Context, j *job) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	conn := verifyConnection().withDatabase(j.DataID)
+	v := &backupVerification{
+		Status:    statusRunning,
+		Server:    fmt.Sprintf("%s:%d", conn.Host, conn.Port),
+		StartTime: j.StartTime,
+	}
+	err := recordVerification(j.ID, v)
+	if err == nil {
+		err = verifyBackup(ctx, j, conn, v)
+		if ctx.Err() != nil {
+			err = fmt.Errorf("Verification of %s cancelled", j.ID)
+		}
+		v.EndTime = time.Now()
+		if err != nil {
+			sugar.Warnf("Verification of backup %s failed. err=%s", j.ID, err)
+			v.Status = verificationFailed
+			v.Message = err.Error()
+		} else {
+			sugar.Infof("Backup %s verified (%d tables, %d rows)", j.ID, v.Tables, v.Rows)
+			v.Status = verificationVerified
+		}
+		if ctx.Err() == nil {
+			err0 := recordVerification(j.ID, v)
+			if err0 != nil {
+				sugar.Errorf("Error recording verification of %s. err=%s", j.ID, err0)
+			}
+		}
+	}
+	verifyJobs.finish(j, err)
+}
+
+func verifyBackup(ctx context.Context, j *job, conn pgConnection, v *backupVerification) error {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	m, err := readManifest(j.ID)
+	if err != nil {
+		return err
+	}
+	assertions, err := readAssertions(*verifySQLFile)
+	if err != nil {
+		return err
+	}
+
+	err = recreateDatabase(ctx, conn)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		//the job context may have been cancelled already
+		_, err := conn.withDatabase(maintenanceDatabase).run(context.Background(), "psql", "--command=DROP DATABASE IF EXISTS "+quoteIdentifier(conn.Database))
+		if err != nil {
+			sugar.Warnf("Couldn't drop scratch database %s. err=%s", conn.Database, err)
+		}
+	}()
+
+	err = restoreManifest(ctx, j, *m, conn)
+	if err != nil {
+		return fmt.Errorf("restore failed: %s", err)
+	}
+
+	restored, err := tableCounts(ctx, conn)
+	if err != nil {
+		return err
+	}
+	v.Tables = len(restored)
+	for _, count := range restored {
+		v.Rows += count
+	}
+	//the source database has changed since the backup, so the restored counts are compared with the ones taken along with it
+	if m.TableCounts != nil {
+		err = compareTableCounts(m.TableCounts, restored, *verifyRowTolerance)
+		if err != nil {
+			return err
+		}
+	}
+	return checkAssertions(ctx, conn, assertions)
+}
+
+//recordVerification stores the verification on the backup manifest, unless the backup was deleted meanwhile
+func recordVerification(apiID string, v *backupVerification) error {
+	_, err := updateManifest(apiID, func(m *backupManifest) error {
+		m.Verification = v
+		return nil
+	})
+	return err
+}
+
+//verifyLatestBackup verifies the most recent available backup, if it wasn't verified yet
+func verifyLatestBackup() error {
+	manifests, _, err := listManifests()
+	if err != nil {
+		return err
+	}
+	var latest *backupManifest
+	for i, m := range manifests {
+		if m.Status == statusAvailable && (latest == nil || m.StartTime.After(latest.StartTime)) {
+			latest = &manifests[i]
+		}
+	}
+	if latest == nil || latest.Verification != nil {
+		return nil
+	}
+	return startVerification(latest.APIID)
+}
+
+//scheduleVerifications verifies the latest backup every interval
+func scheduleVerifications(interval time.Duration) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	go func() {
+		for range time.Tick(interval) {
+			err := verifyLatestBackup()
+			if err != nil {
+				sugar.Warnf("Scheduled backup verification failed to start. err=%s", err)
+			}
+		}
+	}()
+}
+
+//verificationMessage describes the verification of a backup for Schelly responses
+func verificationMessage(apiID string, v backupVerification) string {
+	switch v.Status {
+	case statusRunning:
+		j, ok := verifyJobs.get(apiID)
+		if ok && j.Status == statusRunning {
+			return "verification is running"
+		}
+		return "verification was interrupted"
+	case verificationVerified:
+		return fmt.Sprintf("verified on %s: %d tables, %d rows", v.Server, v.Tables, v.Rows)
+	}
+	return "verification failed: " + v.Message
+}
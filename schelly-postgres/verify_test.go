@@ -0,0 +1,232 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flaviostutz/schelly-webhook/schellyhook"
+	"go.uber.org/zap"
+)
+
+//fakeVerifyPsqlScript answers the table counts query with the contents of $COUNTS_DIR/<dbname> and
+//assertions with true, unless they select false. Sessions that export a snapshot copy the counts to
+//$COUNTS_DIR/snapshot-1 and count the rows of the copy
+const fakeVerifyPsqlScript = `dbname=""
+for arg in "$@"; do
+  case "$arg" in
+    --dbname=*) dbname="${arg#--dbname=}" ;;
+  esac
+done
+case "$*" in
+  *--command=*) ;;
+  *--tuples-only*)
+    echo "$*" >> "$PSQL_LOG"
+    while read -r line; do
+      case "$line" in
+        *pg_export_snapshot*) cp "$COUNTS_DIR/$dbname" "$COUNTS_DIR/snapshot-1" && echo snapshot-1 ;;
+        *query_to_xml*) cat "$COUNTS_DIR/snapshot-1" ;;
+        '\echo '*) echo "${line#* }" ;;
+        COMMIT*) echo COMMIT >> "$PSQL_LOG"; exit 0 ;;
+      esac
+    done
+    exit 0 ;;
+esac
+` + fakePsqlScript + `case "$command" in
+  *query_to_xml*) cat "$COUNTS_DIR/$dbname" ;;
+  *"SELECT false"*) echo f ;;
+  --command=SELECT*) echo t ;;
+esac
+`
+
+//waitForJob waits for a job that is started in background to be registered and finished
+func waitForJob(t *testing.T, registry *jobRegistry, id string) {
+	for i := 0; i < 100; i++ {
+		if _, ok := registry.get(id); ok {
+			registry.wait(id)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("Job %s wasn't started", id)
+}
+
+func setupVerifyTest(t *testing.T, dir string, counts map[string]string) string {
+	installFakeCommand(t, dir, "pg_dump", fakePgDumpScript)
+	installFakeCommand(t, dir, "psql", fakeVerifyPsqlScript)
+	psqlLog := filepath.Join(dir, "psql.log")
+	os.Setenv("PSQL_LOG", psqlLog)
+	os.Setenv("RESTORE_OUT", filepath.Join(dir, "restore.sql"))
+	countsDir := filepath.Join(dir, "counts")
+	mkDirs(countsDir)
+	os.Setenv("COUNTS_DIR", countsDir)
+	for database, contents := range counts {
+		ioutil.WriteFile(filepath.Join(countsDir, database), []byte(contents), 0644)
+	}
+	return psqlLog
+}
+
+func TestVerifyAfterBackup(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestVerifyAfterBackup...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	psqlLog := setupVerifyTest(t, dir, map[string]string{
+		"schelly":           "public.t|10\npublic.u|0\n",
+		"schelly_verify_v1": "public.t|10\npublic.u|0\n",
+	})
+	backupStorage = newMemoryStorage()
+	*verifyAfterBackup = true
+	*verifyHost = "localhost"
+
+	backuper := PostgresBackuper{}
+	backuper.CreateNewBackup("v1", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("v1")
+	waitForJob(t, verifyJobs, "v1")
+
+	m, err := readManifest("v1")
+	if err != nil || m.Verification == nil || m.Verification.Status != verificationVerified || m.Verification.Tables != 2 || m.Verification.Rows != 10 {
+		t.Fatalf("Backup should be verified. manifest=%v err=%s", m, err)
+	}
+	backup, _ := backuper.GetBackup("v1")
+	if backup.Status != statusAvailable || !strings.Contains(backup.Message, "verified on localhost:5432: 2 tables, 10 rows") {
+		t.Errorf("Unexpected backup status after verification: %v", backup)
+	}
+
+	log, _ := ioutil.ReadFile(psqlLog)
+	if strings.Count(string(log), `--command=DROP DATABASE IF EXISTS "schelly_verify_v1"`) != 2 {
+		t.Errorf("Scratch database should be created and dropped: %s", log)
+	}
+}
+
+//fakeSnapshotPgDumpScript adds a row to public.t on the source and then dumps, as a plain dump, the row counts of the
+//snapshot it is given, or of the source without a snapshot
+const fakeSnapshotPgDumpScript = `output=/dev/stdout
+snapshot=schelly
+for arg in "$@"; do
+  case "$arg" in
+    --file=*) output="${arg#--file=}" ;;
+    --snapshot=*) snapshot="${arg#--snapshot=}" ;;
+  esac
+done
+echo 'public.t|11' > "$COUNTS_DIR/schelly"
+{
+  echo '\connect "schelly"'
+  cat "$COUNTS_DIR/$snapshot"
+} > "$output"
+`
+
+func TestVerifySnapshot(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestVerifySnapshot...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	psqlLog := setupVerifyTest(t, dir, map[string]string{})
+	installFakeCommand(t, dir, "pg_dump", fakeSnapshotPgDumpScript)
+	backupStorage = newMemoryStorage()
+	*verifyAfterBackup = true
+	*verifyHost = "localhost"
+
+	backuper := PostgresBackuper{}
+	for _, apiID := range []string{"v5", "v6"} {
+		*streamBackup = apiID == "v6"
+		ioutil.WriteFile(filepath.Join(dir, "counts", "schelly"), []byte("public.t|10\n"), 0644)
+		//the restore writes the dumped row counts as the ones of the scratch database
+		os.Setenv("RESTORE_OUT", filepath.Join(dir, "counts", scratchDatabaseName(apiID)))
+
+		//a row is written after the rows are counted, before pg_dump reads them
+		backuper.CreateNewBackup(apiID, 0, &schellyhook.ShellContext{})
+		backupJobs.wait(apiID)
+		waitForJob(t, verifyJobs, apiID)
+
+		m, err := readManifest(apiID)
+		if err != nil || m.TableCounts["public.t"] != 10 || !hasFlag(m.PgDump.Command, "--snapshot=snapshot-1") {
+			t.Fatalf("Rows should be counted on the snapshot dumped by pg_dump. manifest=%v err=%s", m, err)
+		}
+		if m.Verification == nil || m.Verification.Status != verificationVerified {
+			t.Errorf("Backup should be verified despite the rows written during the dump. verification=%v", m.Verification)
+		}
+	}
+	log, _ := ioutil.ReadFile(psqlLog)
+	if strings.Count(string(log), "COMMIT") != 2 {
+		t.Errorf("Transactions that exported the snapshots should be ended: %s", log)
+	}
+}
+
+func TestVerifyBackupFailures(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestVerifyBackupFailures...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	psqlLog := setupVerifyTest(t, dir, map[string]string{
+		"schelly":           "public.t|10\n",
+		"schelly_verify_v2": "public.t|9\n",
+	})
+	backupStorage = newMemoryStorage()
+	host := "verifyhost"
+	verifyHost = &host
+	assertions := filepath.Join(dir, "assertions.sql")
+	ioutil.WriteFile(assertions, []byte("-- sanity checks\nSELECT true\n\nSELECT false\n"), 0644)
+
+	backuper := PostgresBackuper{}
+	backuper.CreateNewBackup("v2", 0, &schellyhook.ShellContext{})
+	backupJobs.wait("v2")
+	//the source has changed since the backup
+	ioutil.WriteFile(filepath.Join(dir, "counts", "schelly"), []byte("public.t|50\n"), 0644)
+
+	startVerification("v2")
+	verifyJobs.wait("v2")
+	backup, _ := backuper.GetBackup("v2")
+	if backup.Status != statusError || !strings.Contains(backup.Message, "verification failed: table public.t has 9 rows, 10 at backup time") {
+		t.Errorf("Verification should fail on row count mismatch: %v", backup)
+	}
+	log, _ := ioutil.ReadFile(psqlLog)
+	if !strings.Contains(string(log), "--host=verifyhost") {
+		t.Errorf("Scratch database should be on the verification server: %s", log)
+	}
+
+	*verifyRowTolerance = 20
+	*verifySQLFile = assertions
+	startVerification("v2")
+	verifyJobs.wait("v2")
+	backup, _ = backuper.GetBackup("v2")
+	if backup.Status != statusError || !strings.Contains(backup.Message, "assertion failed: SELECT false") {
+		t.Errorf("Verification should fail on assertion: %v", backup)
+	}
+
+	ioutil.WriteFile(assertions, []byte("SELECT true\n"), 0644)
+	startVerification("v2")
+	verifyJobs.wait("v2")
+	backup, _ = backuper.GetBackup("v2")
+	if backup.Status != statusAvailable || !strings.Contains(backup.Message, "verified on verifyhost:5432") {
+		t.Errorf("Verification should pass within tolerance: %v", backup)
+	}
+
+	*verifyHost = ""
+	if startVerification("v2") == nil {
+		t.Errorf("Backups can't be verified without a verification server")
+	}
+}
+
+func TestCompareTableCounts(t *testing.T) {
+	err := compareTableCounts(map[string]int64{"public.a": 1, "public.b": 2}, map[string]int64{"public.a": 1}, 0)
+	if err == nil || !strings.Contains(err.Error(), "table public.b missing") || !strings.Contains(err.Error(), "1 tables restored, 2 at backup time") {
+		t.Errorf("Missing tables should be reported. err=%s", err)
+	}
+	err = compareTableCounts(map[string]int64{"public.a": 100}, map[string]int64{"public.a": 95}, 5)
+	if err != nil {
+		t.Errorf("Row count difference within tolerance should be accepted. err=%s", err)
+	}
+}
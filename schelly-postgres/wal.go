@@ -0,0 +1,630 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+//walDirectory keeps the archived WAL files apart from the backups, inside the backups dir, Azure prefix or S3 prefix
+const walDirectory = "wal"
+
+//walStorage keeps the WAL files archived by PostgreSQL. nil when WAL archiving is disabled
+var walStorage Storage
+
+//walFileName matches the files PostgreSQL archives: WAL segments (timeline, log and segment), partial segments,
+//backup history files and timeline history files
+var walFileName = regexp.MustCompile(`^[0-9A-F]{8}(\.history|[0-9A-F]{16}(\.partial|\.[0-9A-F]{8}\.backup)?)$`)
+
+//walLocation matches the WAL locations of backup history files, such as `0/2000028 (file 000000010000000000000002)`
+var walLocation = regexp.MustCompile(`^([0-9A-F]+/[0-9A-F]+) \(file ([0-9A-F]{24})\)$`)
+
+//walStopTime matches the STOP TIME of backup history files: date, time and time zone
+var walStopTime = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}) (\S+)$`)
+
+//walZoneOffset matches the numeric time zones of STOP TIME, with hours and optional minutes
+var walZoneOffset = regexp.MustCompile(`^([+-])(\d{2})(\d{2})?$`)
+
+//walKeyID matches the key ids on the names of WAL files encrypted directly with a key
+var walKeyID = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+//walObject is a WAL file stored on walStorage. The object name tells how it was compressed and encrypted, as
+//`<wal file><compression extension>[.<key id>].enc`, because WAL files have no manifest. Files without a key id have
+//their own data key, wrapped with a keyring master key and stored next to them as `<wal file>.key.json`
+type walObject struct {
+	Name        string
+	Compression string
+	Encryption  *encryptionInfo
+}
+
+//walRange describes the WAL needed to make a physical backup consistent, as recorded by PostgreSQL on the backup
+//history file it archives at the end of the backup
+type walRange struct {
+	Timeline     int       `json:"timeline"`
+	StartLSN     string    `json:"start_lsn"`
+	StartSegment string    `json:"start_segment"`
+	StopLSN      string    `json:"stop_lsn"`
+	StopSegment  string    `json:"stop_segment"`
+	StopTime     time.Time `json:"stop_time"`
+	HistoryFile  string    `json:"history_file"`
+}
+
+//newWALStorage creates the storage of archived WAL files, under the `wal` directory of the backend selected by
+//--target-data-backend, with its own transfer limits
+func newWALStorage(backend string) (Storage, error) {
+	storage, err := newBackendStorage(backend)
+	if err != nil {
+		return nil, err
+	}
+	switch s := storage.(type) {
+	case *localStorage:
+		storage, err = newLocalStorage(filepath.Join(s.dir, walDirectory))
+		if err != nil {
+			return nil, err
+		}
+	case *azureBlobStorage:
+		s.prefix += walDirectory + "/"
+	case *s3Storage:
+		s.prefix += walDirectory + "/"
+	}
+	return newLimitedStorage(storage), nil
+}
+
+func (o walObject) objectName() string {
+	name := o.Name + compressionExtension(o.Compression)
+	if o.Encryption != nil && o.Encryption.WrappedKey == "" {
+		name += "." + o.Encryption.KeyID
+	}
+	if o.Encryption != nil {
+		name += ".enc"
+	}
+	return name
+}
+
+//walKeyName names the wrapped data key of a WAL file
+func walKeyName(name string) string {
+	return name + wrappedKeySuffix
+}
+
+//parseWALObject reverts objectName. Returns false for objects that aren't WAL files
+func parseWALObject(objectName string) (walObject, bool) {
+	o := walObject{Name: objectName, Compression: "none"}
+	if strings.HasSuffix(o.Name, ".enc") {
+		o.Name = strings.TrimSuffix(o.Name, ".enc")
+		dot := strings.LastIndex(o.Name, ".")
+		if dot >= 0 && walKeyID.MatchString(o.Name[dot+1:]) {
+			o.Encryption = &encryptionInfo{Algorithm: encryptionAlgorithm, KeyID: o.Name[dot+1:]}
+			o.Name = o.Name[:dot]
+		}
+	}
+	for codec, c := range compressionCodecs {
+		if strings.HasSuffix(o.Name, c.extension) {
+			o.Name = strings.TrimSuffix(o.Name, c.extension)
+			o.Compression = codec
+			break
+		}
+	}
+	if strings.HasSuffix(objectName, ".enc") && o.Encryption == nil {
+		o.Encryption = &encryptionInfo{Algorithm: encryptionAlgorithm, WrappedKey: walKeyName(o.Name)}
+	}
+	return o, walFileName.MatchString(o.Name)
+}
+
+//walEncryption describes the encryption of the new WAL file name, or nil when it is disabled. With a keyring, each WAL
+//file gets its own data key, like backups do, so that the master key only ever encrypts data keys
+func walEncryption(name string) *encryptionInfo {
+	if backupKeyring != nil {
+		return &encryptionInfo{Algorithm: encryptionAlgorithm, WrappedKey: walKeyName(name)}
+	}
+	if backupEncryptionKey != nil {
+		return &encryptionInfo{Algorithm: encryptionAlgorithm, KeyID: backupEncryptionKey.ID}
+	}
+	return nil
+}
+
+//walCandidates returns the objects a WAL file may have been stored as, starting with the current compression and
+//encryption options, which were most likely used to archive it. WAL files archived before they had their own data
+//keys are encrypted with a keyring master key
+func walCandidates(name string) []walObject {
+	encryptions := []*encryptionInfo{walEncryption(name), nil, {Algorithm: encryptionAlgorithm, WrappedKey: walKeyName(name)}}
+	if backupEncryptionKey != nil {
+		encryptions = append(encryptions, &encryptionInfo{Algorithm: encryptionAlgorithm, KeyID: backupEncryptionKey.ID})
+	}
+	if backupKeyring != nil {
+		for _, key := range backupKeyring.keys {
+			encryptions = append(encryptions, &encryptionInfo{Algorithm: encryptionAlgorithm, KeyID: keyFingerprint(key)})
+		}
+	}
+	codecs := []string{*compression, "none"}
+	for codec := range compressionCodecs {
+		codecs = append(codecs, codec)
+	}
+
+	seen := make(map[string]bool)
+	candidates := make([]walObject, 0)
+	for _, encryption := range encryptions {
+		for _, codec := range codecs {
+			o := walObject{Name: name, Compression: codec, Encryption: encryption}
+			if !seen[o.objectName()] {
+				seen[o.objectName()] = true
+				candidates = append(candidates, o)
+			}
+		}
+	}
+	return candidates
+}
+
+//findWAL returns the stored object of a WAL file, or errObjectNotFound when it wasn't archived
+func findWAL(name string) (*walObject, error) {
+	for _, o := range walCandidates(name) {
+		_, err := walStorage.Stat(o.objectName())
+		if err == errObjectNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &o, nil
+	}
+	return nil, errObjectNotFound
+}
+
+//archiveWAL stores a WAL file, compressed and encrypted like backups. PostgreSQL may archive a file again after a
+//crash, so archiving a file that is already stored with the same contents succeeds, and tells so. Archiving it with
+//different contents fails, so that a file from another cluster never replaces the archived one
+func archiveWAL(name string, reader io.Reader) (bool, error) {
+	if !walFileName.MatchString(name) {
+		return false, fmt.Errorf("Invalid WAL file name %s", name)
+	}
+	existing, err := findWAL(name)
+	if err != nil && err != errObjectNotFound {
+		return false, err
+	}
+	if existing != nil {
+		cr := newChecksumReader(reader)
+		_, err = io.Copy(ioutil.Discard, cr)
+		if err != nil {
+			return false, err
+		}
+		archived, err := openWAL(*existing)
+		if err != nil {
+			return false, err
+		}
+		defer archived.Close()
+		ar := newChecksumReader(archived)
+		_, err = io.Copy(ioutil.Discard, ar)
+		if err != nil {
+			return false, fmt.Errorf("Error reading archived WAL file %s: %s", name, err)
+		}
+		if ar.sum() != cr.sum() {
+			return false, fmt.Errorf("WAL file %s is already archived with different contents", name)
+		}
+		return true, nil
+	}
+
+	o := walObject{Name: name, Compression: *compression, Encryption: walEncryption(name)}
+	var stored io.ReadCloser = compressStream(reader, o.Compression, *compressionLevel)
+	defer stored.Close()
+	if o.Encryption != nil {
+		key, err := walEncryptionKey(o.Encryption)
+		if err != nil {
+			return false, err
+		}
+		stored = encryptStream(stored, key)
+		defer stored.Close()
+	}
+	return false, walStorage.Put(o.objectName(), stored)
+}
+
+//walEncryptionKey returns the key that encrypts a new WAL file. Data keys are stored on walStorage before the file they
+//encrypt, so that an archived file always has its key
+func walEncryptionKey(info *encryptionInfo) ([]byte, error) {
+	if info.WrappedKey == "" {
+		return keyFor(info)
+	}
+	return newDataKey(walStorage, info)
+}
+
+//walKeyFor returns the key that decrypts a WAL file encrypted as described by info
+func walKeyFor(info *encryptionInfo) ([]byte, error) {
+	if info.WrappedKey == "" {
+		return keyFor(info)
+	}
+	if backupKeyring == nil {
+		return nil, fmt.Errorf("Data key %s of the WAL file is wrapped, but no keyring is loaded", info.WrappedKey)
+	}
+	wk, err := readWrappedKey(walStorage, info.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading data key %s of the WAL file: %s", info.WrappedKey, err)
+	}
+	return backupKeyring.unwrap(wk)
+}
+
+//openWAL fetches an archived WAL file, decrypted and decompressed. The result must be closed by the caller
+func openWAL(o walObject) (io.ReadCloser, error) {
+	var key []byte
+	if o.Encryption != nil {
+		var err error
+		key, err = walKeyFor(o.Encryption)
+		if err != nil {
+			return nil, err
+		}
+	}
+	reader, err := walStorage.Get(o.objectName())
+	if err != nil {
+		return nil, err
+	}
+	var input io.Reader = reader
+	if o.Encryption != nil {
+		input, err = decryptStream(input, key)
+		if err != nil {
+			reader.Close()
+			return nil, err
+		}
+	}
+	decompressed, err := decompressStream(input, o.Compression)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return decompressedReader{decompressed, reader}, nil
+}
+
+//decompressedReader closes the decompressor and the stored object it reads from
+type decompressedReader struct {
+	io.ReadCloser
+	source io.Closer
+}
+
+func (dr decompressedReader) Close() error {
+	dr.ReadCloser.Close()
+	return dr.source.Close()
+}
+
+//restoreWAL writes the archived WAL file name to path, as restore_command does. The file is written under a temporary
+//name first, so that PostgreSQL never reads a partial file
+func restoreWAL(name string, path string) error {
+	if !walFileName.MatchString(name) {
+		return fmt.Errorf("Invalid WAL file name %s", name)
+	}
+	o, err := findWAL(name)
+	if err != nil {
+		return err
+	}
+	reader, err := openWAL(*o)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	tmpPath := path + ".schelly"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, reader)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Error restoring WAL file %s: %s", name, err)
+	}
+	return os.Rename(tmpPath, path)
+}
+
+//runWALCommand archives (--archive-wal) or restores (--restore-wal) a single WAL file, so that the provider can be used
+//as archive_command and restore_command of PostgreSQL
+func runWALCommand(backend string) error {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	err := validateCompression(*compression, *compressionLevel)
+	if err != nil {
+		return err
+	}
+	backupEncryptionKey, err = loadEncryptionKey(*encryptionKeyFile, *encryptionKeyEnv)
+	if err != nil {
+		return err
+	}
+	if *keyringFile != "" {
+		backupKeyring, err = loadKeyring(*keyringFile, *masterKeyID)
+		if err != nil {
+			return err
+		}
+	}
+	walStorage, err = newWALStorage(backend)
+	if err != nil {
+		return err
+	}
+
+	if *restoreWALName != "" {
+		if *restoreWALPath == "" {
+			return fmt.Errorf("`--restore-wal` requires `--restore-wal-to`")
+		}
+		err = restoreWAL(*restoreWALName, *restoreWALPath)
+		if err == errObjectNotFound {
+			return fmt.Errorf("WAL file %s isn't archived", *restoreWALName)
+		}
+		if err != nil {
+			return err
+		}
+		sugar.Infof("WAL file %s restored to %s", *restoreWALName, *restoreWALPath)
+		return nil
+	}
+
+	file, err := os.Open(*archiveWALPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	name := filepath.Base(*archiveWALPath)
+	archived, err := archiveWAL(name, file)
+	if err != nil {
+		return err
+	}
+	if archived {
+		sugar.Infof("WAL file %s was already archived", name)
+	} else {
+		sugar.Infof("WAL file %s archived", name)
+	}
+	return nil
+}
+
+//parseBackupHistory reads a backup history file (`<segment>.<offset>.backup`), which PostgreSQL archives at the end of
+//each base backup. Returns the WAL range of the backup and its label
+func parseBackupHistory(reader io.Reader) (*walRange, string, error) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	r := walRange{}
+	label := ""
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ": ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		switch fields[0] {
+		case "START WAL LOCATION", "STOP WAL LOCATION":
+			location := walLocation.FindStringSubmatch(fields[1])
+			if location == nil {
+				return nil, "", fmt.Errorf("Invalid WAL location %s on backup history file", fields[1])
+			}
+			if fields[0] == "START WAL LOCATION" {
+				r.StartLSN, r.StartSegment = location[1], location[2]
+			} else {
+				r.StopLSN, r.StopSegment = location[1], location[2]
+			}
+		case "START TIMELINE":
+			r.Timeline, _ = strconv.Atoi(fields[1])
+		case "STOP TIME":
+			//the stop time only picks the base backup of time targets, falling back to the backup end time when unknown
+			stopTime, err := parseStopTime(fields[1])
+			if err != nil {
+				sugar.Warnf("Ignoring stop time of backup history file. err=%s", err)
+			}
+			r.StopTime = stopTime
+		case "LABEL":
+			label = fields[1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", err
+	}
+	if r.StartSegment == "" || r.StopSegment == "" {
+		return nil, "", fmt.Errorf("Backup history file has no WAL locations")
+	}
+	return &r, label, nil
+}
+
+//parseStopTime reads the STOP TIME of a backup history file, such as `2019-06-14 09:28:19 CEST`. The zone is the one of
+//the log_timezone of the server, as an abbreviation or, for zones without one, as an offset such as `-03` or `+0530`.
+//Abbreviations other than UTC and GMT are only known when they belong to the local time zone, so others fail instead
+//of being read with a made up offset
+func parseStopTime(value string) (time.Time, error) {
+	match := walStopTime.FindStringSubmatch(value)
+	if match == nil {
+		return time.Time{}, fmt.Errorf("Invalid stop time %q", value)
+	}
+	zone := match[2]
+	if offset := walZoneOffset.FindStringSubmatch(zone); offset != nil {
+		hours, _ := strconv.Atoi(offset[2])
+		minutes, _ := strconv.Atoi(offset[3])
+		seconds := hours*3600 + minutes*60
+		if offset[1] == "-" {
+			seconds = -seconds
+		}
+		return time.ParseInLocation("2006-01-02 15:04:05", match[1], time.FixedZone(zone, seconds))
+	}
+	if zone == "UTC" || zone == "GMT" {
+		return time.ParseInLocation("2006-01-02 15:04:05", match[1], time.UTC)
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05 MST", value, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+	//Parse gives unknown abbreviations a zero offset, on a location of their own
+	if t.Location() != time.Local {
+		return time.Time{}, fmt.Errorf("Unknown time zone %s on stop time %q", zone, value)
+	}
+	return t, nil
+}
+
+//archivedBackupRanges reads the backup history files of the archive and returns the WAL ranges of the physical
+//backups taken by the provider, by apiID
+func archivedBackupRanges(objects []walObject) map[string]*walRange {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	ranges := make(map[string]*walRange)
+	for _, o := range objects {
+		if !strings.HasSuffix(o.Name, ".backup") {
+			continue
+		}
+		reader, err := openWAL(o)
+		if err != nil {
+			sugar.Warnf("Couldn't read backup history file %s. err=%s", o.Name, err)
+			continue
+		}
+		r, label, err := parseBackupHistory(reader)
+		reader.Close()
+		if err != nil {
+			sugar.Warnf("Ignoring backup history file %s. err=%s", o.Name, err)
+			continue
+		}
+		if strings.HasPrefix(label, basebackupLabelPrefix) {
+			r.HistoryFile = o.Name
+			ranges[strings.TrimPrefix(label, basebackupLabelPrefix)] = r
+		}
+	}
+	return ranges
+}
+
+//listWAL returns the WAL files on walStorage
+func listWAL() ([]walObject, error) {
+	objects, err := walStorage.List()
+	if err != nil {
+		return nil, err
+	}
+	wals := make([]walObject, 0)
+	for _, object := range objects {
+		if o, ok := parseWALObject(object.Name); ok {
+			wals = append(wals, o)
+		}
+	}
+	return wals, nil
+}
+
+//pairArchivedWAL records on the manifests of available physical backups the WAL range they need, as found on the
+//backup history files of the archive. Returns the manifests of the physical backups that have their WAL archived, and
+//of the running or available ones whose WAL isn't known yet
+func pairArchivedWAL(wals []walObject) ([]backupManifest, []backupManifest, error) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	manifests, _, err := listManifests()
+	if err != nil {
+		return nil, nil, err
+	}
+	var ranges map[string]*walRange
+	paired := make([]backupManifest, 0)
+	unpaired := make([]backupManifest, 0)
+	for _, m := range manifests {
+		if !m.isPhysical() || (m.Status != statusAvailable && m.Status != statusRunning) {
+			continue
+		}
+		if m.Status == statusRunning {
+			unpaired = append(unpaired, m)
+			continue
+		}
+		if m.WAL == nil {
+			if ranges == nil {
+				ranges = archivedBackupRanges(wals)
+			}
+			r, ok := ranges[m.APIID]
+			if !ok {
+				unpaired = append(unpaired, m)
+				continue
+			}
+			m.WAL = r
+			_, err = updateManifest(m.APIID, func(current *backupManifest) error {
+				current.WAL = r
+				return nil
+			})
+			if err != nil {
+				sugar.Warnf("Error writing manifest for %s. err: %s", m.APIID, err)
+			}
+		}
+		paired = append(paired, m)
+	}
+	return paired, unpaired, nil
+}
+
+//startsAfter tells whether the WAL range r starts after other. Ranges whose locations can't be read are compared by
+//their start segments
+func (r walRange) startsAfter(other walRange) bool {
+	start, err := parseLSN(r.StartLSN)
+	otherStart, err0 := parseLSN(other.StartLSN)
+	if err != nil || err0 != nil {
+		return walPosition(r.StartSegment) > walPosition(other.StartSegment)
+	}
+	return start > otherStart
+}
+
+//walPosition returns the log and segment numbers of a WAL file name, leaving out the timeline, so that files of
+//different timelines can be compared. Timeline history files have no position
+func walPosition(name string) string {
+	if len(name) < 24 {
+		return ""
+	}
+	return name[8:24]
+}
+
+//pruneWAL deletes the WAL files older than the oldest physical backup with archived WAL, which can't be replayed on top
+//of any backup that is kept. Timeline history files are always kept. Nothing is deleted until a physical backup is
+//paired with its WAL, nor while a backup that started before the oldest paired one isn't paired yet, as the WAL it
+//needs isn't known. Returns how many files were deleted
+func pruneWAL() (int, error) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	wals, err := listWAL()
+	if err != nil {
+		return 0, err
+	}
+	paired, unpaired, err := pairArchivedWAL(wals)
+	if err != nil {
+		return 0, err
+	}
+	oldest := ""
+	var oldestStart time.Time
+	for _, m := range paired {
+		if position := walPosition(m.WAL.StartSegment); oldest == "" || position < oldest {
+			oldest = position
+			oldestStart = m.StartTime
+		}
+	}
+	if oldest == "" {
+		sugar.Debugf("No physical backup is paired with archived WAL yet. Nothing to prune")
+		return 0, nil
+	}
+	for _, m := range unpaired {
+		if m.StartTime.Before(oldestStart) {
+			sugar.Infof("Physical backup %s isn't paired with archived WAL yet. Nothing to prune", m.APIID)
+			return 0, nil
+		}
+	}
+
+	pruned := 0
+	for _, o := range wals {
+		position := walPosition(o.Name)
+		if position == "" || position >= oldest {
+			continue
+		}
+		err = walStorage.Delete(o.objectName())
+		if err == nil && o.Encryption != nil && o.Encryption.WrappedKey != "" {
+			err = walStorage.Delete(o.Encryption.WrappedKey)
+		}
+		if err != nil && err != errObjectNotFound {
+			return pruned, err
+		}
+		pruned++
+	}
+	sugar.Infof("%d WAL files older than %s pruned", pruned, oldest)
+	return pruned, nil
+}
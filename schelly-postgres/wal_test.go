@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flaviostutz/schelly-webhook/schellyhook"
+	"go.uber.org/zap"
+)
+
+//backupHistory returns a backup history file as archived by PostgreSQL at the end of a base backup, which finished at
+//stopTime (UTC)
+func backupHistory(label string, start string, stop string, stopTime string) string {
+	return fmt.Sprintf(`START WAL LOCATION: 0/%s000028 (file %s)
+STOP WAL LOCATION: 0/%s000100 (file %s)
+CHECKPOINT LOCATION: 0/%s000060
+BACKUP METHOD: streamed
+BACKUP FROM: primary
+START TIME: 2019-06-14 09:28:18 UTC
+LABEL: %s
+START TIMELINE: 1
+STOP TIME: %s UTC
+STOP TIMELINE: 1
+`, start[23:], start, stop[23:], stop, start[23:], label, stopTime)
+}
+
+func TestWALArchive(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestWALArchive...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	*compression = "gzip"
+	backupEncryptionKey, _ = parseEncryptionKey(testEncryptionKey)
+	storage, err := newWALStorage("file")
+	if err != nil {
+		t.Fatalf("Error creating WAL storage: %s", err)
+	}
+	walStorage = storage
+
+	segment := bytes.Repeat([]byte("wal record "), 1000)
+	archived, err := archiveWAL("000000010000000000000001", bytes.NewReader(segment))
+	if err != nil || archived {
+		t.Fatalf("Error archiving WAL file. archived=%t err=%s", archived, err)
+	}
+	stored := "000000010000000000000001.gz." + backupEncryptionKey.ID + ".enc"
+	if _, err = os.Stat(filepath.Join(*backupsDir, walDirectory, stored)); err != nil {
+		t.Errorf("WAL file should be stored compressed and encrypted as %s. err=%s", stored, err)
+	}
+	archived, err = archiveWAL("000000010000000000000001", bytes.NewReader(segment))
+	if err != nil || !archived {
+		t.Errorf("Archiving the same WAL file again should succeed. archived=%t err=%s", archived, err)
+	}
+	_, err = archiveWAL("000000010000000000000001", strings.NewReader("another cluster"))
+	if err == nil {
+		t.Errorf("WAL file shouldn't be replaced by different contents")
+	}
+	_, err = archiveWAL("../manifest.json", bytes.NewReader(segment))
+	if err == nil {
+		t.Errorf("Invalid WAL file names should be rejected")
+	}
+
+	//files archived with other options are still found
+	*compression = "none"
+	backupEncryptionKey = nil
+	*archiveWALPath = filepath.Join(dir, "000000010000000000000002")
+	ioutil.WriteFile(*archiveWALPath, []byte("segment 2"), 0600)
+	err = runWALCommand("file")
+	if err != nil {
+		t.Fatalf("Error running archive command: %s", err)
+	}
+	*encryptionKeyEnv = "SCHELLY_TEST_KEY"
+	os.Setenv("SCHELLY_TEST_KEY", testEncryptionKey)
+	defer os.Unsetenv("SCHELLY_TEST_KEY")
+	*archiveWALPath, *restoreWALName, *restoreWALPath = "", "000000010000000000000001", filepath.Join(dir, "RECOVERYXLOG")
+	err = runWALCommand("file")
+	if err != nil {
+		t.Fatalf("Error running restore command: %s", err)
+	}
+	restored, _ := ioutil.ReadFile(*restoreWALPath)
+	if !bytes.Equal(restored, segment) {
+		t.Errorf("Restored WAL file should match the archived one. size=%d", len(restored))
+	}
+	*restoreWALName = "000000010000000000000009"
+	err = runWALCommand("file")
+	if err == nil {
+		t.Errorf("Restoring a WAL file that isn't archived should fail")
+	}
+
+	server := httptest.NewServer(newAPIRouter())
+	defer server.Close()
+	req, _ := http.NewRequest("PUT", server.URL+"/wal/000000010000000000000003", strings.NewReader("segment 3"))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil || res.StatusCode != http.StatusCreated {
+		t.Errorf("WAL file should be archived through the API. res=%v err=%s", res, err)
+	}
+	res, err = http.Get(server.URL + "/wal/000000010000000000000002")
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("WAL file should be served by the API. res=%v err=%s", res, err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "segment 2" {
+		t.Errorf("Unexpected WAL file contents %q", body)
+	}
+	res, err = http.Get(server.URL + "/wal/00000002.history")
+	if err != nil || res.StatusCode != http.StatusNotFound {
+		t.Errorf("Missing WAL files should be reported as not found. res=%v err=%s", res, err)
+	}
+}
+
+func TestWALEnvelopeEncryption(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestWALEnvelopeEncryption...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	walStorage, _ = newWALStorage("file")
+	walDir := filepath.Join(*backupsDir, walDirectory)
+
+	//a WAL file archived before WAL files had their own data keys, encrypted with the key now moved to the keyring
+	backupEncryptionKey, _ = parseEncryptionKey(testEncryptionKey)
+	archiveWAL("000000010000000000000001", strings.NewReader("segment 1"))
+	backupEncryptionKey = nil
+	backupKeyring, _ = loadKeyring(writeKeyring(t, dir, "k1 "+testEncryptionKey+"\n"), "")
+
+	_, err := archiveWAL("000000010000000000000002", strings.NewReader("segment 2"))
+	if err != nil {
+		t.Fatalf("Error archiving WAL file: %s", err)
+	}
+	if _, err = os.Stat(filepath.Join(walDir, "000000010000000000000002.enc")); err != nil {
+		t.Errorf("WAL file should be stored without the id of its data key. err=%s", err)
+	}
+	wk, err := readWrappedKey(walStorage, "000000010000000000000002.key.json")
+	if err != nil || wk.MasterKeyID != "k1" {
+		t.Fatalf("Data key of the WAL file should be wrapped by k1. key=%v err=%s", wk, err)
+	}
+	archived, err := archiveWAL("000000010000000000000002", strings.NewReader("segment 2"))
+	if err != nil || !archived {
+		t.Errorf("Archiving the same WAL file again should succeed. archived=%t err=%s", archived, err)
+	}
+
+	//rotate to k2 and retire k1, which the legacy WAL file still needs
+	ring, _ := loadKeyring(writeKeyring(t, dir, "k1 "+testEncryptionKey+"\nk2 "+testMasterKey2+"\n"), "")
+	count, err := rewrapKeys(walStorage, ring)
+	if err != nil || count != 1 {
+		t.Fatalf("Data key of the WAL file should be rewrapped. count=%d err=%s", count, err)
+	}
+	backupKeyring, _ = loadKeyring(writeKeyring(t, dir, "k2 "+testMasterKey2+"\n"), "")
+	path := filepath.Join(dir, "RECOVERYXLOG")
+	err = restoreWAL("000000010000000000000002", path)
+	restored, _ := ioutil.ReadFile(path)
+	if err != nil || string(restored) != "segment 2" {
+		t.Errorf("WAL file should be decrypted with its rewrapped data key. restored=%q err=%s", restored, err)
+	}
+	err = restoreWAL("000000010000000000000001", path)
+	if err == nil {
+		t.Errorf("WAL file encrypted with a retired master key should not be restored")
+	}
+	backupKeyring = ring
+	err = restoreWAL("000000010000000000000001", path)
+	restored, _ = ioutil.ReadFile(path)
+	if err != nil || string(restored) != "segment 1" {
+		t.Errorf("WAL file encrypted with a master key should still be restored. restored=%q err=%s", restored, err)
+	}
+
+	wals, _ := listWAL()
+	if len(wals) != 2 {
+		t.Errorf("Data keys should not be listed as WAL files. wals=%v", wals)
+	}
+}
+func TestWALPrune(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestWALPrune...")
+	dir := setupTestFlags(t)
+	defer os.RemoveAll(dir)
+	setupPhysicalTest(t, dir)
+	backupStorage = newMemoryStorage()
+	storage := newMemoryStorage()
+	walStorage = storage
+
+	backuper := PostgresBackuper{}
+	for _, apiID := range []string{"p1", "p2"} {
+		backuper.CreateNewBackup(apiID, 0, &schellyhook.ShellContext{})
+		backupJobs.wait(apiID)
+	}
+	files := map[string]string{
+		"00000001.history":                         "timeline",
+		"000000010000000000000002":                 "segment 2",
+		"000000010000000000000003":                 "segment 3",
+		"000000010000000000000003.00000028.backup": backupHistory("schelly-p1", "000000010000000000000003", "000000010000000000000003", "2019-06-14 09:28:19"),
+		"000000010000000000000004":                 "segment 4",
+		"000000010000000000000005":                 "segment 5",
+		"000000010000000000000005.00000028.backup": backupHistory("schelly-p2", "000000010000000000000005", "000000010000000000000006", "2019-06-14 09:28:19"),
+		"000000010000000000000006":                 "segment 6",
+		"00000001000000000000000A.00000028.backup": backupHistory("pg_basebackup base backup", "00000001000000000000000A", "00000001000000000000000A", "2019-06-14 09:28:19"),
+	}
+	for name, contents := range files {
+		_, err := archiveWAL(name, strings.NewReader(contents))
+		if err != nil {
+			t.Fatalf("Error archiving %s: %s", name, err)
+		}
+	}
+
+	//p1 started before p2 and its WAL isn't known until its backup history file is archived
+	history := "000000010000000000000003.00000028.backup"
+	storage.Delete(history)
+	pruned, err := pruneWAL()
+	if err != nil || pruned != 0 {
+		t.Errorf("Nothing should be pruned while p1 isn't paired with its WAL. pruned=%d err=%s", pruned, err)
+	}
+	archiveWAL(history, strings.NewReader(files[history]))
+
+	//segments before the first backup go
+	pruned, err = pruneWAL()
+	if err != nil || pruned != 1 {
+		t.Errorf("Only the segment before p1 should be pruned. pruned=%d err=%s", pruned, err)
+	}
+	m, _ := readManifest("p2")
+	if m.WAL == nil || m.WAL.StartSegment != "000000010000000000000005" || m.WAL.StopSegment != "000000010000000000000006" ||
+		m.WAL.StopLSN != "0/6000100" || m.WAL.Timeline != 1 || m.WAL.StopTime.IsZero() {
+		t.Errorf("Backup p2 should be paired with its WAL. wal=%v", m.WAL)
+	}
+
+	err = backuper.DeleteBackup("p1")
+	if err != nil {
+		t.Fatalf("Error deleting backup: %s", err)
+	}
+	for name := range files {
+		_, err := findWAL(name)
+		kept := err == nil
+		shouldKeep := name == "00000001.history" || walPosition(name) >= "0000000000000005"
+		if kept != shouldKeep {
+			t.Errorf("WAL file %s kept=%t, expected %t", name, kept, shouldKeep)
+		}
+	}
+}
+
+func TestParseStopTime(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync() // flushes buffer, if any
+	sugar := logger.Sugar()
+
+	sugar.Infof("Starting TestParseStopTime...")
+	expected := time.Date(2019, 6, 14, 9, 28, 19, 0, time.UTC)
+	local := expected.In(time.Local).Format("2006-01-02 15:04:05 MST")
+	for _, value := range []string{"2019-06-14 09:28:19 UTC", "2019-06-14 09:28:19 GMT", "2019-06-14 06:28:19 -03", "2019-06-14 14:58:19 +0530", local} {
+		stopTime, err := parseStopTime(value)
+		if err != nil || !stopTime.Equal(expected) {
+			t.Errorf("Stop time %q should be read as %s. time=%s err=%s", value, expected, stopTime, err)
+		}
+	}
+	for _, value := range []string{"2019-06-14 09:28:19 XYZT", "2019-06-14 09:28:19", "2019-06-14T09:28:19Z"} {
+		_, err := parseStopTime(value)
+		if err == nil {
+			t.Errorf("Stop time %q should be rejected", value)
+		}
+	}
+
+	//an unknown stop time leaves the rest of the backup history file usable
+	history := strings.Replace(backupHistory("schelly-p1", "000000010000000000000003", "000000010000000000000004", "2019-06-14 09:28:19"), "UTC\nSTOP", "XYZT\nSTOP", 1)
+	r, label, err := parseBackupHistory(strings.NewReader(history))
+	if err != nil || label != "schelly-p1" || r.StopSegment != "000000010000000000000004" || !r.StopTime.IsZero() {
+		t.Errorf("Backup history file with an unknown stop time should be read without it. range=%v err=%s", r, err)
+	}
+}
@@ -2,10 +2,29 @@
 set +e
 # set +x
 
+# patterns may have commas, so environment variables hold one pattern per line and each one is passed on its own flag
+patterns=()
+add_patterns() {
+    while IFS= read -r pattern; do
+        if [ -n "$pattern" ]; then
+            patterns+=("--$1=$pattern")
+        fi
+    done <<< "$2"
+}
+add_patterns schema "$SCHEMA"
+add_patterns exclude-schema "$EXCLUDE_SCHEMA"
+add_patterns table "$TABLE"
+add_patterns exclude-table "$EXCLUDE_TABLE"
+add_patterns exclude-table-data "$EXCLUDE_TABLE_DATA"
+add_patterns include-database "$INCLUDE_DATABASE"
+add_patterns exclude-database "$EXCLUDE_DATABASE"
+
 echo "Starting Postgres API..."
 schelly-postgres \
     --listen-ip=$LISTEN_IP \
     --listen-port=$LISTEN_PORT \
+    --api-listen-port=$API_LISTEN_PORT \
+    --api-listen-ip="$API_LISTEN_IP" \
     --log-level=$LOG_LEVEL \
     --pre-post-timeout=$PRE_POST_TIMEOUT \
     --pre-backup-command="$PRE_BACKUP_COMMAND" \
@@ -15,8 +34,65 @@ schelly-postgres \
     --port="$DATABASE_CONNECTION_PORT" \
     --username="$DATABASE_AUTH_USERNAME" \
     --password="$DATABASE_AUTH_PASSWORD" \
+    --target-data-backend="$TARGET_DATA_BACKEND" \
     --azure-storage="$USE_AZURE_STORAGE" \
     --account-name="$AZURE_STORAGE_ACCOUNT_NAME" \
     --account-key="$AZURE_STORAGE_ACCOUNT_KEY" \
     --container-name="$AZURE_STORAGE_CONTAINER_NAME" \
-
+    --azure-endpoint="$AZURE_STORAGE_ENDPOINT" \
+    --azure-sas-token="$AZURE_STORAGE_SAS_TOKEN" \
+    --azure-connection-string="$AZURE_STORAGE_CONNECTION_STRING" \
+    --azure-block-size="$AZURE_BLOCK_SIZE" \
+    --azure-max-retries="$AZURE_MAX_RETRIES" \
+    --azure-retry-delay="$AZURE_RETRY_DELAY" \
+    --azure-prefix="$AZURE_STORAGE_PREFIX" \
+    --azure-index-tags="$AZURE_INDEX_TAGS" \
+    --azure-access-tier="$AZURE_ACCESS_TIER" \
+    --azure-cool-after-days="$AZURE_COOL_AFTER_DAYS" \
+    --azure-archive-after-days="$AZURE_ARCHIVE_AFTER_DAYS" \
+    --azure-cool-after-backups="$AZURE_COOL_AFTER_BACKUPS" \
+    --azure-archive-after-backups="$AZURE_ARCHIVE_AFTER_BACKUPS" \
+    --azure-rehydrate-tier="$AZURE_REHYDRATE_TIER" \
+    --simultaneous-writes="$SIMULTANEOUS_WRITES" \
+    --max-bandwidth-write="$MAX_BANDWIDTH_WRITE" \
+    --simultaneous-reads="$SIMULTANEOUS_READS" \
+    --max-bandwidth-read="$MAX_BANDWIDTH_READ" \
+    --s3-endpoint="$S3_ENDPOINT" \
+    --s3-region="$S3_REGION" \
+    --s3-bucket="$S3_BUCKET" \
+    --s3-prefix="$S3_PREFIX" \
+    --s3-path-style="$S3_PATH_STYLE" \
+    --s3-access-key-id="$S3_ACCESS_KEY_ID" \
+    --s3-secret-access-key="$S3_SECRET_ACCESS_KEY" \
+    --s3-part-size="$S3_PART_SIZE" \
+    --format="$FORMAT" \
+    "${patterns[@]}" \
+    --dump-compression-level="$DUMP_COMPRESSION_LEVEL" \
+    --jobs="$JOBS" \
+    --cluster="$CLUSTER_BACKUP" \
+    --backup-mode="$BACKUP_MODE" \
+    --basebackup-checkpoint="$BASEBACKUP_CHECKPOINT" \
+    --incremental="$INCREMENTAL_BACKUP" \
+    --max-incremental-chain="$MAX_INCREMENTAL_CHAIN" \
+    --wal-archiving="$WAL_ARCHIVING" \
+    --recovery-dir="$RECOVERY_DIR" \
+    --recovery-port="$RECOVERY_PORT" \
+    --recovery-restore-command="$RECOVERY_RESTORE_COMMAND" \
+    --recovery-user="$RECOVERY_USER" \
+    --stream="$STREAM_BACKUP" \
+    --compression="$COMPRESSION" \
+    --compression-level="$COMPRESSION_LEVEL" \
+    --encryption-key-file="$ENCRYPTION_KEY_FILE" \
+    --encryption-key-env="$ENCRYPTION_KEY_ENV" \
+    --keyring-file="$KEYRING_FILE" \
+    --master-key-id="$MASTER_KEY_ID" \
+    --rewrap-keys="$REWRAP_KEYS" \
+    --verify="$VERIFY_BACKUP" \
+    --verify-interval="$VERIFY_INTERVAL" \
+    --verify-host="$VERIFY_HOST" \
+    --verify-port="$VERIFY_PORT" \
+    --verify-username="$VERIFY_USERNAME" \
+    --verify-password="$VERIFY_PASSWORD" \
+    --verify-sql-file="$VERIFY_SQL_FILE" \
+    --verify-row-tolerance="$VERIFY_ROW_TOLERANCE" \
+    --check-interval="$CHECK_INTERVAL" \